@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	logrus "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Shows the checkpoint of a pipeline and its history, or rewinds it to an
+// earlier position while the replication is stopped.
+func main() {
+
+	var pipelineArg, rewindArg string
+	var historyArg int
+	flag.StringVar(&pipelineArg, "pipeline", "", "id of the pipeline (defaults to the first one)")
+	flag.IntVar(&historyArg, "history", 0, "show the given number of saved checkpoints, the most recent first")
+	flag.StringVar(&rewindArg, "rewind", "", "rewind the checkpoint to this date or timestamp")
+
+	// Load the configuration
+	err := config.Current.LoadConfig()
+	if err != nil {
+		log.Fatal("error loading configuration: ", err)
+	}
+
+	repl := &config.Current.Repl
+	if pipelineArg != "" {
+		if repl = config.Current.Pipeline(pipelineArg); repl == nil {
+			log.Fatal("unknown pipeline: ", pipelineArg)
+		}
+	}
+	p, err := pipeline.New(repl)
+	if err != nil {
+		log.Fatal("error loading the pipeline: ", err)
+	}
+
+	// Logger initiatilization
+	level := log.FromString(config.Current.Logging.Level)
+	log.SetLogLevel(level)
+	log.SetLogFormatter(&logrus.TextFormatter{
+		FullTimestamp: false,
+		DisableColors: false,
+	})
+
+	ctx := context.Background()
+	p.Registry = mdb.NewMongoRegistry(repl)
+	ckpt := p.NewCheckpointManager()
+	current, err := ckpt.GetCheckpoint(ctx)
+	if err != nil {
+		log.Fatal("error getting the checkpoint: ", err)
+	}
+
+	switch {
+	case rewindArg != "":
+		to, err := checkpoint.ParseTimestamp(rewindArg)
+		if err != nil {
+			log.Fatal("invalid -rewind: ", err)
+		}
+		if err := rewind(ctx, p, ckpt, to); err != nil {
+			log.Fatal("checkpoint not rewound: ", err)
+		}
+		print(ckpt.Checkpoint())
+
+	case historyArg > 0:
+		history, err := ckpt.GetHistory(ctx, historyArg)
+		if err != nil {
+			log.Fatal("error getting the checkpoint history: ", err)
+		}
+		for _, saved := range history {
+			print(saved)
+		}
+
+	default:
+		print(current)
+	}
+}
+
+// Rewind the checkpoints of the pipeline and of its additional targets.
+// The entries from there must still be in the oplog of the source.
+func rewind(ctx context.Context, p *pipeline.Pipeline, ckpt checkpoint.CheckpointManager, to primitive.Timestamp) error {
+
+	window, err := checkpoint.GetReplicasetOplogWindow(p.Registry.GetSource())
+	if err != nil {
+		return err
+	}
+	if err := checkpoint.CheckRewind(window, to); err != nil {
+		return err
+	}
+	if err := ckpt.Rewind(ctx, to); err != nil {
+		return err
+	}
+
+	for _, target := range p.Config.Targets {
+		t := p.OpenCheckpoint(p.Id+"-"+target.Name, mdb.NewMongo(target.Uri))
+		current, err := t.GetCheckpoint(ctx)
+		if err != nil {
+			return fmt.Errorf("target %s: %v", target.Name, err)
+		}
+		if checkpoint.CompareTimestamps(current.LatestTs, to) <= 0 {
+			continue
+		}
+		if err := t.Rewind(ctx, to); err != nil {
+			return fmt.Errorf("target %s: %v", target.Name, err)
+		}
+	}
+
+	log.InfoWithFields("checkpoint rewound, the entries from there are re-applied on restart",
+		log.Fields{"to": checkpoint.ToDate(to)})
+	return nil
+}
+
+// One checkpoint per line, as JSON
+func print(ckpt checkpoint.Checkpoint) {
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		log.Fatal("error encoding the checkpoint: ", err)
+	}
+	fmt.Fprintln(os.Stdout, string(data))
+}
@@ -3,15 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/api"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/repl"
 	logrus "github.com/sirupsen/logrus"
 )
@@ -26,6 +25,12 @@ func main() {
 	log.Debug("configuration loaded")
 	config.Current.LogConfig()
 
+	// Filters, mapping and transforms of every pipeline
+	pipelines, err := pipeline.NewPipelines(config.Current)
+	if err != nil {
+		log.Fatal("error loading the pipelines: ", err)
+	}
+
 	// Logger initiatilization
 	level := log.FromString(config.Current.Logging.Level)
 	log.SetLogLevel(level)
@@ -36,24 +41,53 @@ func main() {
 	log.Debug("starting mongo-repl")
 	log.Debug(fmt.Sprintf("log level: %d (%s)", level, config.Current.Logging.Level))
 
-	// Setup mongodb connectivity
-	mdb.Registry = mdb.NewMongoRegistry(config.Current)
-
-	// Create a global commands channel
-	commands := make(chan commands.Command, 10)
+	// Stopped by SIGINT, SIGTERM or the terminate command
+	ctx, terminate := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer terminate()
 
-	// Start the replication
-	repl.StartReplication(context.Background(), commands)
+	// Setup mongodb connectivity and start the replications
+	stopped := make([]<-chan struct{}, 0, len(pipelines))
+	for _, p := range pipelines {
+		p.Connect()
+		p.Terminate = terminate
+		stopped = append(stopped, repl.StartReplication(ctx, p))
+	}
 
 	// Start the API server
-	api.StartApi(commands)
-
-	// Prepare to handle SIGINT
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
+	go api.StartApi(ctx, pipelines)
 
-	// Shutdown
-	// TODO: Pass some context to API and replication to gracefully shutdown
+	<-ctx.Done()
 	log.Info("shutting down")
+
+	// The replications drain their queue and save their checkpoint
+	deadline := time.After(shutdownTimeout(pipelines))
+	for i, done := range stopped {
+		select {
+		case <-done:
+		case <-deadline:
+			log.Warn("replication not stopped before the deadline: ", pipelines[i].Id)
+		}
+	}
+
+	disconnectCtx, cancel := context.WithTimeout(context.Background(), DisconnectTimeout)
+	defer cancel()
+	for _, p := range pipelines {
+		p.Disconnect(disconnectCtx)
+	}
+	log.Info("stopped")
+}
+
+const (
+	// Time given beyond the drain of the queues to stop the replications
+	ShutdownGrace     = 15 * time.Second
+	DisconnectTimeout = 5 * time.Second
+)
+
+// The longest drain timeout of the pipelines, plus the grace period
+func shutdownTimeout(pipelines []*pipeline.Pipeline) time.Duration {
+	var drain int
+	for _, p := range pipelines {
+		drain = max(drain, p.Config.Incr.DrainTimeout)
+	}
+	return time.Duration(drain)*time.Second + ShutdownGrace
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/incr"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/replay"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+	logrus "github.com/sirupsen/logrus"
+)
+
+// Replays archived oplog files into a target, for point-in-time recovery
+// or to seed a test environment.
+func main() {
+
+	var pipelineArg, dirArg, fromArg, toArg, nsArg, targetArg string
+	var speedArg float64
+	flag.StringVar(&pipelineArg, "pipeline", "", "id of the pipeline whose configuration is used (defaults to the first one)")
+	flag.StringVar(&dirArg, "dir", "", "directory of the archive files (defaults to repl.archive.dir)")
+	flag.StringVar(&fromArg, "from", "", "replay the entries from this date or timestamp")
+	flag.StringVar(&toArg, "to", "", "replay the entries up to this date or timestamp")
+	flag.StringVar(&nsArg, "ns", "", "comma separated namespaces to replay, like db.coll or db.*")
+	flag.StringVar(&targetArg, "target", "", "target connection string (defaults to repl.target)")
+	flag.Float64Var(&speedArg, "speed", 0, "replay speed relative to the original pace (0 for as fast as possible)")
+
+	// Load the configuration
+	err := config.Current.LoadConfig()
+	if err != nil {
+		log.Fatal("error loading configuration: ", err)
+	}
+
+	// The mapping of the pipeline is applied. The transforms are not:
+	// the entries were archived with them already applied. Neither are
+	// the document filters, which read the current documents of the source.
+	repl := &config.Current.Repl
+	if pipelineArg != "" {
+		if repl = config.Current.Pipeline(pipelineArg); repl == nil {
+			log.Fatal("unknown pipeline: ", pipelineArg)
+		}
+	}
+	p, err := pipeline.New(repl)
+	if err != nil {
+		log.Fatal("error loading the pipeline: ", err)
+	}
+	p.Transform, _ = transform.NewTransformer(nil)
+	if len(repl.Documents) > 0 {
+		log.Warn("the document filters are not applied by the replay, all the archived entries are replayed")
+	}
+	p.Documents, _ = filters.NewDocumentFilter(nil)
+
+	// Logger initiatilization
+	level := log.FromString(config.Current.Logging.Level)
+	log.SetLogLevel(level)
+	log.SetLogFormatter(&logrus.TextFormatter{
+		FullTimestamp: false,
+		DisableColors: false,
+	})
+	log.Debug(fmt.Sprintf("log level: %d (%s)", level, config.Current.Logging.Level))
+
+	if dirArg == "" {
+		dirArg = repl.Archive.Dir
+	}
+	if targetArg == "" {
+		targetArg = repl.Target
+	}
+
+	from := checkpoint.MongoTimestampMin
+	if fromArg != "" {
+		if from, err = checkpoint.ParseTimestamp(fromArg); err != nil {
+			log.Fatal("invalid -from: ", err)
+		}
+	}
+	to := checkpoint.MongoTimestampMax
+	if toArg != "" {
+		if to, err = checkpoint.ParseTimestamp(toArg); err != nil {
+			log.Fatal("invalid -to: ", err)
+		}
+	}
+
+	var namespaces []string
+	for _, ns := range strings.Split(nsArg, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	// Only the target is needed
+	p.Registry = mdb.NewMongoTargetRegistry(targetArg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		log.Info("interrupting replay")
+		cancel()
+	}()
+
+	// The replayed entries may already be on the target, so the
+	// writer ignores the errors of an idempotent replay.
+	queue := make(chan *oplog.ChangeLog, 100)
+	ckpt := checkpoint.NewMemoryCheckpoint(p.Id)
+	writer := incr.NewOplogWriter(p, ckpt, math.MaxInt64, queue)
+	failed := make(chan error, 1)
+	writer.ReportFailures(failed)
+	done := make(chan struct{})
+	go func() {
+		writer.RunWriter(ctx)
+		close(done)
+	}()
+
+	// An entry rejected by the target stops the replay
+	rejected := make(chan error, 1)
+	go func() {
+		select {
+		case err := <-failed:
+			cancel()
+			rejected <- err
+		case <-done:
+			// Reported before the writer returned
+			select {
+			case err := <-failed:
+				rejected <- err
+			default:
+				rejected <- nil
+			}
+		}
+	}()
+
+	r := replay.NewReplay(dirArg, from, to, namespaces, speedArg, queue)
+	result, err := r.Run(ctx)
+	close(queue)
+	<-done
+	writeErr := <-rejected
+
+	log.InfoWithFields("replay finished", log.Fields{
+		"files":    result.Files,
+		"replayed": result.Replayed,
+		"skipped":  result.Skipped,
+		"first":    result.First,
+		"last":     writer.AppliedTimestamp(),
+	})
+	if writeErr != nil {
+		log.Fatal("replay failed: ", writeErr)
+	}
+	if err != nil {
+		log.Fatal("replay failed: ", err)
+	}
+}
@@ -2,51 +2,168 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	health "github.com/hellofresh/health-go/v5"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 )
 
-func StartApi(commands chan<- commands.Command) {
+const (
+	// Time given to the requests in progress on shutdown
+	ShutdownTimeout = 5 * time.Second
+)
+
+// Serve the API until the context is done
+func StartApi(ctx context.Context, pipelines []*pipeline.Pipeline) {
 
 	router := gin.Default()
 	router.GET("/metrics", gin.WrapH(promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{})))
-	router.GET("/status", gin.WrapH(CreateHealthCheckHandler()))
+	router.GET("/status", CreateStatusHandler(pipelines))
+	router.GET("/pipelines", func(c *gin.Context) {
+		ids := make([]string, 0, len(pipelines))
+		for _, p := range pipelines {
+			ids = append(ids, p.Id)
+		}
+		c.JSON(200, ids)
+	})
+
+	// Every pipeline has its own routes. A single pipeline
+	// is also reachable without its prefix.
+	for _, p := range pipelines {
+		RegisterPipelineApi(router.Group("/pipelines/"+p.Id), p)
+	}
+	if len(pipelines) == 1 {
+		RegisterPipelineApi(&router.RouterGroup, pipelines[0])
+	}
+
+	server := &http.Server{
+		Addr:    ":3000",
+		Handler: router,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Warn("error shutting down the API: ", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal("error serving the API: ", err)
+	}
+}
+
+// Register the commands, namespaces, jobs, checkpoint, cutover, state and status routes of a pipeline
+func RegisterPipelineApi(router *gin.RouterGroup, p *pipeline.Pipeline) {
 
 	// Commands api
-	cmdsApi := NewCommandApi(commands)
+	cmdsApi := NewCommandApi(p.Commands, p.Jobs)
 	router.POST("/command/incr/pause", cmdsApi.PauseIncrReplication)
 	router.POST("/command/incr/resume", cmdsApi.ResumeIncrReplication)
 	router.POST("/command/snapshot", cmdsApi.RunSnapshot)
+	router.POST("/command/incr/delay/apply", cmdsApi.ApplyDelayed)
+	router.POST("/command/incr/delay/skip", cmdsApi.SkipDelayed)
+	router.POST("/command/terminate", cmdsApi.Terminate)
+
+	// Namespaces api
+	nsApi := NewNamespacesApi(p.Namespaces, cmdsApi)
+	router.GET("/namespaces", nsApi.GetNamespaces)
+	router.POST("/command/namespaces/add", nsApi.AddNamespaces)
+	router.POST("/command/namespaces/remove", nsApi.RemoveNamespaces)
+
+	// Jobs api
+	jobsApi := NewJobsApi(p.Jobs)
+	router.GET("/jobs", jobsApi.ListJobs)
+	router.GET("/jobs/:id", jobsApi.GetJob)
+	router.POST("/jobs/:id/cancel", jobsApi.CancelJob)
+
+	// Checkpoint api
+	ckptApi := NewCheckpointApi(p.Checkpoint, p.Rewinds)
+	router.GET("/checkpoint", ckptApi.GetCheckpoint)
+	router.GET("/checkpoint/history", ckptApi.GetHistory)
+	router.POST("/command/checkpoint/rewind", ckptApi.Rewind)
 
-	router.Run(":3000")
+	// Cutover api
+	cutoverApi := NewCutoverApi(p.Cutover, p.Config.Cutover)
+	router.POST("/command/cutover", cutoverApi.StartCutover)
+	router.POST("/command/cutover/abort", cutoverApi.AbortCutover)
+	router.GET("/cutover", cutoverApi.GetCutover)
+
+	// State api
+	stateApi := NewStateApi(p.State)
+	router.GET("/state", stateApi.GetState)
+
+	// Status api
+	replStatusApi := NewReplStatusApi(p)
+	router.GET("/repl/status", replStatusApi.GetReplStatus)
+}
+
+// The health of the servers, and the role of the replica in the leader
+// election of every pipeline. A standby is healthy.
+type Status struct {
+	health.Check
+	Roles map[string]string `json:"roles"`
+}
+
+func CreateStatusHandler(pipelines []*pipeline.Pipeline) gin.HandlerFunc {
+
+	h := NewHealthCheck(pipelines)
+	return func(c *gin.Context) {
+		status := Status{
+			Check: h.Measure(c.Request.Context()),
+			Roles: make(map[string]string, len(pipelines)),
+		}
+		for _, p := range pipelines {
+			status.Roles[p.Id] = p.Role()
+		}
+
+		code := http.StatusOK
+		if status.Status == health.StatusUnavailable {
+			code = http.StatusServiceUnavailable
+		}
+		c.JSON(code, status)
+	}
 }
 
-func CreateHealthCheckHandler() http.Handler {
+func NewHealthCheck(pipelines []*pipeline.Pipeline) *health.Health {
+
+	// The checks are suffixed with the pipeline id when there are several
+	var checks []health.Config
+	for _, p := range pipelines {
+		suffix := ""
+		if len(pipelines) > 1 {
+			suffix = "-" + p.Id
+		}
+		checks = append(checks,
+			health.Config{
+				Name:      "mongodb-source" + suffix,
+				Timeout:   time.Second * 5,
+				SkipOnErr: true,
+				Check: func(ctx context.Context) error {
+					return p.Registry.GetSource().Client.Ping(ctx, nil)
+				}})
+
+		// The changes may go to a sink only
+		if p.Registry.HasTarget() {
+			checks = append(checks, health.Config{
+				Name: "mongodb-target" + suffix,
+				Check: func(ctx context.Context) error {
+					return p.Registry.GetTarget().Client.Ping(ctx, nil)
+				},
+			})
+		}
+	}
 
 	h, _ := health.New(health.WithComponent(health.Component{
 		Name:    "mongo-repl",
 		Version: "v1.0",
-	}), health.WithChecks(
-		health.Config{
-			Name:      "mongodb-source",
-			Timeout:   time.Second * 5,
-			SkipOnErr: true,
-			Check: func(ctx context.Context) error {
-				return mdb.Registry.GetSource().Client.Ping(ctx, nil)
-			}},
-		health.Config{
-			Name: "mongodb-target",
-			Check: func(ctx context.Context) error {
-				return mdb.Registry.GetTarget().Client.Ping(ctx, nil)
-			},
-		},
-	))
-	return h.Handler()
+	}), health.WithChecks(checks...))
+	return h
 }
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+)
+
+const DefaultHistoryLimit = 100
+
+type CheckpointApi struct {
+	ckpt    checkpoint.CheckpointManager
+	rewinds chan<- pipeline.RewindRequest
+}
+
+func NewCheckpointApi(ckpt checkpoint.CheckpointManager, rewinds chan<- pipeline.RewindRequest) *CheckpointApi {
+	return &CheckpointApi{
+		ckpt:    ckpt,
+		rewinds: rewinds,
+	}
+}
+
+// The current checkpoint, ahead of the saved one
+func (a *CheckpointApi) GetCheckpoint(c *gin.Context) {
+	c.JSON(200, a.ckpt.Checkpoint())
+}
+
+// The saved checkpoints, the most recent first, up to `limit`
+func (a *CheckpointApi) GetHistory(c *gin.Context) {
+
+	limit := DefaultHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			c.JSON(400, gin.H{"error": "invalid limit: " + value})
+			return
+		}
+	}
+
+	history, err := a.ckpt.GetHistory(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(200, history)
+}
+
+type RewindRequest struct {
+	// Either a date or a timestamp
+	To string `json:"to" binding:"required"`
+}
+
+// Stop the incremental replication, move the checkpoint back and restart.
+// Answers once rewound.
+func (a *CheckpointApi) Rewind(c *gin.Context) {
+
+	var request RewindRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		log.ErrorWithFields("error when rewinding the checkpoint", log.Fields{"error": err})
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	to, err := checkpoint.ParseTimestamp(request.To)
+	if err != nil {
+		log.ErrorWithFields("error when rewinding the checkpoint", log.Fields{"error": err})
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	req := pipeline.RewindRequest{To: to, Result: make(chan error, 1)}
+	select {
+	case a.rewinds <- req:
+	default:
+		c.JSON(409, gin.H{"error": "the incremental replication is not running"})
+		return
+	}
+
+	select {
+	case err = <-req.Result:
+	case <-c.Request.Context().Done():
+		return
+	}
+	if err != nil {
+		log.Warn("checkpoint not rewound: ", err)
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+
+	a.GetCheckpoint(c)
+}
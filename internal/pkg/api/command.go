@@ -1,79 +1,138 @@
 package api
 
 import (
+	"errors"
+	"fmt"
+
 	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/jobs"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 )
 
 type CommandApi struct {
 	commands chan<- commands.Command
+	jobs     *jobs.Registry
 }
 
-func NewCommandApi(commands chan<- commands.Command) *CommandApi {
+func NewCommandApi(commands chan<- commands.Command, jobs *jobs.Registry) *CommandApi {
 	return &CommandApi{
 		commands: commands,
+		jobs:     jobs,
 	}
 }
 
-func (a *CommandApi) PauseIncrReplication(c *gin.Context) {
+// Errors of the commands not sent
+var ErrTooManyCommands = errors.New("too many commands queued")
 
-	// Pause the incremental replication
+// Send the command with a job to follow it. The job fails right away
+// when the command cannot be queued.
+func (a *CommandApi) send(cmd commands.Command, cancelable bool) (jobs.Job, bool) {
+
+	job := a.jobs.Create(commands.Names[cmd.Id], cmd.Arguments, cancelable)
+	cmd.JobId = job.Id
 	select {
-	case a.commands <- commands.CmdPauseIncremental:
-		log.Info("pause command sent")
-		c.Status(200)
+	case a.commands <- cmd:
+		log.InfoWithFields("command sent", log.Fields{"command": job.Command, "job": job.Id})
+		return job, true
 	default:
-		log.Info("pause command not sent")
 		// Proably due to too much commands enqueued
-		c.Status(429)
+		log.WarnWithFields("command not sent", log.Fields{"command": job.Command, "job": job.Id})
+		a.jobs.Finish(job.Id, "", ErrTooManyCommands)
+		job, _ = a.jobs.Get(job.Id)
+		return job, false
 	}
 }
 
-func (a *CommandApi) ResumeIncrReplication(c *gin.Context) {
+// Send the command and reply with its job
+func (a *CommandApi) reply(c *gin.Context, cmd commands.Command) {
+	a.replyJob(c, cmd, false)
+}
 
-	// Resume the incremental replication
-	select {
-	case a.commands <- commands.CmdResumeIncremental:
-		log.Info("resume command sent")
-		c.Status(200)
-	default:
-		log.Info("resume command not sent")
-		// Proably due to too much commands enqueued
-		c.Status(429)
+func (a *CommandApi) replyJob(c *gin.Context, cmd commands.Command, cancelable bool) {
+	if job, sent := a.send(cmd, cancelable); sent {
+		c.JSON(200, job)
+	} else {
+		c.JSON(429, job)
 	}
 }
 
+func (a *CommandApi) PauseIncrReplication(c *gin.Context) {
+	// Pause the incremental replication
+	a.reply(c, commands.CmdPauseIncremental)
+}
+
+func (a *CommandApi) ResumeIncrReplication(c *gin.Context) {
+	// Resume the incremental replication
+	a.reply(c, commands.CmdResumeIncremental)
+}
+
+func (a *CommandApi) Terminate(c *gin.Context) {
+	// Stop the process gracefully
+	a.reply(c, commands.CmdTerminate)
+}
+
 type SnapshotRequest struct {
 	Database   string `json:"database" binding:"required"`
 	Collection string `json:"collection" binding:"required"`
+	// The job following the snapshot, empty when not requested by the API
+	JobId string `json:"-"`
 }
 
+// Snapshot the collections, one job per collection
 func (a *CommandApi) RunSnapshot(c *gin.Context) {
 
 	var snapshops []SnapshotRequest
 	if err := c.ShouldBindBodyWithJSON(&snapshops); err != nil || len(snapshops) <= 0 {
-		log.ErrorWithFields("error when triggering snapshop",
-			log.Fields{"collection": "collection", "error": err})
-
-		c.Status(500)
+		log.ErrorWithFields("error when triggering snapshop", log.Fields{"error": err})
+		c.Status(400)
+		return
 	}
 
 	success := true
+	snapshotJobs := make([]jobs.Job, 0, len(snapshops))
 	for _, snapshot := range snapshops {
-		select {
-		case a.commands <- commands.NewCmdSnapshot(snapshot.Database, snapshot.Collection):
-			log.InfoWithFields("snaphot command sent",
-				log.Fields{"database": snapshot.Database, "collection": snapshot.Collection})
-		default:
-			log.Error("snaphot command not sent")
-			success = false
-		}
+		job, sent := a.send(commands.NewCmdSnapshot(snapshot.Database, snapshot.Collection), true)
+		snapshotJobs = append(snapshotJobs, job)
+		success = success && sent
 	}
 
 	if success {
-		c.Status(200)
+		c.JSON(200, snapshotJobs)
 	} else {
-		c.Status(429)
+		c.JSON(429, snapshotJobs)
 	}
 }
+
+type DelayRequest struct {
+	// Either a date or a timestamp
+	Until string `json:"until" binding:"required"`
+}
+
+func (a *CommandApi) ApplyDelayed(c *gin.Context) {
+	a.sendDelayCommand(c, commands.NewCmdDelayApply)
+}
+
+func (a *CommandApi) SkipDelayed(c *gin.Context) {
+	a.sendDelayCommand(c, commands.NewCmdDelaySkip)
+}
+
+func (a *CommandApi) sendDelayCommand(c *gin.Context, newCmd func(string) commands.Command) {
+
+	var request DelayRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		log.ErrorWithFields("error when handling delayed entries", log.Fields{"error": err})
+		c.Status(400)
+		return
+	}
+
+	until, err := checkpoint.ParseTimestamp(request.Until)
+	if err != nil {
+		log.ErrorWithFields("error when handling delayed entries", log.Fields{"error": err})
+		c.Status(400)
+		return
+	}
+
+	a.reply(c, newCmd(fmt.Sprintf("%d:%d", until.T, until.I)))
+}
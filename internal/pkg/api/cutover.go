@@ -0,0 +1,80 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/cutover"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+)
+
+type CutoverApi struct {
+	cutover *cutover.Cutover
+	config  config.CutoverConfig
+}
+
+func NewCutoverApi(c *cutover.Cutover, cfg config.CutoverConfig) *CutoverApi {
+	return &CutoverApi{
+		cutover: c,
+		config:  cfg,
+	}
+}
+
+// Optional overrides of the cutover configuration, in seconds
+type CutoverRequest struct {
+	Quiet   *int `json:"quiet"`
+	Timeout *int `json:"timeout"`
+}
+
+func (a *CutoverApi) StartCutover(c *gin.Context) {
+
+	quiet := a.config.Quiet
+	timeout := a.config.Timeout
+
+	var request CutoverRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			log.ErrorWithFields("error when starting the cutover", log.Fields{"error": err})
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if request.Quiet != nil {
+		quiet = *request.Quiet
+	}
+	if request.Timeout != nil {
+		timeout = *request.Timeout
+	}
+
+	// The workflow outlives the request
+	err := a.cutover.Start(context.Background(),
+		time.Duration(quiet)*time.Second,
+		time.Duration(timeout)*time.Second)
+	if err != nil {
+		log.Warn("cutover not started: ", err)
+		if errors.Is(err, cutover.ErrNotAttached) {
+			c.JSON(503, gin.H{"error": err.Error()})
+		} else {
+			c.JSON(409, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	c.JSON(202, a.cutover.Status())
+}
+
+func (a *CutoverApi) AbortCutover(c *gin.Context) {
+	if err := a.cutover.Abort(); err != nil {
+		c.JSON(409, gin.H{"error": err.Error()})
+		return
+	}
+	log.Info("cutover abort requested")
+	c.JSON(202, a.cutover.Status())
+}
+
+func (a *CutoverApi) GetCutover(c *gin.Context) {
+	c.JSON(200, a.cutover.Status())
+}
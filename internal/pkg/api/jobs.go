@@ -0,0 +1,47 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/jobs"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+)
+
+type JobsApi struct {
+	jobs *jobs.Registry
+}
+
+func NewJobsApi(jobs *jobs.Registry) *JobsApi {
+	return &JobsApi{
+		jobs: jobs,
+	}
+}
+
+// The jobs of the commands, the most recent first
+func (a *JobsApi) ListJobs(c *gin.Context) {
+	c.JSON(200, a.jobs.List())
+}
+
+func (a *JobsApi) GetJob(c *gin.Context) {
+	job, ok := a.jobs.Get(c.Param("id"))
+	if !ok {
+		c.JSON(404, gin.H{"error": jobs.ErrNotFound.Error()})
+		return
+	}
+	c.JSON(200, job)
+}
+
+// Cancel a queued or running snapshot job
+func (a *JobsApi) CancelJob(c *gin.Context) {
+	job, err := a.jobs.Cancel(c.Param("id"))
+	switch {
+	case errors.Is(err, jobs.ErrNotFound):
+		c.JSON(404, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(409, gin.H{"error": err.Error()})
+	default:
+		log.InfoWithFields("job cancel requested", log.Fields{"job": job.Id})
+		c.JSON(202, job)
+	}
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+)
+
+type NamespacesApi struct {
+	namespaces *filters.NamespaceFilter
+	cmds       *CommandApi
+}
+
+func NewNamespacesApi(namespaces *filters.NamespaceFilter, cmds *CommandApi) *NamespacesApi {
+	return &NamespacesApi{
+		namespaces: namespaces,
+		cmds:       cmds,
+	}
+}
+
+type NamespacesRequest struct {
+	// Namespaces or patterns, like the `in` / `out` filters
+	Namespaces []string `json:"namespaces" binding:"required,min=1"`
+}
+
+// The entries of the namespace filter
+func (a *NamespacesApi) GetNamespaces(c *gin.Context) {
+	c.JSON(200, a.namespaces.Entries())
+}
+
+// Replicate the namespaces, once their new collections are snapshotted.
+// The job may be canceled until then.
+func (a *NamespacesApi) AddNamespaces(c *gin.Context) {
+	a.change(c, commands.NewCmdAddNamespaces, true)
+}
+
+func (a *NamespacesApi) RemoveNamespaces(c *gin.Context) {
+	a.change(c, commands.NewCmdRemoveNamespaces, false)
+}
+
+func (a *NamespacesApi) change(c *gin.Context, newCmd func([]string) commands.Command, cancelable bool) {
+
+	var request NamespacesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		log.ErrorWithFields("error when changing the namespaces", log.Fields{"error": err})
+		c.Status(400)
+		return
+	}
+	for _, ns := range request.Namespaces {
+		if err := filters.ValidateNamespace(ns); err != nil {
+			c.JSON(400, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Applied by the reader, between two batches of the oplog
+	a.cmds.replyJob(c, newCmd(request.Namespaces), cancelable)
+}
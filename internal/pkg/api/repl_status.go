@@ -0,0 +1,107 @@
+package api
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/state"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type ReplStatusApi struct {
+	p *pipeline.Pipeline
+}
+
+func NewReplStatusApi(p *pipeline.Pipeline) *ReplStatusApi {
+	return &ReplStatusApi{
+		p: p,
+	}
+}
+
+// What the replication of a pipeline is doing
+type ReplStatus struct {
+	Pipeline    string    `json:"pipeline"`
+	Role        string    `json:"role"`
+	State       string    `json:"state"`
+	StateSince  time.Time `json:"state_since"`
+	StateReason string    `json:"state_reason"`
+	Paused      bool      `json:"paused"`
+
+	// Position of the saved checkpoint, and the lag of the applied
+	// entries behind the source oplog, unknown before the initial sync
+	CheckpointTs   primitive.Timestamp `json:"checkpoint_ts"`
+	CheckpointDate *time.Time          `json:"checkpoint_date,omitempty"`
+	Lag            *int64              `json:"lag_secs"`
+
+	// Oplog entries waiting for the writer, and namespaces for a snapshot
+	QueueDepth      int      `json:"queue_depth"`
+	QueuedSnapshots []string `json:"queued_snapshots"`
+
+	// The collection copies in progress
+	SnapshotProgress []status.CollectionProgress `json:"snapshot_progress"`
+
+	Errors    map[string]int64 `json:"errors"`
+	StartedAt time.Time        `json:"started_at"`
+	Uptime    int64            `json:"uptime_secs"`
+}
+
+func (a *ReplStatusApi) GetReplStatus(c *gin.Context) {
+	c.JSON(200, a.status())
+}
+
+func (a *ReplStatusApi) status() ReplStatus {
+
+	p := a.p
+	record := p.State.Record()
+	ckpt := p.Checkpoint.Checkpoint()
+	started := p.Tracker.Started()
+	s := ReplStatus{
+		Pipeline:         p.Id,
+		Role:             p.Role(),
+		State:            record.State,
+		StateSince:       record.Since,
+		StateReason:      record.Reason,
+		Paused:           p.State.Current() == state.StatePaused,
+		CheckpointTs:     ckpt.LatestTs,
+		QueuedSnapshots:  []string{},
+		SnapshotProgress: p.Tracker.Progress(),
+		Errors:           p.Tracker.Errors(),
+		StartedAt:        started,
+		Uptime:           int64(time.Since(started).Seconds()),
+	}
+	slices.SortFunc(s.SnapshotProgress, func(a, b status.CollectionProgress) int {
+		return strings.Compare(a.Database+"."+a.Collection, b.Database+"."+b.Collection)
+	})
+
+	// The running incremental replication knows what is applied
+	applied := ckpt.LatestTs
+	if repl := p.Tracker.Replication(); repl != nil {
+		applied = repl.AppliedTimestamp()
+		s.QueueDepth = repl.QueueDepth()
+		s.QueuedSnapshots = repl.QueuedSnapshots()
+	}
+
+	if !checkpoint.IsZero(ckpt.LatestTs) {
+		date := checkpoint.ToDate(ckpt.LatestTs)
+		s.CheckpointDate = &date
+	}
+	if !checkpoint.IsZero(applied) {
+		window, err := checkpoint.GetReplicasetOplogWindow(p.Registry.GetSource())
+		if err != nil {
+			log.Warn("error measuring the replication lag: ", err)
+		} else {
+			var lag int64 = 0
+			if checkpoint.CompareTimestamps(applied, window.Newest) < 0 {
+				lag = max(int64(window.Newest.T)-int64(applied.T), 1)
+			}
+			s.Lag = &lag
+		}
+	}
+	return s
+}
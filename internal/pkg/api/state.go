@@ -0,0 +1,21 @@
+package api
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/state"
+)
+
+type StateApi struct {
+	state *state.Machine
+}
+
+func NewStateApi(s *state.Machine) *StateApi {
+	return &StateApi{
+		state: s,
+	}
+}
+
+// The state of the replication and its last transitions
+func (a *StateApi) GetState(c *gin.Context) {
+	c.JSON(200, a.state.Record())
+}
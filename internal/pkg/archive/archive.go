@@ -0,0 +1,394 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	FormatBson = "bson"
+	FormatJson = "json"
+
+	IndexExtension = ".idx"
+	GapExtension   = ".gap"
+	GzipExtension  = ".gz"
+
+	FlushInterval = 1 * time.Second
+)
+
+// Describes the content of an archive file. It is stored next to
+// the file it describes, with the `.idx` extension.
+type Index struct {
+	File       string              `json:"file"`
+	Format     string              `json:"format"`
+	Compressed bool                `json:"compressed"`
+	First      primitive.Timestamp `json:"first"`
+	Last       primitive.Timestamp `json:"last"`
+	Count      int64               `json:"count"`
+	OpenedAt   time.Time           `json:"opened_at"`
+	ClosedAt   time.Time           `json:"closed_at"`
+}
+
+// Entries which could not be archived, from `First` to `Last`. Stored in
+// the archive directory with the `.gap` extension, so that the readers of
+// the archive know it is incomplete.
+type Gap struct {
+	File       string              `json:"file"`
+	First      primitive.Timestamp `json:"first"`
+	Last       primitive.Timestamp `json:"last"`
+	RecordedAt time.Time           `json:"recorded_at"`
+}
+
+// Writes the change logs to local files rotated on size or age.
+// Files are written either as a stream of BSON documents or as
+// Extended JSON, one change log per line.
+type Archiver struct {
+	mu       sync.Mutex
+	dir      string
+	prefix   string
+	format   string
+	compress bool
+	maxSize  int64
+	maxAge   time.Duration
+
+	// The fields redacted for the target are not archived either
+	transform *transform.Transformer
+
+	// The file being written
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	out     io.Writer
+	size    int64
+	index   Index
+	indexed int64
+
+	// The entries not archived since the last one archived, nil for none
+	gap *Gap
+
+	// Metrics of the pipeline
+	metrics *metrics.PipelineMetrics
+}
+
+// The files are prefixed with the pipeline id. The entries are archived
+// as written to the target, with the transforms applied (nil for none).
+func NewArchiver(cfg config.ArchiveConfig, prefix string, transformer *transform.Transformer) (*Archiver, error) {
+
+	if cfg.Format != FormatBson && cfg.Format != FormatJson {
+		return nil, fmt.Errorf("unknown archive format: %s", cfg.Format)
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0750); err != nil {
+		return nil, err
+	}
+
+	return &Archiver{
+		dir:       cfg.Dir,
+		prefix:    prefix,
+		format:    cfg.Format,
+		compress:  cfg.Compress,
+		maxSize:   int64(cfg.MaxSize) * 1024 * 1024,
+		maxAge:    time.Duration(cfg.MaxAge) * time.Second,
+		transform: transformer,
+		metrics:   metrics.ForPipeline(prefix),
+	}, nil
+}
+
+// Periodically flush the current file and rotate it once too old
+func (a *Archiver) StartArchiver(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				a.Close()
+				return
+			case <-time.After(FlushInterval):
+			}
+
+			if err := a.flush(); err != nil {
+				log.Error("error flushing the archive: ", err)
+			}
+		}
+	}()
+}
+
+// Append a change log to the archive. The entries not archived are
+// recorded as a gap.
+func (a *Archiver) Archive(l *oplog.ChangeLog) error {
+
+	if a.transform != nil {
+		redacted, keep, err := a.transform.TransformChangeLog(l)
+		if err != nil {
+			a.mu.Lock()
+			defer a.mu.Unlock()
+			return a.failed(err, l.Timestamp, l.Timestamp)
+		}
+		if !keep {
+			return nil
+		}
+		l = redacted
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The entries of the current file may be lost with it
+	first := l.Timestamp
+	if a.file != nil {
+		first = a.index.First
+	}
+	if err := a.write(l); err != nil {
+		return a.failed(err, first, l.Timestamp)
+	}
+	a.gap = nil
+	return nil
+}
+
+// Must be called with the lock held
+func (a *Archiver) write(l *oplog.ChangeLog) error {
+
+	if a.file == nil {
+		if err := a.open(l.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	var data []byte
+	var err error
+	if a.format == FormatBson {
+		data, err = bson.Marshal(l)
+	} else {
+		data, err = bson.MarshalExtJSON(l, true, false)
+		data = append(data, '\n')
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.out.Write(data); err != nil {
+		return err
+	}
+
+	a.size += int64(len(data))
+	a.index.Last = l.Timestamp
+	a.index.Count++
+	a.metrics.ArchiveWriteCounter.WithLabelValues(l.Db, l.Collection, l.Operation).Inc()
+
+	if a.maxSize > 0 && a.size >= a.maxSize {
+		return a.rotate()
+	}
+	return nil
+}
+
+// Close the current file and write its index
+func (a *Archiver) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.failed(a.rotate(), a.index.First, a.index.Last)
+}
+
+func (a *Archiver) flush() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+
+	first, last := a.index.First, a.index.Last
+	if a.maxAge > 0 && time.Since(a.index.OpenedAt) >= a.maxAge {
+		return a.failed(a.rotate(), first, last)
+	}
+
+	if a.gz != nil {
+		if err := a.gz.Flush(); err != nil {
+			return a.failed(err, first, last)
+		}
+	}
+	if err := a.buf.Flush(); err != nil {
+		return a.failed(err, first, last)
+	}
+
+	// Keep the index of the open file up to date, in case of a crash
+	if a.index.Count == a.indexed {
+		return nil
+	}
+	return a.writeIndex()
+}
+
+// Must be called with the lock held
+func (a *Archiver) open(first primitive.Timestamp) error {
+
+	// After a restart, the entries from the checkpoint are archived again:
+	// a file starting at the same entry is never overwritten
+	var file *os.File
+	var name string
+	for n := 0; ; n++ {
+		name = fmt.Sprintf("%s-%010d-%010d", a.prefix, first.T, first.I)
+		if n > 0 {
+			name += fmt.Sprintf(".%d", n)
+		}
+		name += "." + a.format
+		if a.compress {
+			name += GzipExtension
+		}
+
+		var err error
+		file, err = os.OpenFile(filepath.Join(a.dir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return err
+		}
+	}
+
+	a.file = file
+	a.buf = bufio.NewWriter(file)
+	a.out = a.buf
+	if a.compress {
+		a.gz = gzip.NewWriter(a.buf)
+		a.out = a.gz
+	}
+	a.size = 0
+	a.indexed = 0
+	a.index = Index{
+		File:       name,
+		Format:     a.format,
+		Compressed: a.compress,
+		First:      first,
+		OpenedAt:   time.Now(),
+	}
+
+	log.Info("archiving oplog to ", file.Name())
+	return nil
+}
+
+// Must be called with the lock held
+func (a *Archiver) rotate() error {
+
+	if a.file == nil {
+		return nil
+	}
+
+	if a.gz != nil {
+		if err := a.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	a.index.ClosedAt = time.Now()
+	err := a.writeIndex()
+
+	log.InfoWithFields("archive file closed", log.Fields{
+		"file":  a.index.File,
+		"first": a.index.First,
+		"last":  a.index.Last,
+		"count": a.index.Count,
+	})
+
+	a.file = nil
+	a.gz = nil
+	a.buf = nil
+	a.out = nil
+	return err
+}
+
+// Replace the index of the current file. Must be called with the lock held.
+func (a *Archiver) writeIndex() error {
+
+	data, err := json.MarshalIndent(a.index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Written aside then renamed, not to leave a partial index. The
+	// temporary file has the index extension to be ignored by the readers.
+	path := filepath.Join(a.dir, a.index.File+IndexExtension)
+	tmp := filepath.Join(a.dir, a.index.File+".tmp"+IndexExtension)
+	if err := os.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	a.indexed = a.index.Count
+	return nil
+}
+
+// Record the entries from `first` to `last` as a gap of the archive when
+// the error is not nil, extending the current gap. Returns the error.
+// Must be called with the lock held.
+func (a *Archiver) failed(err error, first primitive.Timestamp, last primitive.Timestamp) error {
+
+	if err == nil {
+		return nil
+	}
+	a.metrics.ArchiveErrorCounter.Inc()
+
+	if a.gap == nil {
+		a.gap = &Gap{First: first, Last: last}
+		for n := 0; ; n++ {
+			a.gap.File = fmt.Sprintf("%s-%010d-%010d", a.prefix, first.T, first.I)
+			if n > 0 {
+				a.gap.File += fmt.Sprintf(".%d", n)
+			}
+			a.gap.File += GapExtension
+			if _, err := os.Stat(filepath.Join(a.dir, a.gap.File)); errors.Is(err, os.ErrNotExist) {
+				break
+			}
+		}
+	}
+	if checkpoint.CompareTimestamps(first, a.gap.First) < 0 {
+		a.gap.First = first
+	}
+	if checkpoint.CompareTimestamps(last, a.gap.Last) > 0 {
+		a.gap.Last = last
+	}
+	a.gap.RecordedAt = time.Now()
+
+	// Written aside then renamed, as the index
+	data, merr := json.MarshalIndent(a.gap, "", "  ")
+	if merr == nil {
+		tmp := filepath.Join(a.dir, strings.TrimSuffix(a.gap.File, GapExtension)+".tmp"+GapExtension)
+		if merr = os.WriteFile(tmp, data, 0640); merr == nil {
+			merr = os.Rename(tmp, filepath.Join(a.dir, a.gap.File))
+		}
+	}
+	if merr != nil {
+		log.ErrorWithFields("error recording a gap of the archive", log.Fields{
+			"first": a.gap.First,
+			"last":  a.gap.Last,
+			"error": merr,
+		})
+	}
+	return err
+}
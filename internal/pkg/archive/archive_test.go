@@ -0,0 +1,288 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newChangeLog(t uint32) *oplog.ChangeLog {
+	return &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Timestamp: primitive.Timestamp{T: t, I: 1},
+			Version:   2,
+			Operation: oplog.InsertOp,
+			Namespace: "db1.coll1",
+			Object:    bson.D{{Key: "_id", Value: int64(t)}, {Key: "name", Value: "orange"}},
+		},
+		Db:         "db1",
+		Collection: "coll1",
+	}
+}
+
+func loadIndex(t *testing.T, path string) Index {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading index: %v", err)
+	}
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatalf("error decoding index: %v", err)
+	}
+	return index
+}
+
+func TestArchiveRotation(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := NewArchiver(config.ArchiveConfig{Dir: dir, Format: FormatJson, Compress: true}, "test", nil)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+	// Rotate after three entries, one per line
+	record, _ := bson.MarshalExtJSON(newChangeLog(100), true, false)
+	a.maxSize = int64((len(record)+1)*3 - 1)
+
+	for i := uint32(100); i < 105; i++ {
+		if err := a.Archive(newChangeLog(i)); err != nil {
+			t.Fatalf("Archive() = %v", err)
+		}
+	}
+	a.Close()
+
+	indexes, _ := filepath.Glob(filepath.Join(dir, "*"+IndexExtension))
+	if len(indexes) != 2 {
+		t.Fatalf("found %d index files; want 2", len(indexes))
+	}
+
+	index := loadIndex(t, indexes[0])
+	if index.First.T != 100 || index.Last.T != 102 || index.Count != 3 || !index.Compressed {
+		t.Errorf("index = %+v; want entries 100 to 102", index)
+	}
+	if index.File != "test-0000000100-0000000001.json.gz" {
+		t.Errorf("index.File = %s", index.File)
+	}
+
+	// Read back the last file
+	index = loadIndex(t, indexes[1])
+	f, err := os.Open(filepath.Join(dir, index.File))
+	if err != nil {
+		t.Fatalf("error opening archive: %v", err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("error opening archive: %v", err)
+	}
+
+	scanner := bufio.NewScanner(gz)
+	expected := uint32(103)
+	for scanner.Scan() {
+		var l oplog.ChangeLog
+		if err := bson.UnmarshalExtJSON(scanner.Bytes(), true, &l); err != nil {
+			t.Fatalf("error decoding entry: %v", err)
+		}
+		if l.Timestamp.T != expected || l.Db != "db1" || l.Namespace != "db1.coll1" {
+			t.Errorf("entry = %+v; want %d", l, expected)
+		}
+		expected++
+	}
+	if expected != 105 {
+		t.Errorf("read up to %d; want 105", expected)
+	}
+}
+
+func TestArchiveUnknownFormat(t *testing.T) {
+	_, err := NewArchiver(config.ArchiveConfig{Dir: t.TempDir(), Format: "xml"}, "test", nil)
+	if err == nil {
+		t.Errorf("NewArchiver() = nil; want an error")
+	}
+}
+
+func TestArchiveReadBack(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := NewArchiver(config.ArchiveConfig{Dir: dir, Format: FormatBson}, "test", nil)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+	for i := uint32(100); i < 103; i++ {
+		a.Archive(newChangeLog(i))
+	}
+	a.Close()
+
+	// The second file is left open, without index
+	for i := uint32(200); i < 202; i++ {
+		a.Archive(newChangeLog(i))
+	}
+	a.mu.Lock()
+	a.buf.Flush()
+	a.mu.Unlock()
+
+	files, err := ListFiles(dir, primitive.Timestamp{T: 150}, primitive.Timestamp{T: 300})
+	if err != nil {
+		t.Fatalf("ListFiles() = %v", err)
+	}
+	if len(files) != 1 || files[0].First.T != 200 || files[0].Format != FormatBson {
+		t.Fatalf("ListFiles() = %+v; want the file starting at 200", files)
+	}
+
+	files, _ = ListFiles(dir, primitive.Timestamp{}, primitive.Timestamp{T: 300})
+	if len(files) != 2 || files[0].First.T != 100 {
+		t.Fatalf("ListFiles() = %+v; want both files", files)
+	}
+
+	expected := uint32(100)
+	for _, index := range files {
+		r, err := NewFileReader(dir, index)
+		if err != nil {
+			t.Fatalf("NewFileReader() = %v", err)
+		}
+		for {
+			l, err := r.Next()
+			if err != nil {
+				break
+			}
+			if l.Timestamp.T != expected || l.Collection != "coll1" {
+				t.Errorf("entry = %+v; want %d", l, expected)
+			}
+			expected++
+			if expected == 103 {
+				expected = 200
+			}
+		}
+		r.Close()
+	}
+	if expected != 202 {
+		t.Errorf("read up to %d; want 202", expected)
+	}
+	a.Close()
+}
+
+func TestArchiveReopen(t *testing.T) {
+
+	dir := t.TempDir()
+	for run := 0; run < 2; run++ {
+		a, err := NewArchiver(config.ArchiveConfig{Dir: dir, Format: FormatBson}, "test", nil)
+		if err != nil {
+			t.Fatalf("NewArchiver() = %v", err)
+		}
+		// Archived again from the checkpoint after a restart
+		a.Archive(newChangeLog(100))
+		a.Archive(newChangeLog(101))
+		if err := a.flush(); err != nil {
+			t.Fatalf("flush() = %v", err)
+		}
+
+		// The index follows the open file
+		index := loadIndex(t, filepath.Join(dir, a.index.File+IndexExtension))
+		if index.Count != 2 || !index.ClosedAt.IsZero() {
+			t.Errorf("index = %+v; want 2 entries, not closed", index)
+		}
+		a.Close()
+	}
+
+	files, err := ListFiles(dir, primitive.Timestamp{}, primitive.Timestamp{T: 300})
+	if err != nil {
+		t.Fatalf("ListFiles() = %v", err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("ListFiles() = %+v; want both files", files)
+	}
+	for _, index := range files {
+		if index.Count != 2 || index.First.T != 100 {
+			t.Errorf("index = %+v; want the file kept", index)
+		}
+	}
+	if _, err := readIndex(dir, "test-0000000100-0000000001.1.bson"); err != nil {
+		t.Errorf("readIndex() = %v", err)
+	}
+}
+
+func TestArchiveGap(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := NewArchiver(config.ArchiveConfig{Dir: dir, Format: FormatBson}, "test", nil)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+	a.Archive(newChangeLog(100))
+	a.Archive(newChangeLog(101))
+
+	// The buffered entries are lost with the file
+	a.file.Close()
+	if err := a.flush(); err == nil {
+		t.Fatalf("flush() = nil; want an error")
+	}
+	if err := a.Archive(newChangeLog(102)); err == nil {
+		t.Fatalf("Archive() = nil; want an error")
+	}
+
+	gaps, err := ListGaps(dir, primitive.Timestamp{T: 101}, primitive.Timestamp{T: 300})
+	if err != nil {
+		t.Fatalf("ListGaps() = %v", err)
+	}
+	if len(gaps) != 1 || gaps[0].First.T != 100 || gaps[0].Last.T != 102 {
+		t.Fatalf("ListGaps() = %+v; want the entries 100 to 102", gaps)
+	}
+	if gaps[0].File != "test-0000000100-0000000001.gap" {
+		t.Errorf("gap.File = %s", gaps[0].File)
+	}
+	if gaps, _ := ListGaps(dir, primitive.Timestamp{T: 200}, primitive.Timestamp{T: 300}); len(gaps) != 0 {
+		t.Errorf("ListGaps() = %+v; want none after the gap", gaps)
+	}
+
+	// The gaps are not archive files
+	files, err := ListFiles(dir, primitive.Timestamp{}, primitive.Timestamp{T: 300})
+	if err != nil || len(files) != 1 {
+		t.Errorf("ListFiles() = %+v, %v; want the archive file", files, err)
+	}
+}
+
+func TestArchiveRedacted(t *testing.T) {
+
+	transformer, err := transform.NewTransformer([]config.TransformConfig{{
+		Namespace: "db1.*",
+		Fields:    []config.FieldRuleConfig{{Path: "name", Action: transform.ActionDrop}},
+	}})
+	if err != nil {
+		t.Fatalf("NewTransformer() = %v", err)
+	}
+
+	dir := t.TempDir()
+	a, err := NewArchiver(config.ArchiveConfig{Dir: dir, Format: FormatBson}, "test", transformer)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+	l := newChangeLog(100)
+	a.Archive(l)
+	a.Close()
+
+	// The entry replicated is left untouched
+	if len(l.Object) != 2 {
+		t.Errorf("Object = %v; want the entry unchanged", l.Object)
+	}
+
+	files, _ := ListFiles(dir, primitive.Timestamp{}, primitive.Timestamp{T: 300})
+	r, err := NewFileReader(dir, files[0])
+	if err != nil {
+		t.Fatalf("NewFileReader() = %v", err)
+	}
+	defer r.Close()
+	archived, err := r.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if len(archived.Object) != 1 || archived.Object[0].Key != "_id" {
+		t.Errorf("Object = %v; want the name dropped", archived.Object)
+	}
+}
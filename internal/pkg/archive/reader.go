@@ -0,0 +1,224 @@
+package archive
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Maximum size of a BSON document, plus some room for the change log fields
+	MaxEntrySize = 17 * 1024 * 1024
+)
+
+// Lists the archive files of a directory which may contain entries between
+// `from` and `to`, sorted chronologically. Files not closed (being written or
+// after a crash) are always listed as their last entry is unknown.
+func ListFiles(dir string, from primitive.Timestamp, to primitive.Timestamp) ([]Index, error) {
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []Index
+	for _, entry := range entries {
+
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, IndexExtension) || strings.HasSuffix(name, GapExtension) {
+			continue
+		}
+
+		index, err := readIndex(dir, name)
+		if err != nil {
+			return nil, err
+		}
+
+		if checkpoint.CompareTimestamps(index.Last, from) < 0 ||
+			checkpoint.CompareTimestamps(index.First, to) > 0 {
+			continue
+		}
+		files = append(files, index)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return checkpoint.CompareTimestamps(files[i].First, files[j].First) < 0
+	})
+	return files, nil
+}
+
+// Lists the gaps of the archive of a directory between `from` and `to`,
+// sorted chronologically
+func ListGaps(dir string, from primitive.Timestamp, to primitive.Timestamp) ([]Gap, error) {
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+GapExtension))
+	if err != nil {
+		return nil, err
+	}
+
+	var gaps []Gap
+	for _, name := range names {
+		if strings.HasSuffix(name, ".tmp"+GapExtension) {
+			continue
+		}
+
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		var gap Gap
+		if err := json.Unmarshal(data, &gap); err != nil {
+			return nil, fmt.Errorf("invalid gap %s: %w", filepath.Base(name), err)
+		}
+
+		if checkpoint.CompareTimestamps(gap.Last, from) < 0 ||
+			checkpoint.CompareTimestamps(gap.First, to) > 0 {
+			continue
+		}
+		gaps = append(gaps, gap)
+	}
+
+	sort.Slice(gaps, func(i, j int) bool {
+		return checkpoint.CompareTimestamps(gaps[i].First, gaps[j].First) < 0
+	})
+	return gaps, nil
+}
+
+// Read the index of an archive file, or build one from its name
+func readIndex(dir string, name string) (Index, error) {
+
+	data, err := os.ReadFile(filepath.Join(dir, name+IndexExtension))
+	if err == nil {
+		var index Index
+		err = json.Unmarshal(data, &index)
+		if index.ClosedAt.IsZero() {
+			index.Last = checkpoint.MongoTimestampMax
+		}
+		return index, err
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return Index{}, err
+	}
+
+	// <prefix>-<seconds>-<increment>[.<n>].<format>[.gz]
+	index := Index{
+		File: name,
+		Last: checkpoint.MongoTimestampMax,
+	}
+	base := name
+	if strings.HasSuffix(base, GzipExtension) {
+		index.Compressed = true
+		base = strings.TrimSuffix(base, GzipExtension)
+	}
+	index.Format = strings.TrimPrefix(filepath.Ext(base), ".")
+	base = strings.TrimSuffix(base, filepath.Ext(base))
+	if _, err := strconv.Atoi(strings.TrimPrefix(filepath.Ext(base), ".")); err == nil {
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+
+	parts := strings.Split(base, "-")
+	if len(parts) < 3 || (index.Format != FormatBson && index.Format != FormatJson) {
+		return Index{}, fmt.Errorf("not an archive file: %s", name)
+	}
+	index.First, err = checkpoint.ParseTimestamp(parts[len(parts)-2] + ":" + parts[len(parts)-1])
+	return index, err
+}
+
+// Reads the change logs of an archive file
+type FileReader struct {
+	file    *os.File
+	gz      *gzip.Reader
+	reader  *bufio.Reader
+	scanner *bufio.Scanner
+	format  string
+}
+
+func NewFileReader(dir string, index Index) (*FileReader, error) {
+
+	file, err := os.Open(filepath.Join(dir, index.File))
+	if err != nil {
+		return nil, err
+	}
+
+	r := &FileReader{
+		file:   file,
+		format: index.Format,
+	}
+
+	var in io.Reader = bufio.NewReader(file)
+	if index.Compressed {
+		r.gz, err = gzip.NewReader(in)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		in = r.gz
+	}
+
+	if r.format == FormatJson {
+		r.scanner = bufio.NewScanner(in)
+		r.scanner.Buffer(make([]byte, 64*1024), MaxEntrySize*2)
+	} else {
+		r.reader = bufio.NewReader(in)
+	}
+	return r, nil
+}
+
+// Read the next change log. Returns io.EOF once the end of the file is reached.
+// A truncated last entry, from a file not closed properly, is reported as io.EOF.
+func (r *FileReader) Next() (*oplog.ChangeLog, error) {
+
+	l := &oplog.ChangeLog{}
+	if r.format == FormatJson {
+		if !r.scanner.Scan() {
+			if err := r.scanner.Err(); err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, err
+			}
+			return nil, io.EOF
+		}
+		if err := bson.UnmarshalExtJSON(r.scanner.Bytes(), true, l); err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+
+	// Each BSON document starts with its size
+	header, err := r.reader.Peek(4)
+	if err != nil {
+		return nil, io.EOF
+	}
+	size := binary.LittleEndian.Uint32(header)
+	if size < 5 || size > MaxEntrySize {
+		return nil, fmt.Errorf("invalid entry size %d in %s", size, r.file.Name())
+	}
+
+	raw := make([]byte, size)
+	if _, err := io.ReadFull(r.reader, raw); err != nil {
+		return nil, io.EOF
+	}
+	if err := bson.Unmarshal(raw, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (r *FileReader) Close() error {
+	if r.gz != nil {
+		r.gz.Close()
+	}
+	return r.file.Close()
+}
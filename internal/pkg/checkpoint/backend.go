@@ -0,0 +1,37 @@
+package checkpoint
+
+import (
+	"fmt"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+)
+
+const (
+	// A collection of a MongoDB server, the target unless `state.uri` is set
+	TypeMongoDB = "mongodb"
+	// A JSON file per checkpoint in `state.dir`
+	TypeFile = "file"
+	// Not persisted, for tests and dry runs
+	TypeMemory = "memory"
+)
+
+// A storage of the checkpoint and of what is saved next to it
+type Backend interface {
+	CheckpointManager
+	Store
+}
+
+// Open the checkpoint `name` in the configured storage. The MongoDB
+// backend stores it on the server given.
+func NewCheckpointManager(cfg config.StateConfig, server *mdb.MDB, name string) (Backend, error) {
+	switch cfg.Type {
+	case "", TypeMongoDB:
+		return NewMongoCheckpointService(server, name, cfg.Database, cfg.Collection), nil
+	case TypeFile:
+		return NewFileCheckpoint(cfg.Dir, name)
+	case TypeMemory:
+		return NewMemoryCheckpoint(name), nil
+	}
+	return nil, fmt.Errorf("unknown state type: %s", cfg.Type)
+}
@@ -25,11 +25,26 @@ type Checkpoint struct {
 	Latest    time.Time           `bson:"latest" json:"latest" omitempty`
 	LatestTs  primitive.Timestamp `bson:"ts" json:"ts" omitempty`
 	LatestLSN int64               `bson:"lsn" json:"lsn" omitempty`
+
+	// Oplog entries up to this timestamp may already be applied on the target.
+	// Their errors are tolerated to keep the apply idempotent.
+	OverlapUntil primitive.Timestamp `bson:"overlap_until,omitempty" json:"overlap_until,omitempty"`
+
+	// The process and the configuration which saved the checkpoint
+	Version    string `bson:"version,omitempty" json:"version,omitempty"`
+	ConfigHash string `bson:"config_hash,omitempty" json:"config_hash,omitempty"`
+
+	// Epoch of the leader lease which saved the checkpoint, the fencing token
+	Epoch int64 `bson:"epoch,omitempty" json:"epoch,omitempty"`
+
+	// Term of the source oplog entry at the checkpoint, when known. A different
+	// term on resume means the source rolled the entry back.
+	Term *int64 `bson:"term" json:"term,omitempty"`
 }
 
 // Returns the boundaries of the oplog for the replicaset
 // with the oldest and newest timestamps in it.
-func GetReplicasetOplogWindow() (TsWindow, error) {
+func GetReplicasetOplogWindow(source *mdb.MDB) (TsWindow, error) {
 
 	// smallestNew := MongoTimestampMax
 	// biggestNew := MongoTimestampMin
@@ -41,7 +56,7 @@ func GetReplicasetOplogWindow() (TsWindow, error) {
 
 	// Get the most recent timestamp from the oplog
 	var newest primitive.Timestamp = MongoTimestampMin
-	newest, err := getOplogTimestamp(mdb.Registry.GetSource().Client, Newest)
+	newest, err := getOplogTimestamp(source.Client, Newest)
 	if err != nil {
 		return TsWindow{}, err
 	} else if IsZero(newest) {
@@ -49,7 +64,7 @@ func GetReplicasetOplogWindow() (TsWindow, error) {
 	}
 
 	var oldest primitive.Timestamp = MongoTimestampMin
-	oldest, err = getOplogTimestamp(mdb.Registry.GetSource().Client, Oldest)
+	oldest, err = getOplogTimestamp(source.Client, Oldest)
 	if err != nil {
 		return TsWindow{}, err
 	}
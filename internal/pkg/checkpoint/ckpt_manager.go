@@ -2,7 +2,8 @@ package checkpoint
 
 import (
 	"context"
-	"time"
+	"errors"
+	"sync/atomic"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
@@ -12,15 +13,44 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// The checkpoint was saved by a newer leader
+var ErrFenced = errors.New("the checkpoint was saved by a newer leader")
+
+// Tracks and saves the checkpoint of a replication
 type CheckpointManager interface {
 	GetCheckpoint(context.Context) (Checkpoint, error)
+	Checkpoint() Checkpoint
 	SetCheckpoint(context.Context, primitive.Timestamp, bool) error
+	StartFrom(context.Context, primitive.Timestamp, primitive.Timestamp) error
 	MoveCheckpointForward(primitive.Timestamp)
+	HoldCheckpoint(primitive.Timestamp)
+	ReleaseCheckpoint(primitive.Timestamp, primitive.Timestamp)
+	SaveCheckpoint(context.Context) error
+	Rewind(context.Context, primitive.Timestamp) error
+	GetHistory(context.Context, int) ([]Checkpoint, error)
+	SetConfigHash(string)
+	SetFencingToken(int64)
 	StartAutosave(context.Context)
 	StopAutosave()
 }
 
+// Saves what the replication keeps next to its checkpoint: the terms
+// of the entries read, the replication state and the namespaces changed
+// at runtime
+type Store interface {
+	RecordTerm(primitive.Timestamp, int64)
+	SaveState(context.Context, any) error
+	LoadState(context.Context, any) (bool, error)
+	SaveNamespaces(context.Context, any) error
+	LoadNamespaces(context.Context, any) (bool, error)
+}
+
+// Stores the checkpoints in a collection of a MongoDB server, the target
+// by default, their history in the `<collection>_history` collection,
+// the replication state in the `<collection>_state` collection and the
+// namespaces changed at runtime in the `<collection>_namespaces` collection
 type MongoCheckpoint struct {
+	tracker
 
 	// Database used to store the checkpoint
 	DB string
@@ -28,39 +58,50 @@ type MongoCheckpoint struct {
 	// Collection used to store the checkpoint
 	Collection string
 
-	// In-memory storage of the current checkpoint
-	Current Checkpoint
+	// Server storing the checkpoint
+	Target *mdb.MDB
 
-	// Autosave stop
-	autosave chan bool
+	// The unique index on the name of the checkpoints was created
+	indexed atomic.Bool
 }
 
-func NewMongoCheckpointService(name string, ckptDb string, ckptColl string) *MongoCheckpoint {
+// Name of the unique index on the checkpoint names
+const CheckpointNameIndex = "checkpoint_name_unique"
 
-	if name == "" {
-		name = "default"
-	}
+func NewMongoCheckpointService(target *mdb.MDB, name string, ckptDb string, ckptColl string) *MongoCheckpoint {
 
-	return &MongoCheckpoint{
+	s := &MongoCheckpoint{
+		Target:     target,
 		DB:         ckptDb,
 		Collection: ckptColl,
-		autosave:   make(chan bool),
-		Current: Checkpoint{
-			Name: name,
-		},
 	}
+	s.tracker = newTracker(name, s)
+	return s
+}
+
+func (s *MongoCheckpoint) collection() *mongo.Collection {
+	return s.Target.Client.Database(s.DB).Collection(s.Collection)
+}
+
+func (s *MongoCheckpoint) historyCollection() *mongo.Collection {
+	return s.Target.Client.Database(s.DB).Collection(s.Collection + "_history")
+}
+
+func (s *MongoCheckpoint) stateCollection() *mongo.Collection {
+	return s.Target.Client.Database(s.DB).Collection(s.Collection + "_state")
+}
+
+func (s *MongoCheckpoint) namespacesCollection() *mongo.Collection {
+	return s.Target.Client.Database(s.DB).Collection(s.Collection + "_namespaces")
 }
 
 func (s *MongoCheckpoint) GetCheckpoint(ctx context.Context) (Checkpoint, error) {
 
-	db := mdb.Registry.GetTarget().Client.Database(s.DB)
-	collection := db.Collection(s.Collection)
+	collection := s.collection()
 
-	filter := bson.M{}
-	opts := options.FindOneOptions{
-		Sort: map[string]int{"$natural": -1},
-	}
-	result := collection.FindOne(ctx, filter, &opts)
+	// Several replications may share the state collection
+	filter := bson.M{"name": s.name()}
+	result := collection.FindOne(ctx, filter)
 	err := result.Err()
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
@@ -76,85 +117,116 @@ func (s *MongoCheckpoint) GetCheckpoint(ctx context.Context) (Checkpoint, error)
 		log.Fatal("error decoding the result: ", err)
 	}
 
-	s.Current = ckpt
+	s.loaded(ckpt)
 	return ckpt, nil
 }
 
-func (s *MongoCheckpoint) SetCheckpoint(ctx context.Context, ts primitive.Timestamp, save bool) error {
+func (s *MongoCheckpoint) save(ctx context.Context, ckpt Checkpoint) error {
 
-	// Store the checkpoint in memory
-	s.MoveCheckpointForward(ts)
+	// Store the checkpoint in the database
+	opts := options.Update().SetUpsert(true)
+	filter := bson.M{"name": ckpt.Name}
+	update := bson.M{"$set": ckpt}
 
-	// Save the checkpoint if requested
-	if save {
-		return s.saveCheckpoint(ctx)
+	// A stale leader cannot overwrite the checkpoint of a newer one
+	if ckpt.Epoch > 0 {
+		return s.saveFenced(ctx, ckpt)
 	}
 
+	_, err := s.collection().UpdateOne(ctx, filter, update, opts)
+	if err != nil {
+		log.WarnWithFields("checkpoint upsert error", log.Fields{
+			"checkpoint": ckpt.Name,
+			"updates":    update,
+			"error":      err,
+		})
+		return err
+	}
 	return nil
 }
 
-func (s *MongoCheckpoint) MoveCheckpointForward(ts primitive.Timestamp) {
+// Save the checkpoint unless a greater epoch saved it. The upsert does
+// not match the checkpoint of a newer leader, and the unique index on the
+// name refuses to insert a second one. Partial, it leaves out the leases
+// kept in the same collection, which have no name.
+func (s *MongoCheckpoint) saveFenced(ctx context.Context, ckpt Checkpoint) error {
+
+	collection := s.collection()
+	if !s.indexed.Load() {
+		index := mongo.IndexModel{
+			Keys: bson.D{{Key: "name", Value: 1}},
+			Options: options.Index().SetName(CheckpointNameIndex).SetUnique(true).
+				SetPartialFilterExpression(bson.M{"name": bson.M{"$exists": true}}),
+		}
+		if _, err := collection.Indexes().CreateOne(ctx, index); err != nil {
+			return err
+		}
+		s.indexed.Store(true)
+	}
 
-	if ts.T == 0 || ts.T < s.Current.LatestTs.T {
-		log.Warn("invalid timestamp: ", ts)
-		return
+	opts := options.Update().SetUpsert(true)
+	filter := bson.M{"name": ckpt.Name, "epoch": bson.M{"$not": bson.M{"$gt": ckpt.Epoch}}}
+	_, err := collection.UpdateOne(ctx, filter, bson.M{"$set": ckpt}, opts)
+	if mongo.IsDuplicateKeyError(err) {
+		log.WarnWithFields("checkpoint fenced", log.Fields{"checkpoint": ckpt.Name, "epoch": ckpt.Epoch})
+		return ErrFenced
 	}
+	return err
+}
 
-	// TODO: Should not be the following operation an atomic one?
-	// We have the autosave running. We should stop it, update the checkpoint and restart it.
-	s.Current.LatestTs = ts
-	s.Current.Latest = ToDate(ts)
-	s.Current.LatestLSN = ToInt64(ts)
-	s.Current.SavedAt = time.Now()
+func (s *MongoCheckpoint) record(ctx context.Context, ckpt Checkpoint) error {
+	_, err := s.historyCollection().InsertOne(ctx, ckpt)
+	return err
 }
 
-func (s *MongoCheckpoint) saveCheckpoint(ctx context.Context) error {
+func (s *MongoCheckpoint) history(ctx context.Context, name string, limit int) ([]Checkpoint, error) {
 
-	// Change the saved information
-	s.Current.SavedAt = time.Now()
+	opts := options.Find().SetSort(bson.D{{Key: "saved", Value: -1}}).SetLimit(int64(limit))
+	cur, err := s.historyCollection().Find(ctx, bson.M{"name": name}, opts)
+	if err != nil {
+		return nil, err
+	}
 
-	// Store the checkpoint in the database
-	opts := options.Update().SetUpsert(true)
-	filter := bson.M{"name": s.Current.Name}
-	update := bson.M{"$set": s.Current}
+	history := []Checkpoint{}
+	err = cur.All(ctx, &history)
+	return history, err
+}
+
+func (s *MongoCheckpoint) SaveState(ctx context.Context, state any) error {
 
-	_, err := mdb.Registry.GetTarget().Client.Database(s.DB).Collection(s.Collection).UpdateOne(ctx, filter, update, opts)
+	doc, err := bson.Marshal(state)
 	if err != nil {
-		log.WarnWithFields("checkpoint upsert error", log.Fields{
-			"checkpoint": s.Current.Name,
-			"updates":    update,
-			"error":      err,
-		})
 		return err
 	}
-	return nil
-}
+	var update bson.M
+	if err := bson.Unmarshal(doc, &update); err != nil {
+		return err
+	}
 
-func (s *MongoCheckpoint) StartAutosave(ctx context.Context) {
-	go s.RunAutosave(ctx)
+	opts := options.Update().SetUpsert(true)
+	_, err = s.stateCollection().UpdateOne(ctx, bson.M{"_id": s.name()}, bson.M{"$set": update}, opts)
+	return err
 }
 
-func (s *MongoCheckpoint) RunAutosave(context.Context) {
-
-	log.Info("starting autosave")
-	go func() {
-		for {
+func (s *MongoCheckpoint) LoadState(ctx context.Context, state any) (bool, error) {
+	return s.load(ctx, s.stateCollection(), state)
+}
 
-			// Check if the autosave has been stopped
-			select {
-			case <-s.autosave:
-				return
-			default:
-			}
+func (s *MongoCheckpoint) SaveNamespaces(ctx context.Context, namespaces any) error {
+	opts := options.Replace().SetUpsert(true)
+	_, err := s.namespacesCollection().ReplaceOne(ctx, bson.M{"_id": s.name()}, namespaces, opts)
+	return err
+}
 
-			// Store the checkpoint
-			s.saveCheckpoint(context.Background())
-			log.Info("checkpoint autosaved: ", s.Current)
-			time.Sleep(10 * time.Second)
-		}
-	}()
+func (s *MongoCheckpoint) LoadNamespaces(ctx context.Context, namespaces any) (bool, error) {
+	return s.load(ctx, s.namespacesCollection(), namespaces)
 }
 
-func (s *MongoCheckpoint) StopAutosave() {
-	s.autosave <- true
+// Decode the document of the replication, false when not saved yet
+func (s *MongoCheckpoint) load(ctx context.Context, collection *mongo.Collection, doc any) (bool, error) {
+	err := collection.FindOne(ctx, bson.M{"_id": s.name()}).Decode(doc)
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+	return err == nil, err
 }
@@ -0,0 +1,209 @@
+package checkpoint
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+)
+
+// Stores the checkpoint in a local JSON file, `<dir>/<name>.json`. The file
+// is replaced atomically: the checkpoint is written to a temporary file of
+// the directory, synced to disk, then renamed over the previous one.
+// The history is appended to `<dir>/<name>.history.jsonl`, the replication
+// state saved to `<dir>/<name>.state.json` and the namespaces changed at
+// runtime to `<dir>/<name>.namespaces.json`.
+type FileCheckpoint struct {
+	tracker
+
+	// File holding the checkpoint
+	Path string
+
+	// File holding the history, one checkpoint per line
+	HistoryPath string
+
+	// File holding the replication state
+	StatePath string
+
+	// File holding the namespaces changed at runtime
+	NamespacesPath string
+}
+
+func NewFileCheckpoint(dir string, name string) (*FileCheckpoint, error) {
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &FileCheckpoint{}
+	s.tracker = newTracker(name, s)
+	s.Path = filepath.Join(dir, s.name()+".json")
+	s.HistoryPath = filepath.Join(dir, s.name()+".history.jsonl")
+	s.StatePath = filepath.Join(dir, s.name()+".state.json")
+	s.NamespacesPath = filepath.Join(dir, s.name()+".namespaces.json")
+	return s, nil
+}
+
+func (s *FileCheckpoint) GetCheckpoint(ctx context.Context) (Checkpoint, error) {
+
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Checkpoint{}, nil
+	}
+	if err != nil {
+		return Checkpoint{}, err
+	}
+
+	var ckpt Checkpoint
+	if err := json.Unmarshal(data, &ckpt); err != nil {
+		return Checkpoint{}, err
+	}
+
+	s.loaded(ckpt)
+	return ckpt, nil
+}
+
+func (s *FileCheckpoint) save(ctx context.Context, ckpt Checkpoint) error {
+
+	data, err := json.MarshalIndent(ckpt, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.Path, data); err != nil {
+		log.WarnWithFields("checkpoint save error", log.Fields{
+			"checkpoint": ckpt.Name,
+			"path":       s.Path,
+			"error":      err,
+		})
+		return err
+	}
+	return nil
+}
+
+func (s *FileCheckpoint) record(ctx context.Context, ckpt Checkpoint) error {
+
+	data, err := json.Marshal(ckpt)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(s.HistoryPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *FileCheckpoint) history(ctx context.Context, name string, limit int) ([]Checkpoint, error) {
+
+	f, err := os.Open(s.HistoryPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return []Checkpoint{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// A line partially written by a crash is ignored
+	history := []Checkpoint{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var ckpt Checkpoint
+		if err := json.Unmarshal(scanner.Bytes(), &ckpt); err == nil {
+			history = append(history, ckpt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(history)
+	if limit > 0 && len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
+func (s *FileCheckpoint) SaveState(ctx context.Context, state any) error {
+	return saveJSON(s.StatePath, state)
+}
+
+func (s *FileCheckpoint) LoadState(ctx context.Context, state any) (bool, error) {
+	return loadJSON(s.StatePath, state)
+}
+
+func (s *FileCheckpoint) SaveNamespaces(ctx context.Context, namespaces any) error {
+	return saveJSON(s.NamespacesPath, namespaces)
+}
+
+func (s *FileCheckpoint) LoadNamespaces(ctx context.Context, namespaces any) (bool, error) {
+	return loadJSON(s.NamespacesPath, namespaces)
+}
+
+func saveJSON(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Decode the file, false when not saved yet
+func loadJSON(path string, v any) (bool, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+// Replace the file by the data, never leaving a partially written file
+func writeFileAtomic(path string, data []byte) error {
+
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
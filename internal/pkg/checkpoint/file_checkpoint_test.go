@@ -0,0 +1,126 @@
+package checkpoint
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFileCheckpoint(t *testing.T) {
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	s, err := NewFileCheckpoint(dir, "rs0_to_rs1")
+	if err != nil {
+		t.Fatalf("NewFileCheckpoint() = %v", err)
+	}
+
+	// No checkpoint yet
+	if ckpt, err := s.GetCheckpoint(ctx); err != nil || ckpt.LatestLSN != 0 {
+		t.Fatalf("GetCheckpoint() = %v, %v; want an empty checkpoint", ckpt, err)
+	}
+
+	ts := primitive.Timestamp{T: 1730541600, I: 3}
+	overlap := primitive.Timestamp{T: 1730541700}
+	if err := s.StartFrom(ctx, ts, overlap); err != nil {
+		t.Fatalf("StartFrom() = %v", err)
+	}
+	s.MoveCheckpointForward(primitive.Timestamp{T: 1730541650, I: 1})
+
+	// Only the saved checkpoint survives a restart
+	reopened, _ := NewFileCheckpoint(dir, "rs0_to_rs1")
+	ckpt, err := reopened.GetCheckpoint(ctx)
+	if err != nil || ckpt.LatestTs != ts || ckpt.OverlapUntil != overlap || ckpt.Name != "rs0_to_rs1" {
+		t.Fatalf("GetCheckpoint() = %+v, %v; want %v", ckpt, err, ts)
+	}
+
+	if err := s.SaveCheckpoint(ctx); err != nil {
+		t.Fatalf("SaveCheckpoint() = %v", err)
+	}
+	if ckpt, _ := reopened.GetCheckpoint(ctx); ckpt.LatestTs.T != 1730541650 {
+		t.Errorf("GetCheckpoint() = %v; want the moved checkpoint", ckpt.LatestTs)
+	}
+
+	// The temporary files are renamed or removed
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 || entries[0].Name() != "rs0_to_rs1.history.jsonl" || entries[1].Name() != "rs0_to_rs1.json" {
+		t.Errorf("state directory holds %v; want rs0_to_rs1.json and its history only", entries)
+	}
+}
+
+func TestFileCheckpointHistory(t *testing.T) {
+
+	dir := t.TempDir()
+	ctx := context.Background()
+	s, _ := NewFileCheckpoint(dir, "rs0_to_rs1")
+	s.SetConfigHash("abcd")
+
+	for _, sec := range []uint32{1730541600, 1730541610, 1730541620} {
+		if err := s.SetCheckpoint(ctx, primitive.Timestamp{T: sec}, true); err != nil {
+			t.Fatalf("SetCheckpoint() = %v", err)
+		}
+	}
+
+	// An unchanged position is not recorded twice
+	if err := s.SaveCheckpoint(ctx); err != nil {
+		t.Fatalf("SaveCheckpoint() = %v", err)
+	}
+
+	reopened, _ := NewFileCheckpoint(dir, "rs0_to_rs1")
+	history, err := reopened.GetHistory(ctx, 0)
+	if err != nil || len(history) != 3 {
+		t.Fatalf("GetHistory() = %v, %v; want 3 checkpoints", history, err)
+	}
+	if history[0].LatestTs.T != 1730541620 || history[2].LatestTs.T != 1730541600 {
+		t.Errorf("GetHistory() = %v; want the most recent first", history)
+	}
+	if history[0].ConfigHash != "abcd" || history[0].Version != config.Version {
+		t.Errorf("GetHistory()[0] = %+v; want the version and config hash", history[0])
+	}
+	if history, _ := reopened.GetHistory(ctx, 2); len(history) != 2 || history[0].LatestTs.T != 1730541620 {
+		t.Errorf("GetHistory(2) = %v; want the 2 most recent", history)
+	}
+}
+
+func TestFileCheckpointNamespaces(t *testing.T) {
+
+	ctx := context.Background()
+	s, err := NewFileCheckpoint(t.TempDir(), "rs0_to_rs1")
+	if err != nil {
+		t.Fatalf("NewFileCheckpoint() = %v", err)
+	}
+
+	var loaded map[string][]string
+	if found, err := s.LoadNamespaces(ctx, &loaded); found || err != nil {
+		t.Fatalf("LoadNamespaces() = %v, %v; want nothing saved", found, err)
+	}
+
+	saved := map[string][]string{"in": {"prod.orders"}}
+	if err := s.SaveNamespaces(ctx, saved); err != nil {
+		t.Fatalf("SaveNamespaces() = %v", err)
+	}
+	if found, err := s.LoadNamespaces(ctx, &loaded); !found || err != nil || loaded["in"][0] != "prod.orders" {
+		t.Errorf("LoadNamespaces() = %v, %v, %v; want the saved namespaces", found, err, loaded)
+	}
+}
+
+func TestNewCheckpointManager(t *testing.T) {
+
+	tests := []struct {
+		cfg   config.StateConfig
+		valid bool
+	}{
+		{config.StateConfig{Type: TypeFile, Dir: t.TempDir()}, true},
+		{config.StateConfig{Type: TypeMemory}, true},
+		{config.StateConfig{Type: "redis"}, false},
+	}
+	for _, test := range tests {
+		ckpt, err := NewCheckpointManager(test.cfg, nil, "test")
+		if test.valid != (err == nil && ckpt != nil) {
+			t.Errorf("NewCheckpointManager(%s) = %v; want valid = %v", test.cfg.Type, err, test.valid)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package checkpoint
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sync"
+)
+
+// Keeps the checkpoint in memory only. It is used when there is no
+// state to persist, like when replaying archived oplog files.
+type MemoryCheckpoint struct {
+	tracker
+
+	mu      sync.Mutex
+	saved   Checkpoint
+	records []Checkpoint
+	state   []byte
+	ns      []byte
+}
+
+func NewMemoryCheckpoint(name string) *MemoryCheckpoint {
+	s := &MemoryCheckpoint{}
+	s.tracker = newTracker(name, s)
+	return s
+}
+
+func (s *MemoryCheckpoint) GetCheckpoint(ctx context.Context) (Checkpoint, error) {
+	return s.Checkpoint(), nil
+}
+
+func (s *MemoryCheckpoint) save(ctx context.Context, ckpt Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.saved = ckpt
+	return nil
+}
+
+func (s *MemoryCheckpoint) record(ctx context.Context, ckpt Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, ckpt)
+	return nil
+}
+
+func (s *MemoryCheckpoint) history(ctx context.Context, name string, limit int) ([]Checkpoint, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	history := append([]Checkpoint{}, s.records...)
+	slices.Reverse(history)
+	if limit > 0 && len(history) > limit {
+		history = history[:limit]
+	}
+	return history, nil
+}
+
+func (s *MemoryCheckpoint) SaveState(ctx context.Context, state any) error {
+	return s.saveJSON(&s.state, state)
+}
+
+func (s *MemoryCheckpoint) LoadState(ctx context.Context, state any) (bool, error) {
+	return s.loadJSON(&s.state, state)
+}
+
+func (s *MemoryCheckpoint) SaveNamespaces(ctx context.Context, namespaces any) error {
+	return s.saveJSON(&s.ns, namespaces)
+}
+
+func (s *MemoryCheckpoint) LoadNamespaces(ctx context.Context, namespaces any) (bool, error) {
+	return s.loadJSON(&s.ns, namespaces)
+}
+
+func (s *MemoryCheckpoint) saveJSON(to *[]byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	*to = data
+	return nil
+}
+
+func (s *MemoryCheckpoint) loadJSON(from *[]byte, v any) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if *from == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(*from, v)
+}
+
+// Nothing to save periodically
+func (s *MemoryCheckpoint) StartAutosave(context.Context) {}
+
+func (s *MemoryCheckpoint) StopAutosave() {}
@@ -1,7 +1,10 @@
 package checkpoint
 
 import (
+	"fmt"
 	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -50,3 +53,32 @@ type TsWindow struct {
 	Oldest primitive.Timestamp
 	Newest primitive.Timestamp
 }
+
+// Parses a timestamp given either as a date (RFC 3339), as unix seconds
+// or as a `<seconds>:<increment>` pair, like in a mongo Timestamp.
+func ParseTimestamp(value string) (primitive.Timestamp, error) {
+
+	value = strings.TrimSpace(value)
+	if date, err := time.Parse(time.RFC3339, value); err == nil {
+		if date.Unix() < 0 || date.Unix() > math.MaxUint32 {
+			return MongoTimestampMin, fmt.Errorf("date out of range: %s", value)
+		}
+		return primitive.Timestamp{T: uint32(date.Unix()), I: 0}, nil
+	}
+
+	seconds, increment, found := strings.Cut(value, ":")
+	t, err := strconv.ParseUint(seconds, 10, 32)
+	if err != nil {
+		return MongoTimestampMin, fmt.Errorf("invalid timestamp: %s", value)
+	}
+
+	var i uint64 = 0
+	if found {
+		i, err = strconv.ParseUint(increment, 10, 32)
+		if err != nil {
+			return MongoTimestampMin, fmt.Errorf("invalid timestamp increment: %s", value)
+		}
+	}
+
+	return primitive.Timestamp{T: uint32(t), I: uint32(i)}, nil
+}
@@ -0,0 +1,37 @@
+package checkpoint
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected primitive.Timestamp
+		valid    bool
+	}{
+		{"1730541600", primitive.Timestamp{T: 1730541600}, true},
+		{"1730541600:12", primitive.Timestamp{T: 1730541600, I: 12}, true},
+		{" 1730541600:12 ", primitive.Timestamp{T: 1730541600, I: 12}, true},
+		{"2024-11-02T10:00:00Z", primitive.Timestamp{T: 1730541600}, true},
+		{"2024-11-02T11:00:00+01:00", primitive.Timestamp{T: 1730541600}, true},
+		{"", primitive.Timestamp{}, false},
+		{"yesterday", primitive.Timestamp{}, false},
+		{"1730541600:", primitive.Timestamp{}, false},
+		{"-1", primitive.Timestamp{}, false},
+		{"1969-12-31T23:59:59Z", primitive.Timestamp{}, false},
+	}
+
+	for _, test := range tests {
+		ts, err := ParseTimestamp(test.value)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseTimestamp(%q) error = %v; want valid = %v", test.value, err, test.valid)
+			continue
+		}
+		if ts != test.expected {
+			t.Errorf("ParseTimestamp(%q) = %v; want %v", test.value, ts, test.expected)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package checkpoint
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Interval between the saves of the checkpoint while replicating
+const AutosaveInterval = 10 * time.Second
+
+// Where a backend saves the checkpoints
+type store interface {
+	// Replace the saved checkpoint
+	save(ctx context.Context, ckpt Checkpoint) error
+	// Append the checkpoint to the history
+	record(ctx context.Context, ckpt Checkpoint) error
+	// The history of the checkpoints, the most recent first
+	history(ctx context.Context, name string, limit int) ([]Checkpoint, error)
+}
+
+// Keeps the current checkpoint in memory, shared by the writer and the
+// autosave, and saves it to the store of the backend
+type tracker struct {
+	mu      sync.Mutex
+	Current Checkpoint
+
+	// Orders the saves, an older copy never overwrites a newer one
+	saving   sync.Mutex
+	store    store
+	recorded primitive.Timestamp
+
+	// Hash of the configuration saving the checkpoints
+	configHash string
+
+	// Epoch of the leader lease, 0 without leader election
+	epoch int64
+
+	// Changes of term read from the source oplog, from the checkpoint on
+	terms []termChange
+
+	// Keeps the checkpoint while entries read after it are held back
+	hold *checkpointHold
+
+	// Stops the autosave and waits for it
+	stopAutosave func()
+}
+
+// The source oplog entries have this term from the timestamp on
+type termChange struct {
+	ts   primitive.Timestamp
+	term int64
+}
+
+// The checkpoint stays at a position until released, then until the last
+// entry held back or an entry read after them is written
+type checkpointHold struct {
+	at        primitive.Timestamp
+	released  bool
+	last      primitive.Timestamp
+	readUntil primitive.Timestamp
+}
+
+func newTracker(name string, store store) tracker {
+	if name == "" {
+		name = "default"
+	}
+	return tracker{
+		Current: Checkpoint{Name: name},
+		store:   store,
+	}
+}
+
+// Set the hash of the configuration recorded with the checkpoints
+func (s *tracker) SetConfigHash(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.configHash = hash
+}
+
+// Set the epoch of the leader lease. A checkpoint saved with a greater
+// epoch is never overwritten.
+func (s *tracker) SetFencingToken(epoch int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.epoch = epoch
+}
+
+// Record the term of a source oplog entry, saved with the checkpoint
+// once it reaches the entry
+func (s *tracker) RecordTerm(ts primitive.Timestamp, term int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n := len(s.terms); n > 0 && (s.terms[n-1].term == term || CompareTimestamps(ts, s.terms[n-1].ts) <= 0) {
+		return
+	}
+	s.terms = append(s.terms, termChange{ts: ts, term: term})
+}
+
+// Set the term of the checkpointed entry from the recorded changes,
+// dropping the ones it moved past
+func (s *tracker) updateTerm() {
+	last := -1
+	for i, change := range s.terms {
+		if CompareTimestamps(change.ts, s.Current.LatestTs) > 0 {
+			break
+		}
+		last = i
+	}
+	if last >= 0 {
+		term := s.terms[last].term
+		s.Current.Term = &term
+		s.terms = s.terms[last:]
+	}
+}
+
+func (s *tracker) SetCheckpoint(ctx context.Context, ts primitive.Timestamp, save bool) error {
+
+	// Store the checkpoint in memory
+	s.MoveCheckpointForward(ts)
+
+	// Save the checkpoint if requested
+	if save {
+		return s.SaveCheckpoint(ctx)
+	}
+
+	return nil
+}
+
+// Position the checkpoint on an explicit timestamp and save it.
+// Entries up to `overlapUntil` are tolerated as already applied.
+func (s *tracker) StartFrom(ctx context.Context, ts primitive.Timestamp, overlapUntil primitive.Timestamp) error {
+
+	if IsZero(ts) {
+		return fmt.Errorf("invalid starting timestamp: %v", ts)
+	}
+
+	s.mu.Lock()
+	s.Current.LatestTs = ts
+	s.Current.Latest = ToDate(ts)
+	s.Current.LatestLSN = ToInt64(ts)
+	s.Current.OverlapUntil = overlapUntil
+	s.Current.Term = nil
+	s.mu.Unlock()
+	return s.SaveCheckpoint(ctx)
+}
+
+// Move the checkpoint back to an earlier position and save it. The entries
+// up to the current position are tolerated as already applied.
+func (s *tracker) Rewind(ctx context.Context, ts primitive.Timestamp) error {
+
+	if IsZero(ts) {
+		return fmt.Errorf("invalid rewind timestamp: %v", ts)
+	}
+
+	s.mu.Lock()
+	if CompareTimestamps(ts, s.Current.LatestTs) > 0 {
+		latest := s.Current.LatestTs
+		s.mu.Unlock()
+		return fmt.Errorf("cannot rewind to %v, after the checkpoint %v", ToDate(ts), ToDate(latest))
+	}
+	if CompareTimestamps(s.Current.LatestTs, s.Current.OverlapUntil) > 0 {
+		s.Current.OverlapUntil = s.Current.LatestTs
+	}
+	s.Current.LatestTs = ts
+	s.Current.Latest = ToDate(ts)
+	s.Current.LatestLSN = ToInt64(ts)
+	s.Current.Term = nil
+	s.mu.Unlock()
+	return s.SaveCheckpoint(ctx)
+}
+
+// Move the checkpoint past an entry acknowledged by the target
+func (s *tracker) MoveCheckpointForward(ts primitive.Timestamp) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ts.T == 0 || ts.T < s.Current.LatestTs.T {
+		log.Warn("invalid timestamp: ", ts)
+		return
+	}
+
+	if s.hold != nil {
+		if s.hold.released && (ts == s.hold.last || CompareTimestamps(ts, s.hold.readUntil) > 0) {
+			s.hold = nil
+		} else if CompareTimestamps(ts, s.hold.at) > 0 {
+			return
+		}
+	}
+
+	s.Current.LatestTs = ts
+	s.Current.Latest = ToDate(ts)
+	s.Current.LatestLSN = ToInt64(ts)
+	s.Current.SavedAt = time.Now()
+}
+
+// Keep the checkpoint at a position, the entries read after it are held
+// back and read again after a restart
+func (s *tracker) HoldCheckpoint(ts primitive.Timestamp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hold = &checkpointHold{at: ts}
+}
+
+// Release the checkpoint held once the last entry held back is written, or an
+// entry read after readUntil. Queued in order, every entry before them is written too.
+func (s *tracker) ReleaseCheckpoint(last primitive.Timestamp, readUntil primitive.Timestamp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hold == nil {
+		return
+	}
+	if IsZero(last) {
+		s.hold = nil
+		return
+	}
+	s.hold.released, s.hold.last, s.hold.readUntil = true, last, readUntil
+}
+
+// A copy of the in-memory checkpoint
+func (s *tracker) Checkpoint() Checkpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Current
+}
+
+func (s *tracker) name() string {
+	return s.Checkpoint().Name
+}
+
+// Replace the in-memory checkpoint by the loaded one
+func (s *tracker) loaded(ckpt Checkpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Current = ckpt
+}
+
+// Save the current checkpoint, on the state transitions. Every new
+// position is also appended to the history.
+func (s *tracker) SaveCheckpoint(ctx context.Context) error {
+
+	s.saving.Lock()
+	defer s.saving.Unlock()
+
+	// Save a copy, the writer keeps moving the checkpoint forward
+	s.mu.Lock()
+	s.Current.SavedAt = time.Now()
+	s.Current.Version = config.Version
+	s.Current.ConfigHash = s.configHash
+	s.Current.Epoch = s.epoch
+	s.updateTerm()
+	ckpt := s.Current
+	s.mu.Unlock()
+
+	if err := s.store.save(ctx, ckpt); err != nil {
+		return err
+	}
+	if ckpt.LatestTs == s.recorded {
+		return nil
+	}
+	if err := s.store.record(ctx, ckpt); err != nil {
+		log.WarnWithFields("checkpoint history error", log.Fields{"checkpoint": ckpt.Name, "error": err})
+		return err
+	}
+	s.recorded = ckpt.LatestTs
+	return nil
+}
+
+// The saved checkpoints, the most recent first, up to `limit` (0 for all)
+func (s *tracker) GetHistory(ctx context.Context, limit int) ([]Checkpoint, error) {
+	return s.store.history(ctx, s.name(), limit)
+}
+
+// Save the checkpoint periodically, until stopped or the context is done
+func (s *tracker) StartAutosave(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.mu.Lock()
+	s.stopAutosave = func() {
+		cancel()
+		<-done
+	}
+	s.mu.Unlock()
+
+	go func() {
+		defer close(done)
+		s.RunAutosave(ctx)
+	}()
+}
+
+func (s *tracker) RunAutosave(ctx context.Context) {
+
+	log.Info("starting autosave")
+	ticker := time.NewTicker(AutosaveInterval)
+	defer ticker.Stop()
+	for {
+
+		// Store the checkpoint
+		if err := s.SaveCheckpoint(context.Background()); err == nil {
+			log.Info("checkpoint autosaved: ", s.Checkpoint())
+		}
+
+		// Check if the autosave has been stopped
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *tracker) StopAutosave() {
+	s.mu.Lock()
+	stop := s.stopAutosave
+	s.stopAutosave = nil
+	s.mu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
+
+// Check the checkpoint can be rewound to the timestamp: the entries
+// from there must still be in the oplog of the source
+func CheckRewind(window TsWindow, ts primitive.Timestamp) error {
+	if CompareTimestamps(ts, window.Oldest) < 0 {
+		return fmt.Errorf("%v is older than the oldest oplog entry %v", ToDate(ts), ToDate(window.Oldest))
+	}
+	if CompareTimestamps(ts, window.Newest) > 0 {
+		return fmt.Errorf("%v is newer than the newest oplog entry %v", ToDate(ts), ToDate(window.Newest))
+	}
+	return nil
+}
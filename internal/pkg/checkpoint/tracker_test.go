@@ -0,0 +1,128 @@
+package checkpoint
+
+import (
+	"context"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRewind(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryCheckpoint("rs0_to_rs1")
+	s.SetCheckpoint(ctx, primitive.Timestamp{T: 1730541600}, true)
+	s.MoveCheckpointForward(primitive.Timestamp{T: 1730541700, I: 2})
+
+	if err := s.Rewind(ctx, primitive.Timestamp{T: 1730541800}); err == nil {
+		t.Errorf("Rewind() after the checkpoint = nil; want an error")
+	}
+	if err := s.Rewind(ctx, primitive.Timestamp{}); err == nil {
+		t.Errorf("Rewind() to a zero timestamp = nil; want an error")
+	}
+
+	to := primitive.Timestamp{T: 1730541650}
+	if err := s.Rewind(ctx, to); err != nil {
+		t.Fatalf("Rewind() = %v", err)
+	}
+
+	// The entries up to the previous position are re-applied idempotently
+	ckpt, _ := s.GetCheckpoint(ctx)
+	if ckpt.LatestTs != to || ckpt.OverlapUntil != (primitive.Timestamp{T: 1730541700, I: 2}) {
+		t.Errorf("GetCheckpoint() = %+v; want %v with an overlap up to the previous position", ckpt, to)
+	}
+
+	// Rewound positions are kept in the history too
+	history, _ := s.GetHistory(ctx, 0)
+	if len(history) != 2 || history[0].LatestTs != to {
+		t.Errorf("GetHistory() = %v; want the rewound checkpoint first", history)
+	}
+}
+
+func TestHoldCheckpoint(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryCheckpoint("rs0_to_rs1")
+	s.SetCheckpoint(ctx, primitive.Timestamp{T: 100}, true)
+	s.HoldCheckpoint(primitive.Timestamp{T: 100})
+
+	// The entries read meanwhile do not move it
+	s.MoveCheckpointForward(primitive.Timestamp{T: 110})
+	s.ReleaseCheckpoint(primitive.Timestamp{T: 105}, primitive.Timestamp{T: 120})
+	s.MoveCheckpointForward(primitive.Timestamp{T: 120})
+	if ckpt := s.Checkpoint(); ckpt.LatestTs != (primitive.Timestamp{T: 100}) {
+		t.Fatalf("Checkpoint() = %v; want held at 100", ckpt.LatestTs)
+	}
+
+	// Until the last entry held back is written
+	s.MoveCheckpointForward(primitive.Timestamp{T: 105})
+	s.MoveCheckpointForward(primitive.Timestamp{T: 130})
+	if ckpt := s.Checkpoint(); ckpt.LatestTs != (primitive.Timestamp{T: 130}) {
+		t.Errorf("Checkpoint() = %v; want 130 once released", ckpt.LatestTs)
+	}
+
+	// Or an entry read after the release, whatever happened to the ones held back
+	s.HoldCheckpoint(primitive.Timestamp{T: 130})
+	s.ReleaseCheckpoint(primitive.Timestamp{T: 135}, primitive.Timestamp{T: 140})
+	s.MoveCheckpointForward(primitive.Timestamp{T: 141})
+	if ckpt := s.Checkpoint(); ckpt.LatestTs != (primitive.Timestamp{T: 141}) {
+		t.Errorf("Checkpoint() = %v; want 141 once released", ckpt.LatestTs)
+	}
+}
+
+func TestCheckRewind(t *testing.T) {
+
+	window := TsWindow{Oldest: primitive.Timestamp{T: 100}, Newest: primitive.Timestamp{T: 200, I: 1}}
+	tests := []struct {
+		ts    primitive.Timestamp
+		valid bool
+	}{
+		{primitive.Timestamp{T: 99}, false},
+		{primitive.Timestamp{T: 100}, true},
+		{primitive.Timestamp{T: 150}, true},
+		{primitive.Timestamp{T: 200, I: 1}, true},
+		{primitive.Timestamp{T: 200, I: 2}, false},
+	}
+	for _, test := range tests {
+		if err := CheckRewind(window, test.ts); (err == nil) != test.valid {
+			t.Errorf("CheckRewind(%v) = %v; want valid %v", test.ts, err, test.valid)
+		}
+	}
+}
+
+func TestRecordTerm(t *testing.T) {
+
+	ctx := context.Background()
+	s := NewMemoryCheckpoint("rs0_to_rs1")
+	s.SetCheckpoint(ctx, primitive.Timestamp{T: 100}, true)
+	if ckpt := s.Checkpoint(); ckpt.Term != nil {
+		t.Fatalf("Checkpoint().Term = %v; want unknown", *ckpt.Term)
+	}
+
+	s.RecordTerm(primitive.Timestamp{T: 101}, 3)
+	s.RecordTerm(primitive.Timestamp{T: 102}, 3)
+	s.RecordTerm(primitive.Timestamp{T: 110}, 4)
+
+	// The term of the entry at the checkpoint is saved
+	tests := []struct {
+		ts   uint32
+		term int64
+	}{
+		{105, 3},
+		{109, 3},
+		{110, 4},
+		{120, 4},
+	}
+	for _, test := range tests {
+		s.SetCheckpoint(ctx, primitive.Timestamp{T: test.ts}, true)
+		if ckpt, _ := s.GetCheckpoint(ctx); ckpt.Term == nil || *ckpt.Term != test.term {
+			t.Errorf("checkpoint at %d has term %v; want %d", test.ts, ckpt.Term, test.term)
+		}
+	}
+
+	// The term of a rewound checkpoint is unknown
+	s.Rewind(ctx, primitive.Timestamp{T: 101})
+	if ckpt, _ := s.GetCheckpoint(ctx); ckpt.Term != nil {
+		t.Errorf("rewound checkpoint has term %v; want unknown", *ckpt.Term)
+	}
+}
@@ -1,38 +1,46 @@
 package collections
 
 import (
-	"sync/atomic"
+	"sync"
 )
 
+// A FIFO queue safe for concurrent use. Enqueuing never blocks.
 type AtomicQueue[T comparable] struct {
-	// Items to be added to channel
-	items chan T
-	// counter used to incremented and decremented atomically.
-	counter uint64
+	mu    sync.Mutex
+	items []T
 }
 
 func NewAtomicQueue[T comparable]() *AtomicQueue[T] {
-	return &AtomicQueue[T]{
-		items:   make(chan T, 1),
-		counter: 0,
-	}
+	return &AtomicQueue[T]{}
 }
 
 func (q *AtomicQueue[T]) Enqueue(item T) {
-	// counter variable atomically incremented
-	atomic.AddUint64(&q.counter, 1)
-	// put item to channel
-	q.items <- item
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.items = append(q.items, item)
 }
 
+// Remove the oldest item, the zero value when empty
 func (q *AtomicQueue[T]) Dequeue() T {
-	// read item from channel
-	item := <-q.items
-	// counter variable decremented atomically.
-	atomic.AddUint64(&q.counter, ^uint64(0))
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var item T
+	if len(q.items) > 0 {
+		item = q.items[0]
+		q.items = q.items[1:]
+	}
 	return item
 }
 
 func (q *AtomicQueue[T]) IsEmpty() bool {
-	return q.counter == 0
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) == 0
+}
+
+// A copy of the queued items, the oldest first
+func (q *AtomicQueue[T]) Items() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]T{}, q.items...)
 }
@@ -5,14 +5,33 @@ const (
 	CmdIdPauseIncr  = 2
 	CmdIdResumeIncr = 3
 	CmdIdSnapshot   = 4
+	CmdIdDelayApply = 5
+	CmdIdDelaySkip  = 6
+
+	CmdIdAddNamespaces    = 7
+	CmdIdRemoveNamespaces = 8
 )
 
 type Command struct {
 	Id        int
 	Arguments []string
+	// The job following the command, empty when not tracked
+	JobId string
 }
 
 var (
+	Names = map[int]string{
+		CmdIdTerminate:  "terminate",
+		CmdIdPauseIncr:  "pause_incr",
+		CmdIdResumeIncr: "resume_incr",
+		CmdIdSnapshot:   "snapshot",
+		CmdIdDelayApply: "delay_apply",
+		CmdIdDelaySkip:  "delay_skip",
+
+		CmdIdAddNamespaces:    "add_namespaces",
+		CmdIdRemoveNamespaces: "remove_namespaces",
+	}
+
 	CmdTerminate         = Command{Id: CmdIdTerminate}
 	CmdPauseIncremental  = Command{Id: CmdIdPauseIncr}
 	CmdResumeIncremental = Command{Id: CmdIdResumeIncr}
@@ -25,3 +44,35 @@ func NewCmdSnapshot(database string, collection string) Command {
 		Arguments: args,
 	}
 }
+
+// Apply the delayed entries up to the given timestamp
+func NewCmdDelayApply(until string) Command {
+	return Command{
+		Id:        CmdIdDelayApply,
+		Arguments: []string{until},
+	}
+}
+
+// Skip the delayed entries up to the given timestamp
+func NewCmdDelaySkip(until string) Command {
+	return Command{
+		Id:        CmdIdDelaySkip,
+		Arguments: []string{until},
+	}
+}
+
+// Replicate the namespaces or patterns, snapshotting the new collections
+func NewCmdAddNamespaces(namespaces []string) Command {
+	return Command{
+		Id:        CmdIdAddNamespaces,
+		Arguments: namespaces,
+	}
+}
+
+// Stop replicating the namespaces or patterns
+func NewCmdRemoveNamespaces(namespaces []string) Command {
+	return Command{
+		Id:        CmdIdRemoveNamespaces,
+		Arguments: namespaces,
+	}
+}
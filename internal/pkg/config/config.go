@@ -1,6 +1,8 @@
 package config
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"os"
 	"regexp"
@@ -18,10 +20,195 @@ type FullReplConfig struct {
 
 type IncrReplConfig struct {
 	// The state of the replication
-	State struct {
-		Database   string `yaml:"db"`
-		Collection string `yaml:"collection"`
-	} `yaml:"state"`
+	State StateConfig `yaml:"state"`
+	// Start the incremental replication from this position when no checkpoint
+	// exists, instead of running a snapshot. Either a date or a timestamp.
+	Start string `yaml:"start"`
+	// Duration in seconds after the starting position during which the errors
+	// of already applied operations are tolerated
+	Overlap int `yaml:"overlap"`
+	// Keep the target behind the source
+	Delay DelayConfig `yaml:"delay"`
+	// Acknowledgement required from the target before the checkpoint
+	// moves past a write
+	WriteConcern WriteConcernConfig `yaml:"write_concern"`
+	// Time in seconds given to the writer to apply the queued entries
+	// on shutdown, before the final checkpoint is saved
+	DrainTimeout int `yaml:"drain_timeout"`
+}
+
+type WriteConcernConfig struct {
+	// Number of members or a tag, e.g. `majority`. The default write
+	// concern of the target when empty.
+	W string `yaml:"w"`
+	// Wait for the write to be in the on-disk journal
+	Journal bool `yaml:"j"`
+	// Timeout in milliseconds of the acknowledgement (0 waits forever)
+	Timeout int `yaml:"wtimeout"`
+}
+
+// Storage of the checkpoints
+type StateConfig struct {
+	// Either mongodb (default), file or memory
+	Type string `yaml:"type"`
+	// MongoDB server holding the state, the target when empty
+	Uri        string `yaml:"uri"`
+	Database   string `yaml:"db"`
+	Collection string `yaml:"collection"`
+	// Directory of the state files
+	Dir string `yaml:"dir"`
+}
+
+type DelayConfig struct {
+	// Delay in seconds between the source and the target (0 disables it)
+	Duration int `yaml:"duration"`
+	// Maximum number of oplog entries held in memory
+	Buffer int `yaml:"buffer"`
+	// Directory used to spill the entries beyond the buffer
+	SpillDir string `yaml:"spill_dir"`
+}
+
+// Maps a source namespace to a target one. Both are `db.collection`,
+// where each part may hold a `*` wildcard. The `*` of the target
+// is replaced by what matched the one of the source.
+type NamespaceMapping struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// Field level rules applied to the documents of the namespaces
+// matching the pattern, before they reach the target.
+type TransformConfig struct {
+	// Source namespace, as the entries of the namespace filters
+	Namespace string `yaml:"namespace"`
+	// Keep only these fields (and `_id`), in dotted notation
+	Keep []string `yaml:"keep"`
+	// Rules applied to single fields
+	Fields []FieldRuleConfig `yaml:"fields"`
+}
+
+type FieldRuleConfig struct {
+	// Field path, in dotted notation
+	Path string `yaml:"path"`
+	// One of drop, hash, mask or replace
+	Action string `yaml:"action"`
+	// The constant of the replace action
+	Value interface{} `yaml:"value"`
+	// The salt prepended to the value by the hash action
+	Salt string `yaml:"salt"`
+	// Number of trailing characters left visible by the mask action
+	Visible int `yaml:"visible"`
+}
+
+// Replicate only the documents of the namespaces matching the predicate
+type DocumentFilterConfig struct {
+	// Source namespace, as the entries of the namespace filters
+	Namespace string `yaml:"namespace"`
+	// Query predicate, in Extended JSON, e.g. `{"region": "eu"}`
+	Filter string `yaml:"filter"`
+}
+
+type OperationPolicyConfig struct {
+	// Source namespace, as the entries of the namespace filters
+	Namespace string `yaml:"namespace"`
+	// Replicate only these operations: insert, update, delete or ddl
+	Allow []string `yaml:"allow"`
+	// Skip these operations, whatever the allowed ones
+	Deny []string `yaml:"deny"`
+}
+
+type TargetConfig struct {
+	// Name of the target, for its checkpoint and metrics
+	Name string `yaml:"name"`
+	// The address of the MongoDB server
+	Uri string `yaml:"uri"`
+	// Databases replicated to this target, those of the replication by default
+	Databases []string `yaml:"databases"`
+	// Collection whitelist/blacklist of this target
+	Filters map[string][]string `yaml:"filters"`
+	// Entries held for the target before the reader waits for it
+	Buffer int `yaml:"buffer"`
+}
+
+type ArchiveConfig struct {
+	// Archive the replicated oplog entries to local files
+	Enabled bool `yaml:"enabled"`
+	// Directory of the archive files
+	Dir string `yaml:"dir"`
+	// Either bson or json (Extended JSON, one entry per line)
+	Format string `yaml:"format"`
+	// Compress the files with gzip
+	Compress bool `yaml:"compress"`
+	// Rotate the file once its uncompressed content reaches this size, in MB
+	MaxSize int `yaml:"max_size"`
+	// Rotate the file once opened for this duration, in seconds
+	MaxAge int `yaml:"max_age"`
+}
+
+type SinkConfig struct {
+	// Destination of the changes: mongodb (`repl.target`), file or webhook
+	Type string `yaml:"type"`
+	// The JSON Lines file sink
+	File FileSinkConfig `yaml:"file"`
+	// The HTTP webhook sink
+	Webhook WebhookSinkConfig `yaml:"webhook"`
+}
+
+type FileSinkConfig struct {
+	// Path of the file the change events are appended to
+	Path string `yaml:"path"`
+}
+
+type WebhookSinkConfig struct {
+	// URL the batches of change events are posted to
+	Url string `yaml:"url"`
+	// Additional headers of the requests, e.g. an authorization
+	Headers map[string]string `yaml:"headers"`
+	// Key of the HMAC-SHA256 signature of the body, unsigned when empty
+	Secret string `yaml:"secret"`
+	// Maximum number of events per request
+	BatchSize int `yaml:"batch_size"`
+	// Time an incomplete batch waits for more events, in milliseconds
+	Linger int `yaml:"linger_ms"`
+	// Timeout of a request, in seconds
+	Timeout int `yaml:"timeout"`
+	// Attempts of a request before the replication stops (0 means no limit)
+	Retries int `yaml:"retries"`
+	// Initial and maximum wait between two attempts, in milliseconds
+	Backoff    int `yaml:"backoff_ms"`
+	MaxBackoff int `yaml:"max_backoff_ms"`
+}
+
+// Active-active replication between two clusters, each one replicating to the other
+type BidirectionalConfig struct {
+	// Tag the writes of the replication and skip the tagged entries read from the source
+	Enabled bool `yaml:"enabled"`
+	// Namespace `db.collection` of the marker written on the target with each write
+	Marker string `yaml:"marker"`
+	// Resolution of the writes concurrent on both sides
+	Conflict ConflictConfig `yaml:"conflict"`
+}
+
+type ConflictConfig struct {
+	// Either source_wins or last_writer_wins
+	Rule string `yaml:"rule"`
+	// The top-level field holding the version of the documents, for last_writer_wins
+	Field string `yaml:"field"`
+}
+
+type CutoverConfig struct {
+	// Time without any write on the replicated namespaces, in seconds,
+	// before the replication can be stopped
+	Quiet int `yaml:"quiet"`
+	// Maximum duration of the cutover, in seconds (0 means no limit)
+	Timeout int `yaml:"timeout"`
+}
+
+type LeaseConfig struct {
+	// Elect a leader among the replicas of the replication, the others stand by
+	Enabled bool `yaml:"enabled"`
+	// Seconds without renewal before a standby takes over
+	Ttl int `yaml:"ttl"`
 }
 
 type ReplConfig struct {
@@ -46,9 +233,39 @@ type ReplConfig struct {
 	FiltersIn  map[string]bool     `yaml:"-"`
 	FiltersOut map[string]bool     `yaml:"-"`
 
+	// Namespace renaming from the source to the target
+	Mapping []NamespaceMapping `yaml:"mapping"`
+
+	// Field level redaction, masking and projection
+	Transforms []TransformConfig `yaml:"transforms"`
+
+	// Document level filtering
+	Documents []DocumentFilterConfig `yaml:"documents"`
+
+	// Operation types replicated per namespace
+	Policies []OperationPolicyConfig `yaml:"policies"`
+
+	// Additional targets fed from the same oplog read
+	Targets []TargetConfig `yaml:"targets"`
+
 	// The replication configuration
 	Full FullReplConfig `yaml:"full"`
 	Incr IncrReplConfig `yaml:"incr"`
+
+	// The cutover configuration
+	Cutover CutoverConfig `yaml:"cutover"`
+
+	// The oplog archive configuration
+	Archive ArchiveConfig `yaml:"archive"`
+
+	// Destination of the changes, repl.target by default
+	Sink SinkConfig `yaml:"sink"`
+
+	// Active-active replication
+	Bidirectional BidirectionalConfig `yaml:"bidirectional"`
+
+	// Leader election among several replicas of the process
+	Lease LeaseConfig `yaml:"lease"`
 }
 
 type AppConfig struct {
@@ -59,8 +276,35 @@ type AppConfig struct {
 
 	// The replication configuration
 	Repl ReplConfig `yaml:"repl"`
+
+	// Independent replications run in the same process, keyed by their id.
+	// Defaults to the single `repl` one.
+	Pipelines []ReplConfig `yaml:"pipelines"`
 }
 
+const (
+	DefaultCutoverQuiet = 30
+	DefaultLeaseTtl     = 15
+	DefaultDelayBuffer  = 10000
+	DefaultTargetBuffer = 10000
+	DefaultDrainTimeout = 30
+
+	DefaultArchiveMaxSize = 64
+
+	DefaultBidirectionalMarker = "mongo_repl.marker"
+
+	// The source document always replaces the target one
+	ConflictSourceWins = "source_wins"
+	// The document with the greatest version wins
+	ConflictLastWriterWins = "last_writer_wins"
+
+	DefaultWebhookBatchSize  = 100
+	DefaultWebhookLinger     = 1000
+	DefaultWebhookTimeout    = 10
+	DefaultWebhookBackoff    = 500
+	DefaultWebhookMaxBackoff = 30000
+)
+
 // NewConfig returns a new Config struct
 func NewConfig() *AppConfig {
 	return &AppConfig{}
@@ -68,11 +312,17 @@ func NewConfig() *AppConfig {
 
 var Current *AppConfig = NewConfig()
 
+// Version of the process, set at build time with
+// -ldflags "-X github.com/sebastienferry/mongo-repl/internal/pkg/config.Version=<version>"
+var Version = "dev"
+
 // LoadConfig loads the configuration from a file
 func (c *AppConfig) LoadConfig() error {
 
 	var configFileArg string
+	var startArg string
 	flag.StringVar(&configFileArg, "config", "config.yaml", "path to the configuration file")
+	flag.StringVar(&startArg, "start", "", "start the incremental replication from this date or timestamp when no checkpoint exists")
 	flag.Parse()
 
 	// Fetch the environment variable
@@ -101,52 +351,184 @@ func (c *AppConfig) LoadConfig() error {
 		c.Logging.Level = os.Getenv("lOG_LEVEL")
 	}
 
-	// Ensure the ID is set
-	if c.Repl.Id == "" {
-		c.Repl.Id = "default"
+	// Either a single replication or a list of pipelines
+	if len(c.Pipelines) > 0 && c.Repl.Source != "" {
+		log.Fatal("error in configuration file: either repl or pipelines must be set")
+	}
+
+	// The single replication is the only pipeline
+	if len(c.Pipelines) == 0 {
+		c.Pipelines = []ReplConfig{c.Repl}
 	}
 
+	// The overrides apply to the first pipeline
+	first := &c.Pipelines[0]
+
 	// Override the source and target if set in the environment
 	if os.Getenv("SOURCE") != "" {
-		c.Repl.Source = os.Getenv("SOURCE")
+		first.Source = os.Getenv("SOURCE")
 	}
 	if os.Getenv("TARGET") != "" {
-		c.Repl.Target = os.Getenv("TARGET")
+		first.Target = os.Getenv("TARGET")
+	}
+
+	// Override the incremental starting position
+	if os.Getenv("INCR_START") != "" {
+		first.Incr.Start = os.Getenv("INCR_START")
+	}
+	if startArg != "" {
+		first.Incr.Start = startArg
+	}
+
+	ids := map[string]bool{}
+	for i := range c.Pipelines {
+		repl := &c.Pipelines[i]
+		if repl.Id == "" && len(c.Pipelines) == 1 {
+			repl.Id = "default"
+		}
+		if repl.Id == "" || ids[repl.Id] {
+			log.Fatal("error in configuration file: every pipeline requires an unique id: ", repl.Id)
+		}
+		ids[repl.Id] = true
+		repl.setDefaults()
+	}
+	// The first pipeline is the default one of the tools
+	c.Repl = c.Pipelines[0]
+
+	return nil
+}
+
+// Set the defaults and the lookup tables of a replication
+func (r *ReplConfig) setDefaults() {
+
+	// State defaults
+	if r.Incr.State.Dir == "" {
+		r.Incr.State.Dir = "state"
+	}
+
+	if r.Incr.DrainTimeout <= 0 {
+		r.Incr.DrainTimeout = DefaultDrainTimeout
+	}
+
+	// Delayed replica defaults
+	if r.Incr.Delay.Buffer <= 0 {
+		r.Incr.Delay.Buffer = DefaultDelayBuffer
+	}
+	if r.Incr.Delay.SpillDir == "" {
+		r.Incr.Delay.SpillDir = os.TempDir()
+	}
+
+	// Additional targets defaults
+	for i := range r.Targets {
+		if r.Targets[i].Buffer <= 0 {
+			r.Targets[i].Buffer = DefaultTargetBuffer
+		}
+		if len(r.Targets[i].Databases) == 0 {
+			r.Targets[i].Databases = r.Databases
+		}
+	}
+
+	// Archive defaults
+	if r.Archive.Format == "" {
+		r.Archive.Format = "bson"
+	}
+	if r.Archive.Dir == "" {
+		r.Archive.Dir = "archive"
+	}
+	if r.Archive.MaxSize <= 0 && r.Archive.MaxAge <= 0 {
+		r.Archive.MaxSize = DefaultArchiveMaxSize
+	}
+
+	// Webhook sink defaults
+	webhook := &r.Sink.Webhook
+	if webhook.BatchSize <= 0 {
+		webhook.BatchSize = DefaultWebhookBatchSize
+	}
+	if webhook.Linger <= 0 {
+		webhook.Linger = DefaultWebhookLinger
+	}
+	if webhook.Timeout <= 0 {
+		webhook.Timeout = DefaultWebhookTimeout
+	}
+	if webhook.Backoff <= 0 {
+		webhook.Backoff = DefaultWebhookBackoff
+	}
+	if webhook.MaxBackoff <= 0 {
+		webhook.MaxBackoff = DefaultWebhookMaxBackoff
+	}
+
+	// Bidirectional defaults
+	if r.Bidirectional.Marker == "" {
+		r.Bidirectional.Marker = DefaultBidirectionalMarker
+	}
+	if r.Bidirectional.Conflict.Rule == "" {
+		r.Bidirectional.Conflict.Rule = ConflictSourceWins
+	}
+
+	// Cutover defaults
+	if r.Cutover.Quiet <= 0 {
+		r.Cutover.Quiet = DefaultCutoverQuiet
+	}
+
+	// Leader election defaults
+	if r.Lease.Ttl <= 0 {
+		r.Lease.Ttl = DefaultLeaseTtl
 	}
 
 	// Features
-	c.Repl.FeaturesEnabled = make(map[string]bool)
-	for _, feature := range c.Repl.Features {
-		c.Repl.FeaturesEnabled[feature] = true
+	r.FeaturesEnabled = make(map[string]bool)
+	for _, feature := range r.Features {
+		r.FeaturesEnabled[feature] = true
 	}
 
 	// Databases to replicate
-	c.Repl.DatabasesIn = make(map[string]bool)
-	for _, db := range c.Repl.Databases {
-		c.Repl.DatabasesIn[db] = true
+	r.DatabasesIn = make(map[string]bool)
+	for _, db := range r.Databases {
+		r.DatabasesIn[db] = true
 	}
 
 	// Initialize the filters
-	c.Repl.FiltersIn = make(map[string]bool)
-	for _, filter := range c.Repl.Filters["in"] {
-		c.Repl.FiltersIn[filter] = true
+	r.FiltersIn = make(map[string]bool)
+	for _, filter := range r.Filters["in"] {
+		r.FiltersIn[filter] = true
 	}
 
-	c.Repl.FiltersOut = make(map[string]bool)
-	for _, filter := range c.Repl.Filters["out"] {
-		c.Repl.FiltersOut[filter] = true
+	r.FiltersOut = make(map[string]bool)
+	for _, filter := range r.Filters["out"] {
+		r.FiltersOut[filter] = true
 	}
+}
 
+// The configuration of the pipeline with this id, or nil
+func (c *AppConfig) Pipeline(id string) *ReplConfig {
+	for i := range c.Pipelines {
+		if c.Pipelines[i].Id == id {
+			return &c.Pipelines[i]
+		}
+	}
 	return nil
 }
 
+// Short hash of the replication configuration, recorded with the checkpoints
+// to know which configuration applied a range of the oplog
+func (r *ReplConfig) Hash() string {
+	data, err := yaml.Marshal(r)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
 func (c *AppConfig) LogConfig() {
-	log.Info("mongo configuration:")
-	log.Info("- source: ", ObfuscateCrendentials(c.Repl.Source))
-	log.Info("- target: ", ObfuscateCrendentials(c.Repl.Target))
-	log.Info("databases to replicate:")
-	for _, db := range c.Repl.Databases {
-		log.Info("- ", db)
+	for _, repl := range c.Pipelines {
+		log.Info("mongo configuration of pipeline ", repl.Id, ":")
+		log.Info("- source: ", ObfuscateCrendentials(repl.Source))
+		log.Info("- target: ", ObfuscateCrendentials(repl.Target))
+		log.Info("databases to replicate:")
+		for _, db := range repl.Databases {
+			log.Info("- ", db)
+		}
 	}
 }
 
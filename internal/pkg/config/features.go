@@ -4,10 +4,10 @@ const (
 	DeltaReplication = "delta"
 )
 
-// Checks if a feature is enabled from the list of available features.
-// The default return value is false.
-func IsFeatureEnabled(feature string) bool {
-	if enabled, found := Current.Repl.FeaturesEnabled[feature]; found {
+// Checks if a feature is enabled from the list of available features
+// of the replication. The default return value is false.
+func (r *ReplConfig) IsFeatureEnabled(feature string) bool {
+	if enabled, found := r.FeaturesEnabled[feature]; found {
 		return enabled
 	}
 	return false
@@ -0,0 +1,304 @@
+package cutover
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	StepIdle       = iota
+	StepAnnounced  = 1
+	StepCatchingUp = 2
+	StepQuiescing  = 3
+	StepStopping   = 4
+	StepCompleted  = 5
+	StepAborted    = 6
+	StepFailed     = 7
+)
+
+var (
+	Steps = map[int]string{
+		StepIdle:       "idle",
+		StepAnnounced:  "announced",
+		StepCatchingUp: "catching_up",
+		StepQuiescing:  "quiescing",
+		StepStopping:   "stopping",
+		StepCompleted:  "completed",
+		StepAborted:    "aborted",
+		StepFailed:     "failed",
+	}
+
+	ErrNotAttached    = errors.New("incremental replication is not running")
+	ErrAlreadyRunning = errors.New("a cutover is already in progress")
+	ErrNotRunning     = errors.New("no cutover in progress")
+	ErrCompleted      = errors.New("cutover already completed")
+)
+
+const (
+	DefaultPollInterval = 1 * time.Second
+)
+
+// Defines what the cutover workflow needs to observe and stop
+// the incremental replication.
+type Replication interface {
+	// Timestamp up to which the target is consistent with the source.
+	AppliedTimestamp() primitive.Timestamp
+	// Timestamp of the last oplog entry read for a replicated namespace.
+	LastReadTimestamp() primitive.Timestamp
+	// Stop the replication once every pending entry is applied.
+	// Returns the final applied timestamp.
+	Stop(ctx context.Context) (primitive.Timestamp, error)
+}
+
+// A step change of the cutover workflow.
+type Transition struct {
+	Step string    `json:"step"`
+	At   time.Time `json:"at"`
+}
+
+// Snapshot of the cutover workflow, as exposed through the API.
+type Status struct {
+	Step        string              `json:"step"`
+	Quiet       float64             `json:"quiet_secs"`
+	Timeout     float64             `json:"timeout_secs"`
+	AnnouncedAt *time.Time          `json:"announced_at,omitempty"`
+	Lag         int64               `json:"lag_secs"`
+	QuietFor    int64               `json:"quiet_for_secs"`
+	FinalTs     primitive.Timestamp `json:"final_ts"`
+	FinalDate   *time.Time          `json:"final_date,omitempty"`
+	Error       string              `json:"error,omitempty"`
+	History     []Transition        `json:"history"`
+}
+
+// Drives the switch of the applications from the source to the target.
+// The workflow goes through the following steps:
+// announced -> catching_up -> quiescing -> stopping -> completed
+type Cutover struct {
+	mu      sync.Mutex
+	repl    Replication
+	window  func() (checkpoint.TsWindow, error)
+	poll    time.Duration
+	cancel  context.CancelFunc
+	running bool
+	status  Status
+	observe func(step int, err error)
+}
+
+// Cutover of a replication, the window returns the oplog boundaries of its source
+func NewCutover(window func() (checkpoint.TsWindow, error)) *Cutover {
+	return &Cutover{
+		window: window,
+		poll:   DefaultPollInterval,
+		status: Status{
+			Step:    Steps[StepIdle],
+			History: []Transition{},
+		},
+	}
+}
+
+// Attach the running incremental replication to the cutover workflow.
+// Passing nil detaches it.
+func (c *Cutover) Attach(repl Replication) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.repl = repl
+}
+
+// Call the function on every step of the workflow, with the error
+// of a failed one. It is called with the cutover lock held.
+func (c *Cutover) Observe(observe func(step int, err error)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.observe = observe
+}
+
+// Announce the cutover and start the workflow in a dedicated go routine.
+func (c *Cutover) Start(ctx context.Context, quiet time.Duration, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.repl == nil {
+		return ErrNotAttached
+	}
+	if c.running {
+		return ErrAlreadyRunning
+	}
+	if c.status.Step == Steps[StepCompleted] {
+		return ErrCompleted
+	}
+
+	var runCtx context.Context
+	if timeout > 0 {
+		runCtx, c.cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		runCtx, c.cancel = context.WithCancel(ctx)
+	}
+
+	now := time.Now()
+	c.running = true
+	c.status = Status{
+		Quiet:       quiet.Seconds(),
+		Timeout:     timeout.Seconds(),
+		AnnouncedAt: &now,
+		History:     []Transition{},
+	}
+	c.setStep(StepAnnounced, nil)
+	log.InfoWithFields("cutover announced", log.Fields{"quiet": quiet, "timeout": timeout})
+
+	go c.run(runCtx, c.repl, quiet)
+	return nil
+}
+
+// Abort the running cutover. The replication keeps running
+// unless the workflow already reached the stopping step.
+func (c *Cutover) Abort() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return ErrNotRunning
+	}
+	c.cancel()
+	return nil
+}
+
+// Returns a copy of the current status of the workflow.
+func (c *Cutover) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := c.status
+	status.History = append([]Transition{}, c.status.History...)
+	return status
+}
+
+func (c *Cutover) run(ctx context.Context, repl Replication, quiet time.Duration) {
+
+	defer func() {
+		c.mu.Lock()
+		c.running = false
+		c.cancel()
+		c.mu.Unlock()
+	}()
+
+	// Wait until the target caught up with the source
+	c.transition(StepCatchingUp)
+	err := c.waitFor(ctx, func(lag int64, quietFor int64) bool {
+		return lag == 0
+	})
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	// Wait until no more writes reach the replicated namespaces
+	c.transition(StepQuiescing)
+	err = c.waitFor(ctx, func(lag int64, quietFor int64) bool {
+		return lag == 0 && quietFor >= int64(quiet.Seconds())
+	})
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	// Stop the replication. The stop is not bound to the cutover context anymore
+	// as aborting in the middle would leave the replication half stopped.
+	c.transition(StepStopping)
+	final, err := repl.Stop(context.Background())
+	if err != nil {
+		c.fail(err)
+		return
+	}
+
+	c.mu.Lock()
+	date := checkpoint.ToDate(final)
+	c.status.FinalTs = final
+	c.status.FinalDate = &date
+	c.setStep(StepCompleted, nil)
+	c.mu.Unlock()
+
+	log.InfoWithFields("cutover completed", log.Fields{"ts": final, "date": date})
+}
+
+// Poll the replication positions until the condition is met or the context is done.
+func (c *Cutover) waitFor(ctx context.Context, done func(lag int64, quietFor int64) bool) error {
+	for {
+		lag, quietFor, err := c.measure()
+		if err != nil {
+			log.Warn("cutover: error measuring the replication lag: ", err)
+		} else {
+			c.mu.Lock()
+			c.status.Lag = lag
+			c.status.QuietFor = quietFor
+			c.mu.Unlock()
+
+			if done(lag, quietFor) {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(c.poll):
+		}
+	}
+}
+
+// Computes the lag and the time elapsed since the last write on a replicated
+// namespace. Both are expressed in seconds of the source clock.
+func (c *Cutover) measure() (int64, int64, error) {
+	window, err := c.window()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var lag int64 = 0
+	applied := c.repl.AppliedTimestamp()
+	if checkpoint.CompareTimestamps(applied, window.Newest) < 0 {
+		lag = max(int64(window.Newest.T)-int64(applied.T), 1)
+	}
+
+	quietFor := int64(window.Newest.T) - int64(c.repl.LastReadTimestamp().T)
+	return lag, max(quietFor, 0), nil
+}
+
+func (c *Cutover) transition(step int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.setStep(step, nil)
+	log.Info("cutover step: ", Steps[step])
+}
+
+func (c *Cutover) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if errors.Is(err, context.Canceled) {
+		c.setStep(StepAborted, err)
+		log.Warn("cutover aborted")
+		return
+	}
+
+	c.status.Error = err.Error()
+	c.setStep(StepFailed, err)
+	log.Error("cutover failed: ", err)
+}
+
+// Must be called with the lock held.
+func (c *Cutover) setStep(step int, err error) {
+	c.status.Step = Steps[step]
+	c.status.History = append(c.status.History, Transition{
+		Step: Steps[step],
+		At:   time.Now(),
+	})
+	if c.observe != nil {
+		c.observe(step, err)
+	}
+}
@@ -0,0 +1,144 @@
+package cutover
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type mockReplication struct {
+	mu       sync.Mutex
+	applied  primitive.Timestamp
+	lastRead primitive.Timestamp
+	stopped  bool
+}
+
+func (m *mockReplication) AppliedTimestamp() primitive.Timestamp {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.applied
+}
+
+func (m *mockReplication) LastReadTimestamp() primitive.Timestamp {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastRead
+}
+
+func (m *mockReplication) Stop(ctx context.Context) (primitive.Timestamp, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stopped = true
+	return m.applied, nil
+}
+
+func (m *mockReplication) set(applied uint32, lastRead uint32) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.applied = primitive.Timestamp{T: applied}
+	m.lastRead = primitive.Timestamp{T: lastRead}
+}
+
+func newTestCutover(repl Replication, newest *primitive.Timestamp, mu *sync.Mutex) *Cutover {
+	c := NewCutover(func() (checkpoint.TsWindow, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return checkpoint.TsWindow{Newest: *newest}, nil
+	})
+	c.poll = time.Millisecond
+	c.Attach(repl)
+	return c
+}
+
+func waitForStep(t *testing.T, c *Cutover, step int) Status {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		status := c.Status()
+		if status.Step == Steps[step] {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("cutover did not reach step %s, current step is %s", Steps[step], c.Status().Step)
+	return Status{}
+}
+
+func TestCutoverWorkflow(t *testing.T) {
+
+	var mu sync.Mutex
+	newest := primitive.Timestamp{T: 100}
+	repl := &mockReplication{}
+	repl.set(90, 90)
+	c := newTestCutover(repl, &newest, &mu)
+
+	if err := c.Start(context.Background(), 10*time.Second, 0); err != nil {
+		t.Fatalf("Start() = %v; want nil", err)
+	}
+
+	// The target is 10 seconds behind
+	status := waitForStep(t, c, StepCatchingUp)
+	if err := c.Start(context.Background(), 10*time.Second, 0); err != ErrAlreadyRunning {
+		t.Errorf("Start() = %v; want %v", err, ErrAlreadyRunning)
+	}
+
+	// The target caught up, but the last write is too recent
+	repl.set(100, 95)
+	waitForStep(t, c, StepQuiescing)
+
+	// No write for long enough
+	mu.Lock()
+	newest = primitive.Timestamp{T: 110}
+	mu.Unlock()
+	repl.set(110, 95)
+
+	status = waitForStep(t, c, StepCompleted)
+	if !repl.stopped {
+		t.Errorf("replication was not stopped")
+	}
+	if status.FinalTs.T != 110 {
+		t.Errorf("FinalTs = %d; want 110", status.FinalTs.T)
+	}
+	if len(status.History) != 5 {
+		t.Errorf("len(History) = %d; want 5", len(status.History))
+	}
+	if err := c.Start(context.Background(), 10*time.Second, 0); err != ErrCompleted {
+		t.Errorf("Start() = %v; want %v", err, ErrCompleted)
+	}
+}
+
+func TestCutoverAbort(t *testing.T) {
+
+	var mu sync.Mutex
+	newest := primitive.Timestamp{T: 100}
+	repl := &mockReplication{}
+	repl.set(90, 90)
+	c := newTestCutover(repl, &newest, &mu)
+
+	if err := c.Abort(); err != ErrNotRunning {
+		t.Errorf("Abort() = %v; want %v", err, ErrNotRunning)
+	}
+
+	if err := c.Start(context.Background(), time.Second, 0); err != nil {
+		t.Fatalf("Start() = %v; want nil", err)
+	}
+	waitForStep(t, c, StepCatchingUp)
+
+	if err := c.Abort(); err != nil {
+		t.Errorf("Abort() = %v; want nil", err)
+	}
+	waitForStep(t, c, StepAborted)
+	if repl.stopped {
+		t.Errorf("replication was stopped")
+	}
+}
+
+func TestCutoverNotAttached(t *testing.T) {
+	c := NewCutover(nil)
+	if err := c.Start(context.Background(), time.Second, 0); err != ErrNotAttached {
+		t.Errorf("Start() = %v; want %v", err, ErrNotAttached)
+	}
+}
@@ -0,0 +1,368 @@
+package filters
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The query operators supported by the local evaluation of the predicates
+var PredicateOperators = map[string]bool{
+	"$eq":     true,
+	"$ne":     true,
+	"$gt":     true,
+	"$gte":    true,
+	"$lt":     true,
+	"$lte":    true,
+	"$in":     true,
+	"$nin":    true,
+	"$exists": true,
+}
+
+// A query predicate on the documents of a collection. It is pushed to the
+// source for the snapshots and evaluated locally for the oplog entries.
+type Predicate struct {
+	query bson.D
+}
+
+func NewPredicate(query bson.D) (*Predicate, error) {
+	if err := validateQuery(query); err != nil {
+		return nil, err
+	}
+	return &Predicate{query: query}, nil
+}
+
+// Parse a predicate written in Extended JSON
+func ParsePredicate(filter string) (*Predicate, error) {
+	var query bson.D
+	if err := bson.UnmarshalExtJSON([]byte(filter), false, &query); err != nil {
+		return nil, err
+	}
+	return NewPredicate(query)
+}
+
+// The predicate, as a query for the source
+func (p *Predicate) Query() bson.D {
+	return p.query
+}
+
+// Check if the document matches the predicate
+func (p *Predicate) Matches(doc bson.D) bool {
+	return matchQuery(doc, p.query)
+}
+
+// Holds the predicates of the namespaces
+type DocumentFilter struct {
+	namespaces []namespacePredicate
+}
+
+type namespacePredicate struct {
+	namespace NamespaceMatcher
+	predicate *Predicate
+}
+
+func NewDocumentFilter(documents []config.DocumentFilterConfig) (*DocumentFilter, error) {
+	f := &DocumentFilter{}
+	for _, cfg := range documents {
+		namespace, err := NewNamespaceMatcher(cfg.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid document filter namespace: %v", err)
+		}
+		predicate, err := ParsePredicate(cfg.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("document filter %s: %v", cfg.Namespace, err)
+		}
+		f.namespaces = append(f.namespaces, namespacePredicate{namespace: namespace, predicate: predicate})
+	}
+	return f, nil
+}
+
+// Returns the predicate of a source namespace, the first matching pattern wins.
+// Returns nil when every document is replicated.
+func (f *DocumentFilter) Predicate(db string, collection string) *Predicate {
+	for _, ns := range f.namespaces {
+		if ns.namespace.Match(db, collection) {
+			return ns.predicate
+		}
+	}
+	return nil
+}
+
+func validateQuery(query bson.D) error {
+	for _, e := range query {
+		switch e.Key {
+		case "$and", "$or", "$nor":
+			clauses, ok := e.Value.(bson.A)
+			if !ok || len(clauses) == 0 {
+				return fmt.Errorf("%s expects a non empty array", e.Key)
+			}
+			for _, clause := range clauses {
+				sub, ok := clause.(bson.D)
+				if !ok {
+					return fmt.Errorf("%s expects an array of documents", e.Key)
+				}
+				if err := validateQuery(sub); err != nil {
+					return err
+				}
+			}
+		default:
+			if strings.HasPrefix(e.Key, "$") {
+				return fmt.Errorf("unsupported operator: %s", e.Key)
+			}
+			if cond, ok := e.Value.(bson.D); ok && isOperatorDoc(cond) {
+				for _, op := range cond {
+					if !PredicateOperators[op.Key] {
+						return fmt.Errorf("unsupported operator: %s", op.Key)
+					}
+					if _, isArray := op.Value.(bson.A); (op.Key == "$in" || op.Key == "$nin") && !isArray {
+						return fmt.Errorf("%s expects an array", op.Key)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchQuery(doc bson.D, query bson.D) bool {
+	for _, e := range query {
+		switch e.Key {
+		case "$and":
+			for _, clause := range e.Value.(bson.A) {
+				if !matchQuery(doc, clause.(bson.D)) {
+					return false
+				}
+			}
+		case "$or":
+			matched := false
+			for _, clause := range e.Value.(bson.A) {
+				if matchQuery(doc, clause.(bson.D)) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		case "$nor":
+			for _, clause := range e.Value.(bson.A) {
+				if matchQuery(doc, clause.(bson.D)) {
+					return false
+				}
+			}
+		default:
+			values, found := resolve(doc, strings.Split(e.Key, "."))
+			if !matchCondition(values, found, e.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchCondition(values []interface{}, found bool, condition interface{}) bool {
+
+	cond, ok := condition.(bson.D)
+	if !ok || !isOperatorDoc(cond) {
+		return matchEqual(values, found, condition)
+	}
+
+	for _, op := range cond {
+		var matched bool
+		switch op.Key {
+		case "$eq":
+			matched = matchEqual(values, found, op.Value)
+		case "$ne":
+			matched = !matchEqual(values, found, op.Value)
+		case "$gt", "$gte", "$lt", "$lte":
+			matched = matchAny(values, func(v interface{}) bool {
+				c, comparable := compareValues(v, op.Value)
+				if !comparable {
+					return false
+				}
+				switch op.Key {
+				case "$gt":
+					return c > 0
+				case "$gte":
+					return c >= 0
+				case "$lt":
+					return c < 0
+				default:
+					return c <= 0
+				}
+			})
+		case "$in", "$nin":
+			for _, candidate := range op.Value.(bson.A) {
+				if matchEqual(values, found, candidate) {
+					matched = true
+					break
+				}
+			}
+			if op.Key == "$nin" {
+				matched = !matched
+			}
+		case "$exists":
+			exists, _ := op.Value.(bool)
+			matched = found == exists
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// A missing field equals null. An array matches when one of its elements does.
+func matchEqual(values []interface{}, found bool, expected interface{}) bool {
+	if !found {
+		return expected == nil
+	}
+	for _, v := range values {
+		if equalValues(v, expected) {
+			return true
+		}
+		if array, ok := v.(bson.A); ok {
+			for _, item := range array {
+				if equalValues(item, expected) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func matchAny(values []interface{}, match func(interface{}) bool) bool {
+	for _, v := range values {
+		if match(v) {
+			return true
+		}
+		if array, ok := v.(bson.A); ok {
+			for _, item := range array {
+				if match(item) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// Resolve a dotted path, through the arrays
+func resolve(value interface{}, segments []string) ([]interface{}, bool) {
+
+	if len(segments) == 0 {
+		return []interface{}{value}, true
+	}
+
+	switch v := value.(type) {
+	case bson.D:
+		for _, e := range v {
+			if e.Key == segments[0] {
+				return resolve(e.Value, segments[1:])
+			}
+		}
+	case bson.A:
+		if index, err := strconv.Atoi(segments[0]); err == nil {
+			if index >= 0 && index < len(v) {
+				return resolve(v[index], segments[1:])
+			}
+			return nil, false
+		}
+		var values []interface{}
+		found := false
+		for _, item := range v {
+			if sub, ok := resolve(item, segments); ok {
+				values = append(values, sub...)
+				found = true
+			}
+		}
+		return values, found
+	}
+	return nil, false
+}
+
+func isOperatorDoc(doc bson.D) bool {
+	return len(doc) > 0 && strings.HasPrefix(doc[0].Key, "$")
+}
+
+func equalValues(a interface{}, b interface{}) bool {
+	if c, ok := compareValues(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// Compare two values of the same BSON type family. Numbers of any type
+// are comparable with each other.
+func compareValues(a interface{}, b interface{}) (int, bool) {
+
+	if fa, ok := toFloat(a); ok {
+		if fb, ok := toFloat(b); ok {
+			switch {
+			case fa < fb:
+				return -1, true
+			case fa > fb:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+
+	switch va := a.(type) {
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), true
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			switch {
+			case va == vb:
+				return 0, true
+			case !va:
+				return -1, true
+			}
+			return 1, true
+		}
+	case primitive.DateTime:
+		if vb, ok := b.(primitive.DateTime); ok {
+			switch {
+			case va < vb:
+				return -1, true
+			case va > vb:
+				return 1, true
+			}
+			return 0, true
+		}
+	case primitive.ObjectID:
+		if vb, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(va[:], vb[:]), true
+		}
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,96 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPredicateMatches(t *testing.T) {
+
+	doc := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "region", Value: "eu"},
+		{Key: "total", Value: int32(120)},
+		{Key: "tags", Value: bson.A{"new", "vip"}},
+		{Key: "customer", Value: bson.D{{Key: "country", Value: "FR"}}},
+		{Key: "items", Value: bson.A{bson.D{{Key: "sku", Value: "a"}}, bson.D{{Key: "sku", Value: "b"}}}},
+	}
+
+	tests := []struct {
+		filter   string
+		expected bool
+	}{
+		{`{"region": "eu"}`, true},
+		{`{"region": "us"}`, false},
+		{`{"total": {"$gt": 100}}`, true},
+		{`{"total": {"$gte": 100.5, "$lt": 120}}`, false},
+		{`{"total": {"$lte": 120}}`, true},
+		{`{"region": {"$in": ["eu", "uk"]}}`, true},
+		{`{"region": {"$nin": ["eu", "uk"]}}`, false},
+		{`{"region": {"$ne": "us"}}`, true},
+		{`{"tags": "vip"}`, true},
+		{`{"customer.country": "FR"}`, true},
+		{`{"items.sku": "b"}`, true},
+		{`{"items.1.sku": "a"}`, false},
+		{`{"deleted": {"$exists": false}}`, true},
+		{`{"deleted": null}`, true},
+		{`{"customer": {"country": "FR"}}`, true},
+		{`{"$or": [{"region": "us"}, {"total": {"$gt": 100}}]}`, true},
+		{`{"$and": [{"region": "eu"}, {"total": {"$gt": 200}}]}`, false},
+		{`{"$nor": [{"region": "us"}]}`, true},
+		{`{"total": {"$gt": "100"}}`, false},
+	}
+
+	for _, test := range tests {
+		p, err := ParsePredicate(test.filter)
+		if err != nil {
+			t.Fatalf("ParsePredicate(%s) = %v", test.filter, err)
+		}
+		if matched := p.Matches(doc); matched != test.expected {
+			t.Errorf("Matches(%s) = %v; want %v", test.filter, matched, test.expected)
+		}
+	}
+}
+
+func TestParsePredicateErrors(t *testing.T) {
+	tests := []string{
+		`{"region": {"$regex": "^e"}}`,
+		`{"$where": "true"}`,
+		`{"region": {"$in": "eu"}}`,
+		`{"$or": {"region": "eu"}}`,
+		`not json`,
+	}
+
+	for _, test := range tests {
+		if _, err := ParsePredicate(test); err == nil {
+			t.Errorf("ParsePredicate(%s) = nil; want an error", test)
+		}
+	}
+}
+
+func TestDocumentFilter(t *testing.T) {
+
+	f, err := NewDocumentFilter([]config.DocumentFilterConfig{
+		{Namespace: "prod.orders", Filter: `{"region": "eu"}`},
+		{Namespace: "prod.*", Filter: `{"archived": {"$ne": true}}`},
+		{Namespace: "/^tenant[0-9]+\\.orders$/", Filter: `{"region": "us"}`},
+	})
+	if err != nil {
+		t.Fatalf("NewDocumentFilter() = %v", err)
+	}
+
+	if p := f.Predicate("prod", "orders"); p == nil || p.Query()[0].Key != "region" {
+		t.Errorf("Predicate(prod.orders) = %v", p)
+	}
+	if p := f.Predicate("prod", "users"); p == nil || p.Query()[0].Key != "archived" {
+		t.Errorf("Predicate(prod.users) = %v", p)
+	}
+	if p := f.Predicate("other", "orders"); p != nil {
+		t.Errorf("Predicate(other.orders) = %v; want nil", p)
+	}
+	if p := f.Predicate("tenant1", "orders"); p == nil || p.Query()[0].Key != "region" {
+		t.Errorf("Predicate(tenant1.orders) = %v", p)
+	}
+}
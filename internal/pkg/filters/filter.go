@@ -3,7 +3,6 @@ package filters
 import (
 	"strings"
 
-	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
 )
 
@@ -57,38 +56,15 @@ func Lookup(items map[string]bool, item string) (bool, bool) {
 	return value, found
 }
 
-func ShouldReplicateNamespace(
-	databasesIn map[string]bool,
-	collectionsIn map[string]bool,
-	collectionsOut map[string]bool,
-	db string, collection string) bool {
-
-	// If the database is not in the list of databases to replicate, return false
-	if _, found := databasesIn[db]; !found {
-		return false
-	}
-
-	// If the collection is in the list of collections to replicate, return true
-	// CollectionsIn get the precedence over CollectionsOut !
-	if _, found := collectionsIn[collection]; found {
-		return true
-	}
-
-	// If the collection is in the list of collections to filter out, return false
-	if _, found := collectionsOut[collection]; found {
-		return false
-	}
-
-	// By default, return false
-	return true
-}
-
 type Filter struct {
 	allowedOperations map[string]bool
+	namespaces        *NamespaceFilter
 }
 
-func NewFilter() *Filter {
-	return &Filter{}
+func NewFilter(namespaces *NamespaceFilter) *Filter {
+	return &Filter{
+		namespaces: namespaces,
+	}
 }
 
 // Filter out unwanted operations
@@ -105,15 +81,7 @@ func (f *Filter) KeepCollection(db string, collection string) bool {
 	}
 
 	// Filter unwanted data
-	if !ShouldReplicateNamespace(
-		config.Current.Repl.DatabasesIn,
-		config.Current.Repl.FiltersIn,
-		config.Current.Repl.FiltersOut,
-		db, collection) {
-		return false
-	}
-	return true
-
+	return f.namespaces.Keep(db, collection)
 }
 
 func KeepOperation(command string) bool {
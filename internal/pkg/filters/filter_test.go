@@ -31,20 +31,24 @@ func TestLookup(t *testing.T) {
 }
 
 func TestShouldReplicateNamespace(t *testing.T) {
-	databasesIn :=
-		map[string]bool{
+
+	// Built once, then checked for every namespace
+	namespaces, err := NewNamespaceFilterFromConfig(&config.ReplConfig{
+		DatabasesIn: map[string]bool{
 			"db1": true,
 			"db2": true,
-		}
-	collectionsIn :=
-		map[string]bool{
+		},
+		FiltersIn: map[string]bool{
 			"coll1": true,
 			"coll2": true,
-		}
-	collectionsOut :=
-		map[string]bool{
+		},
+		FiltersOut: map[string]bool{
 			"coll3": true,
-		}
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewNamespaceFilterFromConfig() = %v", err)
+	}
 
 	tests := []struct {
 		db         string
@@ -59,9 +63,9 @@ func TestShouldReplicateNamespace(t *testing.T) {
 		// Explicitly denied
 		{"db1", "coll3", false},
 		{"db2", "coll3", false},
-		// Unspecified with database allowed, should be true as a wild card
-		{"db1", "coll4", true},
-		{"db2", "coll4", true},
+		// Unspecified with database allowed, only the in entries are replicated
+		{"db1", "coll4", false},
+		{"db2", "coll4", false},
 		// Database denied, all collections should be denied
 		{"db3", "coll1", false},
 		{"db3", "coll2", false},
@@ -73,7 +77,7 @@ func TestShouldReplicateNamespace(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		result := ShouldReplicateNamespace(databasesIn, collectionsIn, collectionsOut, test.db, test.collection)
+		result := namespaces.Keep(test.db, test.collection)
 		if result != test.expected {
 			t.Errorf("shouldReplicate(%s, %s) = %v; want %v", test.db, test.collection, result, test.expected)
 		}
@@ -82,19 +86,20 @@ func TestShouldReplicateNamespace(t *testing.T) {
 
 // Test both KeepOperation and KeepCollection
 func TestOplogFilterKeepOperation(t *testing.T) {
-	config.Current = &config.AppConfig{
-		Repl: config.ReplConfig{
-			DatabasesIn: map[string]bool{
-				"db1": true,
-			},
-			FiltersIn: map[string]bool{
-				"coll1": true,
-			},
-			FiltersOut: map[string]bool{},
+	namespaces, err := NewNamespaceFilterFromConfig(&config.ReplConfig{
+		DatabasesIn: map[string]bool{
+			"db1": true,
+		},
+		FiltersIn: map[string]bool{
+			"coll1": true,
 		},
+		FiltersOut: map[string]bool{},
+	})
+	if err != nil {
+		t.Fatalf("NewNamespaceFilterFromConfig() = %v", err)
 	}
 
-	filter := NewFilter()
+	filter := NewFilter(namespaces)
 
 	tests := []struct {
 		db         string
@@ -111,9 +116,9 @@ func TestOplogFilterKeepOperation(t *testing.T) {
 		{"db1", "coll1", "u", true},
 		{"db1", "coll1", "d", true},
 
-		{"db1", "coll2", "i", true},
-		{"db1", "coll2", "u", true},
-		{"db1", "coll2", "d", true},
+		{"db1", "coll2", "i", false},
+		{"db1", "coll2", "u", false},
+		{"db1", "coll2", "d", false},
 
 		{"db2", "coll1", "i", false},
 		{"db2", "coll1", "u", false},
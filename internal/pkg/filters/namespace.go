@@ -0,0 +1,405 @@
+package filters
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+)
+
+const (
+	// Selects every database but the system ones
+	AllDatabases = "*"
+)
+
+// Only replicated when explicitly listed
+var SystemDatabases = map[string]bool{
+	"admin":  true,
+	"config": true,
+	"local":  true,
+}
+
+// Matches a name either exactly, with a glob pattern or a /regex/
+type nameMatcher struct {
+	exact string
+	glob  string
+	regex *regexp.Regexp
+}
+
+// Matches a namespace entry of the `in` / `out` filters, also selecting the
+// namespaces of the policies, document filters and transforms:
+//   - `coll`: the collection, in every database
+//   - `db.coll`: the collection of the database
+//   - `/regex/`: the full namespace `db.coll`
+//
+// Both parts accept the `*`, `?` and `[...]` glob patterns. An entry
+// holding a dot is always qualified: a dotted collection of every
+// database is written `*.coll.name`.
+type NamespaceMatcher struct {
+	db    *nameMatcher
+	coll  *nameMatcher
+	regex *regexp.Regexp
+}
+
+// The entries of a namespace filter, saved once changed at runtime
+type NamespaceEntries struct {
+	Databases []string `json:"databases" bson:"databases"`
+	In        []string `json:"in" bson:"in"`
+	Out       []string `json:"out" bson:"out"`
+}
+
+// Decides which namespaces are replicated. A namespace must belong to one of
+// the databases. Then, when there are `in` entries, only the namespaces
+// matching them are replicated. Otherwise, the namespaces matching none of
+// the `out` entries are. The entries may change at runtime.
+type NamespaceFilter struct {
+	mu        sync.RWMutex
+	entries   NamespaceEntries
+	databases []nameMatcher
+	in        []NamespaceMatcher
+	out       []NamespaceMatcher
+}
+
+func NewNamespaceFilter(databases []string, in []string, out []string) (*NamespaceFilter, error) {
+	f := &NamespaceFilter{}
+	if err := f.Set(NamespaceEntries{Databases: databases, In: in, Out: out}); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Build the filter of a replication configuration
+func NewNamespaceFilterFromConfig(repl *config.ReplConfig) (*NamespaceFilter, error) {
+	return NewNamespaceFilter(keys(repl.DatabasesIn), keys(repl.FiltersIn), keys(repl.FiltersOut))
+}
+
+// The current entries of the filter
+func (f *NamespaceFilter) Entries() NamespaceEntries {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return NamespaceEntries{
+		Databases: slices.Clone(f.entries.Databases),
+		In:        slices.Clone(f.entries.In),
+		Out:       slices.Clone(f.entries.Out),
+	}
+}
+
+// Replace the entries of the filter, unchanged when one is invalid
+func (f *NamespaceFilter) Set(entries NamespaceEntries) error {
+
+	var databases []nameMatcher
+	for _, db := range entries.Databases {
+		m, err := newNameMatcher(db)
+		if err != nil {
+			return err
+		}
+		databases = append(databases, m)
+	}
+	in, err := newNamespaceMatchers(entries.In)
+	if err != nil {
+		return err
+	}
+	out, err := newNamespaceMatchers(entries.Out)
+	if err != nil {
+		return err
+	}
+	if len(databases) > 0 {
+		if err := checkQualified(databases, entries.In, in); err != nil {
+			return err
+		}
+		if err := checkQualified(databases, entries.Out, out); err != nil {
+			return err
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries = NamespaceEntries{
+		Databases: slices.Clone(entries.Databases),
+		In:        slices.Clone(entries.In),
+		Out:       slices.Clone(entries.Out),
+	}
+	f.databases, f.in, f.out = databases, in, out
+	return nil
+}
+
+// Replicate the namespaces or patterns: they are removed from the `out`
+// entries, and added to the `in` ones when some are listed. The database
+// of a qualified entry is added to the databases unless already replicated.
+func (f *NamespaceFilter) Add(namespaces []string) error {
+
+	entries := f.Entries()
+	allowList := len(entries.In) > 0
+	for _, ns := range namespaces {
+		m, err := NewNamespaceMatcher(ns)
+		if err != nil {
+			return err
+		}
+		entries.Out = slices.DeleteFunc(entries.Out, func(e string) bool { return e == ns })
+		if allowList && !slices.Contains(entries.In, ns) {
+			entries.In = append(entries.In, ns)
+		}
+		if !allowList {
+			if err := excluded(ns, m, entries.Out); err != nil {
+				return err
+			}
+		}
+
+		if m.db == nil || slices.Contains(entries.Databases, qualifier(ns)) {
+			continue
+		}
+		if m.db.exact != "" && f.KeepDatabase(m.db.exact) {
+			continue
+		}
+		entries.Databases = append(entries.Databases, qualifier(ns))
+	}
+	return f.Set(entries)
+}
+
+// Stop replicating the namespaces or patterns: they are moved from the
+// `in` entries to the `out` ones. A namespace still matching another
+// `in` entry stays replicated.
+func (f *NamespaceFilter) Remove(namespaces []string) error {
+
+	entries := f.Entries()
+	for _, ns := range namespaces {
+		if _, err := NewNamespaceMatcher(ns); err != nil {
+			return err
+		}
+		entries.In = slices.DeleteFunc(entries.In, func(e string) bool { return e == ns })
+		if !slices.Contains(entries.Out, ns) {
+			entries.Out = append(entries.Out, ns)
+		}
+	}
+	return f.Set(entries)
+}
+
+// Check a namespace or pattern entry
+func ValidateNamespace(entry string) error {
+	_, err := NewNamespaceMatcher(entry)
+	return err
+}
+
+// Check if the database is replicated. The system databases must be listed by name.
+func (f *NamespaceFilter) KeepDatabase(db string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.keepDatabase(db)
+}
+
+func (f *NamespaceFilter) keepDatabase(db string) bool {
+	return keepDatabase(f.databases, db)
+}
+
+func keepDatabase(databases []nameMatcher, db string) bool {
+
+	if db == "" {
+		return false
+	}
+
+	for _, m := range databases {
+		if m.exact == db {
+			return true
+		}
+	}
+	if SystemDatabases[db] {
+		return false
+	}
+	for _, m := range databases {
+		if m.exact == "" && m.match(db) {
+			return true
+		}
+	}
+	return false
+}
+
+// A dotted entry of a database not replicated is most likely a collection
+// whose name holds a dot, which used to apply to every database
+func checkQualified(databases []nameMatcher, entries []string, matchers []NamespaceMatcher) error {
+	for i, m := range matchers {
+		if m.db != nil && m.db.exact != "" && !keepDatabase(databases, m.db.exact) {
+			return fmt.Errorf("ambiguous namespace filter %s: the database %s is not replicated, "+
+				"write *.%s for the collection of every database", entries[i], m.db.exact, entries[i])
+		}
+	}
+	return nil
+}
+
+// Check if the namespace is replicated
+func (f *NamespaceFilter) Keep(db string, collection string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if !f.keepDatabase(db) {
+		return false
+	}
+
+	// When listed, only the `in` entries are replicated
+	if len(f.in) > 0 {
+		for _, m := range f.in {
+			if m.Match(db, collection) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, m := range f.out {
+		if m.Match(db, collection) {
+			return false
+		}
+	}
+	return true
+}
+
+// The databases listed by name, ok is false when some are patterns
+func (f *NamespaceFilter) ExactDatabases() (databases []string, ok bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, m := range f.databases {
+		if m.exact == "" {
+			return nil, false
+		}
+		databases = append(databases, m.exact)
+	}
+	return databases, true
+}
+
+// Select the replicated databases among the given ones
+func (f *NamespaceFilter) SelectDatabases(databases []string) []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	var selected []string
+	for _, db := range databases {
+		if f.keepDatabase(db) {
+			selected = append(selected, db)
+		}
+	}
+	return selected
+}
+
+func newNameMatcher(entry string) (nameMatcher, error) {
+
+	if entry == "" {
+		return nameMatcher{}, fmt.Errorf("empty namespace filter entry")
+	}
+
+	// Anchored, the regex matches the whole name
+	if len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+		regex, err := regexp.Compile("^(?:" + entry[1:len(entry)-1] + ")$")
+		if err != nil {
+			return nameMatcher{}, fmt.Errorf("invalid regex in namespace filter %s: %v", entry, err)
+		}
+		return nameMatcher{regex: regex}, nil
+	}
+
+	if strings.ContainsAny(entry, "*?[") {
+		if _, err := path.Match(entry, ""); err != nil {
+			return nameMatcher{}, fmt.Errorf("invalid pattern in namespace filter %s: %v", entry, err)
+		}
+		return nameMatcher{glob: entry}, nil
+	}
+	return nameMatcher{exact: entry}, nil
+}
+
+func (m *nameMatcher) match(name string) bool {
+	switch {
+	case m.regex != nil:
+		return m.regex.MatchString(name)
+	case m.glob != "":
+		ok, _ := path.Match(m.glob, name)
+		return ok
+	}
+	return m.exact == name
+}
+
+func NewNamespaceMatcher(entry string) (NamespaceMatcher, error) {
+
+	m, err := newNameMatcher(entry)
+	if err != nil {
+		return NamespaceMatcher{}, err
+	}
+	if m.regex != nil {
+		return NamespaceMatcher{regex: m.regex}, nil
+	}
+
+	db, coll, qualified := strings.Cut(entry, ".")
+	if !qualified {
+		return NamespaceMatcher{coll: &m}, nil
+	}
+
+	// Most likely a system collection, e.g. `system.profile`,
+	// rather than a collection of the `system` database
+	if db == "system" {
+		return NamespaceMatcher{}, fmt.Errorf("ambiguous namespace filter %s: "+
+			"qualify it with its database, e.g. *.%s", entry, entry)
+	}
+
+	dbMatcher, err := newNameMatcher(db)
+	if err != nil {
+		return NamespaceMatcher{}, err
+	}
+	collMatcher, err := newNameMatcher(coll)
+	if err != nil {
+		return NamespaceMatcher{}, err
+	}
+	return NamespaceMatcher{db: &dbMatcher, coll: &collMatcher}, nil
+}
+
+func newNamespaceMatchers(entries []string) ([]NamespaceMatcher, error) {
+	var matchers []NamespaceMatcher
+	for _, entry := range entries {
+		m, err := NewNamespaceMatcher(entry)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func (m *NamespaceMatcher) Match(db string, collection string) bool {
+	if m.regex != nil {
+		return m.regex.MatchString(db + "." + collection)
+	}
+	if m.db != nil && !m.db.match(db) {
+		return false
+	}
+	return m.coll.match(collection)
+}
+
+// Check that an added namespace is not still excluded by an `out` pattern,
+// for the namespaces without pattern
+func excluded(ns string, m NamespaceMatcher, out []string) error {
+	if m.db == nil || m.db.exact == "" || m.coll.exact == "" {
+		return nil
+	}
+	for _, entry := range out {
+		o, _ := NewNamespaceMatcher(entry)
+		if o.Match(m.db.exact, m.coll.exact) {
+			return fmt.Errorf("%s is excluded by the out entry %s", ns, entry)
+		}
+	}
+	return nil
+}
+
+// The database part of a qualified entry
+func qualifier(entry string) string {
+	db, _, _ := strings.Cut(entry, ".")
+	return db
+}
+
+// The keys of a set, sorted for a stable order
+func keys(set map[string]bool) []string {
+	result := make([]string, 0, len(set))
+	for key := range set {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
@@ -0,0 +1,211 @@
+package filters
+
+import (
+	"testing"
+)
+
+func TestNamespaceFilter(t *testing.T) {
+
+	f, err := NewNamespaceFilter(
+		[]string{"*", "admin"},
+		nil,
+		[]string{"prod.*", "*_tmp", "logs.[ab]*", "*.system.profile"})
+	if err != nil {
+		t.Fatalf("NewNamespaceFilter() = %v", err)
+	}
+
+	tests := []struct {
+		db         string
+		collection string
+		expected   bool
+	}{
+		// Everything but the out entries
+		{"prod", "orders", false},
+		{"dev", "orders", true},
+		{"dev", "system.profile", false},
+		// Unqualified entries apply to every database
+		{"dev", "users_tmp", false},
+		{"dev", "users", true},
+		{"logs", "access", false},
+		{"logs", "errors", true},
+		// System databases must be listed by name
+		{"admin", "users", true},
+		{"config", "settings", false},
+		{"local", "oplog.rs", false},
+		{"", "users", false},
+	}
+
+	for _, test := range tests {
+		if keep := f.Keep(test.db, test.collection); keep != test.expected {
+			t.Errorf("Keep(%s, %s) = %v; want %v", test.db, test.collection, keep, test.expected)
+		}
+	}
+
+	if _, exact := f.ExactDatabases(); exact {
+		t.Errorf("ExactDatabases() = true; want false")
+	}
+	selected := f.SelectDatabases([]string{"admin", "config", "local", "prod"})
+	if len(selected) != 2 || selected[0] != "admin" || selected[1] != "prod" {
+		t.Errorf("SelectDatabases() = %v; want [admin prod]", selected)
+	}
+}
+
+func TestNamespaceFilterAllowList(t *testing.T) {
+
+	f, err := NewNamespaceFilter(
+		[]string{"*"},
+		[]string{"prod.orders", "/^archive_[0-9]+\\.events$/", "users"},
+		[]string{"prod.*", "users"})
+	if err != nil {
+		t.Fatalf("NewNamespaceFilter() = %v", err)
+	}
+
+	tests := []struct {
+		db         string
+		collection string
+		expected   bool
+	}{
+		// Only the in entries, whatever the out ones
+		{"prod", "orders", true},
+		{"prod", "users", true},
+		{"prod", "invoices", false},
+		{"archive_2024", "events", true},
+		{"archive_2024", "logs", false},
+		{"dev", "users", true},
+		{"dev", "orders", false},
+	}
+
+	for _, test := range tests {
+		if keep := f.Keep(test.db, test.collection); keep != test.expected {
+			t.Errorf("Keep(%s, %s) = %v; want %v", test.db, test.collection, keep, test.expected)
+		}
+	}
+}
+
+func TestNamespaceFilterDatabasePatterns(t *testing.T) {
+
+	f, err := NewNamespaceFilter([]string{"shop_*", "/^tenant[0-9]+$/", "crm"}, nil, nil)
+	if err != nil {
+		t.Fatalf("NewNamespaceFilter() = %v", err)
+	}
+
+	tests := []struct {
+		db       string
+		expected bool
+	}{
+		{"shop_eu", true},
+		{"tenant42", true},
+		{"tenant", false},
+		{"pretenant42", false},
+		{"crm", true},
+		{"crm2", false},
+	}
+
+	for _, test := range tests {
+		if keep := f.KeepDatabase(test.db); keep != test.expected {
+			t.Errorf("KeepDatabase(%s) = %v; want %v", test.db, keep, test.expected)
+		}
+	}
+}
+
+func TestNamespaceMatcherRegexAnchored(t *testing.T) {
+
+	m, err := NewNamespaceMatcher("/prod\\.user.*/")
+	if err != nil {
+		t.Fatalf("NewNamespaceMatcher() = %v", err)
+	}
+	if !m.Match("prod", "users") {
+		t.Errorf("Match(prod, users) = false; want true")
+	}
+	// The whole namespace must match, not a part of it
+	if m.Match("preprod", "users") {
+		t.Errorf("Match(preprod, users) = true; want false")
+	}
+}
+
+func TestNewNamespaceFilterErrors(t *testing.T) {
+	tests := []struct {
+		databases []string
+		in        []string
+	}{
+		{[]string{""}, nil},
+		{[]string{"/[/"}, nil},
+		{[]string{"db"}, []string{"prod.["}},
+		{[]string{"db"}, []string{"prod."}},
+		// A system collection or a collection of the system database
+		{[]string{"db"}, []string{"system.profile"}},
+		// A dotted collection name of every database, or a database not replicated
+		{[]string{"db"}, []string{"orders.archive"}},
+	}
+
+	for _, test := range tests {
+		if _, err := NewNamespaceFilter(test.databases, test.in, nil); err == nil {
+			t.Errorf("NewNamespaceFilter(%v, %v) = nil; want an error", test.databases, test.in)
+		}
+	}
+}
+
+func TestNamespaceFilterChanges(t *testing.T) {
+
+	f, err := NewNamespaceFilter([]string{"prod"}, nil, []string{"prod.orders"})
+	if err != nil {
+		t.Fatalf("NewNamespaceFilter() = %v", err)
+	}
+
+	if err := f.Add([]string{"prod.orders", "crm.*"}); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if !f.Keep("prod", "orders") || !f.Keep("crm", "contacts") {
+		t.Errorf("Keep() = false; want the added namespaces replicated")
+	}
+	if f.Keep("dev", "users") {
+		t.Errorf("Keep(dev, users) = true; want false")
+	}
+
+	if err := f.Remove([]string{"crm.*", "prod.users"}); err != nil {
+		t.Fatalf("Remove() = %v", err)
+	}
+	if f.Keep("crm", "contacts") || f.Keep("prod", "users") || !f.Keep("prod", "orders") {
+		t.Errorf("Keep() after Remove() = %v", f.Entries())
+	}
+
+	entries := f.Entries()
+	if len(entries.Databases) != 2 || len(entries.In) != 0 || len(entries.Out) != 2 {
+		t.Errorf("Entries() = %+v; want databases [prod crm], out [crm.* prod.users]", entries)
+	}
+
+	// Still excluded by a pattern
+	if err := f.Add([]string{"crm.contacts"}); err == nil {
+		t.Errorf("Add() = nil; want an error")
+	}
+
+	// Invalid entries leave the filter unchanged
+	if err := f.Add([]string{"prod.["}); err == nil {
+		t.Errorf("Add() = nil; want an error")
+	}
+	if len(f.Entries().Out) != 2 {
+		t.Errorf("Entries() = %+v; want unchanged", f.Entries())
+	}
+}
+
+func TestNamespaceFilterAllowListChanges(t *testing.T) {
+
+	f, err := NewNamespaceFilter([]string{"prod"}, []string{"prod.orders"}, nil)
+	if err != nil {
+		t.Fatalf("NewNamespaceFilter() = %v", err)
+	}
+
+	if err := f.Add([]string{"crm.*"}); err != nil {
+		t.Fatalf("Add() = %v", err)
+	}
+	if !f.Keep("crm", "contacts") || f.Keep("prod", "users") {
+		t.Errorf("Keep() after Add() = %v", f.Entries())
+	}
+
+	if err := f.Remove([]string{"prod.orders"}); err != nil {
+		t.Fatalf("Remove() = %v", err)
+	}
+	if f.Keep("prod", "orders") || !f.Keep("crm", "contacts") {
+		t.Errorf("Keep() after Remove() = %v", f.Entries())
+	}
+}
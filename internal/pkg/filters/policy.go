@@ -0,0 +1,93 @@
+package filters
+
+import (
+	"fmt"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+)
+
+// The operation types of the policies, mapped to the oplog operations.
+// DDL stands for the commands on a collection, e.g. the index builds.
+var PolicyOperations = map[string]string{
+	"insert": oplog.InsertOp,
+	"update": oplog.UpdateOp,
+	"delete": oplog.DeleteOp,
+	"ddl":    oplog.CommandOp,
+}
+
+// The oplog operations replicated for a namespace
+type OperationPolicy struct {
+	allowed map[string]bool
+}
+
+func NewOperationPolicy(allow []string, deny []string) (*OperationPolicy, error) {
+
+	p := &OperationPolicy{allowed: make(map[string]bool)}
+
+	// Everything is allowed unless restricted
+	if len(allow) == 0 {
+		for _, op := range PolicyOperations {
+			p.allowed[op] = true
+		}
+	}
+	for _, name := range allow {
+		op, ok := PolicyOperations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation type: %s", name)
+		}
+		p.allowed[op] = true
+	}
+
+	// Deny takes precedence over allow
+	for _, name := range deny {
+		op, ok := PolicyOperations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation type: %s", name)
+		}
+		p.allowed[op] = false
+	}
+	return p, nil
+}
+
+// Check if the oplog operation is replicated
+func (p *OperationPolicy) Allow(operation string) bool {
+	return p.allowed[operation]
+}
+
+// Holds the operation policies of the namespaces
+type PolicyFilter struct {
+	namespaces []namespacePolicy
+}
+
+type namespacePolicy struct {
+	namespace NamespaceMatcher
+	policy    *OperationPolicy
+}
+
+func NewPolicyFilter(policies []config.OperationPolicyConfig) (*PolicyFilter, error) {
+	f := &PolicyFilter{}
+	for _, cfg := range policies {
+		namespace, err := NewNamespaceMatcher(cfg.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy namespace: %v", err)
+		}
+		policy, err := NewOperationPolicy(cfg.Allow, cfg.Deny)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %v", cfg.Namespace, err)
+		}
+		f.namespaces = append(f.namespaces, namespacePolicy{namespace: namespace, policy: policy})
+	}
+	return f, nil
+}
+
+// Check if the oplog operation on a source namespace is replicated,
+// the first matching pattern wins.
+func (f *PolicyFilter) Allow(db string, collection string, operation string) bool {
+	for _, ns := range f.namespaces {
+		if ns.namespace.Match(db, collection) {
+			return ns.policy.Allow(operation)
+		}
+	}
+	return true
+}
@@ -0,0 +1,66 @@
+package filters
+
+import (
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+)
+
+func TestPolicyFilter(t *testing.T) {
+
+	f, err := NewPolicyFilter([]config.OperationPolicyConfig{
+		{Namespace: "logs.*", Allow: []string{"insert"}},
+		{Namespace: "archive.*", Deny: []string{"delete", "ddl"}},
+		{Namespace: "prod.*", Allow: []string{"insert", "update", "delete"}, Deny: []string{"update"}},
+		{Namespace: "/^tenant[0-9]+\\.audit$/", Allow: []string{"insert"}},
+		{Namespace: "events", Deny: []string{"delete"}},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicyFilter() = %v", err)
+	}
+
+	tests := []struct {
+		db         string
+		collection string
+		operation  string
+		expected   bool
+	}{
+		{"logs", "access", oplog.InsertOp, true},
+		{"logs", "access", oplog.UpdateOp, false},
+		{"logs", "access", oplog.CommandOp, false},
+		{"archive", "orders", oplog.UpdateOp, true},
+		{"archive", "orders", oplog.DeleteOp, false},
+		{"archive", "orders", oplog.CommandOp, false},
+		{"prod", "orders", oplog.UpdateOp, false},
+		{"prod", "orders", oplog.DeleteOp, true},
+		{"prod", "orders", oplog.CommandOp, false},
+		{"dev", "orders", oplog.DeleteOp, true},
+		// Same entries as the namespace filters
+		{"tenant42", "audit", oplog.UpdateOp, false},
+		{"tenant42", "audit", oplog.InsertOp, true},
+		{"dev", "events", oplog.DeleteOp, false},
+	}
+
+	for _, test := range tests {
+		if allowed := f.Allow(test.db, test.collection, test.operation); allowed != test.expected {
+			t.Errorf("Allow(%s.%s, %s) = %v; want %v", test.db, test.collection, test.operation, allowed, test.expected)
+		}
+	}
+}
+
+func TestNewPolicyFilterErrors(t *testing.T) {
+	tests := []config.OperationPolicyConfig{
+		{Namespace: "", Deny: []string{"delete"}},
+		{Namespace: "prod.[", Deny: []string{"delete"}},
+		{Namespace: "/[/", Deny: []string{"delete"}},
+		{Namespace: "prod.*", Allow: []string{"upsert"}},
+		{Namespace: "prod.*", Deny: []string{"drop"}},
+	}
+
+	for _, test := range tests {
+		if _, err := NewPolicyFilter([]config.OperationPolicyConfig{test}); err == nil {
+			t.Errorf("NewPolicyFilter(%v) = nil; want an error", test)
+		}
+	}
+}
@@ -1,19 +1,23 @@
 package incr
 
 import (
-	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"context"
+
 	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 const (
-	Uuid     = "ui"
-	ApplyOps = "applyOps"
+	Uuid             = "ui"
+	ApplyOps         = "applyOps"
+	RenameCollection = "renameCollection"
 )
 
 // Filter command sub-operations.
@@ -37,30 +41,62 @@ func SanitizeApplyOps(ele primitive.E, keepSubOp func(primitive.D) bool, compute
 	return computedCmd, computedCmdSize
 }
 
-// Check if a sub-operation from an applyOps command should be kept
+// Returns the check of the sub-operations of an applyOps command for a pipeline.
 // We only keep insert, update and delete operations
 // We also apply filter on the namespace
-func KeepSubOp(doc bson.D) bool {
+func KeepSubOp(p *pipeline.Pipeline) func(bson.D) bool {
+	return keepSubOpIn(p, p.Namespaces.Keep)
+}
 
-	// Filter the op
-	op := mdb.GetKey(doc, "op").(string)
-	allowed, found := filters.Lookup(filters.AllowedOperationsForApplyOps, op)
-	if !found || !allowed {
-		return false
+// Same check, on the namespaces kept by the function
+func keepSubOpIn(p *pipeline.Pipeline, keepNamespace func(string, string) bool) func(bson.D) bool {
+	return func(doc bson.D) bool {
+
+		// Filter the op
+		op := mdb.GetKey(doc, "op").(string)
+		allowed, found := filters.Lookup(filters.AllowedOperationsForApplyOps, op)
+		if !found || !allowed {
+			return false
+		}
+
+		// Filter the namespace
+		ns := mdb.GetKey(doc, "ns")
+		subDb, subColl := oplog.GetDbAndCollection(ns.(string))
+
+		if !keepNamespace(subDb, subColl) {
+			return false
+		}
+		return allowedByPolicy(p, subDb, subColl, op)
 	}
+}
 
-	// Filter the namespace
-	ns := mdb.GetKey(doc, "ns")
-	subDb, subColl := oplog.GetDbAndCollection(ns.(string))
+// The namespace of a collection level command, held as the value of the
+// command name: the collection, or the full namespace for renameCollection
+func CommandNamespace(db string, cmd bson.D) (string, string, bool) {
+	if len(cmd) == 0 {
+		return "", "", false
+	}
+	collection, ok := cmd[0].Value.(string)
+	if !ok {
+		return "", "", false
+	}
+	if cmd[0].Key == RenameCollection {
+		db, collection = oplog.GetDbAndCollection(collection)
+	}
+	return db, collection, true
+}
 
-	return filters.ShouldReplicateNamespace(
-		config.Current.Repl.DatabasesIn,
-		config.Current.Repl.FiltersIn,
-		config.Current.Repl.FiltersOut,
-		subDb, subColl)
+// Check the operation policy of the namespace, counting the skipped entries
+func allowedByPolicy(p *pipeline.Pipeline, db string, collection string, operation string) bool {
+	if !p.Policies.Allow(db, collection, operation) {
+		p.Metrics.IncrSyncPolicySkippedCounter.WithLabelValues(db, collection, operation).Inc()
+		return false
+	}
+	return true
 }
 
-func RunCommandApplyOps(database string, l *oplog.ChangeLog, client *mongo.Client) error {
+func RunCommandApplyOps(ctx context.Context, database string, l *oplog.ChangeLog,
+	client *mongo.Client, wc *writeconcern.WriteConcern) error {
 	/*
 	 * Strictly speaking, we should handle applysOps nested case, but it is
 	 * complicate to fulfill, so we just use "applyOps" to run the command directly.
@@ -103,7 +139,7 @@ func RunCommandApplyOps(database string, l *oplog.ChangeLog, client *mongo.Clien
 		}
 		store = append(store, ele)
 	}
-	singleResult := mdb.Registry.GetTarget().Client.Database(database).RunCommand(nil, store)
+	singleResult := client.Database(database).RunCommand(ctx, mdb.WithWriteConcern(store, wc))
 	raw, _ := singleResult.Raw()
 
 	var content bson.M
@@ -1,30 +1,42 @@
 package incr
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+func newTestPipeline(t *testing.T, repl *config.ReplConfig) *pipeline.Pipeline {
+	repl.Id = "test"
+	p, err := pipeline.New(repl)
+	if err != nil {
+		t.Fatalf("pipeline.New() = %v", err)
+	}
+	return p
+}
+
 func TestFilterApplyOps(t *testing.T) {
 
 	// Define some configuration
-	config.Current = &config.AppConfig{
-		Repl: config.ReplConfig{
-			DatabasesIn: map[string]bool{
-				"db1": true,
-			},
-			FiltersIn: map[string]bool{
-				"coll1": true,
-				"coll2": true,
-			},
-			FiltersOut: map[string]bool{
-				"coll3": true,
-			},
+	p := newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{
+			"db1": true,
 		},
-	}
+		FiltersIn: map[string]bool{
+			"coll1": true,
+			"coll2": true,
+		},
+		FiltersOut: map[string]bool{
+			"coll3": true,
+		},
+	})
 
 	// Define a set of applyops operations
 	applyOpsDoc := []bson.E{bson.E{Key: "applyOps", Value: bson.A{
@@ -47,7 +59,7 @@ func TestFilterApplyOps(t *testing.T) {
 		switch ele.Key {
 		case "applyOps":
 			// Filter out unwanted sub-commands
-			computedCmd, computedCmdSize = SanitizeApplyOps(ele, KeepSubOp, bson.D{}, computedCmdSize)
+			computedCmd, computedCmdSize = SanitizeApplyOps(ele, KeepSubOp(p), bson.D{}, computedCmdSize)
 		}
 
 	}
@@ -69,13 +81,11 @@ type FilterSubOpsTestCase struct {
 func TestFilterSubOps(t *testing.T) {
 
 	// Define some configuration
-	config.Current = &config.AppConfig{
-		Repl: config.ReplConfig{
-			DatabasesIn: map[string]bool{
-				"db1": true,
-			},
+	keepSubOp := KeepSubOp(newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{
+			"db1": true,
 		},
-	}
+	}))
 
 	// Define a set of applyops operations
 	applyOpsDoc := []FilterSubOpsTestCase{
@@ -92,9 +102,89 @@ func TestFilterSubOps(t *testing.T) {
 
 	for _, doc := range applyOpsDoc {
 
-		if KeepSubOp(doc.Doc) != doc.Allowed {
+		if keepSubOp(doc.Doc) != doc.Allowed {
 			t.Errorf("filterSubOps() = false; want true")
 		}
 	}
 
 }
+
+func TestKeepSubOpPolicy(t *testing.T) {
+
+	keepSubOp := KeepSubOp(newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{
+			"db1": true,
+		},
+		Policies: []config.OperationPolicyConfig{
+			{Namespace: "db1.archive", Deny: []string{"delete"}},
+		},
+	}))
+
+	tests := []FilterSubOpsTestCase{
+		{Doc: bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.archive"}}, Allowed: true},
+		{Doc: bson.D{{Key: "op", Value: "d"}, {Key: "ns", Value: "db1.archive"}}, Allowed: false},
+		{Doc: bson.D{{Key: "op", Value: "d"}, {Key: "ns", Value: "db1.coll1"}}, Allowed: true},
+	}
+
+	for _, test := range tests {
+		if allowed := keepSubOp(test.Doc); allowed != test.Allowed {
+			t.Errorf("KeepSubOp(%v) = %v; want %v", test.Doc, allowed, test.Allowed)
+		}
+	}
+}
+
+func TestCommandNamespace(t *testing.T) {
+
+	tests := []struct {
+		cmd        bson.D
+		db         string
+		collection string
+		ok         bool
+	}{
+		{bson.D{{Key: "dropIndexes", Value: "orders"}}, "db1", "orders", true},
+		{bson.D{{Key: "renameCollection", Value: "db2.orders"}, {Key: "to", Value: "db2.archive"}}, "db2", "orders", true},
+		{bson.D{{Key: "applyOps", Value: bson.A{}}}, "", "", false},
+		{bson.D{}, "", "", false},
+	}
+
+	for _, test := range tests {
+		db, collection, ok := CommandNamespace("db1", test.cmd)
+		if db != test.db || collection != test.collection || ok != test.ok {
+			t.Errorf("CommandNamespace(%v) = %s, %s, %v; want %s, %s, %v",
+				test.cmd, db, collection, ok, test.db, test.collection, test.ok)
+		}
+	}
+}
+
+func TestFilterApplyOpsFetchError(t *testing.T) {
+
+	p := newTestPipeline(t, &config.ReplConfig{
+		Documents: []config.DocumentFilterConfig{{Namespace: "db1.*", Filter: `{"region": "eu"}`}},
+	})
+	// The source cannot be reached
+	p.Registry = mdb.NewMongoRegistry(&config.ReplConfig{Source: "mongodb://127.0.0.1:1/?serverSelectionTimeoutMS=100"})
+	w := &OplogWriterSingle{p: p}
+
+	subOps := bson.A{
+		bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.coll1"}, {Key: "o", Value: bson.D{{Key: "region", Value: "us"}}}},
+		bson.D{{Key: "op", Value: "u"}, {Key: "ns", Value: "db1.coll1"}, {Key: "o", Value: bson.D{{Key: "$v", Value: 2}}},
+			{Key: "o2", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	l := &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Operation: oplog.CommandOp,
+			Object:    bson.D{{Key: "applyOps", Value: subOps}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := w.filterApplyOps(ctx, l); err == nil {
+		t.Fatalf("filterApplyOps() = nil; want the fetch error")
+	}
+
+	// Left as is, to be filtered again
+	if kept := l.Object[0].Value.(bson.A); len(kept) != 2 || mdb.GetKey(kept[0].(bson.D), "op") != "i" {
+		t.Errorf("applyOps = %v; want the entry unchanged", kept)
+	}
+}
@@ -0,0 +1,199 @@
+package incr
+
+import (
+	"context"
+	"slices"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Tags the writes of the replication with a marker updated in the same
+// transaction. The transaction is a single applyOps entry of the oplog
+// of the target, which the replication in the other direction skips.
+type loopMarker struct {
+	db         string
+	collection string
+	namespace  string
+	// The replication writing the marker
+	origin string
+}
+
+func newLoopMarker(p *pipeline.Pipeline) *loopMarker {
+	if !p.Config.Bidirectional.Enabled {
+		return nil
+	}
+	db, collection := oplog.GetDbAndCollection(p.Config.Bidirectional.Marker)
+	return &loopMarker{
+		db:         db,
+		collection: collection,
+		namespace:  p.Config.Bidirectional.Marker,
+		origin:     p.Id,
+	}
+}
+
+// Check if the entry is a transaction written by a replication
+func (m *loopMarker) IsTagged(l *oplog.ParsedLog) bool {
+
+	if l.Operation != oplog.CommandOp || len(l.Object) == 0 || l.Object[0].Key != ApplyOps {
+		return false
+	}
+	subOps, _ := l.Object[0].Value.(bson.A)
+	for _, subOp := range subOps {
+		if doc, ok := subOp.(bson.D); ok && mdb.GetKey(doc, "ns") == m.namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *loopMarker) update(ts primitive.Timestamp) bson.D {
+	return bson.D{{Key: "$set", Value: bson.D{{Key: "ts", Value: ts}}}}
+}
+
+// Update the marker in the transaction of the session
+func (m *loopMarker) write(ctx context.Context, client *mongo.Client, ts primitive.Timestamp) error {
+	_, err := client.Database(m.db).Collection(m.collection).UpdateOne(ctx,
+		bson.D{{Key: "_id", Value: m.origin}}, m.update(ts), options.Update().SetUpsert(true))
+	return err
+}
+
+// Add the marker to the operations of an applyOps command, applied atomically
+func (m *loopMarker) tagApplyOps(l *oplog.ChangeLog) {
+	subOps, ok := l.Object[0].Value.(bson.A)
+	if !ok {
+		return
+	}
+	l.Object[0].Value = append(subOps, bson.D{
+		{Key: "op", Value: oplog.UpdateOp},
+		{Key: "ns", Value: m.namespace},
+		{Key: "o", Value: m.update(l.Timestamp)},
+		{Key: "o2", Value: bson.D{{Key: "_id", Value: m.origin}}},
+		{Key: "b", Value: true},
+	})
+}
+
+// Run the writes of an entry in a transaction with the marker. The transaction
+// is only retried by the writer on transient errors: the errors ignored by the
+// writes abort it, they are reported.
+func (w *OplogWriterSingle) tagged(ctx context.Context, l *oplog.ChangeLog, write func(ctx context.Context) error) error {
+
+	if w.marker == nil {
+		return write(ctx)
+	}
+
+	client := w.targetClient()
+	session, err := client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	return mongo.WithSession(ctx, session, func(sc mongo.SessionContext) error {
+		opts := options.Transaction().SetWriteConcern(w.p.WriteConcern)
+		if err := session.StartTransaction(opts); err != nil {
+			return err
+		}
+		if err := write(sc); err != nil {
+			session.AbortTransaction(sc)
+			return err
+		}
+		if err := w.marker.write(sc, client, l.Timestamp); err != nil {
+			session.AbortTransaction(sc)
+			return err
+		}
+		return session.CommitTransaction(sc)
+	})
+}
+
+// Last writer wins: a write is applied only when its version is greater
+// than the one of the target document
+type conflictRule struct {
+	field string
+}
+
+func newConflictRule(p *pipeline.Pipeline) *conflictRule {
+	if p.Config.Bidirectional.Conflict.Rule != config.ConflictLastWriterWins {
+		return nil
+	}
+	return &conflictRule{field: p.Config.Bidirectional.Conflict.Field}
+}
+
+// The version of a document
+func (c *conflictRule) version(doc bson.D) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	version, index := mdb.GetKeyWithIndex(doc, c.field)
+	return version, len(doc) > index && doc[index].Key == c.field
+}
+
+// The version set by an update, the updates not setting it always apply
+func (c *conflictRule) updatedVersion(update interface{}) (interface{}, bool) {
+	if c == nil {
+		return nil, false
+	}
+	operators, _ := update.(bson.D)
+	fields, _ := mdb.GetKey(operators, "$set").(bson.D)
+	return c.version(fields)
+}
+
+// The key of the document, restricted to the target documents with an older version
+func (c *conflictRule) olderFilter(key bson.D, version interface{}) bson.D {
+	return append(slices.Clone(key), bson.E{Key: "$or", Value: bson.A{
+		bson.D{{Key: c.field, Value: bson.D{{Key: "$lt", Value: version}}}},
+		bson.D{{Key: c.field, Value: bson.D{{Key: "$exists", Value: false}}}},
+	}})
+}
+
+// Apply the update when the target document is older. Returns false when the
+// document does not exist, for the caller to upsert it.
+func (w *OplogWriterSingle) applyIfNewer(ctx context.Context, l *oplog.ChangeLog, coll *mongo.Collection,
+	key bson.D, version interface{}, update interface{}) (bool, error) {
+
+	res, err := coll.UpdateOne(ctx, w.conflict.olderFilter(key, version), update)
+	if err != nil {
+		return false, err
+	}
+	if res.MatchedCount > 0 {
+		return true, nil
+	}
+
+	count, err := coll.CountDocuments(ctx, key, options.Count().SetLimit(1))
+	if err != nil || count == 0 {
+		return false, err
+	}
+
+	log.DebugWithFields("write skipped, the target document is newer",
+		log.Fields{"ns": l.Namespace, "key": key, "version": version})
+	w.p.Metrics.IncrSyncConflictCounter.WithLabelValues(l.Db, l.Collection).Inc()
+	return true, nil
+}
+
+// Insert or update the document without relying on the duplicate key errors,
+// which abort the transactions. The newer target documents are left as is.
+func (w *OplogWriterSingle) upsertDocument(ctx context.Context, l *oplog.ChangeLog) error {
+
+	coll := w.collection(l.Db, l.Collection)
+	key := bson.D{{Key: "_id", Value: mdb.GetKey(l.Object, "_id")}}
+	update := bson.D{{Key: "$set", Value: l.Object}}
+
+	if version, ok := w.conflict.version(l.Object); ok {
+		if exists, err := w.applyIfNewer(ctx, l, coll, key, version, update); err != nil || exists {
+			return err
+		}
+	}
+
+	_, err := coll.UpdateOne(ctx, key, update, options.Update().SetUpsert(true))
+	if err != nil {
+		log.ErrorWithFields(UpsertError, log.Fields{"id": key, "err": err})
+	}
+	return err
+}
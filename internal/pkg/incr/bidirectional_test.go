@@ -0,0 +1,84 @@
+package incr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newApplyOps(ts uint32, subOps ...bson.D) oplog.ParsedLog {
+	ops := bson.A{}
+	for _, subOp := range subOps {
+		ops = append(ops, subOp)
+	}
+	return oplog.ParsedLog{
+		Timestamp: primitive.Timestamp{T: ts, I: 1},
+		Operation: oplog.CommandOp,
+		Namespace: "admin.$cmd",
+		Object:    bson.D{{Key: ApplyOps, Value: ops}},
+	}
+}
+
+func TestReaderSkipsTaggedEntries(t *testing.T) {
+
+	p := newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{"db1": true},
+		Bidirectional: config.BidirectionalConfig{
+			Enabled: true,
+			Marker:  config.DefaultBidirectionalMarker,
+		},
+	})
+	queue := make(chan *oplog.ChangeLog, 10)
+	r := NewOplogReader(p, nil, primitive.Timestamp{}, queue)
+
+	insert := bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.coll1"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 1}}}}
+
+	// Written by the replication in the other direction
+	tagged := &oplog.ChangeLog{ParsedLog: newApplyOps(1, insert)}
+	r.marker.tagApplyOps(tagged)
+	r.handleEntry(context.Background(), tagged.ParsedLog)
+	if len(queue) != 0 {
+		t.Errorf("tagged entry queued")
+	}
+
+	// Written by an application
+	r.handleEntry(context.Background(), newApplyOps(2, insert))
+	if len(queue) != 1 {
+		t.Errorf("untagged entry not queued")
+	}
+}
+
+func TestConflictRule(t *testing.T) {
+
+	c := &conflictRule{field: "version"}
+
+	if v, ok := c.version(bson.D{{Key: "_id", Value: 1}, {Key: "version", Value: 3}}); !ok || v != 3 {
+		t.Errorf("version() = %v, %v; want 3", v, ok)
+	}
+	if _, ok := c.version(bson.D{{Key: "_id", Value: 1}}); ok {
+		t.Errorf("version() found in a document without version")
+	}
+
+	update := bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "a"}, {Key: "version", Value: 4}}}}
+	if v, ok := c.updatedVersion(update); !ok || v != 4 {
+		t.Errorf("updatedVersion() = %v, %v; want 4", v, ok)
+	}
+	if _, ok := c.updatedVersion(bson.D{{Key: "$unset", Value: bson.D{{Key: "name", Value: true}}}}); ok {
+		t.Errorf("updatedVersion() found in an update not setting it")
+	}
+
+	// Source wins: no version
+	var none *conflictRule
+	if _, ok := none.version(bson.D{{Key: "version", Value: 3}}); ok {
+		t.Errorf("version() found without conflict rule")
+	}
+
+	filter := c.olderFilter(bson.D{{Key: "_id", Value: 1}}, 4)
+	if len(filter) != 2 || filter[1].Key != "$or" {
+		t.Errorf("olderFilter() = %v", filter)
+	}
+}
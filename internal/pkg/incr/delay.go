@@ -0,0 +1,389 @@
+package incr
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	DelayMaxWait = 1 * time.Second
+
+	// Read bytes of the spill file after which it is compacted
+	SpillCompactSize = 64 << 20
+)
+
+// Holds the oplog entries between the reader and the writer until they are
+// older than the configured delay, like a MongoDB delayed secondary.
+// Entries can also be released or skipped on demand.
+type DelayedQueue struct {
+	delay  time.Duration
+	in     <-chan *oplog.ChangeLog
+	out    chan<- *oplog.ChangeLog
+	buffer *spillQueue
+	ckpt   checkpoint.CheckpointManager
+	now    func() time.Time
+
+	// Timestamp of the last entry applied by the writer, and of the
+	// last entry released to it, shared with other go routines
+	applied  func() primitive.Timestamp
+	released atomic.Int64
+
+	// Last entry skipped, checkpointed once the writer applied the entries released before
+	skipped *oplog.ChangeLog
+
+	metrics *metrics.PipelineMetrics
+
+	// Actions requested through the API
+	mu         sync.Mutex
+	applyUntil primitive.Timestamp
+	skipUntil  primitive.Timestamp
+	wake       chan struct{}
+}
+
+func NewDelayedQueue(ckpt checkpoint.CheckpointManager, m *metrics.PipelineMetrics, delay time.Duration, buffer *spillQueue,
+	in <-chan *oplog.ChangeLog, out chan<- *oplog.ChangeLog) *DelayedQueue {
+	return &DelayedQueue{
+		delay:   delay,
+		in:      in,
+		out:     out,
+		buffer:  buffer,
+		ckpt:    ckpt,
+		now:     time.Now,
+		wake:    make(chan struct{}, 1),
+		metrics: m,
+	}
+}
+
+func (d *DelayedQueue) StartDelayedQueue(ctx context.Context) {
+	go d.RunDelayedQueue(ctx)
+}
+
+// Timestamp of the last entry released to the writer
+func (d *DelayedQueue) ReleasedTimestamp() primitive.Timestamp {
+	return checkpoint.FromInt64(d.released.Load())
+}
+
+func (d *DelayedQueue) RunDelayedQueue(ctx context.Context) {
+
+	log.InfoWithFields("starting delayed queue", log.Fields{"delay": d.delay})
+	defer d.buffer.Close()
+
+	for {
+		err := d.release(ctx)
+		if err != nil {
+			log.Error("error releasing delayed entries: ", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-time.After(d.wait()):
+		case l, ok := <-d.in:
+			if !ok {
+				return
+			}
+			if err := d.buffer.Push(l); err != nil {
+				log.Fatal("error buffering delayed entry: ", err)
+			}
+		}
+
+		d.metrics.IncrSyncDelayBufferGauge.Set(float64(d.buffer.Len()))
+	}
+}
+
+// Release every entry which is old enough or requested to be applied,
+// and drop the ones requested to be skipped.
+func (d *DelayedQueue) release(ctx context.Context) error {
+
+	d.mu.Lock()
+	applyUntil := d.applyUntil
+	skipUntil := d.skipUntil
+	d.mu.Unlock()
+
+	for d.buffer.Len() > 0 {
+
+		// Loaded back again after an error
+		head := d.buffer.Peek()
+		if head == nil {
+			if err := d.buffer.load(); err != nil {
+				return fmt.Errorf("delayed entries could not be loaded back from %s: %v", d.buffer.path, err)
+			}
+			continue
+		}
+		if checkpoint.CompareTimestamps(head.Timestamp, skipUntil) <= 0 {
+			_, err := d.buffer.Pop()
+			d.skipped = head
+			d.metrics.IncrSyncDelaySkippedCounter.WithLabelValues(head.Db, head.Collection, head.Operation).Inc()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !d.isDue(head.Timestamp, applyUntil) {
+			break
+		}
+
+		// The entry is popped even when the next ones fail to load
+		l, err := d.buffer.Pop()
+		select {
+		case d.out <- l:
+		case <-ctx.Done():
+			return nil
+		}
+		if released := checkpoint.ToInt64(l.Timestamp); released > d.released.Load() {
+			d.released.Store(released)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	d.checkpointSkipped()
+	d.metrics.IncrSyncDelayBufferGauge.Set(float64(d.buffer.Len()))
+	return nil
+}
+
+// Move the checkpoint past the skipped entries, so they are not read again
+// after a restart. Only once the writer applied every entry released before
+// them, an entry released after them moves the checkpoint anyway.
+func (d *DelayedQueue) checkpointSkipped() {
+	if d.skipped == nil || d.applied == nil {
+		return
+	}
+	if checkpoint.CompareTimestamps(d.applied(), d.ReleasedTimestamp()) < 0 {
+		return
+	}
+	if checkpoint.CompareTimestamps(d.skipped.Timestamp, d.ReleasedTimestamp()) > 0 {
+		d.ckpt.MoveCheckpointForward(d.skipped.Timestamp)
+		log.InfoWithFields("delayed entries skipped", log.Fields{"until": d.skipped.Timestamp})
+	}
+	d.skipped = nil
+}
+
+// An entry is due once older than the delay, or when requested to be applied
+func (d *DelayedQueue) isDue(ts primitive.Timestamp, applyUntil primitive.Timestamp) bool {
+	if checkpoint.CompareTimestamps(ts, applyUntil) <= 0 {
+		return true
+	}
+	return !checkpoint.ToDate(ts).After(d.now().Add(-d.delay))
+}
+
+// Time to wait until the head of the buffer is due
+func (d *DelayedQueue) wait() time.Duration {
+	// Nothing buffered, or the entries are to be loaded back again
+	head := d.buffer.Peek()
+	if head == nil {
+		return DelayMaxWait
+	}
+	due := checkpoint.ToDate(head.Timestamp).Add(d.delay)
+	return min(max(due.Sub(d.now()), 0), DelayMaxWait)
+}
+
+// Apply every entry up to the given timestamp, whatever the delay
+func (d *DelayedQueue) ApplyUntil(ts primitive.Timestamp) {
+	d.mu.Lock()
+	if checkpoint.CompareTimestamps(ts, d.applyUntil) > 0 {
+		d.applyUntil = ts
+	}
+	d.mu.Unlock()
+	d.notify()
+	log.InfoWithFields("delayed entries released", log.Fields{"until": ts})
+}
+
+// Drop every entry up to the given timestamp without applying them
+func (d *DelayedQueue) SkipUntil(ts primitive.Timestamp) {
+	d.mu.Lock()
+	if checkpoint.CompareTimestamps(ts, d.skipUntil) > 0 {
+		d.skipUntil = ts
+	}
+	d.mu.Unlock()
+	d.notify()
+}
+
+func (d *DelayedQueue) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// A FIFO queue of change logs kept in memory up to a given size.
+// Beyond that size, the entries are appended to a file on disk and
+// loaded back in memory as the head of the queue is consumed. The
+// file is compacted once enough of it has been loaded back.
+type spillQueue struct {
+	mem       []*oplog.ChangeLog
+	maxMem    int
+	path      string
+	file      *os.File
+	writer    *bufio.Writer
+	readAt    int64
+	compactAt int64
+	spilled   int
+}
+
+func newSpillQueue(maxMem int, dir string, name string) *spillQueue {
+	return &spillQueue{
+		mem:       make([]*oplog.ChangeLog, 0, maxMem),
+		maxMem:    maxMem,
+		path:      filepath.Join(dir, fmt.Sprintf("mongo-repl-delay-%s.bson", name)),
+		compactAt: SpillCompactSize,
+	}
+}
+
+func (q *spillQueue) Len() int {
+	return len(q.mem) + q.spilled
+}
+
+func (q *spillQueue) Peek() *oplog.ChangeLog {
+	if len(q.mem) == 0 {
+		return nil
+	}
+	return q.mem[0]
+}
+
+func (q *spillQueue) Push(l *oplog.ChangeLog) error {
+
+	// Keep the order: once spilling, everything goes to disk
+	if q.spilled == 0 && len(q.mem) < q.maxMem {
+		q.mem = append(q.mem, l)
+		return nil
+	}
+
+	if q.file == nil {
+		if err := q.open(); err != nil {
+			return err
+		}
+	}
+
+	raw, err := bson.Marshal(l)
+	if err != nil {
+		return err
+	}
+	if _, err := q.writer.Write(raw); err != nil {
+		return err
+	}
+	q.spilled++
+	return nil
+}
+
+func (q *spillQueue) Pop() (*oplog.ChangeLog, error) {
+	if len(q.mem) == 0 {
+		return nil, nil
+	}
+
+	l := q.mem[0]
+	q.mem[0] = nil
+	q.mem = q.mem[1:]
+
+	// Load the spilled entries back in memory
+	if q.spilled > 0 && len(q.mem) <= q.maxMem/2 {
+		if err := q.load(); err != nil {
+			return l, err
+		}
+	}
+	return l, nil
+}
+
+func (q *spillQueue) open() error {
+	file, err := os.OpenFile(q.path, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	q.file = file
+	q.writer = bufio.NewWriter(file)
+	q.readAt = 0
+	log.Info("delayed queue spilling to ", q.path)
+	return nil
+}
+
+func (q *spillQueue) load() error {
+
+	if err := q.writer.Flush(); err != nil {
+		return err
+	}
+
+	for q.spilled > 0 && len(q.mem) < q.maxMem {
+
+		// Each BSON document starts with its size
+		header := make([]byte, 4)
+		if _, err := q.file.ReadAt(header, q.readAt); err != nil {
+			return err
+		}
+		raw := make([]byte, binary.LittleEndian.Uint32(header))
+		if _, err := q.file.ReadAt(raw, q.readAt); err != nil {
+			return err
+		}
+		q.readAt += int64(len(raw))
+
+		l := &oplog.ChangeLog{}
+		if err := bson.Unmarshal(raw, l); err != nil {
+			return err
+		}
+		q.mem = append(q.mem, l)
+		q.spilled--
+	}
+
+	// Everything has been loaded back, the file can be reset
+	if q.spilled == 0 {
+		return q.Close()
+	}
+	if q.readAt >= q.compactAt {
+		return q.compact()
+	}
+	return nil
+}
+
+// Replace the spill file by the entries not loaded back yet
+func (q *spillQueue) compact() error {
+
+	tmp, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, io.NewSectionReader(q.file, q.readAt, math.MaxInt64-q.readAt)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), q.path); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The new file is positioned at its end for the next entries
+	q.file.Close()
+	q.file = tmp
+	q.writer = bufio.NewWriter(tmp)
+	q.readAt = 0
+	return nil
+}
+
+func (q *spillQueue) Close() error {
+	if q.file == nil {
+		return nil
+	}
+	q.file.Close()
+	q.file = nil
+	q.writer = nil
+	return os.Remove(q.path)
+}
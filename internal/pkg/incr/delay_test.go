@@ -0,0 +1,212 @@
+package incr
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mocks"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newChangeLog(t uint32) *oplog.ChangeLog {
+	return &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Timestamp: primitive.Timestamp{T: t, I: 1},
+			Operation: oplog.InsertOp,
+			Namespace: "db1.coll1",
+			Object:    bson.D{{Key: "_id", Value: int32(t)}, {Key: "nested", Value: bson.D{{Key: "a", Value: "b"}}}},
+		},
+		Db:         "db1",
+		Collection: "coll1",
+	}
+}
+
+func TestSpillQueue(t *testing.T) {
+
+	q := newSpillQueue(4, t.TempDir(), "test")
+	defer q.Close()
+
+	for i := uint32(1); i <= 20; i++ {
+		if err := q.Push(newChangeLog(i)); err != nil {
+			t.Fatalf("Push() = %v", err)
+		}
+	}
+
+	if q.Len() != 20 || q.spilled != 16 {
+		t.Fatalf("Len() = %d, spilled = %d; want 20, 16", q.Len(), q.spilled)
+	}
+
+	// Keep pushing while consuming to mix memory and disk
+	next := uint32(21)
+	for i := uint32(1); i <= 25; i++ {
+		l, err := q.Pop()
+		if err != nil {
+			t.Fatalf("Pop() = %v", err)
+		}
+		if l.Timestamp.T != i {
+			t.Fatalf("Pop() = %d; want %d", l.Timestamp.T, i)
+		}
+		if i == 1 && l.Object[1].Value.(bson.D)[0].Value != "b" {
+			t.Errorf("Pop() object = %v", l.Object)
+		}
+		if next <= 25 {
+			q.Push(newChangeLog(next))
+			next++
+		}
+	}
+
+	if q.Len() != 0 || q.file != nil {
+		t.Errorf("Len() = %d, file = %v; want an empty queue", q.Len(), q.file)
+	}
+}
+
+func TestSpillQueueCompact(t *testing.T) {
+
+	q := newSpillQueue(4, t.TempDir(), "test")
+	q.compactAt = 1024
+	defer q.Close()
+
+	// Always something spilled: the file is never reset
+	next := uint32(1)
+	for ; next <= 20; next++ {
+		q.Push(newChangeLog(next))
+	}
+	for i := uint32(1); i <= 500; i++ {
+		l, err := q.Pop()
+		if err != nil {
+			t.Fatalf("Pop() = %v", err)
+		}
+		if l.Timestamp.T != i {
+			t.Fatalf("Pop() = %d; want %d", l.Timestamp.T, i)
+		}
+		q.Push(newChangeLog(next))
+		next++
+	}
+
+	if q.spilled == 0 {
+		t.Fatalf("spilled = 0; want entries left on disk")
+	}
+	q.writer.Flush()
+	info, err := os.Stat(q.path)
+	if err != nil {
+		t.Fatalf("Stat() = %v", err)
+	}
+	if info.Size() > 4*q.compactAt {
+		t.Errorf("spill file = %d bytes; want it compacted", info.Size())
+	}
+}
+
+func TestDelayedQueueLoadError(t *testing.T) {
+
+	now := time.Unix(1001, 0)
+	ctx := context.Background()
+	out := make(chan *oplog.ChangeLog, 100)
+	d := NewDelayedQueue(mocks.NewMockCheckpoint(), metrics.ForPipeline("test"), 100*time.Second, newSpillQueue(2, t.TempDir(), "test"), nil, out)
+	d.now = func() time.Time { return now }
+	defer d.buffer.Close()
+
+	for _, ts := range []uint32{850, 900, 950, 990} {
+		d.buffer.Push(newChangeLog(ts))
+	}
+	d.buffer.file.Close()
+
+	// The entries popped are released, even though the next ones cannot be loaded back
+	for i := 0; i < 2; i++ {
+		if err := d.release(ctx); err == nil {
+			t.Fatalf("release() = nil; want the load error")
+		}
+	}
+	if len(out) != 2 || d.buffer.Len() != 2 {
+		t.Fatalf("released %d, held %d; want 2, 2", len(out), d.buffer.Len())
+	}
+
+	// Nothing left in memory to wait for
+	if wait := d.wait(); wait != DelayMaxWait {
+		t.Errorf("wait() = %v; want %v", wait, DelayMaxWait)
+	}
+	if err := d.release(ctx); err == nil || len(out) != 2 {
+		t.Errorf("release() = %v, released %d; want the load error again", err, len(out))
+	}
+}
+
+func TestDelayedQueueRelease(t *testing.T) {
+
+	now := time.Unix(1001, 0)
+	ctx := context.Background()
+	ckpt := mocks.NewMockCheckpoint()
+	out := make(chan *oplog.ChangeLog, 100)
+	d := NewDelayedQueue(ckpt, metrics.ForPipeline("test"), 100*time.Second, newSpillQueue(2, t.TempDir(), "test"), nil, out)
+	d.now = func() time.Time { return now }
+	var applied primitive.Timestamp
+	d.applied = func() primitive.Timestamp { return applied }
+	defer d.buffer.Close()
+
+	for _, ts := range []uint32{850, 900, 950, 990} {
+		d.buffer.Push(newChangeLog(ts))
+	}
+
+	// Only the entries older than the delay are released
+	d.release(ctx)
+	if len(out) != 2 || d.buffer.Len() != 2 {
+		t.Fatalf("released %d, held %d; want 2, 2", len(out), d.buffer.Len())
+	}
+	if ts := d.ReleasedTimestamp(); ts.T != 900 {
+		t.Errorf("ReleasedTimestamp() = %d; want 900", ts.T)
+	}
+	<-out
+	<-out
+
+	// Skip the next one, checkpointed once the writer applied the released ones
+	d.SkipUntil(primitive.Timestamp{T: 950, I: 1})
+	d.release(ctx)
+	if len(out) != 0 || d.buffer.Len() != 1 {
+		t.Fatalf("released %d, held %d; want 0, 1", len(out), d.buffer.Len())
+	}
+	if ckpt.Current.LatestTs.T != 0 {
+		t.Errorf("checkpoint = %d; want unchanged while the writer is behind", ckpt.Current.LatestTs.T)
+	}
+	applied = primitive.Timestamp{T: 900, I: 1}
+	d.release(ctx)
+	if ckpt.Current.LatestTs.T != 950 {
+		t.Errorf("checkpoint = %d; want 950", ckpt.Current.LatestTs.T)
+	}
+
+	// Apply the last one before its delay
+	d.ApplyUntil(primitive.Timestamp{T: 990, I: 1})
+	d.release(ctx)
+	if len(out) != 1 || d.buffer.Len() != 0 {
+		t.Fatalf("released %d, held %d; want 1, 0", len(out), d.buffer.Len())
+	}
+}
+
+func TestIncrDrainedWithHeldEntries(t *testing.T) {
+
+	queue := make(chan *oplog.ChangeLog, 10)
+	o := &Incr{
+		queue:  queue,
+		reader: &OplogReader{},
+		writer: &OplogWriterSingle{},
+	}
+	o.reader.lastRead.Store(checkpoint.ToInt64(primitive.Timestamp{T: 1000}))
+	o.writer.applied.Store(checkpoint.ToInt64(primitive.Timestamp{T: 900}))
+	if o.drained() {
+		t.Fatalf("drained() = true; want false with entries not applied")
+	}
+
+	// The entries held by the delayed queue are not waited for
+	o.delayed = NewDelayedQueue(mocks.NewMockCheckpoint(), metrics.ForPipeline("test"), time.Hour, nil, queue, nil)
+	o.delayed.released.Store(checkpoint.ToInt64(primitive.Timestamp{T: 900}))
+	queue <- newChangeLog(1000)
+	if !o.drained() {
+		t.Errorf("drained() = false; want true once the released entries are applied")
+	}
+	if ts := o.handedOver(); ts.T != 900 {
+		t.Errorf("handedOver() = %d; want 900", ts.T)
+	}
+}
@@ -0,0 +1,158 @@
+package incr
+
+import (
+	"context"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// The outcome of the document level filtering of an oplog entry
+type documentFilter struct {
+	// The entry is applied as is
+	apply bool
+	// The entry is an update on a filtered namespace. The target document is
+	// replaced by the source one when it matches, or deleted otherwise.
+	resync bool
+	// The source document, nil when deleted or not matching
+	current bson.D
+}
+
+// Evaluate the predicate of the source namespace against the entry. Inserts
+// are evaluated as is. As the oplog only holds the changes of an update, the
+// document is fetched from the source.
+func (w *OplogWriterSingle) filterDocument(ctx context.Context, l *oplog.ChangeLog) (documentFilter, error) {
+
+	if l.Operation == oplog.CommandOp {
+		apply, err := w.filterApplyOps(ctx, l)
+		return documentFilter{apply: apply}, err
+	}
+
+	predicate := w.p.Documents.Predicate(l.Db, l.Collection)
+	if predicate == nil {
+		return documentFilter{apply: true}, nil
+	}
+
+	switch l.Operation {
+	case oplog.InsertOp:
+		return documentFilter{apply: predicate.Matches(l.Object)}, nil
+	case oplog.UpdateOp:
+		current, err := w.fetchFromSource(ctx, l.Db, l.Collection, documentKey(&l.ParsedLog))
+		if err != nil {
+			return documentFilter{}, err
+		}
+		if current != nil && !predicate.Matches(current) {
+			current = nil
+		}
+		return documentFilter{resync: true, current: current}, nil
+	}
+	return documentFilter{apply: true}, nil
+}
+
+// Apply the predicates to the sub-operations of an applyOps command.
+// Updates are replaced by the insert of the source document, which applyOps
+// runs as an upsert, or by a delete when it does not match anymore.
+// Returns false when no sub-operation is left. The entry is left as is
+// when a document cannot be fetched, so that it can be filtered again.
+func (w *OplogWriterSingle) filterApplyOps(ctx context.Context, l *oplog.ChangeLog) (bool, error) {
+
+	if len(l.Object) == 0 || l.Object[0].Key != ApplyOps {
+		return true, nil
+	}
+	subOps, ok := l.Object[0].Value.(bson.A)
+	if !ok {
+		return true, nil
+	}
+
+	kept := make(bson.A, 0, len(subOps))
+	for _, subOp := range subOps {
+		doc, ok := subOp.(bson.D)
+		if !ok {
+			kept = append(kept, subOp)
+			continue
+		}
+
+		ns, _ := mdb.GetKey(doc, "ns").(string)
+		db, coll := oplog.GetDbAndCollection(ns)
+		predicate := w.p.Documents.Predicate(db, coll)
+		if predicate == nil {
+			kept = append(kept, doc)
+			continue
+		}
+
+		switch mdb.GetKey(doc, "op") {
+		case oplog.InsertOp:
+			object, _ := mdb.GetKey(doc, "o").(bson.D)
+			if !predicate.Matches(object) {
+				continue
+			}
+		case oplog.UpdateOp:
+			key, _ := mdb.GetKey(doc, "o2").(bson.D)
+			current, err := w.fetchFromSource(ctx, db, coll, key)
+			if err != nil {
+				log.ErrorWithFields("error fetching the document from the source", log.Fields{"ns": ns, "err": err})
+				return false, err
+			}
+			if current != nil && predicate.Matches(current) {
+				doc = bson.D{{Key: "op", Value: oplog.InsertOp}, {Key: "ns", Value: ns}, {Key: "o", Value: current}}
+			} else {
+				doc = bson.D{{Key: "op", Value: oplog.DeleteOp}, {Key: "ns", Value: ns},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: mdb.GetKey(key, "_id")}}}}
+			}
+		}
+		kept = append(kept, doc)
+	}
+
+	l.Object[0].Value = kept
+	return len(kept) > 0, nil
+}
+
+// Replace the target document by the source one, or delete it
+// when it does not exist or does not match anymore.
+func (w *OplogWriterSingle) Resync(ctx context.Context, l *oplog.ChangeLog, current bson.D, rules *transform.Rules) error {
+
+	collectionHandle := w.collection(l.Db, l.Collection)
+	id := bson.D{{Key: "_id", Value: mdb.GetKey(documentKey(&l.ParsedLog), "_id")}}
+
+	if current == nil {
+		if _, err := collectionHandle.DeleteOne(ctx, id); err != nil {
+			log.ErrorWithFields(DeleteError, log.Fields{"err": err})
+			return err
+		}
+		return nil
+	}
+
+	opts := options.Replace().SetUpsert(true)
+	if _, err := collectionHandle.ReplaceOne(ctx, id, rules.TransformDocument(current), opts); err != nil {
+		log.ErrorWithFields(UpsertError, log.Fields{"id": id, "err": err})
+		return err
+	}
+	return nil
+}
+
+// Fetch the current version of a document from the source.
+// Returns nil when the document does not exist anymore.
+func (w *OplogWriterSingle) fetchFromSource(ctx context.Context, db string, collection string, key bson.D) (bson.D, error) {
+
+	var doc bson.D
+	err := w.p.Registry.GetSource().Client.Database(db).Collection(collection).
+		FindOne(ctx, key).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return nil, nil
+	}
+	return doc, err
+}
+
+// The key of the document of an update: the shard key and _id
+// when the collection is sharded, _id otherwise
+func documentKey(l *oplog.ParsedLog) bson.D {
+	if len(l.DocumentKey) > 0 {
+		return l.DocumentKey
+	}
+	return l.Query
+}
@@ -0,0 +1,298 @@
+package incr
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Name of the pipeline target in the metrics
+	PrimaryTarget = "primary"
+
+	FanOutMetricsInterval = 5 * time.Second
+)
+
+// An additional target, with its own namespace filter, checkpoint and writer
+type FanOutTarget struct {
+	Name   string
+	queue  chan *oplog.ChangeLog
+	ckpt   checkpoint.CheckpointManager
+	writer *OplogWriterSingle
+	full   bool
+}
+
+// Feeds the additional targets from the same oplog read. Every entry is
+// copied to a bounded buffer per target, so a slow target only holds the
+// others back once its buffer is full.
+type FanOut struct {
+	p       *pipeline.Pipeline
+	input   <-chan *oplog.ChangeLog
+	primary chan *oplog.ChangeLog
+	targets []*FanOutTarget
+
+	// Writer of the pipeline target, for the lag metrics
+	primaryWriter *OplogWriterSingle
+
+	// Timestamp of the last entry dispatched, shared with other go routines
+	dispatched atomic.Int64
+}
+
+// Creates the additional targets of the pipeline
+func NewFanOut(p *pipeline.Pipeline, input <-chan *oplog.ChangeLog) (*FanOut, error) {
+
+	f := &FanOut{
+		p:       p,
+		input:   input,
+		primary: make(chan *oplog.ChangeLog, cap(input)),
+	}
+
+	names := map[string]bool{PrimaryTarget: true}
+	for _, cfg := range p.Config.Targets {
+
+		if cfg.Name == "" || cfg.Uri == "" {
+			return nil, fmt.Errorf("a target requires a name and an uri")
+		}
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("duplicated target name: %s", cfg.Name)
+		}
+		names[cfg.Name] = true
+
+		filter, err := filters.NewNamespaceFilter(cfg.Databases, cfg.Filters["in"], cfg.Filters["out"])
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %v", cfg.Name, err)
+		}
+
+		target := mdb.NewMongo(cfg.Uri)
+		ckpt := p.OpenCheckpoint(p.Id+"-"+cfg.Name, target)
+		queue := make(chan *oplog.ChangeLog, cfg.Buffer)
+
+		writer := NewOplogWriter(p, ckpt, 0, queue)
+		writer.name = cfg.Name
+		writer.target = target
+		writer.filter = filter
+
+		f.targets = append(f.targets, &FanOutTarget{
+			Name:   cfg.Name,
+			queue:  queue,
+			ckpt:   ckpt,
+			writer: writer,
+		})
+	}
+	return f, nil
+}
+
+// The queue of the pipeline target writer
+func (f *FanOut) Primary() chan *oplog.ChangeLog {
+	return f.primary
+}
+
+// Position every target on its own checkpoint. A target without checkpoint
+// starts from the primary one, it must have been seeded by other means.
+// Returns the oldest checkpoint, from which the reader resumes.
+func (f *FanOut) Resume(ctx context.Context, primary checkpoint.Checkpoint) (primitive.Timestamp, error) {
+
+	oldest := primary.LatestTs
+	for _, t := range f.targets {
+
+		ckpt, err := t.ckpt.GetCheckpoint(ctx)
+		if err != nil {
+			return oldest, err
+		}
+
+		if ckpt.LatestLSN == 0 {
+			log.WarnWithFields("no checkpoint for the target, starting from the primary one",
+				log.Fields{"target": t.Name, "ts": primary.LatestTs})
+			if err := t.ckpt.StartFrom(ctx, primary.LatestTs, primary.OverlapUntil); err != nil {
+				return oldest, err
+			}
+			ckpt, err = t.ckpt.GetCheckpoint(ctx)
+			if err != nil {
+				return oldest, err
+			}
+		}
+
+		t.writer.fullFinishTs = max(ckpt.LatestLSN, checkpoint.ToInt64(ckpt.OverlapUntil))
+		t.writer.skipUntil = ckpt.LatestLSN
+		t.writer.applied.Store(ckpt.LatestLSN)
+
+		if checkpoint.CompareTimestamps(ckpt.LatestTs, oldest) < 0 {
+			oldest = ckpt.LatestTs
+		}
+	}
+	f.dispatched.Store(checkpoint.ToInt64(oldest))
+	return oldest, nil
+}
+
+// Start the writers of the targets and the dispatch of the entries
+func (f *FanOut) StartFanOut(ctx context.Context, primaryWriter *OplogWriterSingle) {
+	f.primaryWriter = primaryWriter
+	for _, t := range f.targets {
+		t.writer.StartWriter(ctx)
+		t.ckpt.StartAutosave(ctx)
+	}
+	go f.RunFanOut(ctx)
+	go f.reportMetrics(ctx)
+}
+
+func (f *FanOut) RunFanOut(ctx context.Context) {
+
+	log.InfoWithFields("starting fan-out", log.Fields{"targets": len(f.targets)})
+	for {
+		var l *oplog.ChangeLog
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return
+		case l, ok = <-f.input:
+		}
+		if !ok {
+			break
+		}
+
+		// The targets get a copy, the writers modify the entries
+		for _, t := range f.targets {
+			c, err := l.Clone()
+			if err != nil {
+				log.ErrorWithFields("error copying the oplog entry", log.Fields{"target": t.Name, "ts": l.Timestamp, "err": err})
+				continue
+			}
+			t.dispatch(c)
+		}
+
+		f.primary <- l
+		f.dispatched.Store(checkpoint.ToInt64(l.Timestamp))
+	}
+
+	close(f.primary)
+	for _, t := range f.targets {
+		close(t.queue)
+	}
+}
+
+// Queue an entry, waiting for the target once its buffer is full
+func (t *FanOutTarget) dispatch(l *oplog.ChangeLog) {
+	select {
+	case t.queue <- l:
+		t.full = false
+		return
+	default:
+	}
+
+	if !t.full {
+		log.WarnWithFields("target buffer full, waiting for the target", log.Fields{"target": t.Name, "buffer": cap(t.queue)})
+		t.full = true
+	}
+	t.queue <- l
+}
+
+// Timestamp of the last entry dispatched to the targets
+func (f *FanOut) DispatchedTimestamp() primitive.Timestamp {
+	return checkpoint.FromInt64(f.dispatched.Load())
+}
+
+func (f *FanOut) reportMetrics(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(FanOutMetricsInterval):
+		}
+
+		dispatched := f.DispatchedTimestamp()
+		if f.primaryWriter != nil {
+			f.reportTargetMetrics(PrimaryTarget, dispatched, f.primaryWriter.AppliedTimestamp(), len(f.primary))
+		}
+		for _, t := range f.targets {
+			f.reportTargetMetrics(t.Name, dispatched, t.writer.AppliedTimestamp(), len(t.queue))
+		}
+	}
+}
+
+func (f *FanOut) reportTargetMetrics(name string, dispatched primitive.Timestamp, applied primitive.Timestamp, buffered int) {
+	lag := 0.0
+	if dispatched.T > applied.T {
+		lag = float64(dispatched.T - applied.T)
+	}
+	f.p.Metrics.TargetLagGauge.WithLabelValues(name).Set(lag)
+	f.p.Metrics.TargetBufferGauge.WithLabelValues(name).Set(float64(buffered))
+}
+
+// Wait for the targets to apply the entries up to the given timestamp,
+// then save their checkpoints.
+func (f *FanOut) Stop(ctx context.Context, until primitive.Timestamp) error {
+
+	for _, t := range f.targets {
+		for len(t.queue) > 0 || checkpoint.CompareTimestamps(t.writer.AppliedTimestamp(), until) < 0 {
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("target %s: %v", t.Name, ctx.Err())
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+
+		t.ckpt.StopAutosave()
+		if err := t.ckpt.SetCheckpoint(ctx, t.writer.AppliedTimestamp(), true); err != nil {
+			return fmt.Errorf("target %s: %v", t.Name, err)
+		}
+		log.InfoWithFields("target stopped", log.Fields{"target": t.Name, "ts": t.writer.AppliedTimestamp()})
+	}
+	return nil
+}
+
+// Move the checkpoints of the targets back to the timestamp, the
+// targets behind it are left as is
+func (f *FanOut) Rewind(ctx context.Context, to primitive.Timestamp) error {
+	for _, t := range f.targets {
+		ckpt, err := t.ckpt.GetCheckpoint(ctx)
+		if err != nil {
+			return fmt.Errorf("target %s: %v", t.Name, err)
+		}
+		if checkpoint.CompareTimestamps(ckpt.LatestTs, to) <= 0 {
+			continue
+		}
+		if err := t.ckpt.Rewind(ctx, to); err != nil {
+			return fmt.Errorf("target %s: %v", t.Name, err)
+		}
+	}
+	return nil
+}
+
+// Check if the entry concerns the namespaces of the writer target.
+// The sub-operations of applyOps are filtered, the other commands
+// are kept with their collection.
+func (w *OplogWriterSingle) keep(l *oplog.ChangeLog) bool {
+
+	if l.Operation != oplog.CommandOp {
+		return w.filter.Keep(l.Db, l.Collection)
+	}
+
+	command, found := mdb.ExtraCommandName(l.Object)
+	if !found {
+		return false
+	}
+	if command != ApplyOps {
+		db, collection, _ := CommandNamespace(l.Db, l.Object)
+		return w.filter.Keep(db, collection)
+	}
+
+	kept, size := SanitizeApplyOps(l.Object[0], func(doc bson.D) bool {
+		ns, _ := mdb.GetKey(doc, "ns").(string)
+		return w.filter.Keep(oplog.GetDbAndCollection(ns))
+	}, bson.D{}, 0)
+	if size == 0 {
+		return false
+	}
+	l.Object[0] = kept[0]
+	return true
+}
@@ -0,0 +1,147 @@
+package incr
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestFanOut(t *testing.T, input chan *oplog.ChangeLog, buffers ...int) *FanOut {
+	p := newTestPipeline(t, &config.ReplConfig{})
+	f := &FanOut{
+		p:       p,
+		input:   input,
+		primary: make(chan *oplog.ChangeLog, cap(input)),
+	}
+	for i, buffer := range buffers {
+		queue := make(chan *oplog.ChangeLog, buffer)
+		ckpt := checkpoint.NewMemoryCheckpoint("test")
+		f.targets = append(f.targets, &FanOutTarget{
+			Name:   string(rune('a' + i)),
+			queue:  queue,
+			ckpt:   ckpt,
+			writer: NewOplogWriter(p, ckpt, 0, queue),
+		})
+	}
+	return f
+}
+
+func TestFanOutDispatch(t *testing.T) {
+
+	input := make(chan *oplog.ChangeLog, 10)
+	f := newTestFanOut(t, input, 10, 10)
+
+	for i := uint32(1); i <= 3; i++ {
+		input <- &oplog.ChangeLog{
+			ParsedLog: oplog.ParsedLog{
+				Timestamp: primitive.Timestamp{T: i},
+				Operation: oplog.InsertOp,
+				Object:    bson.D{{Key: "_id", Value: int32(i)}},
+			},
+			Db:         "db",
+			Collection: "coll",
+		}
+	}
+	close(input)
+	f.RunFanOut(context.Background())
+
+	if len(f.primary) != 3 {
+		t.Fatalf("primary received %d entries; want 3", len(f.primary))
+	}
+	primary := <-f.primary
+	for _, target := range f.targets {
+		if len(target.queue) != 3 {
+			t.Fatalf("target %s received %d entries; want 3", target.Name, len(target.queue))
+		}
+
+		// Each target gets its own copy
+		l := <-target.queue
+		if l == primary || l.Object[0].Value != primary.Object[0].Value {
+			t.Errorf("target %s received %v; want a copy of %v", target.Name, l, primary)
+		}
+		l.Object[0].Value = int32(42)
+		if primary.Object[0].Value == int32(42) {
+			t.Errorf("target %s shares the entry with the primary", target.Name)
+		}
+	}
+
+	if ts := f.DispatchedTimestamp(); ts.T != 3 {
+		t.Errorf("DispatchedTimestamp() = %v; want 3", ts)
+	}
+}
+
+func TestFanOutBoundedBuffer(t *testing.T) {
+
+	input := make(chan *oplog.ChangeLog, 10)
+	f := newTestFanOut(t, input, 1, 10)
+
+	done := make(chan bool)
+	go func() {
+		f.RunFanOut(context.Background())
+		done <- true
+	}()
+
+	for i := uint32(1); i <= 3; i++ {
+		input <- &oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Timestamp: primitive.Timestamp{T: i}}}
+	}
+	close(input)
+
+	// The slow target holds the dispatch once its buffer is full
+	slow := f.targets[0]
+	<-slow.queue
+	<-slow.queue
+	<-slow.queue
+	<-done
+
+	if len(f.targets[1].queue) != 3 || len(f.primary) != 3 {
+		t.Errorf("targets received %d and %d entries; want 3", len(f.targets[1].queue), len(f.primary))
+	}
+}
+
+func TestFanOutWriterKeep(t *testing.T) {
+
+	filter, err := filters.NewNamespaceFilter([]string{"db1"}, []string{"orders"}, []string{"*"})
+	if err != nil {
+		t.Fatalf("NewNamespaceFilter() = %v", err)
+	}
+	w := NewOplogWriter(newTestPipeline(t, &config.ReplConfig{}), checkpoint.NewMemoryCheckpoint("test"), 0, nil)
+	w.filter = filter
+
+	tests := []struct {
+		l        *oplog.ChangeLog
+		expected bool
+	}{
+		{&oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Operation: oplog.InsertOp}, Db: "db1", Collection: "orders"}, true},
+		{&oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Operation: oplog.InsertOp}, Db: "db1", Collection: "users"}, false},
+		{&oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Operation: oplog.InsertOp}, Db: "db2", Collection: "orders"}, false},
+		{&oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Operation: oplog.CommandOp,
+			Object: bson.D{{Key: "dropIndexes", Value: "orders"}}}, Db: "db1", Collection: "$cmd"}, true},
+		{&oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Operation: oplog.CommandOp,
+			Object: bson.D{{Key: "dropIndexes", Value: "users"}}}, Db: "db1", Collection: "$cmd"}, false},
+	}
+
+	for _, test := range tests {
+		if keep := w.keep(test.l); keep != test.expected {
+			t.Errorf("keep(%s.%s, %v) = %v; want %v", test.l.Db, test.l.Collection, test.l.Object, keep, test.expected)
+		}
+	}
+
+	// Only the sub-operations of the target are kept
+	l := &oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Operation: oplog.CommandOp,
+		Object: bson.D{{Key: ApplyOps, Value: bson.A{
+			bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.orders"}},
+			bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.users"}},
+		}}}}, Db: "admin", Collection: "$cmd"}
+	if !w.keep(l) {
+		t.Fatalf("keep(applyOps) = false; want true")
+	}
+	if subOps := l.Object[0].Value.(bson.A); len(subOps) != 1 {
+		t.Errorf("applyOps has %d operations; want 1", len(subOps))
+	}
+}
@@ -2,31 +2,56 @@ package incr
 
 import (
 	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
 
+	"github.com/sebastienferry/mongo-repl/internal/pkg/archive"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/jobs"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type Incr struct {
+	p        *pipeline.Pipeline
 	ckpt     checkpoint.CheckpointManager
 	latestTs primitive.Timestamp
 	queue    chan *oplog.ChangeLog
-	cmdc     chan commands.Command
+	reader   *OplogReader
+	writer   *OplogWriterSingle
+	fanout   *FanOut
+	delayed  *DelayedQueue
+	stopped  atomic.Bool
+
+	// The writers stopped on an entry rejected by their target
+	failed chan error
 }
 
-func NewIncr(ckptManager checkpoint.CheckpointManager, cmdc chan commands.Command) *Incr {
+const (
+	// Time given to the save of the final checkpoint on shutdown
+	CheckpointSaveTimeout = 10 * time.Second
+)
+
+func NewIncr(p *pipeline.Pipeline, ckptManager checkpoint.CheckpointManager) *Incr {
 	return &Incr{
-		ckpt:  ckptManager,
-		queue: make(chan *oplog.ChangeLog, 1000),
-		cmdc:  cmdc,
+		p:      p,
+		ckpt:   ckptManager,
+		queue:  make(chan *oplog.ChangeLog, 1000),
+		failed: make(chan error, 1),
 	}
 }
 
 func (o *Incr) RunIncremental(ctx context.Context) {
 
+	// The go routines of the replication end with it. They keep
+	// running while the queue is drained on shutdown.
+	shutdown := ctx.Done()
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+
 	// Get the starting timestamp
 	startingTimestamp, err := o.ckpt.GetCheckpoint(context.TODO())
 	if err != nil {
@@ -34,7 +59,7 @@ func (o *Incr) RunIncremental(ctx context.Context) {
 	}
 
 	// Check the starting timestamp is within the boundaries of the oplog
-	oplogBoundaries, err := checkpoint.GetReplicasetOplogWindow()
+	oplogBoundaries, err := checkpoint.GetReplicasetOplogWindow(o.p.Registry.GetSource())
 	if err != nil {
 		log.Fatal("error computing the last checkpoint: ", err)
 	}
@@ -43,31 +68,344 @@ func (o *Incr) RunIncremental(ctx context.Context) {
 		log.Fatal("the starting timestamp is older than the oldest timestamp in the oplog")
 	}
 
+	// The source may have rolled back entries already replicated
+	rolledBack, err := o.checkRollback(ctx, startingTimestamp, oplogBoundaries)
+	if err != nil {
+		log.Fatal("error checking the source for a rollback: ", err)
+	}
+	if rolledBack != nil {
+		startingTimestamp = o.ckpt.Checkpoint()
+	}
+
 	o.latestTs = checkpoint.FromInt64(startingTimestamp.LatestLSN)
 
+	// Errors are tolerated for the entries which may already be applied
+	fullFinishTs := max(startingTimestamp.LatestLSN, checkpoint.ToInt64(startingTimestamp.OverlapUntil))
+
+	// In delayed replica mode, the entries are held between the reader and the writer
+	writerQueue := o.queue
+	var delayed *DelayedQueue
+	if delay := o.p.Config.Incr.Delay; delay.Duration > 0 {
+		if window := oplogBoundaries.Newest.T - oplogBoundaries.Oldest.T; uint32(delay.Duration) >= window {
+			log.WarnWithFields("the delay is larger than the oplog window, entries held may be lost on restart",
+				log.Fields{"delay": delay.Duration, "window": window})
+		}
+		writerQueue = make(chan *oplog.ChangeLog, cap(o.queue))
+		delayed = NewDelayedQueue(o.ckpt, o.p.Metrics, time.Duration(delay.Duration)*time.Second,
+			newSpillQueue(delay.Buffer, delay.SpillDir, o.p.Id), o.queue, writerQueue)
+	}
+
+	// Feed the additional targets from the same oplog read. The reader
+	// resumes from the oldest checkpoint, each writer skips what it applied.
+	readerStart := startingTimestamp.LatestTs
+	if len(o.p.Config.Targets) > 0 {
+		o.fanout, err = NewFanOut(o.p, writerQueue)
+		if err != nil {
+			log.Fatal("error creating the additional targets: ", err)
+		}
+		if rolledBack != nil {
+			if err := o.fanout.Rewind(ctx, rolledBack.divergence); err != nil {
+				log.Fatal("error rewinding the additional targets: ", err)
+			}
+		}
+		readerStart, err = o.fanout.Resume(ctx, startingTimestamp)
+		if err != nil {
+			log.Fatal("error getting the checkpoints of the additional targets: ", err)
+		}
+		if readerStart.Compare(oplogBoundaries.Oldest) < 0 {
+			log.Fatal("the checkpoint of a target is older than the oldest timestamp in the oplog")
+		}
+		writerQueue = o.fanout.Primary()
+	}
+
 	// Create both the reader and the writer
-	writer := NewOplogWriter(o.ckpt, startingTimestamp.LatestLSN, o.queue)
-	reader := NewOplogReader(o.ckpt, startingTimestamp.LatestTs, o.cmdc, o.queue)
+	o.writer = NewOplogWriter(o.p, o.ckpt, fullFinishTs, writerQueue)
+	o.writer.applied.Store(startingTimestamp.LatestLSN)
+	o.writer.skipUntil = startingTimestamp.LatestLSN
+	o.writer.failed = o.failed
+	if o.fanout != nil {
+		for _, t := range o.fanout.targets {
+			t.writer.failed = o.failed
+		}
+	}
+	if o.p.Sink != nil {
+		o.writer.sink = o.p.Sink
+		o.p.Sink.OnAcknowledged(o.writer.acknowledge)
+	}
+	o.reader = NewOplogReader(o.p, o.ckpt, readerStart, o.queue)
+	o.reader.delayed = delayed
+	if delayed != nil {
+		delayed.applied = o.writer.AppliedTimestamp
+		delayed.released.Store(checkpoint.ToInt64(readerStart))
+		o.delayed = delayed
+	}
+	if readerStart == startingTimestamp.LatestTs {
+		o.reader.term = startingTimestamp.Term
+	}
+
+	// The collections written by the rolled back entries are resynchronized
+	// before the oplog is read again. Not possible with a sink.
+	if rolledBack != nil && o.p.Sink == nil {
+		for _, ns := range rolledBack.resync {
+			o.reader.snapshots.Enqueue(ns)
+		}
+	} else if rolledBack != nil {
+		log.Warn("the sink cannot be resynchronized, the changes since the divergence are sent again")
+	}
+
+	// Archive the replicated entries to local files
+	if o.p.Config.Archive.Enabled {
+		archiver, err := archive.NewArchiver(o.p.Config.Archive, o.p.Id, o.p.Transform)
+		if err != nil {
+			log.Fatal("error creating the oplog archiver: ", err)
+		}
+		archiver.StartArchiver(ctx)
+		o.reader.archiver = archiver
+	}
 
 	// Start the writer, then the reader
-	writer.StartWriter(ctx)
-	reader.StartReader(ctx)
+	o.writer.StartWriter(ctx)
+	if o.fanout != nil {
+		o.fanout.StartFanOut(ctx, o.writer)
+	}
+	if delayed != nil {
+		delayed.StartDelayedQueue(ctx)
+	}
+	o.reader.StartReader(ctx)
 
 	// Also, start the checlpoint autosaver
 	o.ckpt.StartAutosave(ctx)
 
+	// The cutover workflow and the status can now observe the replication
+	o.p.Cutover.Attach(o)
+	defer o.p.Cutover.Attach(nil)
+	o.p.Tracker.Attach(o)
+	defer o.p.Tracker.Attach(nil)
+
 	// Waits until a command arrives on the decicated channel
 	for {
 		select {
-		case <-ctx.Done():
+		case <-shutdown:
+			o.Shutdown(cancel)
 			return
-			// case cmd := <-o.cmdc:
-			// 	switch cmd.Id {
-			// 	case commands.CmdIdTerminate:
-			// 		log.Info("received termination command")
-			// 		ctx.Done()
-			// 	}
-			// }
+		case err := <-o.failed:
+			// Stays stopped, the checkpoint before the rejected entry
+			o.fail(err)
+			<-shutdown
+			return
+		case <-o.reader.rolledBack:
+			// Resumed from the checkpoint by the caller, which checks it
+			if _, err := o.Stop(ctx); err != nil {
+				log.Error("error stopping the incremental replication: ", err)
+			}
+			return
+		case req := <-o.p.Rewinds:
+			err := o.Rewind(ctx, req.To)
+			req.Result <- err
+			if err == nil {
+				// Restarted from the rewound checkpoint by the caller
+				return
+			}
+		}
+	}
+}
+
+// Stop the replication on shutdown. The writer is given the drain timeout
+// to apply the queued entries, then the checkpoint of what was applied
+// is saved whether the queue is empty or not. With leader election, the
+// writes stop before a standby may take over, right away once the lease is lost.
+// The go routines are stopped with the function before the checkpoint is saved.
+func (o *Incr) Shutdown(stop context.CancelFunc) {
+
+	// Already stopped by a cutover
+	if o.stopped.Load() {
+		return
+	}
+
+	timeout := time.Duration(o.p.Config.Incr.DrainTimeout) * time.Second
+	if o.p.Lease != nil {
+		timeout = min(timeout, o.p.Lease.Remaining())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err := o.Stop(ctx)
+	if err == nil {
+		return
+	}
+	log.WarnWithFields("the queue was not drained on shutdown", log.Fields{
+		"queued": len(o.queue),
+		"error":  err,
+	})
+	stop()
+
+	ctx, cancel = context.WithTimeout(context.Background(), CheckpointSaveTimeout)
+	defer cancel()
+	o.ckpt.StopAutosave()
+	if err := o.ckpt.SaveCheckpoint(ctx); err != nil {
+		log.Error("error saving the final checkpoint: ", err)
+	}
+}
+
+// Stop the replication on an entry rejected by a target. The entries
+// applied so far are checkpointed, and the state records the error.
+func (o *Incr) fail(err error) {
+
+	log.ErrorWithFields("stopping the incremental replication on a rejected write", log.Fields{"error": err})
+	o.stopped.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), CheckpointSaveTimeout)
+	defer cancel()
+	o.reader.StopReader(ctx)
+	o.ckpt.StopAutosave()
+	if err := o.ckpt.SaveCheckpoint(ctx); err != nil {
+		log.Error("error saving the checkpoint: ", err)
+	}
+	o.p.State.Fail(ctx, err)
+}
+
+// Timestamp of the last entry handed over to the writers. In delayed
+// replica mode, the entries still held are read again on restart.
+func (o *Incr) handedOver() primitive.Timestamp {
+	if o.delayed != nil {
+		return o.delayed.ReleasedTimestamp()
+	}
+	return o.reader.LastReadTimestamp()
+}
+
+// Whether the writer applied every entry handed over to it
+func (o *Incr) drained() bool {
+	if o.delayed == nil && len(o.queue) > 0 {
+		return false
+	}
+	return checkpoint.CompareTimestamps(o.writer.AppliedTimestamp(), o.handedOver()) >= 0
+}
+
+// Timestamp up to which the target is consistent with the source.
+// When nothing is in flight, every entry scanned by the reader is considered
+// as applied, even the ones filtered out.
+func (o *Incr) AppliedTimestamp() primitive.Timestamp {
+
+	// Read the scanned position first: every entry before it
+	// has already been queued when it is read.
+	scanned := o.reader.ScannedTimestamp()
+	lastRead := o.reader.LastReadTimestamp()
+	applied := o.writer.AppliedTimestamp()
+
+	if len(o.queue) == 0 && checkpoint.CompareTimestamps(applied, lastRead) >= 0 {
+		return scanned
+	}
+	return applied
+}
+
+// Timestamp of the last oplog entry read for a replicated namespace.
+func (o *Incr) LastReadTimestamp() primitive.Timestamp {
+	return o.reader.LastReadTimestamp()
+}
+
+// Number of oplog entries read and waiting for the writer.
+func (o *Incr) QueueDepth() int {
+	return len(o.queue)
+}
+
+// Namespaces waiting for a snapshot, `db.collection`.
+func (o *Incr) QueuedSnapshots() []string {
+	requests := o.reader.snapshots.Items()
+	namespaces := make([]string, 0, len(requests))
+	for _, request := range requests {
+		if job, ok := o.p.Jobs.Get(request.JobId); ok && job.Status == jobs.StatusCanceled {
+			continue
+		}
+		namespaces = append(namespaces, request.Database+"."+request.Collection)
+	}
+	return namespaces
+}
+
+// Stop the replication, then move the checkpoints of the pipeline and
+// of its additional targets back to the timestamp. The entries up to the
+// current positions are re-applied idempotently once restarted.
+func (o *Incr) Rewind(ctx context.Context, to primitive.Timestamp) error {
+
+	// The entries from there must still be in the oplog of the source
+	window, err := checkpoint.GetReplicasetOplogWindow(o.p.Registry.GetSource())
+	if err != nil {
+		return err
+	}
+	if err := checkpoint.CheckRewind(window, to); err != nil {
+		return err
+	}
+	if applied := o.writer.AppliedTimestamp(); checkpoint.CompareTimestamps(to, applied) > 0 {
+		return fmt.Errorf("cannot rewind to %v, after the checkpoint %v",
+			checkpoint.ToDate(to), checkpoint.ToDate(applied))
+	}
+
+	log.InfoWithFields("rewinding the incremental replication", log.Fields{"to": to})
+	if _, err := o.Stop(ctx); err != nil {
+		return err
+	}
+
+	if err := o.ckpt.Rewind(ctx, to); err != nil {
+		return err
+	}
+	if o.fanout != nil {
+		if err := o.fanout.Rewind(ctx, to); err != nil {
+			return err
+		}
+	}
+
+	// The sink was closed with the replication
+	if o.p.Sink != nil {
+		o.p.OpenSink()
+	}
+
+	log.InfoWithFields("incremental replication rewound", log.Fields{"to": checkpoint.ToDate(to)})
+	return nil
+}
+
+// Stop the reader, wait for the writer to apply every queued entry
+// and save the final checkpoint.
+func (o *Incr) Stop(ctx context.Context) (primitive.Timestamp, error) {
+
+	log.Info("stopping incremental replication")
+	o.reader.StopReader(ctx)
+
+	// Wait for the queue to be drained
+	for !o.drained() {
+		select {
+		case <-ctx.Done():
+			return o.writer.AppliedTimestamp(), ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	// Wait for the additional targets
+	if o.fanout != nil {
+		if err := o.fanout.Stop(ctx, o.handedOver()); err != nil {
+			log.Error("error stopping the additional targets: ", err)
+		}
+	}
+
+	// Close the current archive file
+	if o.reader.archiver != nil {
+		if err := o.reader.archiver.Close(); err != nil {
+			log.Error("error closing the oplog archive: ", err)
 		}
 	}
+
+	// Write what the sink still buffers
+	if o.p.Sink != nil {
+		if err := o.p.Sink.Close(ctx); err != nil {
+			log.Error("error closing the sink: ", err)
+		}
+	}
+
+	// Save the final checkpoint
+	final := o.AppliedTimestamp()
+	o.ckpt.StopAutosave()
+	if err := o.ckpt.SetCheckpoint(ctx, final, true); err != nil {
+		return final, err
+	}
+
+	o.stopped.Store(true)
+	log.InfoWithFields("incremental replication stopped", log.Fields{"ts": final})
+	return final, nil
 }
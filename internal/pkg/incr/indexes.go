@@ -4,13 +4,16 @@ import (
 	"context"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 // Create indexes on a collection using the createIndexes command
-func RunCommandCreateIndexes(database string, l *oplog.ChangeLog, client *mongo.Client) error {
+func RunCommandCreateIndexes(ctx context.Context, database string, l *oplog.ChangeLog,
+	client *mongo.Client, wc *writeconcern.WriteConcern) error {
 
 	log.DebugWithFields("execute DDL command", log.Fields{"command": "createIndexes"})
 
@@ -34,10 +37,11 @@ func RunCommandCreateIndexes(database string, l *oplog.ChangeLog, client *mongo.
 		{"indexes", indexes},
 	}
 
-	return client.Database(database).RunCommand(context.TODO(), cmd).Err()
+	return client.Database(database).RunCommand(ctx, mdb.WithWriteConcern(cmd, wc)).Err()
 }
 
-func RunCommandDropIndexes(database string, l *oplog.ChangeLog, client *mongo.Client) error {
+func RunCommandDropIndexes(ctx context.Context, database string, l *oplog.ChangeLog,
+	client *mongo.Client, wc *writeconcern.WriteConcern) error {
 
 	log.DebugWithFields("execute DDL command", log.Fields{"command": "dropIndexes"})
 
@@ -59,21 +63,23 @@ func RunCommandDropIndexes(database string, l *oplog.ChangeLog, client *mongo.Cl
 		{"index", index},
 	}
 
-	return client.Database(database).RunCommand(context.TODO(), cmd).Err()
+	return client.Database(database).RunCommand(ctx, mdb.WithWriteConcern(cmd, wc)).Err()
 
 }
 
 // See this documentation for a full list of available commands:
 // https://www.mongodb.com/docs/manual/reference/command/
-func RunCommand(database, command string, l *oplog.ChangeLog, client *mongo.Client) error {
+// The commands are run with the write concern, nil for the default one.
+func RunCommand(ctx context.Context, database, command string, l *oplog.ChangeLog,
+	client *mongo.Client, wc *writeconcern.WriteConcern) error {
 
 	switch command {
 	case "applyOps":
-		return RunCommandApplyOps(database, l, client)
+		return RunCommandApplyOps(ctx, database, l, client, wc)
 	case "commitIndexBuild":
-		return RunCommandCreateIndexes(database, l, client)
+		return RunCommandCreateIndexes(ctx, database, l, client, wc)
 	case "dropIndexes":
-		return RunCommandDropIndexes(database, l, client)
+		return RunCommandDropIndexes(ctx, database, l, client, wc)
 	default:
 		log.DebugWithFields("unkknow command", log.Fields{"command": command})
 	}
@@ -0,0 +1,271 @@
+package incr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/api"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/snapshot"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/state"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Errors of the namespaces not added
+var ErrNamespacesStopped = errors.New("the replication stopped before the snapshots were done")
+
+// An addition of namespaces waiting for the snapshots of its new collections.
+// Meanwhile, the reader holds back the entries of these namespaces only.
+type namespaceAdd struct {
+	cmd       commands.Command
+	changed   *filters.NamespaceFilter
+	snapshots []api.SnapshotRequest
+	held      []*oplog.ChangeLog
+	cancel    context.CancelFunc
+
+	// Set by the snapshots before done is closed
+	err  error
+	done chan struct{}
+}
+
+// The namespace is replicated once added, and not yet
+func (a *namespaceAdd) keeps(r *OplogReader, db string, collection string) bool {
+	return db != "" && collection != "" && a.changed.Keep(db, collection) && !r.p.Namespaces.Keep(db, collection)
+}
+
+// Change the replicated namespaces. Run by the reader loop: a removal is
+// applied right away, an addition once its new collections are snapshotted
+// by a job of its own.
+func (r *OplogReader) changeNamespaces(ctx context.Context, cmd commands.Command) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	if !r.p.Jobs.Start(cmd.JobId, cancel) {
+		cancel()
+		return
+	}
+	add, result, err := r.applyNamespaces(ctx, cmd)
+	if add != nil {
+		add.cancel = cancel
+		r.startSnapshots(jobCtx, add)
+		return
+	}
+	cancel()
+	if err != nil {
+		log.Error("error changing the namespaces: ", err)
+	}
+	r.p.Jobs.Finish(cmd.JobId, result, err)
+}
+
+// Change the filter, unless collections are to be snapshotted first
+func (r *OplogReader) applyNamespaces(ctx context.Context, cmd commands.Command) (*namespaceAdd, string, error) {
+
+	current := r.p.Namespaces.Entries()
+	changed, err := filters.NewNamespaceFilter(current.Databases, current.In, current.Out)
+	if err != nil {
+		return nil, "", err
+	}
+	if cmd.Id == commands.CmdIdAddNamespaces {
+		err = changed.Add(cmd.Arguments)
+	} else {
+		err = changed.Remove(cmd.Arguments)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The collections to snapshot, before changing anything
+	if cmd.Id == commands.CmdIdAddNamespaces {
+		added, err := r.addedCollections(ctx, changed)
+		if err != nil {
+			return nil, "", fmt.Errorf("error listing the collections to snapshot: %v", err)
+		}
+		if len(added) > 0 {
+			return &namespaceAdd{cmd: cmd, changed: changed, snapshots: added, done: make(chan struct{})}, "", nil
+		}
+	}
+
+	if err := r.setNamespaces(ctx, cmd, changed); err != nil {
+		return nil, "", err
+	}
+	if cmd.Id == commands.CmdIdRemoveNamespaces {
+		return nil, "removed " + strings.Join(cmd.Arguments, ", "), nil
+	}
+	return nil, "added " + strings.Join(cmd.Arguments, ", ") + ", no collection to snapshot", nil
+}
+
+// Save the filter with the checkpoint, so that it survives restarts, then use it
+func (r *OplogReader) setNamespaces(ctx context.Context, cmd commands.Command, changed *filters.NamespaceFilter) error {
+	entries := changed.Entries()
+	if r.store != nil {
+		if err := r.store.SaveNamespaces(ctx, entries); err != nil {
+			return fmt.Errorf("error saving the namespaces: %v", err)
+		}
+	}
+	if err := r.p.Namespaces.Set(entries); err != nil {
+		return err
+	}
+	log.InfoWithFields("replicated namespaces changed", log.Fields{
+		"command": commands.Names[cmd.Id], "namespaces": cmd.Arguments})
+	return nil
+}
+
+// Snapshot the new collections while the reader goes on. The checkpoint
+// stays before the entries held back, read again after a restart.
+func (r *OplogReader) startSnapshots(ctx context.Context, add *namespaceAdd) {
+	if r.ckpt != nil {
+		r.ckpt.HoldCheckpoint(r.latest)
+	}
+	r.adding = add
+	go func() {
+		defer close(add.done)
+		add.err = r.snapshotCollections(ctx, add.snapshots)
+	}()
+}
+
+// Snapshot the collections one after the other, the first error stops them
+func (r *OplogReader) snapshotCollections(ctx context.Context, requests []api.SnapshotRequest) error {
+
+	r.setState(ctx, state.StateResyncing, "snapshot of the added namespaces")
+	var err error
+	for _, request := range requests {
+		if err = r.synchronize(ctx, request.Database, request.Collection); err != nil {
+			err = fmt.Errorf("snapshot of %s.%s: %v", request.Database, request.Collection, err)
+			break
+		}
+	}
+
+	// Unless paused meanwhile
+	if _, err := r.p.State.TransitionFrom(context.WithoutCancel(ctx), state.StateResyncing, state.StateCatchingUp,
+		"snapshot of the added namespaces done"); err != nil {
+		log.Error("error saving the replication state: ", err)
+	}
+	return err
+}
+
+// Copy a collection of the source to the target
+func (r *OplogReader) snapshotCollection(ctx context.Context, db string, collection string) error {
+	return snapshot.NewMappedDeltaReplication(r.p, db, collection, false).SynchronizeCollection(ctx)
+}
+
+// Hold back an entry of a namespace being added
+func (r *OplogReader) holdBack(l oplog.ParsedLog, db string, collection string) {
+	if r.adding == nil || !r.adding.keeps(r, db, collection) || !allowedByPolicy(r.p, db, collection, l.Operation) {
+		return
+	}
+	r.adding.held = append(r.adding.held, &oplog.ChangeLog{ParsedLog: l, Db: db, Collection: collection})
+	r.latest = l.Timestamp
+}
+
+// Hold back the sub-operations of an applyOps command on the namespaces being
+// added, in a copy of the command. The ones replicated already are left as is.
+func (r *OplogReader) holdBackApplyOps(l oplog.ParsedLog, ele primitive.E, db string, collection string) {
+	subOps, ok := ele.Value.(bson.A)
+	if r.adding == nil || !ok {
+		return
+	}
+	keep := keepSubOpIn(r.p, func(db string, collection string) bool {
+		return r.adding.keeps(r, db, collection)
+	})
+	held, size := SanitizeApplyOps(primitive.E{Key: ele.Key, Value: append(bson.A{}, subOps...)}, keep, primitive.D{}, 0)
+	if size > 0 {
+		l.Object = held
+		r.adding.held = append(r.adding.held, &oplog.ChangeLog{ParsedLog: l, Db: db, Collection: collection})
+	}
+}
+
+// Once the snapshots of an addition are done, queue the entries held back
+// and replicate the namespaces. When one of them failed, the namespaces
+// stay out and their entries are dropped. Returns false when stopped meanwhile.
+func (r *OplogReader) completeNamespaces(ctx context.Context) bool {
+
+	add := r.adding
+	if add == nil {
+		return true
+	}
+	select {
+	case <-add.done:
+	default:
+		return true
+	}
+	r.adding = nil
+	add.cancel()
+
+	// Queued before the new filter is saved, the entries are never lost
+	err := add.err
+	if err == nil {
+		for _, l := range add.held {
+			if !r.enqueue(ctx, l) {
+				err = ErrNamespacesStopped
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = r.setNamespaces(ctx, add.cmd, add.changed)
+	}
+	if err != nil {
+		if r.ckpt != nil {
+			r.ckpt.ReleaseCheckpoint(primitive.Timestamp{}, r.latest)
+		}
+		log.Error("error adding the namespaces: ", err)
+		r.p.Jobs.Finish(add.cmd.JobId, "", err)
+		return !errors.Is(err, ErrNamespacesStopped)
+	}
+
+	if r.ckpt != nil {
+		var last primitive.Timestamp
+		if len(add.held) > 0 {
+			last = add.held[len(add.held)-1].Timestamp
+		}
+		r.ckpt.ReleaseCheckpoint(last, r.latest)
+	}
+	r.p.Jobs.Finish(add.cmd.JobId, fmt.Sprintf("added %s, %d collections snapshotted",
+		strings.Join(add.cmd.Arguments, ", "), len(add.snapshots)), nil)
+	return true
+}
+
+// Give up the addition in progress when the reader stops
+func (r *OplogReader) abandonNamespaces() {
+	add := r.adding
+	if add == nil {
+		return
+	}
+	r.adding = nil
+	add.cancel()
+	if r.ckpt != nil {
+		r.ckpt.ReleaseCheckpoint(primitive.Timestamp{}, r.latest)
+	}
+	r.p.Jobs.Finish(add.cmd.JobId, "", ErrNamespacesStopped)
+}
+
+// The collections of the source kept by the changed filter only
+func (r *OplogReader) addedCollections(ctx context.Context, changed *filters.NamespaceFilter) ([]api.SnapshotRequest, error) {
+
+	collections, err := mdb.GetReplicatedCollections(ctx, r.p.Registry.GetSource(), changed)
+	if err != nil {
+		return nil, err
+	}
+
+	databases := make([]string, 0, len(collections))
+	for db := range collections {
+		databases = append(databases, db)
+	}
+	sort.Strings(databases)
+
+	var added []api.SnapshotRequest
+	for _, db := range databases {
+		for _, collection := range collections[db] {
+			if !r.p.Namespaces.Keep(db, collection) {
+				added = append(added, api.SnapshotRequest{Database: db, Collection: collection})
+			}
+		}
+	}
+	return added, nil
+}
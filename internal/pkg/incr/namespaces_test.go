@@ -0,0 +1,117 @@
+package incr
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/api"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/jobs"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A reader adding db1.coll2, its snapshot ending with the error
+func newAddingReader(t *testing.T, snapshotErr error) (*OplogReader, chan *oplog.ChangeLog, chan struct{}) {
+
+	p := newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{"db1": true},
+		FiltersIn:   map[string]bool{"coll1": true},
+	})
+	queue := make(chan *oplog.ChangeLog, 10)
+	r := NewOplogReader(p, nil, primitive.Timestamp{}, queue)
+
+	// The snapshot waits for the test
+	release := make(chan struct{})
+	r.synchronize = func(ctx context.Context, db string, collection string) error {
+		<-release
+		return snapshotErr
+	}
+
+	cmd := commands.NewCmdAddNamespaces([]string{"coll2"})
+	job := p.Jobs.Create(commands.Names[cmd.Id], cmd.Arguments, true)
+	cmd.JobId = job.Id
+	changed, _ := filters.NewNamespaceFilter([]string{"db1"}, []string{"coll1", "coll2"}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if !p.Jobs.Start(cmd.JobId, cancel) {
+		t.Fatalf("Start() = false")
+	}
+	r.startSnapshots(ctx, &namespaceAdd{
+		cmd:       cmd,
+		changed:   changed,
+		snapshots: []api.SnapshotRequest{{Database: "db1", Collection: "coll2"}},
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	})
+	return r, queue, release
+}
+
+func insertInto(ns string, t uint32) oplog.ParsedLog {
+	return oplog.ParsedLog{
+		Timestamp: primitive.Timestamp{T: t},
+		Operation: oplog.InsertOp,
+		Namespace: ns,
+		Object:    bson.D{{Key: "_id", Value: t}},
+	}
+}
+
+func TestAddNamespacesHoldsBack(t *testing.T) {
+
+	ctx := context.Background()
+	r, queue, release := newAddingReader(t, nil)
+
+	// Only the entries of the namespace added wait for the snapshot
+	r.handleEntry(ctx, insertInto("db1.coll2", 1))
+	r.handleEntry(ctx, insertInto("db1.coll1", 2))
+	r.handleEntry(ctx, insertInto("db1.coll3", 3))
+	if len(queue) != 1 || (<-queue).Collection != "coll1" {
+		t.Fatalf("queued %d entries; want the one of coll1", len(queue))
+	}
+	if !r.completeNamespaces(ctx) || r.adding == nil {
+		t.Fatalf("completeNamespaces() done before the snapshot")
+	}
+
+	close(release)
+	<-r.adding.done
+	job := r.adding.cmd.JobId
+	if !r.completeNamespaces(ctx) {
+		t.Fatalf("completeNamespaces() = false")
+	}
+	if len(queue) != 1 || (<-queue).Collection != "coll2" {
+		t.Errorf("queued %d entries; want the one held back", len(queue))
+	}
+	if !r.p.Namespaces.Keep("db1", "coll2") {
+		t.Errorf("Keep(db1.coll2) = false; want the namespace added")
+	}
+	if j, _ := r.p.Jobs.Get(job); j.Status != jobs.StatusSucceeded {
+		t.Errorf("job status = %s; want %s", j.Status, jobs.StatusSucceeded)
+	}
+}
+
+func TestAddNamespacesSnapshotFailed(t *testing.T) {
+
+	ctx := context.Background()
+	r, queue, release := newAddingReader(t, errors.New("snapshot failed"))
+
+	r.handleEntry(ctx, insertInto("db1.coll2", 1))
+	close(release)
+	<-r.adding.done
+	job := r.adding.cmd.JobId
+	r.completeNamespaces(ctx)
+
+	// The namespace stays out, its entries are dropped
+	if len(queue) != 0 {
+		t.Errorf("queued %d entries; want none", len(queue))
+	}
+	if r.p.Namespaces.Keep("db1", "coll2") {
+		t.Errorf("Keep(db1.coll2) = true; want the namespace left out")
+	}
+	if j, _ := r.p.Jobs.Get(job); j.Status != jobs.StatusFailed {
+		t.Errorf("job status = %s; want %s", j.Status, jobs.StatusFailed)
+	}
+}
@@ -3,19 +3,24 @@ package incr
 import (
 	"context"
 	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/api"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/archive"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/collections"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/snapshot"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/state"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -31,38 +36,110 @@ type Reader interface {
 }
 
 type OplogReader struct {
+	p         *pipeline.Pipeline
 	ckpt      checkpoint.CheckpointManager
+	store     checkpoint.Store
 	filter    *filters.Filter
 	latest    primitive.Timestamp
 	queue     chan *oplog.ChangeLog
 	options   *options.FindOptions
 	cmdc      <-chan commands.Command
 	done      chan bool
-	state     int
+	stopped   chan struct{}
 	snapshots *collections.AtomicQueue[api.SnapshotRequest]
+	changes   *collections.AtomicQueue[*commands.Command]
+	adding    *namespaceAdd
+	delayed   *DelayedQueue
+	archiver  *archive.Archiver
+	marker    *loopMarker
+
+	// Term and hash of the entry at `latest`, to detect a rollback of the source
+	term       *int64
+	hash       *int64
+	readTerm   *int64
+	rolledBack chan struct{}
+
+	// Copies a collection once its namespace is added
+	synchronize func(context.Context, string, string) error
+
+	// Positions in the oplog, shared with other go routines
+	scanned  atomic.Int64 // last entry seen, whatever the namespace
+	lastRead atomic.Int64 // last entry queued for a replicated namespace
 }
 
-func NewOplogReader(ckpt checkpoint.CheckpointManager,
+func NewOplogReader(p *pipeline.Pipeline,
+	ckpt checkpoint.CheckpointManager,
 	latest primitive.Timestamp,
-	cmdc <-chan commands.Command,
 	queue chan *oplog.ChangeLog) *OplogReader {
-	return &OplogReader{
+	r := &OplogReader{
+		p:         p,
 		latest:    latest,
 		ckpt:      ckpt,
-		filter:    filters.NewFilter(),
+		store:     p.Store,
+		filter:    filters.NewFilter(p.Namespaces),
 		options:   options.Find(),
 		queue:     queue,
-		cmdc:      cmdc,
+		cmdc:      p.Commands,
 		done:      make(chan bool),
-		state:     StateUnknown,
+		stopped:   make(chan struct{}),
 		snapshots: collections.NewAtomicQueue[api.SnapshotRequest](),
+		changes:   collections.NewAtomicQueue[*commands.Command](),
+		marker:    newLoopMarker(p),
+
+		rolledBack: make(chan struct{}),
+	}
+	r.synchronize = r.snapshotCollection
+	r.scanned.Store(checkpoint.ToInt64(latest))
+	r.lastRead.Store(checkpoint.ToInt64(latest))
+	return r
+}
+
+// Timestamp of the last oplog entry seen by the reader
+func (r *OplogReader) ScannedTimestamp() primitive.Timestamp {
+	return checkpoint.FromInt64(r.scanned.Load())
+}
+
+// Timestamp of the last oplog entry queued for the writer
+func (r *OplogReader) LastReadTimestamp() primitive.Timestamp {
+	return checkpoint.FromInt64(r.lastRead.Load())
+}
+
+// Queue an entry for the writer and keep track of the position.
+// Returns false when stopped while waiting for the writer.
+func (r *OplogReader) enqueue(ctx context.Context, l *oplog.ChangeLog) bool {
+	if r.archiver != nil {
+		if err := r.archiver.Archive(l); err != nil {
+			log.Error("error archiving oplog entry: ", err)
+		}
+	}
+	select {
+	case r.queue <- l:
+	case <-r.done:
+		return false
+	case <-ctx.Done():
+		return false
 	}
+	// Unless held back by a change of the namespaces
+	if read := checkpoint.ToInt64(l.Timestamp); read > r.lastRead.Load() {
+		r.lastRead.Store(read)
+	}
+	return true
 }
 
 func (r *OplogReader) StartReader(ctx context.Context) {
 	go r.RunReader(ctx)
 }
 
+// Save the checkpoint on the state transitions
+func (r *OplogReader) saveCheckpoint(ctx context.Context) {
+	if r.ckpt == nil {
+		return
+	}
+	if err := r.ckpt.SaveCheckpoint(ctx); err != nil {
+		log.Error("error saving the checkpoint: ", err)
+	}
+}
+
 func (r *OplogReader) RunReader(ctx context.Context) {
 
 	// Set options
@@ -71,89 +148,92 @@ func (r *OplogReader) RunReader(ctx context.Context) {
 	//r.findOptions.SetCursorType(options.Tailable)
 	//r.findOptions.SetSort(bson.D{{"$natural", 1}})
 
+	// Handle the commands until the reader stops
+	defer close(r.stopped)
+	go r.handleCommands(ctx, r.stopped)
+	defer r.abandonNamespaces()
+
 	// Read forever
-	r.state = StateRunning
 	for {
 
-		go func() {
-
-			for {
-				cmd := <-r.cmdc
-				switch cmd.Id {
-				case commands.CmdIdPauseIncr:
-					r.state = StatePaused
-					log.Info("incremental replication paused")
-				case commands.CmdIdResumeIncr:
-					r.state = StateRunning
-					log.Info("incremental replication resumed")
-				case commands.CmdIdSnapshot:
-
-					// Extract the collection to snapshot
-					if len(cmd.Arguments) <= 1 {
-						log.Warn("invalid argument for snapshot")
-					}
-
-					database := cmd.Arguments[0]
-					collection := cmd.Arguments[1]
-
-					r.snapshots.Enqueue(api.SnapshotRequest{
-						Database:   database,
-						Collection: collection,
-					})
-					log.Info("snapshot request received for ", collection)
-
-				case StateRunning:
-				default:
-				}
-			}
-		}()
-
 		// Check if we should stop processing
 		select {
 		case <-r.done:
 			log.Info("stopping oplog reader")
 			return
+		case <-ctx.Done():
+			log.Info("stopping oplog reader")
+			return
 		default:
 		}
 
-		if r.state == StatePaused {
+		if r.p.State.Current() == state.StatePaused {
 			time.Sleep(CursorWaitTime)
 			log.Debug("incremental replication is paused, sleeping for ", CursorWaitTime.Seconds(), " secs")
 			continue
 		}
 
+		// The namespaces change one after the other, an addition once
+		// its snapshots are done
+		if !r.completeNamespaces(ctx) {
+			log.Info("stopping oplog reader")
+			return
+		}
+		for r.adding == nil && !r.changes.IsEmpty() {
+			r.changeNamespaces(ctx, *r.changes.Dequeue())
+		}
+
 		if !r.snapshots.IsEmpty() {
 			// Execute the snapshot for the collection
 			// Currenctly this is synchronous to the reader.
 			// Shall we have a dedicated go routine to handle this
 			// And have this thread to be waiting for it ?
 			// Should we store some state (the snapshot queue) in the database ?
-			requested := r.snapshots.Dequeue()
-			snapshot := snapshot.NewDeltaReplication(
-				mdb.NewMongoItemReader(mdb.Registry.GetSource(), requested.Database, requested.Collection),
-				mdb.NewMongoItemReader(mdb.Registry.GetTarget(), requested.Database, requested.Collection),
-				mdb.NewMongoWriter(mdb.Registry.GetTarget(), requested.Database, requested.Collection),
-				requested.Database, requested.Collection, false, config.Current.Repl.Full.BatchSize)
-
-			err := snapshot.SynchronizeCollection(ctx)
-			if err != nil {
+			if err := r.runSnapshot(ctx, r.snapshots.Dequeue()); err != nil {
 				log.Error("error during snapshot: ", err)
 			}
 		}
 
+		// The entry read last must still be in the oplog of the source
+		if rolledBack, err := r.checkLatest(ctx); err != nil {
+			log.Error("error checking the last oplog entry read: ", err)
+		} else if rolledBack {
+			log.ErrorWithFields("the source rolled back the entries read, stopping the reader",
+				log.Fields{"ts": r.latest})
+			close(r.rolledBack)
+			select {
+			case <-r.done:
+			case <-ctx.Done():
+			}
+			return
+		}
+
 		// Get the oplog cursor
 		filterOnTs := bson.D{{"ts", bson.D{{"$gt", r.latest}}}}
-		cur, err := mdb.Registry.GetSource().Client.Database(checkpoint.OplogDatabase).Collection(checkpoint.OplogCollection).Find(nil, filterOnTs, r.options)
+		cur, err := r.p.Registry.GetSource().Client.Database(checkpoint.OplogDatabase).Collection(checkpoint.OplogCollection).Find(ctx, filterOnTs, r.options)
 		if err != nil {
 			log.Error("error getting oplog cursor: ", err)
+			r.p.Tracker.Error(status.ErrorOplogRead)
 			time.Sleep(CursorWaitTime)
 			continue
 		}
 
-		for cur.Next(context.Background()) {
+		read := 0
+		for cur.Next(ctx) {
+			read++
+
+			// Stop in the middle of a batch
+			select {
+			case <-r.done:
+				log.Info("stopping oplog reader")
+				cur.Close(context.Background())
+				return
+			default:
+			}
 
 			if err := cur.Err(); err != nil {
 				log.Error("error getting next oplog entry: ", err)
+				r.p.Tracker.Error(status.ErrorOplogRead)
 				// Release the cursor
 				cur.Close(context.Background())
 				// Wait a bit
@@ -173,104 +253,332 @@ func (r *OplogReader) RunReader(ctx context.Context) {
 			err := bson.Unmarshal(bytes, &l)
 			if err != nil {
 				log.Error("error unmarshalling oplog entry: ", err)
+				r.p.Tracker.Error(status.ErrorOplogRead)
 				continue
 			}
 
-			if !r.filter.KeepOperation(l.Operation) {
+			r.recordTerm(l)
+			if !r.completeNamespaces(ctx) || !r.handleEntry(ctx, l) {
+				// Neither queued nor scanned, read again once restarted
+				log.Info("stopping oplog reader")
+				cur.Close(context.Background())
+				return
+			}
+			if r.latest == l.Timestamp {
+				r.term, r.hash = l.Term, l.Hash
+			}
+
+			// The entry has been handled, whether it was kept or not
+			r.scanned.Store(checkpoint.ToInt64(l.Timestamp))
+		}
+
+		// Release the cursor
+		cur.Close(context.Background())
+		r.followSource(ctx, read)
+		time.Sleep(CursorWaitTime)
+	}
+}
+
+// The reader streams once it reached the end of the oplog, and catches
+// up again when more than a batch of entries was waiting for it
+func (r *OplogReader) followSource(ctx context.Context, read int) {
+	var err error
+	if read > int(*r.options.BatchSize) {
+		_, err = r.p.State.TransitionFrom(ctx, state.StateStreaming, state.StateCatchingUp, "behind the source oplog")
+	} else {
+		_, err = r.p.State.TransitionFrom(ctx, state.StateCatchingUp, state.StateStreaming, "reached the end of the source oplog")
+	}
+	if err != nil {
+		log.Error("error saving the replication state: ", err)
+	}
+}
+
+// Change the replication state, logging the invalid transitions
+func (r *OplogReader) setState(ctx context.Context, to int, reason string) error {
+	err := r.p.State.Transition(ctx, to, reason)
+	if err != nil {
+		log.Warn("replication state unchanged: ", err)
+	}
+	return err
+}
+
+// Snapshot a collection requested by the API or after a rollback.
+// The job of the request may be canceled meanwhile.
+func (r *OplogReader) runSnapshot(ctx context.Context, requested api.SnapshotRequest) error {
+
+	ns := requested.Database + "." + requested.Collection
+	if !r.filter.KeepCollection(requested.Database, requested.Collection) {
+		log.Warn("skipping snapshot of a filtered namespace: ", ns)
+		err := fmt.Errorf("the namespace %s is not replicated", ns)
+		r.p.Jobs.Finish(requested.JobId, "", err)
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if !r.p.Jobs.Start(requested.JobId, cancel) {
+		log.Info("skipping canceled snapshot of ", ns)
+		return nil
+	}
+
+	r.setState(ctx, state.StateResyncing, "snapshot of "+ns)
+	snapshot := snapshot.NewMappedDeltaReplication(r.p, requested.Database, requested.Collection, false)
+	err := snapshot.SynchronizeCollection(ctx)
+	r.p.Jobs.Finish(requested.JobId, "snapshot of "+ns+" done", err)
+
+	// Unless paused meanwhile
+	if _, err := r.p.State.TransitionFrom(context.WithoutCancel(ctx), state.StateResyncing, state.StateCatchingUp,
+		"snapshot of "+ns+" done"); err != nil {
+		log.Error("error saving the replication state: ", err)
+	}
+	return err
+}
+
+// Check the entry at the position of the reader is still in the oplog
+// of the source, with the same term and hash
+func (r *OplogReader) checkLatest(ctx context.Context) (bool, error) {
+	if r.term == nil && r.hash == nil {
+		return false, nil
+	}
+	entry, err := findOplogEntry(ctx, r.p.Registry.GetSource(), r.latest)
+	if err != nil {
+		return false, err
+	}
+	return entry == nil || !sameEntry(entry, r.term, r.hash), nil
+}
+
+// Record the changes of term with the checkpoint
+func (r *OplogReader) recordTerm(l oplog.ParsedLog) {
+	if r.store == nil || l.Term == nil || (r.readTerm != nil && *r.readTerm == *l.Term) {
+		return
+	}
+	r.readTerm = l.Term
+	r.store.RecordTerm(l.Timestamp, *l.Term)
+}
+
+// Handle the commands of the API until the reader is stopped
+func (r *OplogReader) handleCommands(ctx context.Context, stopped <-chan struct{}) {
+	for {
+		var cmd commands.Command
+		select {
+		case <-stopped:
+			return
+		case <-ctx.Done():
+			return
+		case cmd = <-r.cmdc:
+		}
+
+		switch cmd.Id {
+		case commands.CmdIdPauseIncr:
+			err := r.setState(ctx, state.StatePaused, "paused by the API")
+			if err == nil {
+				r.saveCheckpoint(ctx)
+				log.Info("incremental replication paused")
+			}
+			r.p.Jobs.Finish(cmd.JobId, "paused", err)
+		case commands.CmdIdResumeIncr:
+			err := r.setState(ctx, state.StateCatchingUp, "resumed by the API")
+			if err == nil {
+				r.saveCheckpoint(ctx)
+				log.Info("incremental replication resumed")
+			}
+			r.p.Jobs.Finish(cmd.JobId, "resumed", err)
+		case commands.CmdIdSnapshot:
+
+			// Extract the collection to snapshot
+			if len(cmd.Arguments) <= 1 {
+				log.Warn("invalid argument for snapshot")
+				r.p.Jobs.Finish(cmd.JobId, "", fmt.Errorf("invalid argument for snapshot"))
 				continue
 			}
 
-			// Filter out unwanted operations
-			var db, coll string
-			if l.Operation == oplog.CommandOp {
-
-				// Namespace is not what you think it is for "c" operations
-				// It would be "admin.$cmd", the real collection is store in
-				// the "ns" field for sub-entries of the command
-				db, coll = oplog.GetDbAndCollection(l.Namespace)
-
-				// Filter out unwanted commands
-				command, found := mdb.ExtraCommandName(l.Object)
-				if found && filters.KeepOperation(command) {
-
-					cmd := l.Object
-					computedCmd := primitive.D{}
-					computedCmdSize := 0
-
-					// A command is a map of sub-commands
-					for _, ele := range cmd {
-						switch ele.Key {
-
-						// ApplyOps is a special command that contains a list of sub-commands
-						// We should filter out the unwanted sub-commands on the operation and namespace
-						case ApplyOps:
-							computedCmd, computedCmdSize = SanitizeApplyOps(ele, KeepSubOp, computedCmd, computedCmdSize)
-						case "startIndexBuild":
-						case "indexBuildUUID":
-						case "index":
-						case "indexes":
-							continue
-						case "commitIndexBuild":
-						case "dropIndexes":
-							computedCmd = cmd
-						default:
-							log.Info("unknown command: ", ele.Key)
-							jsonCmd, _ := json.Marshal(l)
-							log.Info("command: " + string(jsonCmd))
-						}
-					}
-
-					if computedCmdSize > 0 {
-						// Replace the command with the filtered one
-						l.Object = computedCmd
-						r.queue <- &oplog.ChangeLog{
-							ParsedLog:  l,
-							Db:         db,
-							Collection: coll,
-						}
-
-						// Only increment the counter if we have sanitized sub-commands
-						// TODO: Should we increment by the number of sub-commands?
-						metrics.IncrSyncOplogReadCounter.WithLabelValues(db, coll, l.Operation).Inc()
-					}
-
-					// Always update the checkpoint to advance in the oplog
-					r.latest = l.Timestamp
-
-				} else {
-					// We are not interested in this command
-					// Yet we still need to update the checkpoint
-					// TODO: Check if we need to update the checkpoint
-					log.Debug("unwanted command: ", command)
-					continue
-				}
+			database := cmd.Arguments[0]
+			collection := cmd.Arguments[1]
+
+			// Run by the reader loop, the job stays queued until then
+			r.snapshots.Enqueue(api.SnapshotRequest{
+				Database:   database,
+				Collection: collection,
+				JobId:      cmd.JobId,
+			})
+			log.Info("snapshot request received for ", collection)
+
+		case commands.CmdIdAddNamespaces, commands.CmdIdRemoveNamespaces:
+			// Run by the reader loop, between two batches of the oplog
+			r.changes.Enqueue(&cmd)
+			log.Info("namespaces change received for ", strings.Join(cmd.Arguments, ", "))
+
+		case commands.CmdIdDelayApply, commands.CmdIdDelaySkip:
+			err := r.handleDelayCommand(cmd)
+			if err != nil {
+				log.Warn(err)
+			}
+			r.p.Jobs.Finish(cmd.JobId, "released until "+strings.Join(cmd.Arguments, ""), err)
+
+		case commands.CmdIdTerminate:
+			// Stops every pipeline, like a SIGTERM
+			log.Info("terminate command received")
+			r.p.Jobs.Finish(cmd.JobId, "terminating", nil)
+			if r.p.Terminate != nil {
+				r.p.Terminate()
+			}
+
+		default:
+			r.p.Jobs.Finish(cmd.JobId, "", fmt.Errorf("unknown command %d", cmd.Id))
+		}
+	}
+}
 
-			} else {
-				// Get the database and collection
-				db, coll = oplog.GetDbAndCollection(l.Namespace)
+// Release or skip the entries held by the delayed replica mode
+func (r *OplogReader) handleDelayCommand(cmd commands.Command) error {
+
+	if r.delayed == nil {
+		return fmt.Errorf("delayed replica mode is not enabled")
+	}
+
+	if len(cmd.Arguments) < 1 {
+		return fmt.Errorf("invalid argument for delayed entries command")
+	}
 
-				// Check if we should replicate the command
-				if !r.filter.KeepCollection(db, coll) {
+	until, err := checkpoint.ParseTimestamp(cmd.Arguments[0])
+	if err != nil {
+		return fmt.Errorf("invalid timestamp for delayed entries command: %v", err)
+	}
+
+	if cmd.Id == commands.CmdIdDelayApply {
+		r.delayed.ApplyUntil(until)
+	} else {
+		r.delayed.SkipUntil(until)
+	}
+	return nil
+}
+
+// Filter an oplog entry and queue it for the writer if it should be replicated.
+// Returns false when the reader is stopped before the entry is queued.
+func (r *OplogReader) handleEntry(ctx context.Context, l oplog.ParsedLog) bool {
+
+	if !r.filter.KeepOperation(l.Operation) {
+		return true
+	}
+
+	// Skip the writes of the replication in the other direction
+	if r.marker != nil && r.marker.IsTagged(&l) {
+		r.p.Metrics.IncrSyncLoopSkippedCounter.Inc()
+		return true
+	}
+
+	// Filter out unwanted operations
+	var db, coll string
+	if l.Operation == oplog.CommandOp {
+
+		// Namespace is not what you think it is for "c" operations
+		// It would be "admin.$cmd", the real collection is store in
+		// the "ns" field for sub-entries of the command
+		db, coll = oplog.GetDbAndCollection(l.Namespace)
+
+		// Filter out unwanted commands
+		command, found := mdb.ExtraCommandName(l.Object)
+		if found && filters.KeepOperation(command) {
+
+			// The DDL commands are subject to the policy of their collection,
+			// the sub-operations of applyOps to the policy of their own namespace
+			if command != ApplyOps {
+				if targetDb, target, ok := CommandNamespace(db, l.Object); ok && !allowedByPolicy(r.p, targetDb, target, l.Operation) {
+					return true
+				}
+			}
+
+			cmd := l.Object
+			computedCmd := primitive.D{}
+			computedCmdSize := 0
+
+			// A command is a map of sub-commands
+			for _, ele := range cmd {
+				switch ele.Key {
+
+				// ApplyOps is a special command that contains a list of sub-commands
+				// We should filter out the unwanted sub-commands on the operation and namespace
+				case ApplyOps:
+					r.holdBackApplyOps(l, ele, db, coll)
+					computedCmd, computedCmdSize = SanitizeApplyOps(ele, KeepSubOp(r.p), computedCmd, computedCmdSize)
+				case "startIndexBuild":
+				case "indexBuildUUID":
+				case "index":
+				case "indexes":
 					continue
+				case "commitIndexBuild":
+				case "dropIndexes":
+					computedCmd = cmd
+				default:
+					log.Info("unknown command: ", ele.Key)
+					jsonCmd, _ := json.Marshal(l)
+					log.Info("command: " + string(jsonCmd))
 				}
+			}
 
-				// Process the oplog entry
-				r.queue <- &oplog.ChangeLog{
+			if computedCmdSize > 0 {
+				// Replace the command with the filtered one
+				l.Object = computedCmd
+				if !r.enqueue(ctx, &oplog.ChangeLog{
 					ParsedLog:  l,
 					Db:         db,
 					Collection: coll,
+				}) {
+					return false
 				}
-				r.latest = l.Timestamp
-				metrics.IncrSyncOplogReadCounter.WithLabelValues(db, coll, l.Operation).Inc()
+
+				// Only increment the counter if we have sanitized sub-commands
+				// TODO: Should we increment by the number of sub-commands?
+				r.p.Metrics.IncrSyncOplogReadCounter.WithLabelValues(db, coll, l.Operation).Inc()
 			}
+
+			// Always update the checkpoint to advance in the oplog
+			r.latest = l.Timestamp
+
+		} else {
+			// We are not interested in this command
+			// Yet we still need to update the checkpoint
+			// TODO: Check if we need to update the checkpoint
+			log.Debug("unwanted command: ", command)
+			return true
 		}
 
-		// Release the cursor
-		cur.Close(context.Background())
-		time.Sleep(CursorWaitTime)
+	} else {
+		// Get the database and collection
+		db, coll = oplog.GetDbAndCollection(l.Namespace)
+
+		// Check if we should replicate the command,
+		// or hold it back while its namespace is added
+		if !r.filter.KeepCollection(db, coll) {
+			r.holdBack(l, db, coll)
+			return true
+		}
+
+		// Check the operation policy of the namespace
+		if !allowedByPolicy(r.p, db, coll, l.Operation) {
+			return true
+		}
+
+		// Process the oplog entry
+		if !r.enqueue(ctx, &oplog.ChangeLog{
+			ParsedLog:  l,
+			Db:         db,
+			Collection: coll,
+		}) {
+			return false
+		}
+		r.latest = l.Timestamp
+		r.p.Metrics.IncrSyncOplogReadCounter.WithLabelValues(db, coll, l.Operation).Inc()
 	}
+	return true
 }
 
-func (o *OplogReader) StopReader() {
-	o.done <- true
+// Stop the reader, unless it already exited or the context is done first
+func (o *OplogReader) StopReader(ctx context.Context) {
+	select {
+	case o.done <- true:
+	case <-o.stopped:
+	case <-ctx.Done():
+		log.Warn("the oplog reader did not stop in time")
+	}
 }
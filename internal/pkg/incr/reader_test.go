@@ -0,0 +1,76 @@
+package incr
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestReaderStopsWhileQueueFull(t *testing.T) {
+
+	p := newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{"db1": true},
+	})
+
+	// The writer is gone, nothing empties the queue
+	queue := make(chan *oplog.ChangeLog)
+	r := NewOplogReader(p, nil, primitive.Timestamp{}, queue)
+
+	insert := oplog.ParsedLog{
+		Timestamp: primitive.Timestamp{T: 1, I: 1},
+		Operation: oplog.InsertOp,
+		Namespace: "db1.coll1",
+		Object:    bson.D{{Key: "_id", Value: 1}},
+	}
+	queued := make(chan bool)
+	go func() {
+		queued <- r.handleEntry(context.Background(), insert)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	r.StopReader(ctx)
+	if ctx.Err() != nil {
+		t.Fatalf("StopReader() timed out")
+	}
+	if <-queued {
+		t.Errorf("handleEntry() = true; want false once stopped")
+	}
+	if ts := r.LastReadTimestamp(); !ts.IsZero() {
+		t.Errorf("LastReadTimestamp() = %v; want unchanged", ts)
+	}
+
+	// Nothing reads the stop request anymore
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	r.StopReader(ctx)
+}
+
+func TestStopReaderExited(t *testing.T) {
+
+	p := newTestPipeline(t, &config.ReplConfig{
+		DatabasesIn: map[string]bool{"db1": true},
+	})
+	r := NewOplogReader(p, nil, primitive.Timestamp{}, make(chan *oplog.ChangeLog))
+
+	// The reader exits on its own, before being stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r.RunReader(ctx)
+
+	stopped := make(chan struct{})
+	go func() {
+		r.StopReader(context.Background())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatalf("StopReader() blocked on the exited reader")
+	}
+}
@@ -0,0 +1,235 @@
+package incr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/api"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/archive"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Entries replicated from the source were rolled back by a failover
+type rollback struct {
+	// The source and the target histories are the same up to this timestamp
+	divergence primitive.Timestamp
+	// Collections resynchronized with the source
+	resync []api.SnapshotRequest
+}
+
+// Check the checkpointed entry is still in the oplog of the source, with the
+// same term. Otherwise, the checkpoint moves back to the point where the
+// histories diverge and the collections written since are resynchronized.
+// Returns nil when there was no rollback.
+func (o *Incr) checkRollback(ctx context.Context, ckpt checkpoint.Checkpoint, window checkpoint.TsWindow) (*rollback, error) {
+
+	// Only the entries read by the replication have a known term
+	if ckpt.Term == nil {
+		return nil, nil
+	}
+
+	source := o.p.Registry.GetSource()
+	entry, err := findOplogEntry(ctx, source, ckpt.LatestTs)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil && sameEntry(entry, ckpt.Term, nil) {
+		return nil, nil
+	}
+
+	o.p.Metrics.IncrSyncRollbackCounter.Inc()
+	log.ErrorWithFields("the source rolled back replicated entries", log.Fields{
+		"ts":   ckpt.LatestTs,
+		"term": *ckpt.Term,
+	})
+
+	// The entries of the rolled back term before the divergence are still in the oplog
+	divergence, found, err := findDivergence(ctx, source, ckpt.LatestTs, *ckpt.Term)
+	if err != nil {
+		return nil, err
+	}
+
+	rb := &rollback{divergence: divergence}
+	if found && o.p.Config.Archive.Enabled {
+		rb.resync, err = archivedNamespaces(o.p.Config.Archive.Dir, divergence, ckpt.LatestTs)
+		if err != nil {
+			log.Warn("error reading the archive, resynchronizing every collection: ", err)
+		}
+	}
+	if rb.resync == nil {
+		rb.resync, err = o.replicatedNamespaces(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Every collection is resynchronized when the divergence is out of the oplog
+	if !found {
+		rb.divergence = window.Newest
+	}
+
+	log.WarnWithFields("resuming from the divergence with the source", log.Fields{
+		"divergence":  checkpoint.ToDate(rb.divergence),
+		"collections": len(rb.resync),
+	})
+
+	// The entries applied again after the resync are tolerated
+	if err := o.ckpt.StartFrom(ctx, rb.divergence, window.Newest); err != nil {
+		return nil, err
+	}
+	return rb, nil
+}
+
+// The oplog entry of the timestamp, nil when it is not in the oplog
+func findOplogEntry(ctx context.Context, source *mdb.MDB, ts primitive.Timestamp) (*oplog.ParsedLog, error) {
+
+	result := source.Client.Database(checkpoint.OplogDatabase).Collection(checkpoint.OplogCollection).
+		FindOne(ctx, bson.M{"ts": ts})
+	entry := &oplog.ParsedLog{}
+	if err := result.Decode(entry); errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Check the entry read again has the term and the hash of the one
+// replicated, when known. The hash identifies the entries of the
+// replica sets of protocol version 0, without term.
+func sameEntry(l *oplog.ParsedLog, term *int64, hash *int64) bool {
+	if term != nil && (l.Term == nil || *l.Term != *term) {
+		return false
+	}
+	if hash != nil && *hash != 0 && (l.Hash == nil || *l.Hash != *hash) {
+		return false
+	}
+	return true
+}
+
+// The last entry of the term up to the timestamp: the histories of the
+// source and the target are the same up to it
+func findDivergence(ctx context.Context, source *mdb.MDB, ts primitive.Timestamp, term int64) (primitive.Timestamp, bool, error) {
+
+	opts := options.FindOne().SetSort(bson.D{{Key: "$natural", Value: -1}})
+	filter := bson.M{"ts": bson.M{"$lte": ts}, "t": term}
+	result := source.Client.Database(checkpoint.OplogDatabase).Collection(checkpoint.OplogCollection).
+		FindOne(ctx, filter, opts)
+
+	entry := oplog.ParsedLog{}
+	if err := result.Decode(&entry); errors.Is(err, mongo.ErrNoDocuments) {
+		return primitive.Timestamp{}, false, nil
+	} else if err != nil {
+		return primitive.Timestamp{}, false, err
+	}
+	return entry.Timestamp, true, nil
+}
+
+// The collections written by the archived entries after `from`, up to `to`.
+// Fails when some of these entries could not be archived.
+func archivedNamespaces(dir string, from primitive.Timestamp, to primitive.Timestamp) ([]api.SnapshotRequest, error) {
+
+	gaps, err := archive.ListGaps(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	if len(gaps) > 0 {
+		return nil, fmt.Errorf("the entries from %v to %v were not archived", gaps[0].First, gaps[0].Last)
+	}
+
+	files, err := archive.ListFiles(dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[api.SnapshotRequest]bool{}
+	namespaces := []api.SnapshotRequest{}
+	add := func(database string, collection string) {
+		ns := api.SnapshotRequest{Database: database, Collection: collection}
+		if collection != "" && !seen[ns] {
+			seen[ns] = true
+			namespaces = append(namespaces, ns)
+		}
+	}
+
+	for _, index := range files {
+		reader, err := archive.NewFileReader(dir, index)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			l, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return nil, err
+			}
+			if checkpoint.CompareTimestamps(l.Timestamp, from) <= 0 || checkpoint.CompareTimestamps(l.Timestamp, to) > 0 {
+				continue
+			}
+			for _, ns := range writtenNamespaces(l) {
+				add(oplog.GetDbAndCollection(ns))
+			}
+		}
+		reader.Close()
+	}
+	return namespaces, nil
+}
+
+// The namespaces written by an entry, the ones of the sub-operations
+// for an applyOps command
+func writtenNamespaces(l *oplog.ChangeLog) []string {
+
+	if l.Operation != oplog.CommandOp {
+		return []string{l.Namespace}
+	}
+	if len(l.Object) == 0 {
+		return nil
+	}
+
+	if l.Object[0].Key == ApplyOps {
+		var namespaces []string
+		subOps, _ := l.Object[0].Value.(bson.A)
+		for _, subOp := range subOps {
+			if doc, ok := subOp.(bson.D); ok {
+				if ns, ok := mdb.GetKey(doc, "ns").(string); ok {
+					namespaces = append(namespaces, ns)
+				}
+			}
+		}
+		return namespaces
+	}
+
+	// Other commands hold the collection as the value of the command name
+	db, _ := oplog.GetDbAndCollection(l.Namespace)
+	db, collection, _ := CommandNamespace(db, l.Object)
+	return []string{db + "." + collection}
+}
+
+// Every collection of the replication
+func (o *Incr) replicatedNamespaces(ctx context.Context) ([]api.SnapshotRequest, error) {
+
+	dbAndCollections, err := mdb.GetReplicatedCollections(ctx, o.p.Registry.GetSource(), o.p.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []api.SnapshotRequest{}
+	for db, collections := range dbAndCollections {
+		for _, collection := range collections {
+			namespaces = append(namespaces, api.SnapshotRequest{Database: db, Collection: collection})
+		}
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,112 @@
+package incr
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/api"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/archive"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSameEntry(t *testing.T) {
+
+	term, other := int64(3), int64(4)
+	hash, otherHash := int64(-42), int64(7)
+	tests := []struct {
+		entry oplog.ParsedLog
+		term  *int64
+		hash  *int64
+		same  bool
+	}{
+		{oplog.ParsedLog{Term: &term}, &term, nil, true},
+		{oplog.ParsedLog{Term: &other}, &term, nil, false},
+		{oplog.ParsedLog{}, &term, nil, false},
+		{oplog.ParsedLog{Term: &term, Hash: &hash}, &term, &hash, true},
+		{oplog.ParsedLog{Term: &term, Hash: &otherHash}, &term, &hash, false},
+		{oplog.ParsedLog{Hash: &otherHash}, nil, &hash, false},
+		{oplog.ParsedLog{Term: &other}, nil, nil, true},
+	}
+	for i, test := range tests {
+		if same := sameEntry(&test.entry, test.term, test.hash); same != test.same {
+			t.Errorf("test %d: sameEntry() = %v; want %v", i, same, test.same)
+		}
+	}
+}
+
+func TestArchivedNamespaces(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := archive.NewArchiver(config.ArchiveConfig{Dir: dir, Format: archive.FormatBson}, "test", nil)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+
+	entry := func(ts uint32, op string, ns string, object bson.D) *oplog.ChangeLog {
+		db, coll := oplog.GetDbAndCollection(ns)
+		return &oplog.ChangeLog{
+			ParsedLog: oplog.ParsedLog{
+				Timestamp: primitive.Timestamp{T: ts},
+				Version:   2,
+				Operation: op,
+				Namespace: ns,
+				Object:    object,
+			},
+			Db:         db,
+			Collection: coll,
+		}
+	}
+	entries := []*oplog.ChangeLog{
+		entry(100, oplog.InsertOp, "shop.before", bson.D{{Key: "_id", Value: 1}}),
+		entry(101, oplog.InsertOp, "shop.orders", bson.D{{Key: "_id", Value: 1}}),
+		entry(102, oplog.UpdateOp, "shop.orders", bson.D{{Key: "_id", Value: 1}}),
+		entry(103, oplog.CommandOp, "admin.$cmd", bson.D{{Key: ApplyOps, Value: bson.A{
+			bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "shop.items"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 1}}}},
+			bson.D{{Key: "op", Value: "d"}, {Key: "ns", Value: "shop.orders"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 2}}}},
+		}}}),
+		entry(104, oplog.CommandOp, "shop.$cmd", bson.D{{Key: "dropIndexes", Value: "users"}}),
+		entry(105, oplog.InsertOp, "shop.after", bson.D{{Key: "_id", Value: 1}}),
+	}
+	for _, l := range entries {
+		if err := a.Archive(l); err != nil {
+			t.Fatalf("Archive() = %v", err)
+		}
+	}
+	a.Close()
+
+	// Only the entries after the divergence, up to the checkpoint
+	namespaces, err := archivedNamespaces(dir, primitive.Timestamp{T: 100}, primitive.Timestamp{T: 104})
+	if err != nil {
+		t.Fatalf("archivedNamespaces() = %v", err)
+	}
+	want := []api.SnapshotRequest{
+		{Database: "shop", Collection: "orders"},
+		{Database: "shop", Collection: "items"},
+		{Database: "shop", Collection: "users"},
+	}
+	if len(namespaces) != len(want) {
+		t.Fatalf("archivedNamespaces() = %v; want %v", namespaces, want)
+	}
+	for i := range want {
+		if namespaces[i] != want[i] {
+			t.Errorf("archivedNamespaces()[%d] = %v; want %v", i, namespaces[i], want[i])
+		}
+	}
+
+	// Every collection is resynchronized when entries were not archived
+	gap, _ := json.Marshal(archive.Gap{First: primitive.Timestamp{T: 102}, Last: primitive.Timestamp{T: 102}})
+	if err := os.WriteFile(filepath.Join(dir, "test-0000000102-0000000000.gap"), gap, 0640); err != nil {
+		t.Fatalf("error writing the gap: %v", err)
+	}
+	if _, err := archivedNamespaces(dir, primitive.Timestamp{T: 100}, primitive.Timestamp{T: 104}); err == nil {
+		t.Errorf("archivedNamespaces() = nil; want an error for the gap")
+	}
+	if _, err := archivedNamespaces(dir, primitive.Timestamp{T: 103}, primitive.Timestamp{T: 105}); err != nil {
+		t.Errorf("archivedNamespaces() = %v; want the gap ignored", err)
+	}
+}
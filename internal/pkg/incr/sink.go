@@ -0,0 +1,39 @@
+package incr
+
+import (
+	"context"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/sink"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+)
+
+// Write the change events of the entry to the sink. The entries filtered out
+// are written without event, so that the sink acknowledges them in order and
+// the checkpoint moves forward. The entries in error are not written: the
+// checkpoint stays before them.
+func (w *OplogWriterSingle) writeToSink(ctx context.Context, l *oplog.ChangeLog, filtered documentFilter,
+	rules *transform.Rules, opErr error) error {
+
+	var events []*sink.ChangeEvent
+	switch {
+	case opErr != nil:
+		return opErr
+	case filtered.resync:
+		// The target document is replaced by the source one, or deleted
+		event := &sink.ChangeEvent{Operation: sink.OpDelete, Db: l.Db, Collection: l.Collection,
+			Id: mdb.GetKey(documentKey(&l.ParsedLog), "_id"), ClusterTime: l.Timestamp}
+		if filtered.current != nil {
+			event.Operation = sink.OpReplace
+			event.Document = rules.TransformDocument(filtered.current)
+		}
+		events = []*sink.ChangeEvent{event}
+	case filtered.apply:
+		var err error
+		if events, err = sink.NewChangeEvents(l, rules); err != nil {
+			return err
+		}
+	}
+	return w.sink.Write(ctx, l.Timestamp, events)
+}
@@ -1,8 +0,0 @@
-package incr
-
-const (
-	StateUnknown  = iota
-	StateRunning  = 1
-	StatePaused   = 2
-	StateSnapshot = 3
-)
@@ -12,15 +12,22 @@ package incr
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/sink"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -37,24 +44,86 @@ const (
 	MatchedCountError = "matched count error"
 )
 
+const (
+	// Delay before retrying a write not acknowledged, doubled up to the maximum
+	RetryBackoff    = 100 * time.Millisecond
+	MaxRetryBackoff = 10 * time.Second
+)
+
+// HostUnreachable, HostNotFound, NetworkTimeout, ShutdownInProgress, WriteConcernFailed,
+// PrimarySteppedDown, NotWritablePrimary, InterruptedDueToReplStateChange,
+// NotPrimaryNoSecondaryOk, NotPrimaryOrSecondary, InterruptedAtShutdown
+var transientErrorCodes = []int{6, 7, 89, 91, 64, 189, 10107, 11602, 13435, 13436, 11600}
+
 type Writer interface {
 	StartWriter(context.Context)
 	StopWriter(context.Context)
 }
 
 type OplogWriterSingle struct {
+	p            *pipeline.Pipeline
 	queuedLogs   chan *oplog.ChangeLog
 	fullFinishTs int64
 	done         chan bool
 	ckptManager  checkpoint.CheckpointManager
+
+	// Set for the additional targets, the pipeline target is used otherwise
+	name   string
+	target *mdb.MDB
+	filter *filters.NamespaceFilter
+
+	// Set when the changes are written to a sink instead of a MongoDB target
+	sink sink.Sink
+
+	// Active-active replication: the marker of the writes and the conflict rule
+	marker   *loopMarker
+	conflict *conflictRule
+
+	// Entries up to this timestamp are already applied
+	skipUntil int64
+
+	// Timestamp of the last entry applied, shared with other go routines
+	applied atomic.Int64
+
+	// Reports the entry rejected by the target, which stops the writer
+	failed chan<- error
 }
 
-func NewOplogWriter(ckptManager checkpoint.CheckpointManager, fullFinishTs int64, queue chan *oplog.ChangeLog) *OplogWriterSingle {
+func NewOplogWriter(p *pipeline.Pipeline, ckptManager checkpoint.CheckpointManager, fullFinishTs int64, queue chan *oplog.ChangeLog) *OplogWriterSingle {
 	return &OplogWriterSingle{
+		p:            p,
 		queuedLogs:   queue,
 		fullFinishTs: fullFinishTs,
 		done:         make(chan bool),
 		ckptManager:  ckptManager,
+		marker:       newLoopMarker(p),
+		conflict:     newConflictRule(p),
+	}
+}
+
+// The client of the target database
+func (w *OplogWriterSingle) targetClient() *mongo.Client {
+	if w.target != nil {
+		return w.target.Client
+	}
+	return w.p.Registry.GetTarget().Client
+}
+
+// The collection of the target, with the write concern of the replication
+func (w *OplogWriterSingle) collection(db string, collection string) *mongo.Collection {
+	return w.targetClient().Database(db, options.Database().SetWriteConcern(w.p.WriteConcern)).Collection(collection)
+}
+
+// Timestamp of the last oplog entry applied on the target
+func (w *OplogWriterSingle) AppliedTimestamp() primitive.Timestamp {
+	return checkpoint.FromInt64(w.applied.Load())
+}
+
+// The entries held back by a change of the namespaces are applied after
+// newer ones, the position never moves back
+func (w *OplogWriterSingle) setApplied(ts primitive.Timestamp) {
+	if applied := checkpoint.ToInt64(ts); applied > w.applied.Load() {
+		w.applied.Store(applied)
 	}
 }
 
@@ -71,21 +140,64 @@ func (w *OplogWriterSingle) StartWriter(ctx context.Context) {
 func (w *OplogWriterSingle) RunWriter(ctx context.Context) {
 
 	log.Info("starting oplog writer")
-	for l := range w.queuedLogs {
-
-		// Check if we should stop processing
+	for {
+		var l *oplog.ChangeLog
+		var ok bool
 		select {
+		case <-ctx.Done():
+			log.Info("oplog writer stopped")
+			return
 		case <-w.done:
 			log.Info("Stopping oplog writer")
 			return
-		default:
+		case l, ok = <-w.queuedLogs:
+		}
+		if !ok {
+			break
+		}
+
+		// Already applied to this target, the reader resumes from the oldest checkpoint
+		if checkpoint.ToInt64(l.Timestamp) <= w.skipUntil {
+			continue
+		}
+
+		// Namespaces not replicated to this target only move its checkpoint
+		if w.filter != nil && !w.keep(l) {
+			w.ckptManager.MoveCheckpointForward(l.Timestamp)
+			w.setApplied(l.Timestamp)
+			continue
 		}
 
 		if l.Version != 2 {
 			log.Warn(OplogVersionError, log.Fields{"version": l.Version})
+			if w.sink != nil {
+				w.writeToSink(ctx, l, documentFilter{}, nil, nil)
+			} else {
+				w.setApplied(l.Timestamp)
+			}
 			continue
 		}
 
+		// Replicate only the documents matching the predicate of the source namespace.
+		// The source is read again on a transient error.
+		var filtered documentFilter
+		filterErr := w.retry(ctx, l, func() (err error) {
+			filtered, err = w.filterDocument(ctx, l)
+			return err
+		})
+
+		// Apply the field level rules of the source namespace
+		rules := w.p.Transform.Rules(l.Db, l.Collection)
+		if l.Operation == oplog.InsertOp {
+			l.Object = rules.TransformDocument(l.Object)
+		}
+		if l.Operation == oplog.CommandOp && filtered.apply {
+			filtered.apply = w.p.Transform.TransformApplyOps(l)
+		}
+
+		// Rename the namespaces for the target
+		w.p.Mapping.MapChangeLog(l)
+
 		// Try to get the object id
 		var id interface{}
 		if l.Operation != "c" {
@@ -99,49 +211,182 @@ func (w *OplogWriterSingle) RunWriter(ctx context.Context) {
 			// debugLog(id, &l.ParsedLog)
 		}
 
-		// Handle the operation
-		var opErr error = nil
-		switch l.Operation {
-		case "i":
-			opErr = w.Insert(l)
-		case "u":
-			opErr = w.Update(l, true)
-		case "d":
-			opErr = w.Delete(l)
-		case "c":
-			opErr = w.Command(l)
+		// Handle the operation, retried until the target acknowledges it
+		var opErr error
+		if w.sink != nil {
+			opErr = w.writeToSink(ctx, l, filtered, rules, filterErr)
+		} else {
+			opErr = w.retry(ctx, l, func() error {
+				return w.apply(ctx, l, filtered, rules, filterErr)
+			})
 		}
 
-		// Check for errors
+		// Stopped before the target acknowledged the entry:
+		// the checkpoint stays before it
+		if ctx.Err() != nil {
+			log.WarnWithFields("oplog writer stopped before the entry was acknowledged",
+				log.Fields{"ts": l.Timestamp, "err": opErr})
+			return
+		}
+
+		// The entries rejected by the target stop the writer. The checkpoint
+		// stays before them, they are applied again once restarted.
 		if opErr != nil {
 			log.ErrorWithFields(OperationError, log.Fields{
 				"err": opErr,
 				"op":  l.Operation,
 				"id":  id,
+				"ts":  l.Timestamp,
 			})
+			w.p.Tracker.Error(status.ErrorOplogWrite)
+			w.fail(fmt.Errorf("entry %v of %s rejected by the target: %w", l.Timestamp, l.Namespace, opErr))
+			return
+		}
+
+		if w.name != "" {
+			w.p.Metrics.TargetWriteCounter.WithLabelValues(w.name, l.Db, l.Collection, l.Operation).Inc()
+		} else {
+			w.p.Metrics.IncrSyncOplogWriteCounter.WithLabelValues(l.Db, l.Collection, l.Operation).Inc()
+		}
+
+		// Save the checkpoint, the sink does it once the entry is acknowledged
+		if w.sink == nil {
+			w.acknowledge(l.Timestamp)
+		}
+	}
+
+	// The queue is only closed once nothing more is to be applied
+	log.Info("oplog writer stopped, queue closed")
+
+}
+
+// Report the writer stopped on an error, once
+// Report the entry rejected by the target on the channel
+func (w *OplogWriterSingle) ReportFailures(failed chan<- error) {
+	w.failed = failed
+}
+
+func (w *OplogWriterSingle) fail(err error) {
+	select {
+	case w.failed <- err:
+	default:
+	}
+}
+
+// Apply the operation of the entry to the target
+func (w *OplogWriterSingle) apply(ctx context.Context, l *oplog.ChangeLog, filtered documentFilter,
+	rules *transform.Rules, filterErr error) error {
+
+	switch {
+	case filterErr != nil:
+		return filterErr
+	case filtered.resync:
+		return w.tagged(ctx, l, func(ctx context.Context) error {
+			return w.Resync(ctx, l, filtered.current, rules)
+		})
+	case !filtered.apply:
+		log.DebugWithFields("entry filtered out", log.Fields{"ns": l.Namespace, "op": l.Operation})
+	case l.Operation == "i":
+		return w.tagged(ctx, l, func(ctx context.Context) error {
+			return w.Insert(ctx, l)
+		})
+	case l.Operation == "u":
+		return w.tagged(ctx, l, func(ctx context.Context) error {
+			return w.Update(ctx, l, rules, true)
+		})
+	case l.Operation == "d":
+		return w.tagged(ctx, l, func(ctx context.Context) error {
+			return w.Delete(ctx, l)
+		})
+	case l.Operation == "c":
+		return w.Command(ctx, l)
+	}
+	return nil
+}
+
+// Run the write until the target acknowledges it or the context is done.
+// The writes failing on a transient error (network, election, write concern
+// not satisfied) are retried with an exponential backoff.
+func (w *OplogWriterSingle) retry(ctx context.Context, l *oplog.ChangeLog, write func() error) error {
+
+	backoff := RetryBackoff
+	for attempt := 1; ; attempt++ {
+
+		err := write()
+		if err == nil || !IsTransientError(err) {
+			return err
 		}
 
-		metrics.IncrSyncOplogWriteCounter.WithLabelValues(l.Db, l.Collection, l.Operation).Inc()
-		metrics.CheckpointGauge.Set(float64(l.ParsedLog.Timestamp.T))
+		log.WarnWithFields("write not acknowledged by the target, retrying", log.Fields{
+			"ts":      l.Timestamp,
+			"ns":      l.Namespace,
+			"op":      l.Operation,
+			"err":     err,
+			"attempt": attempt,
+			"backoff": backoff,
+		})
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, MaxRetryBackoff)
+	}
+}
+
+// The errors after which the write is not acknowledged, and may succeed when retried
+func IsTransientError(err error) bool {
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) || errors.Is(err, mongo.ErrClientDisconnected) {
+		return true
+	}
 
-		// Save the checkpoint
-		w.ckptManager.MoveCheckpointForward(l.Timestamp)
+	// The write concern was not satisfied, e.g. no majority available
+	var we mongo.WriteException
+	if errors.As(err, &we) && we.WriteConcernError != nil {
+		return true
 	}
 
-	// We should not reach this point
-	log.Error("oplog writer stopped unexpectedly")
+	var se mongo.ServerError
+	if !errors.As(err, &se) {
+		return false
+	}
+	if se.HasErrorLabel("RetryableWriteError") || se.HasErrorLabel("TransientTransactionError") ||
+		se.HasErrorLabel("UnknownTransactionCommitResult") {
+		return true
+	}
+	// https://github.com/mongodb/mongo/blob/master/src/mongo/base/error_codes.yml
+	for _, code := range transientErrorCodes {
+		if se.HasErrorCode(code) {
+			return true
+		}
+	}
+	return false
+}
 
+// Move the checkpoint forward once the entry is written
+func (w *OplogWriterSingle) acknowledge(ts primitive.Timestamp) {
+	if w.name == "" {
+		w.p.Metrics.CheckpointGauge.Set(float64(ts.T))
+	}
+	w.ckptManager.MoveCheckpointForward(ts)
+	w.setApplied(ts)
 }
 
-func (w *OplogWriterSingle) Insert(l *oplog.ChangeLog) error {
+func (w *OplogWriterSingle) Insert(ctx context.Context, l *oplog.ChangeLog) error {
+
+	// The duplicate key errors would abort the transaction of the marker
+	if w.marker != nil || w.conflict != nil {
+		return w.upsertDocument(ctx, l)
+	}
 
 	// DB Connection
-	collectionHandle := mdb.Registry.GetTarget().Client.Database(l.Db).Collection(l.Collection)
+	collectionHandle := w.collection(l.Db, l.Collection)
 
 	// Insert the document
-	if _, err := collectionHandle.InsertOne(context.Background(), l.ParsedLog.Object); err != nil {
+	if _, err := collectionHandle.InsertOne(ctx, l.ParsedLog.Object); err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			err = w.Upsert(l, true)
+			err = w.Upsert(ctx, l, true)
 			return err
 		} else {
 			log.ErrorWithFields(InsertError, log.Fields{"err": err})
@@ -153,10 +398,10 @@ func (w *OplogWriterSingle) Insert(l *oplog.ChangeLog) error {
 }
 
 // Upsert the document
-func (w *OplogWriterSingle) Upsert(l *oplog.ChangeLog, upsert bool) error {
+func (w *OplogWriterSingle) Upsert(ctx context.Context, l *oplog.ChangeLog, upsert bool) error {
 
 	// DB Connection
-	collectionHandle := mdb.Registry.GetTarget().Client.Database(l.Db).Collection(l.Collection)
+	collectionHandle := w.collection(l.Db, l.Collection)
 
 	var id interface{}
 	var update interface{} = bson.D{{"$set", l.ParsedLog.Object}}
@@ -179,7 +424,7 @@ func (w *OplogWriterSingle) Upsert(l *oplog.ChangeLog, upsert bool) error {
 	}
 
 	// Update the document
-	res, err := collectionHandle.UpdateOne(context.Background(), id, update, updateOpts)
+	res, err := collectionHandle.UpdateOne(ctx, id, update, updateOpts)
 	if err != nil {
 
 		log.WarnWithFields(UpsertError, log.Fields{
@@ -214,26 +459,36 @@ func (w *OplogWriterSingle) Upsert(l *oplog.ChangeLog, upsert bool) error {
 }
 
 // Update the document
-func (w *OplogWriterSingle) Update(l *oplog.ChangeLog, upsert bool) error {
+func (w *OplogWriterSingle) Update(ctx context.Context, l *oplog.ChangeLog, rules *transform.Rules, upsert bool) error {
 
 	// DB Connection
-	collectionHandle := mdb.Registry.GetTarget().Client.Database(l.Db).Collection(l.Collection)
+	collectionHandle := w.collection(l.Db, l.Collection)
 
 	var err error
 	var res *mongo.UpdateResult
 
-	// Below we check if the object has a version mark which is identified by "$v"
-	if mdb.FindFiledPrefix(l.Object, "$v") {
+	// Below we check if the object has a version mark which is identified by "$v".
+	// The archived updates of the transformed namespaces are already operators.
+	diff := mdb.FindFiledPrefix(l.Object, "$v")
+	if diff || mdb.FindFiledPrefix(l.Object, "$set") || mdb.FindFiledPrefix(l.Object, "$unset") {
 
 		// To keep track of the update
-		var update interface{}
+		var update interface{} = l.Object
 		var oplogErr error
-		if update, oplogErr = mdb.DiffUpdateOplogToNormal(l.Object); oplogErr != nil {
-			log.ErrorWithFields("Update failed", log.Fields{
-				"err":     oplogErr,
-				"org_doc": l.Object,
-			})
-			return oplogErr
+		if diff {
+			if update, oplogErr = mdb.DiffUpdateOplogToNormal(l.Object); oplogErr != nil {
+				log.ErrorWithFields("Update failed", log.Fields{
+					"err":     oplogErr,
+					"org_doc": l.Object,
+				})
+				return oplogErr
+			}
+		}
+
+		// The redacted fields must not leak through the updates
+		if update = rules.TransformUpdate(update); update == nil {
+			log.DebugWithFields("update skipped, only redacted fields", log.Fields{"ns": l.Namespace})
+			return nil
 		}
 
 		updateOpts := options.Update()
@@ -241,12 +496,20 @@ func (w *OplogWriterSingle) Update(l *oplog.ChangeLog, upsert bool) error {
 			updateOpts.SetUpsert(true)
 		}
 
+		key := l.ParsedLog.Query
 		if upsert && len(l.DocumentKey) > 0 {
-			res, err = collectionHandle.UpdateOne(context.Background(), l.ParsedLog.DocumentKey, update, updateOpts)
-		} else {
-			res, err = collectionHandle.UpdateOne(context.Background(), l.ParsedLog.Query, update, updateOpts)
+			key = l.ParsedLog.DocumentKey
 		}
 
+		// The target document is left as is when newer
+		if version, ok := w.conflict.updatedVersion(update); ok {
+			if exists, err := w.applyIfNewer(ctx, l, collectionHandle, key, version, update); err != nil || exists {
+				return err
+			}
+		}
+
+		res, err = collectionHandle.UpdateOne(ctx, key, update, updateOpts)
+
 		if err != nil {
 			if IgnoreError(err, "u",
 				checkpoint.ToInt64(l.ParsedLog.Timestamp) <= w.fullFinishTs) {
@@ -282,9 +545,9 @@ func (w *OplogWriterSingle) Update(l *oplog.ChangeLog, upsert bool) error {
 	return nil
 }
 
-func (ow *OplogWriterSingle) Delete(l *oplog.ChangeLog) error {
-	collectionHandle := mdb.Registry.GetTarget().Client.Database(l.Db).Collection(l.Collection)
-	_, err := collectionHandle.DeleteOne(context.Background(), l.ParsedLog.Object)
+func (ow *OplogWriterSingle) Delete(ctx context.Context, l *oplog.ChangeLog) error {
+	collectionHandle := ow.collection(l.Db, l.Collection)
+	_, err := collectionHandle.DeleteOne(ctx, l.ParsedLog.Object)
 	if err != nil {
 		log.ErrorWithFields(DeleteError, log.Fields{"err": err})
 		return err
@@ -292,13 +555,18 @@ func (ow *OplogWriterSingle) Delete(l *oplog.ChangeLog) error {
 	return nil
 }
 
-func (w *OplogWriterSingle) Command(l *oplog.ChangeLog) error {
+func (w *OplogWriterSingle) Command(ctx context.Context, l *oplog.ChangeLog) error {
 
 	// Extract the sub-command
 	if command, found := mdb.ExtraCommandName(l.ParsedLog.Object); found && filters.KeepOperation(command) {
 
+		// The DDL cannot be tagged, they are idempotent
+		if command == ApplyOps && w.marker != nil {
+			w.marker.tagApplyOps(l)
+		}
+
 		var err error
-		if err = RunCommand(l.Db, command, l, mdb.Registry.GetTarget().Client); err == nil {
+		if err = RunCommand(ctx, l.Db, command, l, w.targetClient(), w.p.WriteConcern); err == nil {
 			//log.InfoWithFields("execute cmd operation", log.Fields{"op": "c", "command": command})
 		} else if err.Error() == "ns not found" {
 			log.InfoWithFields("execute cmd operation, ignore error", log.Fields{"op": "c", "command": command})
@@ -0,0 +1,174 @@
+package incr
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/sink"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func TestIsTransientError(t *testing.T) {
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"network", mongo.CommandError{Labels: []string{"NetworkError"}}, true},
+		{"retryable", mongo.CommandError{Code: 10107, Labels: []string{"RetryableWriteError"}}, true},
+		{"stepped down", mongo.CommandError{Code: 189}, true},
+		{"timeout", context.DeadlineExceeded, true},
+		{"write concern", mongo.WriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}}, true},
+		{"duplicate key", mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000}}}, false},
+		{"validation", mongo.CommandError{Code: 121}, false},
+		{"other", errors.New("update fail"), false},
+	}
+	for _, tt := range tests {
+		if got := IsTransientError(tt.err); got != tt.want {
+			t.Errorf("IsTransientError(%s) = %v; want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRetryUntilAcknowledged(t *testing.T) {
+
+	w := &OplogWriterSingle{}
+	l := &oplog.ChangeLog{}
+
+	// Retried on the transient errors only
+	attempts := 0
+	err := w.retry(context.Background(), l, func() error {
+		attempts++
+		if attempts < 3 {
+			return mongo.CommandError{Code: 91}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Errorf("retry() = %v after %d attempts; want nil after 3", err, attempts)
+	}
+
+	attempts = 0
+	rejected := errors.New("document failed validation")
+	err = w.retry(context.Background(), l, func() error {
+		attempts++
+		return rejected
+	})
+	if !errors.Is(err, rejected) || attempts != 1 {
+		t.Errorf("retry() = %v after %d attempts; want the rejection after 1", err, attempts)
+	}
+
+	// Never acknowledged: given up once stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	err = w.retry(ctx, l, func() error {
+		cancel()
+		return mongo.CommandError{Labels: []string{"NetworkError"}}
+	})
+	if err == nil || ctx.Err() == nil {
+		t.Errorf("retry() = %v; want the network error once stopped", err)
+	}
+}
+
+// Acknowledges the entries as written, but the rejected one
+type rejectingSink struct {
+	rejected primitive.Timestamp
+	ack      func(ts primitive.Timestamp)
+}
+
+func (s *rejectingSink) Load(context.Context, string, string, []*bson.Raw) error {
+	return nil
+}
+
+func (s *rejectingSink) Write(ctx context.Context, ts primitive.Timestamp, events []*sink.ChangeEvent) error {
+	if ts == s.rejected {
+		return errors.New("document failed validation")
+	}
+	s.ack(ts)
+	return nil
+}
+
+func (s *rejectingSink) OnAcknowledged(ack func(ts primitive.Timestamp)) {
+	s.ack = ack
+}
+
+func (s *rejectingSink) Close(context.Context) error {
+	return nil
+}
+
+func TestWriterStopsOnRejectedEntry(t *testing.T) {
+
+	p := newTestPipeline(t, &config.ReplConfig{DatabasesIn: map[string]bool{"db1": true}})
+	ckpt := checkpoint.NewMemoryCheckpoint("test")
+	queue := make(chan *oplog.ChangeLog, 3)
+	failed := make(chan error, 1)
+
+	w := NewOplogWriter(p, ckpt, 0, queue)
+	w.sink = &rejectingSink{rejected: primitive.Timestamp{T: 2}}
+	w.sink.OnAcknowledged(w.acknowledge)
+	w.failed = failed
+
+	for ts := uint32(1); ts <= 3; ts++ {
+		queue <- &oplog.ChangeLog{
+			ParsedLog: oplog.ParsedLog{
+				Timestamp: primitive.Timestamp{T: ts},
+				Version:   2,
+				Operation: oplog.InsertOp,
+				Namespace: "db1.coll1",
+				Object:    bson.D{{Key: "_id", Value: ts}},
+			},
+			Db:         "db1",
+			Collection: "coll1",
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.RunWriter(ctx)
+
+	select {
+	case err := <-failed:
+		if err == nil {
+			t.Fatalf("failed = nil; want the rejection")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the writer did not stop on the rejected entry")
+	}
+
+	// Neither the rejected entry nor the next ones are checkpointed
+	want := primitive.Timestamp{T: 1}
+	if ts := ckpt.Checkpoint().LatestTs; ts != want {
+		t.Errorf("Checkpoint() = %v; want %v", ts, want)
+	}
+	if ts := w.AppliedTimestamp(); ts != want {
+		t.Errorf("AppliedTimestamp() = %v; want %v", ts, want)
+	}
+	if len(queue) != 1 {
+		t.Errorf("queue = %d entries; want the entry after the rejected one left", len(queue))
+	}
+}
+
+func TestWriteToSinkEntryInError(t *testing.T) {
+
+	p := newTestPipeline(t, &config.ReplConfig{DatabasesIn: map[string]bool{"db1": true}})
+	w := NewOplogWriter(p, checkpoint.NewMemoryCheckpoint("test"), 0, nil)
+	acknowledged := false
+	w.sink = &rejectingSink{}
+	w.sink.OnAcknowledged(func(primitive.Timestamp) { acknowledged = true })
+
+	// The entry in error is not acknowledged, the checkpoint stays before it
+	l := &oplog.ChangeLog{ParsedLog: oplog.ParsedLog{Timestamp: primitive.Timestamp{T: 1}}, Db: "db1", Collection: "coll1"}
+	if err := w.writeToSink(context.Background(), l, documentFilter{apply: true}, nil, errors.New("fetch failed")); err == nil {
+		t.Errorf("writeToSink() = nil; want the error of the entry")
+	}
+	if acknowledged {
+		t.Errorf("the entry in error was written to the sink")
+	}
+}
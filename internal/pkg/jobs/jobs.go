@@ -0,0 +1,200 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	StatusQueued    = "queued"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusCanceled  = "canceled"
+)
+
+const (
+	// Finished jobs kept in memory
+	MaxFinished = 100
+)
+
+var (
+	ErrNotFound      = errors.New("job not found")
+	ErrNotCancelable = errors.New("the job cannot be canceled")
+	ErrFinished      = errors.New("the job is already finished")
+)
+
+// A command sent through the API and its outcome
+type Job struct {
+	Id        string     `json:"id"`
+	Command   string     `json:"command"`
+	Arguments []string   `json:"arguments,omitempty"`
+	Status    string     `json:"status"`
+	CreatedAt time.Time  `json:"created_at"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	Result    string     `json:"result,omitempty"`
+	Error     string     `json:"error,omitempty"`
+
+	cancelable bool
+	canceled   bool
+	cancel     context.CancelFunc
+}
+
+func (j *Job) finished() bool {
+	return j.EndedAt != nil
+}
+
+// The jobs of a pipeline, kept in memory
+type Registry struct {
+	mu    sync.Mutex
+	next  int64
+	jobs  map[string]*Job
+	order []string
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		jobs: make(map[string]*Job),
+	}
+}
+
+// Create a queued job for the command. Only the cancelable jobs
+// can be canceled, before they end.
+func (r *Registry) Create(command string, arguments []string, cancelable bool) Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.next++
+	job := &Job{
+		Id:         strconv.FormatInt(r.next, 10),
+		Command:    command,
+		Arguments:  arguments,
+		Status:     StatusQueued,
+		CreatedAt:  time.Now(),
+		cancelable: cancelable,
+	}
+	r.jobs[job.Id] = job
+	r.order = append(r.order, job.Id)
+	r.evict()
+	return *job
+}
+
+// Mark the job as running, canceled with the function. Returns false
+// when the job was canceled while queued. The empty id is no job.
+func (r *Registry) Start(id string, cancel context.CancelFunc) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return true
+	}
+	if job.finished() {
+		return false
+	}
+	now := time.Now()
+	job.Status = StatusRunning
+	job.StartedAt = &now
+	job.cancel = cancel
+	return true
+}
+
+// Record the outcome of the job
+func (r *Registry) Finish(id string, result string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok || job.finished() {
+		return
+	}
+	now := time.Now()
+	job.EndedAt = &now
+	job.Result = result
+	job.cancel = nil
+	switch {
+	case job.canceled:
+		job.Status = StatusCanceled
+	case err != nil:
+		job.Status = StatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = StatusSucceeded
+	}
+}
+
+// Cancel the job, either queued or running
+func (r *Registry) Cancel(id string) (Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, ErrNotFound
+	}
+	if !job.cancelable {
+		return *job, ErrNotCancelable
+	}
+	if job.finished() {
+		return *job, ErrFinished
+	}
+
+	job.canceled = true
+	if job.cancel != nil {
+		// Finished by the job once stopped
+		job.cancel()
+		return *job, nil
+	}
+	now := time.Now()
+	job.Status = StatusCanceled
+	job.EndedAt = &now
+	return *job, nil
+}
+
+func (r *Registry) Get(id string) (Job, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	job, ok := r.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// The jobs, the most recent first
+func (r *Registry) List() []Job {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobs := make([]Job, 0, len(r.order))
+	for i := len(r.order) - 1; i >= 0; i-- {
+		jobs = append(jobs, *r.jobs[r.order[i]])
+	}
+	return jobs
+}
+
+// Forget the oldest finished jobs beyond the limit.
+// Must be called with the lock held.
+func (r *Registry) evict() {
+	finished := 0
+	for _, id := range r.order {
+		if r.jobs[id].finished() {
+			finished++
+		}
+	}
+	order := r.order[:0]
+	for _, id := range r.order {
+		if finished > MaxFinished && r.jobs[id].finished() {
+			delete(r.jobs, id)
+			finished--
+			continue
+		}
+		order = append(order, id)
+	}
+	r.order = order
+}
@@ -0,0 +1,102 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLifecycle(t *testing.T) {
+
+	registry := NewRegistry()
+	job := registry.Create("pause_incr", nil, false)
+	if job.Id != "1" || job.Status != StatusQueued {
+		t.Fatalf("Create() = %+v; want queued job 1", job)
+	}
+
+	if !registry.Start(job.Id, nil) {
+		t.Fatalf("Start() = false; want true")
+	}
+	if job, _ := registry.Get(job.Id); job.Status != StatusRunning || job.StartedAt == nil {
+		t.Errorf("Get() = %+v; want running", job)
+	}
+
+	registry.Finish(job.Id, "paused", nil)
+	job, _ = registry.Get(job.Id)
+	if job.Status != StatusSucceeded || job.Result != "paused" || job.EndedAt == nil {
+		t.Errorf("Get() = %+v; want succeeded", job)
+	}
+
+	failed := registry.Create("snapshot", []string{"db", "users"}, true)
+	registry.Finish(failed.Id, "", errors.New("boom"))
+	if failed, _ = registry.Get(failed.Id); failed.Status != StatusFailed || failed.Error != "boom" {
+		t.Errorf("Get() = %+v; want failed", failed)
+	}
+
+	if jobs := registry.List(); len(jobs) != 2 || jobs[0].Id != failed.Id {
+		t.Errorf("List() = %+v; want the most recent first", jobs)
+	}
+
+	// Commands without a job
+	if !registry.Start("", nil) {
+		t.Errorf("Start() = false; want true for no job")
+	}
+	registry.Finish("", "", nil)
+}
+
+func TestCancel(t *testing.T) {
+
+	registry := NewRegistry()
+
+	// Queued, never started
+	queued := registry.Create("snapshot", nil, true)
+	if job, err := registry.Cancel(queued.Id); err != nil || job.Status != StatusCanceled {
+		t.Fatalf("Cancel() = %+v, %v; want canceled", job, err)
+	}
+	if registry.Start(queued.Id, nil) {
+		t.Errorf("Start() = true; want false once canceled")
+	}
+
+	// Running, finished once stopped
+	running := registry.Create("snapshot", nil, true)
+	stopped := false
+	registry.Start(running.Id, func() { stopped = true })
+	if _, err := registry.Cancel(running.Id); err != nil || !stopped {
+		t.Fatalf("Cancel() = %v, stopped %v; want the job stopped", err, stopped)
+	}
+	registry.Finish(running.Id, "", errors.New("context canceled"))
+	if job, _ := registry.Get(running.Id); job.Status != StatusCanceled {
+		t.Errorf("Get() = %+v; want canceled", job)
+	}
+	if _, err := registry.Cancel(running.Id); err != ErrFinished {
+		t.Errorf("Cancel() = %v; want %v", err, ErrFinished)
+	}
+
+	pause := registry.Create("pause_incr", nil, false)
+	if _, err := registry.Cancel(pause.Id); err != ErrNotCancelable {
+		t.Errorf("Cancel() = %v; want %v", err, ErrNotCancelable)
+	}
+	if _, err := registry.Cancel("42"); err != ErrNotFound {
+		t.Errorf("Cancel() = %v; want %v", err, ErrNotFound)
+	}
+}
+
+func TestEvict(t *testing.T) {
+
+	registry := NewRegistry()
+	pending := registry.Create("snapshot", nil, true)
+	for i := 0; i < MaxFinished+10; i++ {
+		job := registry.Create("pause_incr", nil, false)
+		registry.Finish(job.Id, "", nil)
+	}
+	registry.Create("pause_incr", nil, false)
+
+	if jobs := registry.List(); len(jobs) != MaxFinished+2 {
+		t.Errorf("List() = %d jobs; want %d", len(jobs), MaxFinished+2)
+	}
+	if _, ok := registry.Get(pending.Id); !ok {
+		t.Errorf("Get() = false; want the pending job kept")
+	}
+	if _, ok := registry.Get("2"); ok {
+		t.Errorf("Get() = true; want the oldest finished job evicted")
+	}
+}
@@ -0,0 +1,214 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Holds the lease and replicates
+	RoleLeader = "leader"
+	// Waits for the lease to expire to take over
+	RoleStandby = "standby"
+)
+
+// The lease is held by another replica
+var ErrHeld = errors.New("the lease is held by another replica")
+
+// Where the lease is stored, shared by the replicas
+type store interface {
+	// Take or renew the lease for the duration, returns its epoch
+	acquire(ctx context.Context, holder string, ttl time.Duration) (int64, error)
+	// Let the lease expire now
+	release(ctx context.Context, holder string) error
+}
+
+// Lease based election of the replica running a replication. Every new
+// leader gets a greater epoch, the fencing token of its checkpoint saves.
+type Lease struct {
+	key    string
+	holder string
+	ttl    time.Duration
+	store  store
+
+	mu       sync.Mutex
+	role     string
+	epoch    int64
+	deadline time.Time
+}
+
+func newLease(key string, ttl time.Duration, store store) *Lease {
+	host, _ := os.Hostname()
+	return &Lease{
+		key:    key,
+		holder: fmt.Sprintf("%s-%d-%s", host, os.Getpid(), primitive.NewObjectID().Hex()),
+		ttl:    ttl,
+		store:  store,
+		role:   RoleStandby,
+	}
+}
+
+// The lease is renewed three times per ttl
+func (l *Lease) renewInterval() time.Duration {
+	return l.ttl / 3
+}
+
+// The current role of the replica
+func (l *Lease) Role() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.role
+}
+
+// The epoch of the lease, 0 until it is acquired once
+func (l *Lease) Epoch() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch
+}
+
+// The time left before a standby may take over, 0 once the lease is lost
+func (l *Lease) Remaining() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return max(time.Until(l.deadline), 0)
+}
+
+// Stand by until the lease is acquired, then run `lead` until the
+// lease is lost and stand by again. Returns once the context is done.
+func (l *Lease) Run(ctx context.Context, lead func(ctx context.Context, epoch int64)) {
+
+	for ctx.Err() == nil {
+
+		epoch, err := l.wait(ctx)
+		if err != nil {
+			return
+		}
+
+		leadCtx, cancel := context.WithCancel(ctx)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			lead(leadCtx, epoch)
+		}()
+
+		l.keep(leadCtx, done)
+		cancel()
+		<-done
+
+		l.mu.Lock()
+		l.role = RoleStandby
+		l.mu.Unlock()
+	}
+
+	// Let a standby take over without waiting for the expiry
+	ctx, cancel := context.WithTimeout(context.Background(), l.renewInterval())
+	defer cancel()
+	if err := l.store.release(ctx, l.holder); err != nil {
+		log.WarnWithFields("error releasing the lease", log.Fields{"lease": l.key, "error": err})
+	}
+}
+
+// Try to acquire the lease until it succeeds
+func (l *Lease) wait(ctx context.Context) (int64, error) {
+
+	log.InfoWithFields("standing by", log.Fields{"lease": l.key, "holder": l.holder})
+	for {
+		epoch, err := l.renew(ctx)
+		if err == nil {
+			log.InfoWithFields("lease acquired, leading", log.Fields{"lease": l.key, "epoch": epoch})
+			return epoch, nil
+		}
+		if !errors.Is(err, ErrHeld) {
+			log.WarnWithFields("error acquiring the lease", log.Fields{"lease": l.key, "error": err})
+		}
+
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-time.After(l.renewInterval()):
+		}
+	}
+}
+
+// Renew the lease until it is lost or the leader returns. The leader
+// gives up at the end of the last renewed period, before a standby can
+// see the lease expire.
+func (l *Lease) keep(ctx context.Context, done <-chan struct{}) {
+
+	ticker := time.NewTicker(l.renewInterval())
+	defer ticker.Stop()
+	for {
+		l.mu.Lock()
+		expiry := time.NewTimer(time.Until(l.deadline))
+		l.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			expiry.Stop()
+			return
+		case <-done:
+			expiry.Stop()
+			return
+		case <-expiry.C:
+			log.WarnWithFields("lease expired, standing by", log.Fields{"lease": l.key})
+			l.lost()
+			return
+		case <-ticker.C:
+			expiry.Stop()
+		}
+
+		// Another leader may have come and gone meanwhile
+		previous := l.Epoch()
+		epoch, err := l.renew(ctx)
+		if errors.Is(err, ErrHeld) || (err == nil && epoch != previous) {
+			log.WarnWithFields("lease taken over, standing by", log.Fields{"lease": l.key})
+			l.lost()
+			return
+		}
+		if err != nil {
+			log.WarnWithFields("error renewing the lease", log.Fields{"lease": l.key, "error": err})
+		}
+	}
+}
+
+// Another leader may write from now on
+func (l *Lease) lost() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.deadline = time.Time{}
+}
+
+// Acquire or extend the lease, bounded by the current period
+func (l *Lease) renew(ctx context.Context) (int64, error) {
+
+	start := time.Now()
+	l.mu.Lock()
+	deadline := l.deadline
+	l.mu.Unlock()
+	if deadline.Before(start) {
+		deadline = start.Add(l.renewInterval())
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	epoch, err := l.store.acquire(ctx, l.holder, l.ttl)
+	if err != nil {
+		return 0, err
+	}
+
+	// The store computes the expiry after the request is sent
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.role = RoleLeader
+	l.epoch = epoch
+	l.deadline = start.Add(l.ttl)
+	return epoch, nil
+}
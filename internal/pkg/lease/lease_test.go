@@ -0,0 +1,142 @@
+package lease
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A lease shared in memory, expiring with the local clock
+type memoryStore struct {
+	mu      sync.Mutex
+	holder  string
+	epoch   int64
+	expires time.Time
+	down    bool
+}
+
+func (s *memoryStore) acquire(ctx context.Context, holder string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return 0, errors.New("unreachable")
+	}
+	if s.holder != holder && time.Now().Before(s.expires) {
+		return 0, ErrHeld
+	}
+	if s.holder != holder {
+		s.epoch++
+		s.holder = holder
+	}
+	s.expires = time.Now().Add(ttl)
+	return s.epoch, nil
+}
+
+func (s *memoryStore) release(ctx context.Context, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.holder == holder {
+		s.expires = time.Now()
+	}
+	return nil
+}
+
+func (s *memoryStore) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// Runs the lease, the epochs led are sent on the channel
+func run(ctx context.Context, l *Lease) (<-chan int64, <-chan struct{}) {
+	led := make(chan int64, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		l.Run(ctx, func(ctx context.Context, epoch int64) {
+			led <- epoch
+			<-ctx.Done()
+		})
+	}()
+	return led, done
+}
+
+func TestLeaseTakeOver(t *testing.T) {
+
+	store := &memoryStore{}
+	ttl := 150 * time.Millisecond
+	first, second := newLease("rs0_to_rs1", ttl, store), newLease("rs0_to_rs1", ttl, store)
+
+	ctx1, stop1 := context.WithCancel(context.Background())
+	led1, done1 := run(ctx1, first)
+	if epoch := <-led1; epoch != 1 || first.Role() != RoleLeader {
+		t.Fatalf("first lease epoch %d, role %s; want 1, %s", epoch, first.Role(), RoleLeader)
+	}
+
+	ctx2, stop2 := context.WithCancel(context.Background())
+	defer stop2()
+	led2, _ := run(ctx2, second)
+
+	// The renewed lease is kept
+	select {
+	case <-led2:
+		t.Fatalf("the standby leads while the lease is renewed")
+	case <-time.After(3 * ttl):
+	}
+	if second.Role() != RoleStandby {
+		t.Errorf("second lease role %s; want %s", second.Role(), RoleStandby)
+	}
+
+	// The released lease is taken over with a greater epoch
+	stop1()
+	<-done1
+	select {
+	case epoch := <-led2:
+		if epoch != 2 {
+			t.Errorf("second lease epoch %d; want 2", epoch)
+		}
+	case <-time.After(3 * ttl):
+		t.Fatalf("the standby did not take over")
+	}
+}
+
+func TestLeaseExpired(t *testing.T) {
+
+	store := &memoryStore{}
+	ttl := 150 * time.Millisecond
+	l := newLease("rs0_to_rs1", ttl, store)
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	led, _ := run(ctx, l)
+	<-led
+	if left := l.Remaining(); left <= 0 || left > ttl {
+		t.Errorf("Remaining() = %v; want up to the ttl while leading", left)
+	}
+
+	// The leader gives up once it cannot renew for the ttl
+	store.setDown(true)
+	start := time.Now()
+	for l.Role() == RoleLeader {
+		if time.Since(start) > 2*ttl {
+			t.Fatalf("the leader did not give up the unrenewed lease")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if left := l.Remaining(); left != 0 {
+		t.Errorf("Remaining() = %v; want 0 once the lease is lost", left)
+	}
+
+	// And leads again once the lease can be acquired
+	store.setDown(false)
+	select {
+	case epoch := <-led:
+		if epoch != 1 {
+			t.Errorf("lease epoch %d; want 1, no other leader", epoch)
+		}
+	case <-time.After(3 * ttl):
+		t.Fatalf("the lease was not acquired again")
+	}
+}
@@ -0,0 +1,74 @@
+package lease
+
+import (
+	"context"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Stores the lease in the state collection, in the document whose id is
+// the replication id. The expiry is computed with the clock of the server.
+type mongoStore struct {
+	key        string
+	collection *mongo.Collection
+}
+
+// The lease `key` stored in a collection of the server
+func NewMongoLease(server *mdb.MDB, db string, collection string, key string, ttl time.Duration) *Lease {
+	return newLease(key, ttl, &mongoStore{
+		key:        key,
+		collection: server.Client.Database(db).Collection(collection),
+	})
+}
+
+type leaseDocument struct {
+	Holder  string    `bson:"holder"`
+	Epoch   int64     `bson:"epoch"`
+	Expires time.Time `bson:"expires"`
+}
+
+func (s *mongoStore) acquire(ctx context.Context, holder string, ttl time.Duration) (int64, error) {
+
+	// Either renewed by its holder or taken once expired. The upsert of
+	// a lease held by another replica fails on the duplicate id.
+	filter := bson.M{
+		"_id": s.key,
+		"$expr": bson.M{"$or": bson.A{
+			bson.M{"$eq": bson.A{"$holder", holder}},
+			bson.M{"$lt": bson.A{"$expires", "$$NOW"}},
+		}},
+	}
+
+	// A new holder increments the epoch
+	update := mongo.Pipeline{{{Key: "$set", Value: bson.D{
+		{Key: "epoch", Value: bson.M{"$cond": bson.A{
+			bson.M{"$eq": bson.A{"$holder", holder}},
+			"$epoch",
+			bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$epoch", 0}}, 1}},
+		}}},
+		{Key: "holder", Value: holder},
+		{Key: "expires", Value: bson.M{"$add": bson.A{"$$NOW", ttl.Milliseconds()}}},
+	}}}}
+
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var doc leaseDocument
+	err := s.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&doc)
+	if mongo.IsDuplicateKeyError(err) {
+		return 0, ErrHeld
+	}
+	if err != nil {
+		return 0, err
+	}
+	return doc.Epoch, nil
+}
+
+func (s *mongoStore) release(ctx context.Context, holder string) error {
+	_, err := s.collection.UpdateOne(ctx,
+		bson.M{"_id": s.key, "holder": holder},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{"expires": "$$NOW"}}}})
+	return err
+}
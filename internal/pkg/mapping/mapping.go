@@ -0,0 +1,214 @@
+package mapping
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	Wildcard = "*"
+)
+
+// Renames the namespaces from the source to the target.
+// Exact rules take precedence over the ones with wildcards,
+// which are evaluated in the order of the configuration.
+type Mapper struct {
+	exact    map[string]string
+	patterns []rule
+}
+
+// One part of a namespace (database or collection) with an optional wildcard
+type part struct {
+	prefix   string
+	suffix   string
+	wildcard bool
+}
+
+type rule struct {
+	fromDb   part
+	fromColl part
+	toDb     part
+	toColl   part
+}
+
+func NewMapper(mappings []config.NamespaceMapping) (*Mapper, error) {
+
+	m := &Mapper{exact: map[string]string{}}
+	for _, mapping := range mappings {
+
+		fromDb, fromColl, err := splitNamespace(mapping.From)
+		if err != nil {
+			return nil, err
+		}
+		toDb, toColl, err := splitNamespace(mapping.To)
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.Contains(mapping.From, Wildcard) {
+			if strings.Contains(mapping.To, Wildcard) {
+				return nil, fmt.Errorf("mapping %s: wildcard in the target without one in the same part of the source", mapping.From)
+			}
+			m.exact[mapping.From] = mapping.To
+			continue
+		}
+
+		r := rule{}
+		if r.fromDb, err = parsePart(fromDb); err != nil {
+			return nil, err
+		}
+		if r.fromColl, err = parsePart(fromColl); err != nil {
+			return nil, err
+		}
+		if r.toDb, err = parsePart(toDb); err != nil {
+			return nil, err
+		}
+		if r.toColl, err = parsePart(toColl); err != nil {
+			return nil, err
+		}
+		if (r.toDb.wildcard && !r.fromDb.wildcard) || (r.toColl.wildcard && !r.fromColl.wildcard) {
+			return nil, fmt.Errorf("mapping %s: wildcard in the target without one in the same part of the source", mapping.From)
+		}
+		m.patterns = append(m.patterns, r)
+	}
+	return m, nil
+}
+
+// True when no namespace is renamed
+func (m *Mapper) IsEmpty() bool {
+	return len(m.exact) == 0 && len(m.patterns) == 0
+}
+
+// Returns the target database and collection of a source namespace
+func (m *Mapper) Target(db string, collection string) (string, string) {
+
+	if collection == "" || m.IsEmpty() {
+		return db, collection
+	}
+
+	if to, found := m.exact[db+"."+collection]; found {
+		return oplog.GetDbAndCollection(to)
+	}
+
+	for _, r := range m.patterns {
+		capturedDb, ok := r.fromDb.match(db)
+		if !ok {
+			continue
+		}
+		capturedColl, ok := r.fromColl.match(collection)
+		if !ok {
+			continue
+		}
+		return r.toDb.expand(capturedDb), r.toColl.expand(capturedColl)
+	}
+	return db, collection
+}
+
+// Returns the target namespace of a source namespace
+func (m *Mapper) TargetNamespace(namespace string) string {
+	db, collection := oplog.GetDbAndCollection(namespace)
+	if collection == "" {
+		return namespace
+	}
+	db, collection = m.Target(db, collection)
+	return db + "." + collection
+}
+
+// Rename the namespaces of a change log before it is applied on the target.
+// For commands, this covers the collection they apply to and the namespaces
+// of the applyOps sub-operations.
+func (m *Mapper) MapChangeLog(l *oplog.ChangeLog) {
+
+	if m.IsEmpty() {
+		return
+	}
+
+	if l.Operation != oplog.CommandOp {
+		l.Db, l.Collection = m.Target(l.Db, l.Collection)
+		l.Namespace = l.Db + "." + l.Collection
+		return
+	}
+
+	if len(l.Object) == 0 {
+		return
+	}
+
+	switch l.Object[0].Key {
+	case "applyOps":
+		if subOps, ok := l.Object[0].Value.(bson.A); ok {
+			for _, subOp := range subOps {
+				if doc, ok := subOp.(bson.D); ok {
+					m.mapField(doc, "ns")
+				}
+			}
+		}
+	case "renameCollection":
+		m.mapField(l.Object, "renameCollection")
+		m.mapField(l.Object, "to")
+	default:
+		// Collection level commands (indexes, DDL) hold the collection as value
+		collection, ok := l.Object[0].Value.(string)
+		if !ok {
+			return
+		}
+		db, collection := m.Target(l.Db, collection)
+		l.Object[0].Value = collection
+		l.Db = db
+		l.Namespace = db + ".$cmd"
+	}
+}
+
+// Rename the namespace held by a field of the document, in place
+func (m *Mapper) mapField(doc bson.D, key string) {
+	for i := range doc {
+		if doc[i].Key != key {
+			continue
+		}
+		if ns, ok := doc[i].Value.(string); ok {
+			doc[i].Value = m.TargetNamespace(ns)
+		}
+	}
+}
+
+func splitNamespace(namespace string) (string, string, error) {
+	db, collection := oplog.GetDbAndCollection(namespace)
+	if db == "" || collection == "" {
+		return "", "", fmt.Errorf("invalid namespace in mapping: %s", namespace)
+	}
+	return db, collection, nil
+}
+
+func parsePart(s string) (part, error) {
+	switch strings.Count(s, Wildcard) {
+	case 0:
+		return part{prefix: s}, nil
+	case 1:
+		prefix, suffix, _ := strings.Cut(s, Wildcard)
+		return part{prefix: prefix, suffix: suffix, wildcard: true}, nil
+	default:
+		return part{}, fmt.Errorf("more than one wildcard in mapping: %s", s)
+	}
+}
+
+// Returns what matched the wildcard
+func (p part) match(s string) (string, bool) {
+	if !p.wildcard {
+		return "", s == p.prefix
+	}
+	if len(s) < len(p.prefix)+len(p.suffix) ||
+		!strings.HasPrefix(s, p.prefix) || !strings.HasSuffix(s, p.suffix) {
+		return "", false
+	}
+	return s[len(p.prefix) : len(s)-len(p.suffix)], true
+}
+
+func (p part) expand(captured string) string {
+	if !p.wildcard {
+		return p.prefix
+	}
+	return p.prefix + captured + p.suffix
+}
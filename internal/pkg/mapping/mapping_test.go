@@ -0,0 +1,113 @@
+package mapping
+
+import (
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func newTestMapper(t *testing.T) *Mapper {
+	m, err := NewMapper([]config.NamespaceMapping{
+		{From: "prod.*", To: "archive.*_eu"},
+		{From: "prod.orders", To: "archive.orders_eu"},
+		{From: "prod.users", To: "prod.users"},
+		{From: "logs_*.events", To: "archive_*.events"},
+	})
+	if err != nil {
+		t.Fatalf("NewMapper() = %v", err)
+	}
+	return m
+}
+
+func TestTarget(t *testing.T) {
+
+	m := newTestMapper(t)
+	tests := []struct {
+		db, collection string
+		expected       string
+	}{
+		{"prod", "orders", "archive.orders_eu"},
+		{"prod", "users", "prod.users"},
+		{"prod", "invoices", "archive.invoices_eu"},
+		{"prod", "system.views", "archive.system.views_eu"},
+		{"logs_2024", "events", "archive_2024.events"},
+		{"logs_2024", "other", "logs_2024.other"},
+		{"other", "orders", "other.orders"},
+	}
+
+	for _, test := range tests {
+		db, collection := m.Target(test.db, test.collection)
+		if db+"."+collection != test.expected {
+			t.Errorf("Target(%s, %s) = %s.%s; want %s", test.db, test.collection, db, collection, test.expected)
+		}
+	}
+}
+
+func TestNewMapperErrors(t *testing.T) {
+	tests := []config.NamespaceMapping{
+		{From: "prod", To: "archive.orders"},
+		{From: "prod.orders", To: "archive.*"},
+		{From: "prod.orders", To: ""},
+		{From: "prod.*", To: "*.orders"},
+		{From: "prod.a*b*", To: "archive.*"},
+	}
+
+	for _, test := range tests {
+		if _, err := NewMapper([]config.NamespaceMapping{test}); err == nil {
+			t.Errorf("NewMapper(%v) = nil; want an error", test)
+		}
+	}
+}
+
+func TestMapChangeLog(t *testing.T) {
+
+	m := newTestMapper(t)
+
+	insert := &oplog.ChangeLog{
+		ParsedLog:  oplog.ParsedLog{Operation: oplog.InsertOp, Namespace: "prod.orders"},
+		Db:         "prod",
+		Collection: "orders",
+	}
+	m.MapChangeLog(insert)
+	if insert.Db != "archive" || insert.Collection != "orders_eu" || insert.Namespace != "archive.orders_eu" {
+		t.Errorf("insert mapped to %s %s.%s", insert.Namespace, insert.Db, insert.Collection)
+	}
+
+	applyOps := &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Operation: oplog.CommandOp,
+			Namespace: "admin.$cmd",
+			Object: bson.D{{Key: "applyOps", Value: bson.A{
+				bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "prod.orders"}},
+				bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "other.orders"}},
+			}}},
+		},
+		Db: "admin",
+	}
+	m.MapChangeLog(applyOps)
+	subOps := applyOps.Object[0].Value.(bson.A)
+	if ns := subOps[0].(bson.D)[1].Value; ns != "archive.orders_eu" {
+		t.Errorf("applyOps sub-operation mapped to %s", ns)
+	}
+	if ns := subOps[1].(bson.D)[1].Value; ns != "other.orders" {
+		t.Errorf("applyOps sub-operation mapped to %s", ns)
+	}
+	if applyOps.Db != "admin" {
+		t.Errorf("applyOps database mapped to %s", applyOps.Db)
+	}
+
+	dropIndexes := &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Operation: oplog.CommandOp,
+			Namespace: "prod.$cmd",
+			Object:    bson.D{{Key: "dropIndexes", Value: "orders"}, {Key: "index", Value: "name_1"}},
+		},
+		Db: "prod",
+	}
+	m.MapChangeLog(dropIndexes)
+	if dropIndexes.Db != "archive" || dropIndexes.Object[0].Value != "orders_eu" {
+		t.Errorf("dropIndexes mapped to %s %v", dropIndexes.Db, dropIndexes.Object)
+	}
+}
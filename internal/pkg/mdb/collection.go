@@ -3,6 +3,7 @@ package mdb
 import (
 	"context"
 
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -48,10 +49,10 @@ func GetCollectionsByDb(ctx context.Context, db string, mongo *MDB) ([]string, e
 }
 
 // Get the list of collections to replicate
-func GetCollections(ctx context.Context, databases []string) (map[string][]string, error) {
+func GetCollections(ctx context.Context, databases []string, mongo *MDB) (map[string][]string, error) {
 	collections := make(map[string][]string)
 	for _, db := range databases {
-		c, err := GetCollectionsByDb(ctx, db, Registry.GetSource())
+		c, err := GetCollectionsByDb(ctx, db, mongo)
 		if err != nil {
 			log.Fatal("error getting the list of collections to replicate: ", err)
 			return nil, err
@@ -61,10 +62,38 @@ func GetCollections(ctx context.Context, databases []string) (map[string][]strin
 	return collections, nil
 }
 
+// Get the collections to replicate according to the namespace filter.
+// The databases of the source are listed when selected by patterns.
+func GetReplicatedCollections(ctx context.Context, mongo *MDB, namespaces *filters.NamespaceFilter) (map[string][]string, error) {
+
+	databases, exact := namespaces.ExactDatabases()
+	if !exact {
+		all, err := mongo.Client.ListDatabaseNames(ctx, bson.D{})
+		if err != nil {
+			return nil, err
+		}
+		databases = namespaces.SelectDatabases(all)
+	}
+
+	collections := make(map[string][]string)
+	for _, db := range databases {
+		c, err := GetCollectionsByDb(ctx, db, mongo)
+		if err != nil {
+			return nil, err
+		}
+		for _, collection := range c {
+			if namespaces.Keep(db, collection) {
+				collections[db] = append(collections[db], collection)
+			}
+		}
+	}
+	return collections, nil
+}
+
 // GetIndexesByDb returns the indexes of a collection
-func GetIndexesByDb(ctx context.Context, database string, collection string) ([]primitive.M, error) {
+func GetIndexesByDb(ctx context.Context, mongo *MDB, database string, collection string) ([]primitive.M, error) {
 	var indexes []primitive.M
-	cursor, err := Registry.GetSource().Client.Database(database).Collection(collection).Indexes().List(ctx)
+	cursor, err := mongo.Client.Database(database).Collection(collection).Indexes().List(ctx)
 	if err != nil {
 		return nil, err
 	}
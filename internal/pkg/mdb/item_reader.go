@@ -15,6 +15,10 @@ type MongoItemReader struct {
 	Database   string // Database to read from
 	Collection string // Collection to read from
 	Source     *MDB   // Source MongoDB client
+	Filter     bson.D // Optional predicate on the items
+
+	// Metrics of the pipeline, the reads are only counted when set
+	Metrics *metrics.PipelineMetrics
 }
 
 func NewMongoItemReader(source *MDB, database string, collection string) *MongoItemReader {
@@ -27,6 +31,9 @@ func NewMongoItemReader(source *MDB, database string, collection string) *MongoI
 
 // Counts the number of items in the database
 func (r *MongoItemReader) Count(ctx context.Context) (int64, error) {
+	if len(r.Filter) > 0 {
+		return r.Source.Client.Database(r.Database).Collection(r.Collection).CountDocuments(ctx, r.Filter)
+	}
 	return GetDocumentCountByCollection(r.Source, r.Database, r.Collection)
 }
 
@@ -69,6 +76,10 @@ func (r *MongoItemReader) ReadItems(ctx context.Context, batchSize int,
 		}}
 	}
 
+	if len(r.Filter) > 0 {
+		filter = bson.D{{Key: "$and", Value: bson.A{filter, r.Filter}}}
+	}
+
 	// Read the documents
 	cur, err := r.Source.Client.Database(r.Database).Collection(r.Collection).Find(ctx, filter, findOptions)
 	if err != nil {
@@ -94,7 +105,9 @@ func (r *MongoItemReader) ReadItems(ctx context.Context, batchSize int,
 		err := cur.Decode(item)
 
 		// Successfully read a batch of documents. Increment the counter
-		metrics.SnapshotReadCounter.WithLabelValues(r.Database, r.Collection).Inc()
+		if r.Metrics != nil {
+			r.Metrics.SnapshotReadCounter.WithLabelValues(r.Database, r.Collection).Inc()
+		}
 
 		if err != nil || item == nil {
 			log.Error("error reading document: ", err)
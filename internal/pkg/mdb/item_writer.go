@@ -16,6 +16,8 @@ type MongoItemWriter struct {
 	Target     *MDB
 	Database   string
 	Collection string
+	// Update the documents failing to insert on duplicate keys
+	UpdateOnDuplicate bool
 }
 
 func NewMongoWriter(target *MDB, database string, collection string) *MongoItemWriter {
@@ -180,7 +182,7 @@ func (r *MongoItemWriter) WriteMany(ctx context.Context, items []*bson.D) (inter
 
 	// Bulk write the documents
 	opts := options.BulkWrite().SetOrdered(false)
-	_, err := Registry.GetTarget().Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, models, opts)
+	_, err := r.Target.Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, models, opts)
 
 	// All documents were successfully written
 	if err == nil {
@@ -203,7 +205,7 @@ func (r *MongoItemWriter) WriteMany(ctx context.Context, items []*bson.D) (inter
 
 		if IsDuplicateKeyError(wError) {
 
-			if config.Current.Repl.Full.UpdateOnDuplicate {
+			if r.UpdateOnDuplicate {
 
 				log.WarnWithFields("insert of documents failed, attempting to update them",
 					log.Fields{
@@ -251,7 +253,7 @@ func (r *MongoItemWriter) WriteMany(ctx context.Context, items []*bson.D) (inter
 
 	if len(updateModels) != 0 {
 		opts := options.BulkWrite().SetOrdered(false)
-		_, err := Registry.GetTarget().Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, updateModels, opts)
+		_, err := r.Target.Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, updateModels, opts)
 		if err != nil {
 			result.ErrorCount = len(updateModels)
 			return result, err
@@ -2,6 +2,9 @@ package mdb
 
 import (
 	"context"
+	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
@@ -10,6 +13,7 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
 type MDB struct {
@@ -81,3 +85,50 @@ func ExtractId(doc bson.Raw) primitive.E {
 	}
 	return primitive.E{}
 }
+
+// The write concern of the configuration, nil for the default one of the server.
+// The unacknowledged writes are refused: the checkpoint would move past them.
+func NewWriteConcern(cfg config.WriteConcernConfig) (*writeconcern.WriteConcern, error) {
+
+	if cfg.W == "" && !cfg.Journal && cfg.Timeout == 0 {
+		return nil, nil
+	}
+	if cfg.Timeout < 0 {
+		return nil, fmt.Errorf("invalid write concern timeout: %d", cfg.Timeout)
+	}
+
+	wc := &writeconcern.WriteConcern{WTimeout: time.Duration(cfg.Timeout) * time.Millisecond}
+	if cfg.W != "" {
+		if n, err := strconv.Atoi(cfg.W); err == nil {
+			if n <= 0 {
+				return nil, fmt.Errorf("the write concern must be acknowledged: w=%s", cfg.W)
+			}
+			wc.W = n
+		} else {
+			wc.W = cfg.W
+		}
+	}
+	if cfg.Journal {
+		wc.Journal = &cfg.Journal
+	}
+	return wc, nil
+}
+
+// Add the write concern to a command, which does not inherit the one of
+// its database. The command is unchanged for the default write concern.
+func WithWriteConcern(cmd bson.D, wc *writeconcern.WriteConcern) bson.D {
+	if wc == nil {
+		return cmd
+	}
+	doc := bson.D{}
+	if wc.W != nil {
+		doc = append(doc, bson.E{Key: "w", Value: wc.W})
+	}
+	if wc.Journal != nil {
+		doc = append(doc, bson.E{Key: "j", Value: *wc.Journal})
+	}
+	if wc.WTimeout > 0 {
+		doc = append(doc, bson.E{Key: "wtimeout", Value: wc.WTimeout.Milliseconds()})
+	}
+	return append(cmd, bson.E{Key: "writeConcern", Value: doc})
+}
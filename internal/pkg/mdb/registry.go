@@ -1,6 +1,8 @@
 package mdb
 
 import (
+	"context"
+
 	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 )
@@ -8,21 +10,34 @@ import (
 type MongoRegistry struct {
 	source *MDB
 	target *MDB
+	// Server holding the state when not the target
+	state *MDB
 }
 
-func NewMongoRegistry(appConfig *config.AppConfig) *MongoRegistry {
+// Registry of the source and target of a replication. The target is
+// optional when the changes go to a sink and the state is stored elsewhere.
+func NewMongoRegistry(repl *config.ReplConfig) *MongoRegistry {
 
-	source := NewMongo(appConfig.Repl.Source)
-	target := NewMongo(appConfig.Repl.Target)
+	m := &MongoRegistry{
+		source: NewMongo(repl.Source),
+	}
+	if repl.Target != "" {
+		m.target = NewMongo(repl.Target)
+	}
+	if repl.Incr.State.Uri != "" {
+		m.state = NewMongo(repl.Incr.State.Uri)
+	}
+	return m
+}
 
+// Registry with only a target, for tools writing to a target
+// without reading from a source (replay).
+func NewMongoTargetRegistry(target string) *MongoRegistry {
 	return &MongoRegistry{
-		source: source,
-		target: target,
+		target: NewMongo(target),
 	}
 }
 
-var Registry *MongoRegistry = nil
-
 func (m *MongoRegistry) GetSource() *MDB {
 
 	if m.source == nil {
@@ -31,6 +46,18 @@ func (m *MongoRegistry) GetSource() *MDB {
 	return m.source
 }
 
+func (m *MongoRegistry) HasTarget() bool {
+	return m.target != nil
+}
+
+// The server holding the state, the target by default
+func (m *MongoRegistry) GetState() *MDB {
+	if m.state != nil {
+		return m.state
+	}
+	return m.GetTarget()
+}
+
 func (m *MongoRegistry) GetTarget() *MDB {
 
 	if m.target == nil {
@@ -38,3 +65,15 @@ func (m *MongoRegistry) GetTarget() *MDB {
 	}
 	return m.target
 }
+
+// Disconnect from the servers of the registry
+func (m *MongoRegistry) Disconnect(ctx context.Context) {
+	for _, server := range []*MDB{m.source, m.target, m.state} {
+		if server == nil {
+			continue
+		}
+		if err := server.Client.Disconnect(ctx); err != nil {
+			log.Warn("error disconnecting from the server: ", err)
+		}
+	}
+}
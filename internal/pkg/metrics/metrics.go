@@ -9,6 +9,9 @@ const (
 	DeleteOp  = "d"  // Delete operation
 	InsertOp  = "i"  // Insert operation
 	CommandOp = "c"  // Command operation
+
+	// Label of the replication pipeline on every metric
+	PipelineLabel = "pipeline"
 )
 
 var (
@@ -18,42 +21,112 @@ var (
 	SnapshotProgressGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mongo_repl_full_sync_progress",
 		Help: "The progress of the full sync",
-	}, []string{"database", "collection"})
+	}, []string{PipelineLabel, "database", "collection"})
 
 	SnapshotReadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mongo_repl_full_sync_documents_read_total",
 		Help: "The total number of documents fetched during a full sync",
-	}, []string{"database", "collection"})
+	}, []string{PipelineLabel, "database", "collection"})
 
 	SnapshotWriteCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mongo_repl_full_sync_documents_write_total",
 		Help: "The total number of documents written during a full sync",
-	}, []string{"database", "collection", "operation"})
+	}, []string{PipelineLabel, "database", "collection", "operation"})
 
 	SnapshotErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mongo_repl_full_sync_documents_error_total",
 		Help: "The total number of documents written during a full sync",
-	}, []string{"database", "collection", "error"})
+	}, []string{PipelineLabel, "database", "collection", "error"})
 
 	IncrSyncOplogReadCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mongo_repl_incr_sync_oplog_read_total",
 		Help: "The total number of documents fetched during an incremental sync",
-	}, []string{"database", "collection", "operation"})
+	}, []string{PipelineLabel, "database", "collection", "operation"})
 
 	IncrSyncOplogWriteCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "mongo_repl_incr_sync_oplog_write_total",
 		Help: "The total number of documents written during an incremental sync",
-	}, []string{"database", "collection", "operation"})
+	}, []string{PipelineLabel, "database", "collection", "operation"})
+
+	IncrSyncDelayBufferGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_repl_incr_sync_delay_buffer",
+		Help: "The number of oplog entries held by the delayed replica mode",
+	}, []string{PipelineLabel})
+
+	IncrSyncDelaySkippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_incr_sync_delay_skipped_total",
+		Help: "The total number of delayed oplog entries skipped on demand",
+	}, []string{PipelineLabel, "database", "collection", "operation"})
+
+	IncrSyncPolicySkippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_incr_sync_policy_skipped_total",
+		Help: "The total number of oplog entries skipped by the operation policies",
+	}, []string{PipelineLabel, "database", "collection", "operation"})
+
+	TargetWriteCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_target_oplog_write_total",
+		Help: "The total number of oplog entries written to an additional target",
+	}, []string{PipelineLabel, "target", "database", "collection", "operation"})
+
+	TargetLagGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_repl_target_lag_seconds",
+		Help: "The lag of a target behind the last oplog entry read",
+	}, []string{PipelineLabel, "target"})
+
+	TargetBufferGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_repl_target_buffer",
+		Help: "The number of oplog entries buffered for a target",
+	}, []string{PipelineLabel, "target"})
+
+	ArchiveWriteCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_archive_oplog_write_total",
+		Help: "The total number of oplog entries written to the archive",
+	}, []string{PipelineLabel, "database", "collection", "operation"})
+
+	ArchiveErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_archive_oplog_error_total",
+		Help: "The total number of errors leaving a gap in the archive",
+	}, []string{PipelineLabel})
+
+	IncrSyncLoopSkippedCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_incr_sync_loop_skipped_total",
+		Help: "The total number of oplog entries skipped as written by a replication",
+	}, []string{PipelineLabel})
 
-	CheckpointGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	IncrSyncRollbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_incr_sync_rollback_total",
+		Help: "The total number of rollbacks of the source detected",
+	}, []string{PipelineLabel})
+
+	IncrSyncConflictCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_incr_sync_conflict_total",
+		Help: "The total number of writes skipped as the target document is newer",
+	}, []string{PipelineLabel, "database", "collection"})
+
+	SinkRequestCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_sink_request_total",
+		Help: "The total number of requests sent by the webhook sink, by HTTP status",
+	}, []string{PipelineLabel, "status"})
+
+	CheckpointGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mongo_repl_incr_sync_checkpoint",
 		Help: "The checkpoint of the incremental sync",
-	})
+	}, []string{PipelineLabel})
+
+	ReplStateGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "mongo_repl_state",
+		Help: "The state of the replication, 1 for the current state",
+	}, []string{PipelineLabel, "state"})
+
+	ReplStateTransitionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongo_repl_state_transitions_total",
+		Help: "The total number of transitions between the replication states",
+	}, []string{PipelineLabel, "from", "to"})
 
 	MongoReplSourceTotalDocumentCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "mongo_repl_total_document_count",
 		Help: "The total number of documents in the source database",
-	}, []string{"origin", "database", "collection"})
+	}, []string{PipelineLabel, "origin", "database", "collection"})
 )
 
 func init() {
@@ -64,6 +137,74 @@ func init() {
 	Registry.MustRegister(SnapshotErrorTotal)
 	Registry.MustRegister(IncrSyncOplogReadCounter)
 	Registry.MustRegister(IncrSyncOplogWriteCounter)
+	Registry.MustRegister(IncrSyncDelayBufferGauge)
+	Registry.MustRegister(IncrSyncDelaySkippedCounter)
+	Registry.MustRegister(IncrSyncPolicySkippedCounter)
+	Registry.MustRegister(IncrSyncLoopSkippedCounter)
+	Registry.MustRegister(IncrSyncRollbackCounter)
+	Registry.MustRegister(IncrSyncConflictCounter)
+	Registry.MustRegister(TargetWriteCounter)
+	Registry.MustRegister(TargetLagGauge)
+	Registry.MustRegister(TargetBufferGauge)
+	Registry.MustRegister(ArchiveWriteCounter)
+	Registry.MustRegister(ArchiveErrorCounter)
+	Registry.MustRegister(SinkRequestCounter)
 	Registry.MustRegister(CheckpointGauge)
+	Registry.MustRegister(ReplStateGauge)
+	Registry.MustRegister(ReplStateTransitionCounter)
 	Registry.MustRegister(MongoReplSourceTotalDocumentCount)
 }
+
+// The metrics of a replication pipeline, labelled with its id
+type PipelineMetrics struct {
+	SnapshotProgressGauge             *prometheus.GaugeVec
+	SnapshotReadCounter               *prometheus.CounterVec
+	SnapshotWriteCounter              *prometheus.CounterVec
+	SnapshotErrorTotal                *prometheus.CounterVec
+	IncrSyncOplogReadCounter          *prometheus.CounterVec
+	IncrSyncOplogWriteCounter         *prometheus.CounterVec
+	IncrSyncDelayBufferGauge          prometheus.Gauge
+	IncrSyncDelaySkippedCounter       *prometheus.CounterVec
+	IncrSyncPolicySkippedCounter      *prometheus.CounterVec
+	IncrSyncLoopSkippedCounter        prometheus.Counter
+	IncrSyncRollbackCounter           prometheus.Counter
+	IncrSyncConflictCounter           *prometheus.CounterVec
+	TargetWriteCounter                *prometheus.CounterVec
+	TargetLagGauge                    *prometheus.GaugeVec
+	TargetBufferGauge                 *prometheus.GaugeVec
+	ArchiveWriteCounter               *prometheus.CounterVec
+	ArchiveErrorCounter               prometheus.Counter
+	SinkRequestCounter                *prometheus.CounterVec
+	CheckpointGauge                   prometheus.Gauge
+	ReplStateGauge                    *prometheus.GaugeVec
+	ReplStateTransitionCounter        *prometheus.CounterVec
+	MongoReplSourceTotalDocumentCount *prometheus.GaugeVec
+}
+
+func ForPipeline(id string) *PipelineMetrics {
+	labels := prometheus.Labels{PipelineLabel: id}
+	return &PipelineMetrics{
+		SnapshotProgressGauge:             SnapshotProgressGauge.MustCurryWith(labels),
+		SnapshotReadCounter:               SnapshotReadCounter.MustCurryWith(labels),
+		SnapshotWriteCounter:              SnapshotWriteCounter.MustCurryWith(labels),
+		SnapshotErrorTotal:                SnapshotErrorTotal.MustCurryWith(labels),
+		IncrSyncOplogReadCounter:          IncrSyncOplogReadCounter.MustCurryWith(labels),
+		IncrSyncOplogWriteCounter:         IncrSyncOplogWriteCounter.MustCurryWith(labels),
+		IncrSyncDelayBufferGauge:          IncrSyncDelayBufferGauge.With(labels),
+		IncrSyncDelaySkippedCounter:       IncrSyncDelaySkippedCounter.MustCurryWith(labels),
+		IncrSyncPolicySkippedCounter:      IncrSyncPolicySkippedCounter.MustCurryWith(labels),
+		IncrSyncLoopSkippedCounter:        IncrSyncLoopSkippedCounter.With(labels),
+		IncrSyncRollbackCounter:           IncrSyncRollbackCounter.With(labels),
+		IncrSyncConflictCounter:           IncrSyncConflictCounter.MustCurryWith(labels),
+		TargetWriteCounter:                TargetWriteCounter.MustCurryWith(labels),
+		TargetLagGauge:                    TargetLagGauge.MustCurryWith(labels),
+		TargetBufferGauge:                 TargetBufferGauge.MustCurryWith(labels),
+		ArchiveWriteCounter:               ArchiveWriteCounter.MustCurryWith(labels),
+		ArchiveErrorCounter:               ArchiveErrorCounter.With(labels),
+		SinkRequestCounter:                SinkRequestCounter.MustCurryWith(labels),
+		CheckpointGauge:                   CheckpointGauge.With(labels),
+		ReplStateGauge:                    ReplStateGauge.MustCurryWith(labels),
+		ReplStateTransitionCounter:        ReplStateTransitionCounter.MustCurryWith(labels),
+		MongoReplSourceTotalDocumentCount: MongoReplSourceTotalDocumentCount.MustCurryWith(labels),
+	}
+}
@@ -0,0 +1,97 @@
+package mocks
+
+import (
+	"context"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Keeps the checkpoint in memory and records the calls
+type MockCheckpoint struct {
+	Current checkpoint.Checkpoint
+	Saved   int
+}
+
+func NewMockCheckpoint() *MockCheckpoint {
+	return &MockCheckpoint{}
+}
+
+func (m *MockCheckpoint) GetCheckpoint(context.Context) (checkpoint.Checkpoint, error) {
+	return m.Current, nil
+}
+
+func (m *MockCheckpoint) Checkpoint() checkpoint.Checkpoint {
+	return m.Current
+}
+
+func (m *MockCheckpoint) SetCheckpoint(ctx context.Context, ts primitive.Timestamp, save bool) error {
+	m.MoveCheckpointForward(ts)
+	if save {
+		m.Saved++
+	}
+	return nil
+}
+
+func (m *MockCheckpoint) StartFrom(ctx context.Context, ts primitive.Timestamp, overlapUntil primitive.Timestamp) error {
+	m.MoveCheckpointForward(ts)
+	m.Current.OverlapUntil = overlapUntil
+	m.Saved++
+	return nil
+}
+
+func (m *MockCheckpoint) MoveCheckpointForward(ts primitive.Timestamp) {
+	m.Current.LatestTs = ts
+	m.Current.Latest = checkpoint.ToDate(ts)
+	m.Current.LatestLSN = checkpoint.ToInt64(ts)
+}
+
+func (m *MockCheckpoint) HoldCheckpoint(primitive.Timestamp) {
+}
+
+func (m *MockCheckpoint) ReleaseCheckpoint(primitive.Timestamp, primitive.Timestamp) {
+}
+
+func (m *MockCheckpoint) SaveCheckpoint(context.Context) error {
+	m.Saved++
+	return nil
+}
+
+func (m *MockCheckpoint) Rewind(ctx context.Context, ts primitive.Timestamp) error {
+	m.Current.OverlapUntil = m.Current.LatestTs
+	m.Current.LatestTs = ts
+	m.Current.Latest = checkpoint.ToDate(ts)
+	m.Current.LatestLSN = checkpoint.ToInt64(ts)
+	m.Saved++
+	return nil
+}
+
+func (m *MockCheckpoint) GetHistory(context.Context, int) ([]checkpoint.Checkpoint, error) {
+	return nil, nil
+}
+
+func (m *MockCheckpoint) SetConfigHash(string) {}
+
+func (m *MockCheckpoint) SetFencingToken(int64) {}
+
+func (m *MockCheckpoint) RecordTerm(primitive.Timestamp, int64) {}
+
+func (m *MockCheckpoint) SaveState(context.Context, any) error {
+	return nil
+}
+
+func (m *MockCheckpoint) LoadState(context.Context, any) (bool, error) {
+	return false, nil
+}
+
+func (m *MockCheckpoint) SaveNamespaces(context.Context, any) error {
+	return nil
+}
+
+func (m *MockCheckpoint) LoadNamespaces(context.Context, any) (bool, error) {
+	return false, nil
+}
+
+func (m *MockCheckpoint) StartAutosave(context.Context) {}
+
+func (m *MockCheckpoint) StopAutosave() {}
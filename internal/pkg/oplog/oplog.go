@@ -24,7 +24,7 @@ type GenericOplog struct {
 // https://github.com/mongodb/mongo/blob/r6.2.0/src/mongo/db/repl/oplog_entry.idl
 
 type ChangeLog struct {
-	ParsedLog
+	ParsedLog `bson:",inline"`
 
 	// /*
 	//  * Every field subsequent declared is NEVER persistent or
@@ -64,6 +64,19 @@ type GenericObject struct {
 	Id primitive.ObjectID `bson:"_id" json:"_id omitempty"`
 }
 
+// Deep copy of the entry, for the consumers modifying it
+func (l *ChangeLog) Clone() (*ChangeLog, error) {
+	raw, err := bson.Marshal(l.ParsedLog)
+	if err != nil {
+		return nil, err
+	}
+	c := &ChangeLog{Db: l.Db, Collection: l.Collection}
+	if err := bson.Unmarshal(raw, &c.ParsedLog); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
 // Split the namespace to get the collection name
 // namespace = "whatever.$cmd"
 func ParseCmd(namespace string) (string, string) {
@@ -2,6 +2,9 @@ package oplog
 
 import (
 	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestGetDbAndCollection(t *testing.T) {
@@ -23,3 +26,32 @@ func TestGetDbAndCollection(t *testing.T) {
 		}
 	}
 }
+
+func TestChangeLogClone(t *testing.T) {
+
+	l := &ChangeLog{
+		ParsedLog: ParsedLog{
+			Timestamp: primitive.Timestamp{T: 10, I: 1},
+			Version:   2,
+			Operation: InsertOp,
+			Namespace: "db.coll",
+			Object:    bson.D{{Key: "_id", Value: 1}, {Key: "tags", Value: bson.A{"a", bson.D{{Key: "b", Value: 2}}}}},
+		},
+		Db:         "db",
+		Collection: "coll",
+	}
+
+	c, err := l.Clone()
+	if err != nil {
+		t.Fatalf("Clone() = %v", err)
+	}
+	if c.Timestamp != l.Timestamp || c.Namespace != l.Namespace || c.Db != l.Db || c.Collection != l.Collection {
+		t.Errorf("Clone() = %v; want %v", c, l)
+	}
+
+	// The copy does not share the documents
+	c.Object[1].Value.(bson.A)[1].(bson.D)[0].Value = 3
+	if l.Object[1].Value.(bson.A)[1].(bson.D)[0].Value != 2 {
+		t.Errorf("Clone() shares the nested documents")
+	}
+}
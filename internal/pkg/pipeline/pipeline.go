@@ -0,0 +1,268 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/cutover"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/jobs"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/lease"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mapping"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/sink"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/state"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// A replication from a source to a target, independent of the
+// other pipelines running in the same process.
+type Pipeline struct {
+	// The replication id, also the name of its checkpoint
+	Id     string
+	Config *config.ReplConfig
+
+	// Source and target servers, set once connected
+	Registry *mdb.MongoRegistry
+
+	// Destination of the changes when not the MongoDB target, set once connected
+	Sink sink.Sink
+
+	// The checkpoint of the pipeline, set once connected
+	Checkpoint checkpoint.CheckpointManager
+
+	// What is saved next to the checkpoint, set once connected
+	Store checkpoint.Store
+
+	// Compiled rules of the configuration
+	Namespaces *filters.NamespaceFilter
+	Policies   *filters.PolicyFilter
+	Documents  *filters.DocumentFilter
+	Mapping    *mapping.Mapper
+	Transform  *transform.Transformer
+
+	// Write concern of the writes to the target, nil for the default one
+	WriteConcern *writeconcern.WriteConcern
+
+	// Metrics labelled with the pipeline id
+	Metrics *metrics.PipelineMetrics
+
+	// Commands sent by the API
+	Commands chan commands.Command
+
+	// The cutover workflow of the pipeline
+	Cutover *cutover.Cutover
+
+	// Rewinds requested by the API, served by the incremental replication
+	Rewinds chan RewindRequest
+
+	// The leader election among the replicas, nil when disabled
+	Lease *lease.Lease
+
+	// The state of the replication, saved with the checkpoint once connected
+	State *state.Machine
+
+	// Stops the process gracefully, set when run as a service
+	Terminate func()
+
+	// What the replication is doing, for its status
+	Tracker *status.Tracker
+
+	// The commands sent by the API and their outcome
+	Jobs *jobs.Registry
+}
+
+// A request to move the checkpoint back and re-apply the oplog from there
+type RewindRequest struct {
+	To primitive.Timestamp
+	// Receives the outcome once the replication is stopped and rewound
+	Result chan error
+}
+
+// Compiles the rules of the replication configuration.
+// The servers are not connected yet.
+func New(cfg *config.ReplConfig) (*Pipeline, error) {
+
+	p := &Pipeline{
+		Id:       cfg.Id,
+		Config:   cfg,
+		Metrics:  metrics.ForPipeline(cfg.Id),
+		Commands: make(chan commands.Command, 10),
+		Rewinds:  make(chan RewindRequest),
+		Tracker:  status.NewTracker(),
+		Jobs:     jobs.NewRegistry(),
+	}
+	p.State = state.NewMachine(p.Metrics.ReplStateGauge, p.Metrics.ReplStateTransitionCounter)
+
+	var err error
+	if p.Namespaces, err = filters.NewNamespaceFilterFromConfig(cfg); err != nil {
+		return nil, fmt.Errorf("error loading the namespace filters: %v", err)
+	}
+	if p.Policies, err = filters.NewPolicyFilter(cfg.Policies); err != nil {
+		return nil, fmt.Errorf("error loading the operation policies: %v", err)
+	}
+	if p.Documents, err = filters.NewDocumentFilter(cfg.Documents); err != nil {
+		return nil, fmt.Errorf("error loading the document filters: %v", err)
+	}
+	if p.Mapping, err = mapping.NewMapper(cfg.Mapping); err != nil {
+		return nil, fmt.Errorf("error loading the namespace mapping: %v", err)
+	}
+	if p.Transform, err = transform.NewTransformer(cfg.Transforms); err != nil {
+		return nil, fmt.Errorf("error loading the field transforms: %v", err)
+	}
+
+	if p.WriteConcern, err = mdb.NewWriteConcern(cfg.Incr.WriteConcern); err != nil {
+		return nil, err
+	}
+
+	switch cfg.Incr.State.Type {
+	case "", checkpoint.TypeMongoDB, checkpoint.TypeFile, checkpoint.TypeMemory:
+	default:
+		return nil, fmt.Errorf("unknown state type: %s", cfg.Incr.State.Type)
+	}
+
+	// The replicas share the lease through the state server
+	if cfg.Lease.Enabled && cfg.Incr.State.Type != "" && cfg.Incr.State.Type != checkpoint.TypeMongoDB {
+		return nil, fmt.Errorf("the leader election requires the %s state", checkpoint.TypeMongoDB)
+	}
+
+	// The conflict rule of the active-active replication
+	switch conflict := cfg.Bidirectional.Conflict; conflict.Rule {
+	case "", config.ConflictSourceWins:
+	case config.ConflictLastWriterWins:
+		if conflict.Field == "" || strings.Contains(conflict.Field, ".") {
+			return nil, fmt.Errorf("the %s conflict rule requires a top-level version field", conflict.Rule)
+		}
+	default:
+		return nil, fmt.Errorf("unknown conflict rule: %s", conflict.Rule)
+	}
+
+	// The delta replication compares the documents with the target ones
+	if cfg.Sink.Type != "" && cfg.Sink.Type != sink.TypeMongoDB && cfg.IsFeatureEnabled(config.DeltaReplication) {
+		return nil, fmt.Errorf("the delta replication requires the %s sink", sink.TypeMongoDB)
+	}
+
+	p.Cutover = cutover.NewCutover(func() (checkpoint.TsWindow, error) {
+		return checkpoint.GetReplicasetOplogWindow(p.Registry.GetSource())
+	})
+	p.Cutover.Observe(p.cutoverStep)
+	return p, nil
+}
+
+// Follow the cutover workflow in the replication state
+func (p *Pipeline) cutoverStep(step int, err error) {
+	ctx := context.Background()
+	switch step {
+	case cutover.StepAnnounced:
+		err = p.State.Transition(ctx, state.StateCutover, "cutover announced")
+	case cutover.StepAborted:
+		_, err = p.State.TransitionFrom(ctx, state.StateCutover, state.StateCatchingUp, "cutover aborted")
+	case cutover.StepFailed:
+		_, err = p.State.TransitionFrom(ctx, state.StateCutover, state.StateCatchingUp, "cutover failed: "+err.Error())
+	default:
+		return
+	}
+	if err != nil {
+		log.Warn("error changing the replication state: ", err)
+	}
+}
+
+// Builds the pipelines of the configuration, in order
+func NewPipelines(cfg *config.AppConfig) ([]*Pipeline, error) {
+	pipelines := make([]*Pipeline, 0, len(cfg.Pipelines))
+	for i := range cfg.Pipelines {
+		p, err := New(&cfg.Pipelines[i])
+		if err != nil {
+			return nil, fmt.Errorf("pipeline %s: %v", cfg.Pipelines[i].Id, err)
+		}
+		pipelines = append(pipelines, p)
+	}
+	return pipelines, nil
+}
+
+// Connect to the source and the target of the pipeline
+func (p *Pipeline) Connect() {
+	// The target holds the changes, or the state by default
+	state := p.Config.Incr.State
+	mongoState := (state.Type == "" || state.Type == checkpoint.TypeMongoDB) && state.Uri == ""
+	mongoSink := p.Config.Sink.Type == "" || p.Config.Sink.Type == sink.TypeMongoDB
+	if p.Config.Target == "" && (mongoState || mongoSink) {
+		log.Fatal("the target is required by the sink or the state of pipeline ", p.Id)
+	}
+	p.Registry = mdb.NewMongoRegistry(p.Config)
+	p.OpenSink()
+	backend := p.NewCheckpointManager()
+	p.Checkpoint, p.Store = backend, backend
+	if err := p.State.Load(context.Background(), p.Store); err != nil {
+		log.Fatal("error loading the replication state: ", err)
+	}
+
+	// The lease is stored next to the checkpoints
+	if p.Config.Lease.Enabled {
+		p.Lease = lease.NewMongoLease(p.Registry.GetState(), state.Database, state.Collection,
+			p.Id, time.Duration(p.Config.Lease.Ttl)*time.Second)
+	}
+}
+
+// Disconnect from the servers of the pipeline
+func (p *Pipeline) Disconnect(ctx context.Context) {
+	if p.Registry != nil {
+		p.Registry.Disconnect(ctx)
+	}
+}
+
+// Role of the replica in the leader election, always the leader when disabled
+func (p *Pipeline) Role() string {
+	if p.Lease == nil {
+		return lease.RoleLeader
+	}
+	return p.Lease.Role()
+}
+
+// Open the sink of the configuration, nil for the MongoDB target
+func (p *Pipeline) OpenSink() {
+	var err error
+	if p.Sink, err = sink.NewSink(p.Config.Sink, p.Metrics); err != nil {
+		log.Fatal("error opening the sink: ", err)
+	}
+}
+
+// The checkpoint of the pipeline, stored in the configured state
+func (p *Pipeline) NewCheckpointManager() checkpoint.Backend {
+	return p.OpenCheckpoint(p.Id, nil)
+}
+
+// Open the checkpoint `name` in the configured state. With the mongodb
+// state and no state server, it is stored on the given target, or the
+// pipeline one when nil.
+func (p *Pipeline) OpenCheckpoint(name string, target *mdb.MDB) checkpoint.Backend {
+
+	var server *mdb.MDB
+	switch state := p.Config.Incr.State; {
+	case state.Type != "" && state.Type != checkpoint.TypeMongoDB:
+	case state.Uri == "" && target != nil:
+		server = target
+	default:
+		server = p.Registry.GetState()
+	}
+
+	ckpt, err := checkpoint.NewCheckpointManager(p.Config.Incr.State, server, name)
+	if err != nil {
+		log.Fatal("error opening the checkpoint: ", err)
+	}
+	ckpt.SetConfigHash(p.Config.Hash())
+	if p.Lease != nil {
+		ckpt.SetFencingToken(p.Lease.Epoch())
+	}
+	return ckpt
+}
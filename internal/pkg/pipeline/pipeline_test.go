@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+)
+
+func TestNewPipelines(t *testing.T) {
+
+	pipelines, err := NewPipelines(&config.AppConfig{
+		Pipelines: []config.ReplConfig{
+			{Id: "rs0_to_rs1", DatabasesIn: map[string]bool{"shop": true}},
+			{Id: "rs2_to_rs3", DatabasesIn: map[string]bool{"billing": true}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPipelines() = %v", err)
+	}
+	if len(pipelines) != 2 {
+		t.Fatalf("NewPipelines() = %d pipelines; want 2", len(pipelines))
+	}
+
+	// Each pipeline has its own filters
+	if !pipelines[0].Namespaces.Keep("shop", "orders") || pipelines[0].Namespaces.Keep("billing", "invoices") {
+		t.Errorf("pipeline %s: unexpected namespace filter", pipelines[0].Id)
+	}
+	if pipelines[1].Namespaces.Keep("shop", "orders") || !pipelines[1].Namespaces.Keep("billing", "invoices") {
+		t.Errorf("pipeline %s: unexpected namespace filter", pipelines[1].Id)
+	}
+	if pipelines[0].Commands == pipelines[1].Commands || pipelines[0].Cutover == pipelines[1].Cutover {
+		t.Errorf("pipelines share their commands or cutover")
+	}
+}
+
+func TestNewPipelinesInvalidRule(t *testing.T) {
+
+	_, err := NewPipelines(&config.AppConfig{
+		Pipelines: []config.ReplConfig{
+			{Id: "rs0_to_rs1"},
+			{Id: "rs2_to_rs3", Policies: []config.OperationPolicyConfig{
+				{Namespace: "db.coll", Deny: []string{"truncate"}},
+			}},
+		},
+	})
+	if err == nil {
+		t.Errorf("NewPipelines() = nil; want an error")
+	}
+}
+
+func TestNewPipelineWriteConcern(t *testing.T) {
+
+	repl := config.ReplConfig{Id: "test"}
+	repl.Incr.WriteConcern = config.WriteConcernConfig{W: "majority", Journal: true, Timeout: 5000}
+	p, err := New(&repl)
+	if err != nil {
+		t.Fatalf("New() = %v", err)
+	}
+	if p.WriteConcern.W != "majority" || !*p.WriteConcern.Journal || p.WriteConcern.WTimeout.Seconds() != 5 {
+		t.Errorf("WriteConcern = %+v", p.WriteConcern)
+	}
+
+	// The checkpoint would move past the unacknowledged writes
+	repl.Incr.WriteConcern = config.WriteConcernConfig{W: "0"}
+	if _, err := New(&repl); err == nil {
+		t.Errorf("New() = nil; want an error for w=0")
+	}
+}
+
+func TestNewPipelineInvalidState(t *testing.T) {
+
+	repl := config.ReplConfig{Id: "test"}
+	repl.Incr.State.Type = "redis"
+	if _, err := New(&repl); err == nil {
+		t.Errorf("New() = nil; want an error for an unknown state type")
+	}
+
+	// The replicas share the lease in the mongodb state only
+	repl.Incr.State.Type = "file"
+	repl.Lease.Enabled = true
+	if _, err := New(&repl); err == nil {
+		t.Errorf("New() = nil; want an error for the leader election with a file state")
+	}
+}
@@ -2,84 +2,145 @@ package repl
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/commands"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/incr"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/snapshot"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/state"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/stats"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-const (
-	UnknownReplState     = iota
-	InitialReplState     = 1
-	IncrementalReplState = 2
-)
-
-var (
-	ReplicationStates = map[int]string{
-		UnknownReplState:     "unknown",
-		InitialReplState:     "initial",
-		IncrementalReplState: "incremental",
+// Start the replication in a dedicated go routine. The returned
+// channel is closed once the replication is stopped with the context.
+func StartReplication(ctx context.Context, p *pipeline.Pipeline) <-chan struct{} {
+	done := make(chan struct{})
+	if p.Lease == nil {
+		go func() {
+			defer close(done)
+			RunReplication(ctx, p)
+		}()
+		return done
 	}
-)
 
-func StartReplication(ctx context.Context, commands chan commands.Command) {
-	go RunReplication(ctx, commands)
+	// Only the leader replicates, from the last saved checkpoint
+	go func() {
+		defer close(done)
+		p.Lease.Run(ctx, func(ctx context.Context, epoch int64) {
+			p.Checkpoint.SetFencingToken(epoch)
+			RunReplication(ctx, p)
+		})
+	}()
+	return done
 }
 
-func RunReplication(ctx context.Context, commands chan commands.Command) {
+func RunReplication(ctx context.Context, p *pipeline.Pipeline) {
 
-	log.Info("starting replication")
-	checkpointManager := checkpoint.NewMongoCheckpointService(
-		config.Current.Repl.Id,
-		config.Current.Repl.Incr.State.Database,
-		config.Current.Repl.Incr.State.Collection)
+	log.InfoWithFields("starting replication", log.Fields{"pipeline": p.Id})
+	checkpointManager := p.Checkpoint
+	loadNamespaces(ctx, p)
 
 	// Establish the list of dbAndCollections to replicate
-	dbAndCollections, err := mdb.GetCollections(ctx, config.Current.Repl.Databases)
+	dbAndCollections, err := mdb.GetReplicatedCollections(ctx, p.Registry.GetSource(), p.Namespaces)
 	if err != nil {
-		log.Fatal("error getting the list of collections to replicate: ", err)
+		fatal(p, "error getting the list of collections to replicate", err)
+	}
+
+	// The target may have been seeded by other means
+	err = startFromPosition(ctx, p, checkpointManager)
+	if err != nil {
+		fatal(p, "error starting from the configured position", err)
 	}
 
 	// Start the collections stats monitoring
-	stats := stats.NewCollectionStats(dbAndCollections)
+	stats := stats.NewCollectionStats(p, dbAndCollections)
 	stats.StartCollectionStats(ctx)
+	defer log.InfoWithFields("replication stopped", log.Fields{"pipeline": p.Id})
 
-	replicationState := UnknownReplState
-	for replicationState < IncrementalReplState {
+	// Runs again after a rewind, until stopped
+	for ctx.Err() == nil {
 
 		// Determine the replication state
 		ckpt, err := checkpointManager.GetCheckpoint(ctx)
 		if err != nil {
-			log.Fatal("error getting the checkpoint: ", err)
+			fatal(p, "error getting the checkpoint", err)
 		}
 
-		metrics.CheckpointGauge.Set(float64(ckpt.LatestTs.T))
+		p.Metrics.CheckpointGauge.Set(float64(ckpt.LatestTs.T))
 
-		var state int = getReplState(ckpt)
-		log.Info("replication state: ", ReplicationStates[state])
+		var next int = getReplState(ckpt)
+		log.Info("replication state: ", state.States[next])
 
 		// Start the replication based on the type
-		switch state {
-		case InitialReplState:
+		switch next {
+		case state.StateInitialSync:
 			log.Info("starting full replication")
+			if err := p.State.Start(ctx, state.StateInitialSync, "no checkpoint found"); err != nil {
+				log.Error("error saving the replication state: ", err)
+			}
 			// Block until the full replication is done
-			snapshot.NewSnapshot(checkpointManager).RunSnapshots(ctx, dbAndCollections)
-		case IncrementalReplState:
+			snapshot.NewSnapshot(p, checkpointManager).RunSnapshots(ctx, dbAndCollections)
+			if ctx.Err() == nil {
+				if err := p.State.Transition(ctx, state.StateCatchingUp, "initial sync completed"); err != nil {
+					log.Error("error saving the replication state: ", err)
+				}
+			}
+		case state.StateCatchingUp:
 			log.Info("starting incremental replication")
+			resumeState(ctx, p)
 			// Run the incremental replication, blocking here
-			incr.NewIncr(checkpointManager, commands).RunIncremental(ctx)
+			incr.NewIncr(p, checkpointManager).RunIncremental(ctx)
 		default:
-			log.Fatal("unknown replication type")
+			fatal(p, "unknown replication type", fmt.Errorf("state %d", next))
 		}
 	}
 }
 
+// Catch up from the checkpoint. A paused replication stays paused
+// until resumed, even across restarts.
+func resumeState(ctx context.Context, p *pipeline.Pipeline) {
+	var err error
+	switch p.State.Current() {
+	case state.StateCatchingUp:
+	case state.StatePaused:
+		log.Warn("the incremental replication is paused, resume it to apply the oplog")
+	default:
+		err = p.State.Start(ctx, state.StateCatchingUp, "resuming from the checkpoint")
+	}
+	if err != nil {
+		log.Error("error saving the replication state: ", err)
+	}
+}
+
+// The namespaces changed at runtime replace the configured filters.
+// Loaded once leader, as changed by the previous leader meanwhile.
+func loadNamespaces(ctx context.Context, p *pipeline.Pipeline) {
+	var entries filters.NamespaceEntries
+	found, err := p.Store.LoadNamespaces(ctx, &entries)
+	if err != nil {
+		fatal(p, "error loading the namespaces", err)
+	}
+	if !found {
+		return
+	}
+	if err := p.Namespaces.Set(entries); err != nil {
+		fatal(p, "error loading the namespaces", err)
+	}
+	log.InfoWithFields("namespaces changed at runtime loaded", log.Fields{
+		"databases": entries.Databases, "in": entries.In, "out": entries.Out})
+}
+
+// Record the error in the replication state, then exit
+func fatal(p *pipeline.Pipeline, msg string, err error) {
+	p.State.Fail(context.Background(), fmt.Errorf("%s: %v", msg, err))
+	log.Fatal(msg+": ", err)
+}
+
 // Check the replication state to determine if
 // a full document replication is needed of if we can proceed
 // with the incremental replication based on the oplog.
@@ -88,19 +149,64 @@ func getReplState(ckpt checkpoint.Checkpoint) int {
 	log.Info("checking replication state")
 
 	// We start with an unknown replication state
-	foundReplType := UnknownReplState
+	foundReplType := state.StateUnknown
 
 	var lastLsnSync int64 = ckpt.LatestLSN
 	if lastLsnSync == 0 {
 		log.Info("no previous replication state found")
-		foundReplType = InitialReplState
+		foundReplType = state.StateInitialSync
 	} else {
 
 		// We need to chech if the last LSN synched on the target
 		// is included in the oplog of the source. Otherwise we need
 		// to perform a full replication.
 		log.Info("last LSN synched: ", lastLsnSync)
-		foundReplType = IncrementalReplState
+		foundReplType = state.StateCatchingUp
 	}
 	return foundReplType
 }
+
+// Position the checkpoint on the configured starting point when the target
+// was seeded by other means (restored backup, filesystem snapshot...).
+// It is ignored as soon as a checkpoint exists.
+func startFromPosition(ctx context.Context, p *pipeline.Pipeline, checkpointManager checkpoint.CheckpointManager) error {
+
+	if p.Config.Incr.Start == "" {
+		return nil
+	}
+
+	ckpt, err := checkpointManager.GetCheckpoint(ctx)
+	if err != nil {
+		return err
+	}
+	if ckpt.LatestLSN != 0 {
+		log.Info("checkpoint found, ignoring the configured starting position")
+		return nil
+	}
+
+	start, err := checkpoint.ParseTimestamp(p.Config.Incr.Start)
+	if err != nil {
+		return err
+	}
+
+	// The starting position must still be in the oplog of the source
+	window, err := checkpoint.GetReplicasetOplogWindow(p.Registry.GetSource())
+	if err != nil {
+		return err
+	}
+	if checkpoint.CompareTimestamps(start, window.Oldest) < 0 {
+		return fmt.Errorf("the starting position %v is older than the oldest oplog entry %v",
+			checkpoint.ToDate(start), checkpoint.ToDate(window.Oldest))
+	}
+	if checkpoint.CompareTimestamps(start, window.Newest) > 0 {
+		return fmt.Errorf("the starting position %v is newer than the newest oplog entry %v",
+			checkpoint.ToDate(start), checkpoint.ToDate(window.Newest))
+	}
+
+	overlapUntil := primitive.Timestamp{T: start.T + uint32(max(p.Config.Incr.Overlap, 0)), I: start.I}
+	log.InfoWithFields("starting incremental replication from an explicit position", log.Fields{
+		"start":   checkpoint.ToDate(start),
+		"overlap": checkpoint.ToDate(overlapUntil),
+	})
+	return checkpointManager.StartFrom(ctx, start, overlapUntil)
+}
@@ -0,0 +1,202 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/archive"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/incr"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Reads archived change logs and pushes them to the writer queue
+type Replay struct {
+	// Directory of the archive files
+	Dir string
+	// Only the entries between From and To (included) are replayed
+	From primitive.Timestamp
+	To   primitive.Timestamp
+	// Namespace patterns to replay, like `db.coll` or `db.*`. Empty means all.
+	Namespaces []string
+	// Speed relative to the original pace of the entries (0 means as fast as possible)
+	Speed float64
+
+	queue chan<- *oplog.ChangeLog
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// Outcome of a replay
+type Result struct {
+	Files    int
+	Replayed int64
+	Skipped  int64
+	First    primitive.Timestamp
+	Last     primitive.Timestamp
+}
+
+func NewReplay(dir string, from primitive.Timestamp, to primitive.Timestamp,
+	namespaces []string, speed float64, queue chan<- *oplog.ChangeLog) *Replay {
+	return &Replay{
+		Dir:        dir,
+		From:       from,
+		To:         to,
+		Namespaces: namespaces,
+		Speed:      speed,
+		queue:      queue,
+		now:        time.Now,
+		after:      time.After,
+	}
+}
+
+// Replay the archived entries, in order. Entries archived twice (after a
+// restart of the replication) are only replayed once.
+func (r *Replay) Run(ctx context.Context) (Result, error) {
+
+	result := Result{}
+	files, err := archive.ListFiles(r.Dir, r.From, r.To)
+	if err != nil {
+		return result, err
+	}
+
+	// The entries not archived are not replayed either
+	gaps, err := archive.ListGaps(r.Dir, r.From, r.To)
+	if err != nil {
+		return result, err
+	}
+	for _, gap := range gaps {
+		log.WarnWithFields("the archive has a gap, its entries are not replayed", log.Fields{
+			"first": gap.First,
+			"last":  gap.Last,
+		})
+	}
+
+	log.InfoWithFields("starting replay", log.Fields{
+		"dir":   r.Dir,
+		"files": len(files),
+		"from":  r.From,
+		"to":    r.To,
+		"speed": r.Speed,
+	})
+
+	var startedAt time.Time
+	for _, index := range files {
+
+		reader, err := archive.NewFileReader(r.Dir, index)
+		if err != nil {
+			return result, err
+		}
+		result.Files++
+		log.InfoWithFields("replaying archive file", log.Fields{"file": index.File})
+
+		for {
+			l, err := reader.Next()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				reader.Close()
+				return result, err
+			}
+
+			if ctx.Err() != nil {
+				reader.Close()
+				return result, ctx.Err()
+			}
+
+			// Out of range or already replayed
+			if checkpoint.CompareTimestamps(l.Timestamp, r.From) < 0 ||
+				checkpoint.CompareTimestamps(l.Timestamp, result.Last) <= 0 {
+				continue
+			}
+			if checkpoint.CompareTimestamps(l.Timestamp, r.To) > 0 {
+				reader.Close()
+				return result, nil
+			}
+
+			if !r.keep(l) {
+				result.Skipped++
+				continue
+			}
+
+			// Follow the original pace of the entries
+			if result.Replayed == 0 {
+				result.First = l.Timestamp
+				startedAt = r.now()
+			} else if r.Speed > 0 {
+				elapsed := checkpoint.ToDate(l.Timestamp).Sub(checkpoint.ToDate(result.First))
+				due := startedAt.Add(time.Duration(float64(elapsed) / r.Speed))
+				if wait := due.Sub(r.now()); wait > 0 {
+					select {
+					case <-r.after(wait):
+					case <-ctx.Done():
+						reader.Close()
+						return result, ctx.Err()
+					}
+				}
+			}
+
+			select {
+			case r.queue <- l:
+			case <-ctx.Done():
+				reader.Close()
+				return result, ctx.Err()
+			}
+			result.Replayed++
+			result.Last = l.Timestamp
+		}
+		reader.Close()
+	}
+
+	return result, nil
+}
+
+// Check the namespace of the entry against the patterns. The sub-operations
+// of an applyOps command are filtered individually.
+func (r *Replay) keep(l *oplog.ChangeLog) bool {
+
+	if len(r.Namespaces) == 0 {
+		return true
+	}
+
+	if l.Operation != oplog.CommandOp {
+		return r.match(l.Namespace)
+	}
+
+	if len(l.Object) == 0 {
+		return false
+	}
+
+	if l.Object[0].Key == incr.ApplyOps {
+		computedCmd, computedCmdSize := incr.SanitizeApplyOps(l.Object[0], func(doc bson.D) bool {
+			ns, _ := mdb.GetKey(doc, "ns").(string)
+			return r.match(ns)
+		}, bson.D{}, 0)
+		if computedCmdSize == 0 {
+			return false
+		}
+		l.Object = append(computedCmd, l.Object[1:]...)
+		return true
+	}
+
+	// Other commands hold the collection as the value of the command name
+	db, collection, _ := incr.CommandNamespace(l.Db, l.Object)
+	return r.match(db + "." + collection)
+}
+
+func (r *Replay) match(namespace string) bool {
+	for _, pattern := range r.Namespaces {
+		if ok, _ := path.Match(pattern, namespace); ok {
+			return true
+		}
+	}
+	return false
+}
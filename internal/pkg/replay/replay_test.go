@@ -0,0 +1,147 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/archive"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newChangeLog(t uint32, db string, coll string) *oplog.ChangeLog {
+	return &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Timestamp: primitive.Timestamp{T: t, I: 1},
+			Version:   2,
+			Operation: oplog.InsertOp,
+			Namespace: db + "." + coll,
+			Object:    bson.D{{Key: "_id", Value: int64(t)}},
+		},
+		Db:         db,
+		Collection: coll,
+	}
+}
+
+func TestReplay(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := archive.NewArchiver(config.ArchiveConfig{Dir: dir, Format: archive.FormatJson}, "test", nil)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+	a.Archive(newChangeLog(100, "db1", "coll1"))
+	a.Archive(newChangeLog(101, "db2", "coll1"))
+	a.Archive(newChangeLog(102, "db1", "coll2"))
+	a.Close()
+
+	// Archived again after a restart of the replication
+	a.Archive(newChangeLog(102, "db1", "coll2"))
+	a.Archive(newChangeLog(110, "db1", "coll1"))
+	a.Archive(newChangeLog(120, "db1", "coll1"))
+	a.Close()
+
+	queue := make(chan *oplog.ChangeLog, 10)
+	r := NewReplay(dir, primitive.Timestamp{T: 101}, primitive.Timestamp{T: 115}, []string{"db1.*"}, 10, queue)
+	var slept time.Duration
+	r.after = func(d time.Duration) <-chan time.Time {
+		slept += d
+		return time.After(0)
+	}
+
+	result, err := r.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run() = %v", err)
+	}
+	close(queue)
+
+	var replayed []uint32
+	for l := range queue {
+		replayed = append(replayed, l.Timestamp.T)
+	}
+	if len(replayed) != 2 || replayed[0] != 102 || replayed[1] != 110 {
+		t.Errorf("replayed %v; want [102 110]", replayed)
+	}
+	if result.Replayed != 2 || result.Skipped != 1 || result.Last.T != 110 {
+		t.Errorf("result = %+v", result)
+	}
+	// 8 seconds between the entries at 10x
+	if slept < 700*time.Millisecond || slept > 800*time.Millisecond {
+		t.Errorf("slept %v; want about 800ms", slept)
+	}
+}
+
+func TestReplayCanceled(t *testing.T) {
+
+	dir := t.TempDir()
+	a, err := archive.NewArchiver(config.ArchiveConfig{Dir: dir, Format: archive.FormatJson}, "test", nil)
+	if err != nil {
+		t.Fatalf("NewArchiver() = %v", err)
+	}
+	a.Archive(newChangeLog(100, "db1", "coll1"))
+	a.Archive(newChangeLog(200, "db1", "coll1"))
+	a.Archive(newChangeLog(201, "db1", "coll1"))
+	a.Close()
+
+	// Stopped while waiting for the pace, then for the writer
+	for _, speed := range []float64{1, 0} {
+		ctx, cancel := context.WithCancel(context.Background())
+		queue := make(chan *oplog.ChangeLog, 1)
+		r := NewReplay(dir, primitive.Timestamp{}, primitive.Timestamp{T: 300}, nil, speed, queue)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := r.Run(ctx)
+			done <- err
+		}()
+		<-queue
+		cancel()
+
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Errorf("Run() = %v; want %v", err, context.Canceled)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Run() did not return once canceled, speed %v", speed)
+		}
+	}
+}
+
+func TestKeepApplyOps(t *testing.T) {
+
+	r := NewReplay("", primitive.Timestamp{}, primitive.Timestamp{}, []string{"db1.coll1"}, 0, nil)
+	l := &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Operation: oplog.CommandOp,
+			Namespace: "admin.$cmd",
+			Object: bson.D{{Key: "applyOps", Value: bson.A{
+				bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.coll1"}},
+				bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db2.coll1"}},
+			}}},
+		},
+		Db: "admin",
+	}
+
+	if !r.keep(l) {
+		t.Fatalf("keep() = false; want true")
+	}
+	ops := l.Object[0].Value.(bson.A)
+	if len(ops) != 1 {
+		t.Errorf("applyOps has %d operations; want 1", len(ops))
+	}
+
+	drop := &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Operation: oplog.CommandOp,
+			Object:    bson.D{{Key: "drop", Value: "coll2"}},
+		},
+		Db: "db1",
+	}
+	if r.keep(drop) {
+		t.Errorf("keep(drop db1.coll2) = true; want false")
+	}
+}
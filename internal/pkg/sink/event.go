@@ -0,0 +1,211 @@
+package sink
+
+import (
+	"strings"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	OpInsert   = "insert"
+	OpUpdate   = "update"
+	OpReplace  = "replace"
+	OpDelete   = "delete"
+	OpDDL      = "ddl"
+	OpSnapshot = "snapshot"
+)
+
+// A change of the source, independent of the oplog format
+type ChangeEvent struct {
+	// One of insert, update, replace, delete, ddl or snapshot
+	Operation  string `bson:"op"`
+	Db         string `bson:"db"`
+	Collection string `bson:"coll"`
+	// The _id of the document, unset for the DDL
+	Id interface{} `bson:"_id,omitempty"`
+	// The document of an insert, a replace or the snapshot
+	Document bson.D `bson:"document,omitempty"`
+	// The fields changed by an update
+	Update *UpdateDescription `bson:"update,omitempty"`
+	// The command of a DDL
+	Command bson.D `bson:"command,omitempty"`
+	// Timestamp of the oplog entry, unset for the snapshot
+	ClusterTime primitive.Timestamp `bson:"clusterTime,omitempty"`
+}
+
+type UpdateDescription struct {
+	UpdatedFields   bson.D           `bson:"updatedFields,omitempty"`
+	RemovedFields   []string         `bson:"removedFields,omitempty"`
+	TruncatedArrays []TruncatedArray `bson:"truncatedArrays,omitempty"`
+}
+
+type TruncatedArray struct {
+	Field   string `bson:"field"`
+	NewSize int64  `bson:"newSize"`
+}
+
+// Relaxed Extended JSON, on a single line
+func (e *ChangeEvent) MarshalJSON() ([]byte, error) {
+	return bson.MarshalExtJSON(e, false, false)
+}
+
+// Normalise an oplog entry into change events. The rules are applied to the
+// update of a single operation, the sub-operations of applyOps are expected
+// to be transformed already. Returns no event when nothing is left to write.
+func NewChangeEvents(l *oplog.ChangeLog, rules *transform.Rules) ([]*ChangeEvent, error) {
+
+	if l.Operation == oplog.CommandOp {
+		return commandEvents(l)
+	}
+
+	key := l.Query
+	if len(l.DocumentKey) > 0 {
+		key = l.DocumentKey
+	}
+	event, err := newChangeEvent(l.Operation, l.Db, l.Collection, l.Object, key, l.Timestamp, rules)
+	if event == nil || err != nil {
+		return nil, err
+	}
+	return []*ChangeEvent{event}, nil
+}
+
+func newChangeEvent(op string, db string, collection string, object bson.D, key bson.D,
+	ts primitive.Timestamp, rules *transform.Rules) (*ChangeEvent, error) {
+
+	e := &ChangeEvent{Db: db, Collection: collection, ClusterTime: ts}
+	switch op {
+	case oplog.InsertOp:
+		e.Operation = OpInsert
+		e.Id = mdb.GetKey(object, "_id")
+		e.Document = object
+	case oplog.DeleteOp:
+		e.Operation = OpDelete
+		e.Id = mdb.GetKey(object, "_id")
+	case oplog.UpdateOp:
+		e.Id = mdb.GetKey(key, "_id")
+		if ok, err := e.setUpdate(object, rules); !ok || err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return e, nil
+}
+
+// Describe the update, either a diff, update operators or a replacement.
+// Returns false when only redacted fields were changed.
+func (e *ChangeEvent) setUpdate(object bson.D, rules *transform.Rules) (bool, error) {
+
+	var update interface{} = object
+	if mdb.GetKey(object, "diff") != nil {
+		var err error
+		if update, err = mdb.DiffUpdateOplogToNormal(object); err != nil {
+			return false, err
+		}
+	} else if len(object) > 0 && !strings.HasPrefix(object[0].Key, "$") {
+		e.Operation = OpReplace
+		e.Document = rules.TransformDocument(object)
+		return true, nil
+	}
+
+	if update = rules.TransformUpdate(update); update == nil {
+		return false, nil
+	}
+	e.Operation = OpUpdate
+	e.Update = newUpdateDescription(update)
+	return true, nil
+}
+
+func newUpdateDescription(update interface{}) *UpdateDescription {
+
+	d := &UpdateDescription{}
+	switch u := update.(type) {
+	case bson.D:
+		for _, op := range u {
+			fields, _ := op.Value.(bson.D)
+			switch op.Key {
+			case "$set":
+				d.UpdatedFields = append(d.UpdatedFields, fields...)
+			case "$unset":
+				for _, field := range fields {
+					d.RemovedFields = append(d.RemovedFields, field.Key)
+				}
+			}
+		}
+
+	case mongo.Pipeline:
+		// The truncation of an array: {$set: {field: {$slice: ["$field", size]}}}
+		for _, stage := range u {
+			for _, op := range stage {
+				fields, _ := op.Value.(bson.D)
+				for _, field := range fields {
+					slice, _ := field.Value.(bson.D)
+					args, _ := mdb.GetKey(slice, "$slice").([]interface{})
+					if len(args) == 2 {
+						d.TruncatedArrays = append(d.TruncatedArrays,
+							TruncatedArray{Field: field.Key, NewSize: toInt64(args[1])})
+					}
+				}
+			}
+		}
+	}
+	return d
+}
+
+// The DDL, and the operations of applyOps
+func commandEvents(l *oplog.ChangeLog) ([]*ChangeEvent, error) {
+
+	command, found := mdb.ExtraCommandName(l.Object)
+	if !found || !filters.KeepOperation(command) {
+		return nil, nil
+	}
+
+	if command != "applyOps" {
+		collection, _ := l.Object[0].Value.(string)
+		return []*ChangeEvent{{Operation: OpDDL, Db: l.Db, Collection: collection,
+			Command: l.Object, ClusterTime: l.Timestamp}}, nil
+	}
+
+	subOps, _ := l.Object[0].Value.(bson.A)
+	var events []*ChangeEvent
+	for _, subOp := range subOps {
+		doc, ok := subOp.(bson.D)
+		if !ok {
+			continue
+		}
+		op, _ := mdb.GetKey(doc, "op").(string)
+		ns, _ := mdb.GetKey(doc, "ns").(string)
+		object, _ := mdb.GetKey(doc, "o").(bson.D)
+		key, _ := mdb.GetKey(doc, "o2").(bson.D)
+		db, collection := oplog.GetDbAndCollection(ns)
+
+		event, err := newChangeEvent(op, db, collection, object, key, l.Timestamp, nil)
+		if err != nil {
+			return nil, err
+		}
+		if event != nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+func toInt64(value interface{}) int64 {
+	switch v := value.(type) {
+	case int32:
+		return int64(v)
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	}
+	return 0
+}
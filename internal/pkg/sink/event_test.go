@@ -0,0 +1,99 @@
+package sink
+
+import (
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newChangeLog(op string, object bson.D, query bson.D) *oplog.ChangeLog {
+	return &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Timestamp: primitive.Timestamp{T: 100, I: 1},
+			Version:   2,
+			Operation: op,
+			Namespace: "db1.coll1",
+			Object:    object,
+			Query:     query,
+		},
+		Db:         "db1",
+		Collection: "coll1",
+	}
+}
+
+func TestNewChangeEventsInsertDelete(t *testing.T) {
+
+	events, err := NewChangeEvents(newChangeLog(oplog.InsertOp,
+		bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "orange"}}, nil), nil)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("NewChangeEvents() = %v, %v; want 1 event", events, err)
+	}
+	if e := events[0]; e.Operation != OpInsert || e.Id != 1 || len(e.Document) != 2 || e.ClusterTime.T != 100 {
+		t.Errorf("insert event = %+v", e)
+	}
+
+	events, _ = NewChangeEvents(newChangeLog(oplog.DeleteOp, bson.D{{Key: "_id", Value: 2}}, nil), nil)
+	if len(events) != 1 || events[0].Operation != OpDelete || events[0].Id != 2 || events[0].Document != nil {
+		t.Errorf("delete event = %+v", events)
+	}
+}
+
+func TestNewChangeEventsUpdate(t *testing.T) {
+
+	// $v:2 diff, setting `name` and removing `color`
+	diff := bson.D{{Key: "$v", Value: 2}, {Key: "diff", Value: bson.D{
+		{Key: "u", Value: bson.D{{Key: "name", Value: "lemon"}}},
+		{Key: "d", Value: bson.D{{Key: "color", Value: false}}},
+	}}}
+	events, err := NewChangeEvents(newChangeLog(oplog.UpdateOp, diff, bson.D{{Key: "_id", Value: 1}}), nil)
+	if err != nil || len(events) != 1 {
+		t.Fatalf("NewChangeEvents() = %v, %v; want 1 event", events, err)
+	}
+	e := events[0]
+	if e.Operation != OpUpdate || e.Id != 1 || e.Update == nil {
+		t.Fatalf("update event = %+v", e)
+	}
+	if len(e.Update.UpdatedFields) != 1 || e.Update.UpdatedFields[0].Key != "name" {
+		t.Errorf("updated fields = %v; want name", e.Update.UpdatedFields)
+	}
+	if len(e.Update.RemovedFields) != 1 || e.Update.RemovedFields[0] != "color" {
+		t.Errorf("removed fields = %v; want color", e.Update.RemovedFields)
+	}
+
+	// Replacement of the whole document
+	events, _ = NewChangeEvents(newChangeLog(oplog.UpdateOp,
+		bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "lime"}}, bson.D{{Key: "_id", Value: 1}}), nil)
+	if len(events) != 1 || events[0].Operation != OpReplace || len(events[0].Document) != 2 {
+		t.Errorf("replace event = %+v", events)
+	}
+}
+
+func TestNewChangeEventsCommands(t *testing.T) {
+
+	applyOps := bson.D{{Key: "applyOps", Value: bson.A{
+		bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "db1.coll1"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 1}}}},
+		bson.D{{Key: "op", Value: "d"}, {Key: "ns", Value: "db2.coll2"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 2}}}},
+		bson.D{{Key: "op", Value: "n"}, {Key: "ns", Value: ""}, {Key: "o", Value: bson.D{}}},
+	}}}
+	events, err := NewChangeEvents(newChangeLog(oplog.CommandOp, applyOps, nil), nil)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("NewChangeEvents(applyOps) = %v, %v; want 2 events", events, err)
+	}
+	if events[1].Operation != OpDelete || events[1].Db != "db2" || events[1].Collection != "coll2" {
+		t.Errorf("applyOps delete event = %+v", events[1])
+	}
+
+	dropIndexes := bson.D{{Key: "dropIndexes", Value: "coll1"}, {Key: "index", Value: "name_1"}}
+	events, _ = NewChangeEvents(newChangeLog(oplog.CommandOp, dropIndexes, nil), nil)
+	if len(events) != 1 || events[0].Operation != OpDDL || events[0].Collection != "coll1" || len(events[0].Command) != 2 {
+		t.Errorf("ddl event = %+v", events)
+	}
+
+	// Commands not replicated
+	events, _ = NewChangeEvents(newChangeLog(oplog.CommandOp, bson.D{{Key: "create", Value: "coll1"}}, nil), nil)
+	if len(events) != 0 {
+		t.Errorf("create events = %+v; want none", events)
+	}
+}
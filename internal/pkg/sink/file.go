@@ -0,0 +1,98 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Appends the change events to a file, one JSON document per line.
+// The entries are acknowledged once flushed to the file.
+type FileSink struct {
+	acker
+
+	mu   sync.Mutex
+	file *os.File
+	out  *bufio.Writer
+}
+
+func NewFileSink(cfg config.FileSinkConfig) (*FileSink, error) {
+
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("the file sink requires a path")
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{file: file, out: bufio.NewWriter(file)}, nil
+}
+
+func (s *FileSink) Load(ctx context.Context, db string, collection string, docs []*bson.Raw) error {
+
+	events := make([]*ChangeEvent, 0, len(docs))
+	for _, raw := range docs {
+		var doc bson.D
+		if err := bson.Unmarshal(*raw, &doc); err != nil {
+			return err
+		}
+		events = append(events, &ChangeEvent{Operation: OpSnapshot, Db: db, Collection: collection,
+			Id: mdb.GetKey(doc, "_id"), Document: doc})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(events)
+}
+
+func (s *FileSink) Write(ctx context.Context, ts primitive.Timestamp, events []*ChangeEvent) error {
+
+	s.mu.Lock()
+	err := s.write(events)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.acknowledge(ts)
+	return nil
+}
+
+func (s *FileSink) write(events []*ChangeEvent) error {
+
+	if len(events) == 0 {
+		return nil
+	}
+	for _, event := range events {
+		data, err := event.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err := s.out.Write(append(data, '\n')); err != nil {
+			return err
+		}
+	}
+	return s.out.Flush()
+}
+
+func (s *FileSink) Close(ctx context.Context) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.out.Flush(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,81 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestFileSink(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "events", "changes.jsonl")
+	s, err := NewFileSink(config.FileSinkConfig{Path: path})
+	if err != nil {
+		t.Fatalf("NewFileSink() = %v", err)
+	}
+
+	var acked []primitive.Timestamp
+	s.OnAcknowledged(func(ts primitive.Timestamp) { acked = append(acked, ts) })
+
+	ctx := context.Background()
+	doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: 1}, {Key: "name", Value: "orange"}})
+	raw := bson.Raw(doc)
+	if err := s.Load(ctx, "db1", "coll1", []*bson.Raw{&raw}); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+
+	events, _ := NewChangeEvents(newChangeLog("d", bson.D{{Key: "_id", Value: 1}}, nil), nil)
+	if err := s.Write(ctx, primitive.Timestamp{T: 100, I: 1}, events); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	// Entries without event are acknowledged too
+	if err := s.Write(ctx, primitive.Timestamp{T: 101, I: 1}, nil); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	if len(acked) != 2 || acked[1].T != 101 {
+		t.Errorf("acknowledged = %v; want 100 then 101", acked)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("error opening the sink file: %v", err)
+	}
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid JSON line %s: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("lines = %d; want 2", len(lines))
+	}
+	if lines[0]["op"] != OpSnapshot || lines[1]["op"] != OpDelete || lines[1]["coll"] != "coll1" {
+		t.Errorf("lines = %v", lines)
+	}
+}
+
+func TestNewSink(t *testing.T) {
+
+	if s, err := NewSink(config.SinkConfig{}, nil); s != nil || err != nil {
+		t.Errorf("NewSink(default) = %v, %v; want nil", s, err)
+	}
+	if _, err := NewSink(config.SinkConfig{Type: "kafka"}, nil); err == nil {
+		t.Errorf("NewSink(kafka) = nil; want an error")
+	}
+}
@@ -0,0 +1,77 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// The changes are applied to `repl.target`
+	TypeMongoDB = "mongodb"
+	// The change events are appended to a JSON Lines file
+	TypeFile = "file"
+	// The change events are posted to an HTTP endpoint
+	TypeWebhook = "webhook"
+)
+
+// A destination of the replicated changes other than a MongoDB target.
+// The checkpoint only moves forward once the destination acknowledged the
+// entries, which may happen after Write returns for the buffering sinks.
+type Sink interface {
+
+	// Load a batch of documents of the snapshot of a collection
+	Load(ctx context.Context, db string, collection string, docs []*bson.Raw) error
+
+	// Write the change events of the oplog entry at the given timestamp.
+	// The entries without event are written too: the acknowledgements
+	// follow the order of the oplog.
+	Write(ctx context.Context, ts primitive.Timestamp, events []*ChangeEvent) error
+
+	// Set the function called with the timestamp of the last entry
+	// acknowledged by the destination
+	OnAcknowledged(ack func(ts primitive.Timestamp))
+
+	// Write what is buffered, then release the resources
+	Close(ctx context.Context) error
+}
+
+// Open the sink of the configuration. Returns nil for the MongoDB target,
+// which is written by the replication itself.
+func NewSink(cfg config.SinkConfig, m *metrics.PipelineMetrics) (Sink, error) {
+	switch cfg.Type {
+	case "", TypeMongoDB:
+		return nil, nil
+	case TypeFile:
+		return NewFileSink(cfg.File)
+	case TypeWebhook:
+		return NewWebhookSink(cfg.Webhook, m)
+	}
+	return nil, fmt.Errorf("unknown sink type: %s", cfg.Type)
+}
+
+// Calls the acknowledgement function of a sink
+type acker struct {
+	mu  sync.Mutex
+	ack func(ts primitive.Timestamp)
+}
+
+func (a *acker) OnAcknowledged(ack func(ts primitive.Timestamp)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ack = ack
+}
+
+func (a *acker) acknowledge(ts primitive.Timestamp) {
+	a.mu.Lock()
+	ack := a.ack
+	a.mu.Unlock()
+	if ack != nil {
+		ack(ts)
+	}
+}
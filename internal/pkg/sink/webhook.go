@@ -0,0 +1,303 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// HMAC-SHA256 of the body, `sha256=<hex>`
+	SignatureHeader = "X-Signature"
+)
+
+// A batch of events, acknowledged up to the timestamp when it is set.
+// The events of an entry may span several batches, only the last one
+// acknowledges the entry.
+type webhookBatch struct {
+	events []*ChangeEvent
+	ts     primitive.Timestamp
+}
+
+// Posts the change events to an HTTP endpoint, as a JSON array, in batches
+// of up to `batch_size` events or after `linger_ms`. The batches are sent in
+// order by a single go routine and acknowledged on a 2xx response.
+type WebhookSink struct {
+	acker
+
+	cfg     config.WebhookSinkConfig
+	client  *http.Client
+	metrics *metrics.PipelineMetrics
+
+	// The batch being filled
+	mu      sync.Mutex
+	events  []*ChangeEvent
+	ts      primitive.Timestamp
+	pending bool
+	timer   *time.Timer
+	closing bool
+
+	// The batches to send
+	batches  chan *webhookBatch
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func NewWebhookSink(cfg config.WebhookSinkConfig, m *metrics.PipelineMetrics) (*WebhookSink, error) {
+
+	if cfg.Url == "" {
+		return nil, fmt.Errorf("the webhook sink requires an url")
+	}
+
+	s := &WebhookSink{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		metrics: m,
+		batches: make(chan *webhookBatch, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+// Post the documents of the snapshot, without waiting for a linger
+func (s *WebhookSink) Load(ctx context.Context, db string, collection string, docs []*bson.Raw) error {
+
+	events := make([]*ChangeEvent, 0, len(docs))
+	for _, raw := range docs {
+		var doc bson.D
+		if err := bson.Unmarshal(*raw, &doc); err != nil {
+			return err
+		}
+		events = append(events, &ChangeEvent{Operation: OpSnapshot, Db: db, Collection: collection,
+			Id: mdb.GetKey(doc, "_id"), Document: doc})
+	}
+
+	for len(events) > 0 {
+		n := min(len(events), s.cfg.BatchSize)
+		if err := s.post(ctx, events[:n]); err != nil {
+			return err
+		}
+		events = events[n:]
+	}
+	return nil
+}
+
+func (s *WebhookSink) Write(ctx context.Context, ts primitive.Timestamp, events []*ChangeEvent) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closing {
+		return fmt.Errorf("the webhook sink is closed")
+	}
+
+	// The events of a large entry are split, the entry is acknowledged with the last part
+	s.events = append(s.events, events...)
+	for len(s.events) > s.cfg.BatchSize {
+		if err := s.send(ctx, &webhookBatch{events: s.events[:s.cfg.BatchSize]}); err != nil {
+			return err
+		}
+		s.events = s.events[s.cfg.BatchSize:]
+	}
+	s.ts = ts
+	s.pending = true
+
+	if len(s.events) == s.cfg.BatchSize {
+		return s.flush(ctx)
+	}
+	if s.timer == nil {
+		s.timer = time.AfterFunc(time.Duration(s.cfg.Linger)*time.Millisecond, s.linger)
+	}
+	return nil
+}
+
+// Send the incomplete batch once the linger expired
+func (s *WebhookSink) linger() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.flush(context.Background()); err != nil {
+		log.Error("error sending the webhook batch: ", err)
+	}
+}
+
+// Send the batch being filled, the lock must be held
+func (s *WebhookSink) flush(ctx context.Context) error {
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if !s.pending {
+		return nil
+	}
+
+	batch := &webhookBatch{events: s.events, ts: s.ts}
+	s.events = nil
+	s.pending = false
+	return s.send(ctx, batch)
+}
+
+// Queue a batch, waits while the previous one is being sent
+func (s *WebhookSink) send(ctx context.Context, batch *webhookBatch) error {
+	select {
+	case s.batches <- batch:
+		return nil
+	case <-s.stop:
+		return fmt.Errorf("the webhook sink is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Post the batches in order. A batch which cannot be delivered stops the
+// replication: the next ones must not move the checkpoint past it.
+func (s *WebhookSink) run() {
+	defer close(s.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	for batch := range s.batches {
+		if len(batch.events) > 0 {
+			if err := s.post(ctx, batch.events); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Fatal("the webhook did not acknowledge the batch, stopping the replication: ", err)
+			}
+		}
+		if !batch.ts.IsZero() {
+			s.acknowledge(batch.ts)
+		}
+	}
+}
+
+// Post the events, retrying with an exponential backoff until a 2xx response
+func (s *WebhookSink) post(ctx context.Context, events []*ChangeEvent) error {
+
+	body, err := marshalEvents(events)
+	if err != nil {
+		return err
+	}
+
+	backoff := time.Duration(s.cfg.Backoff) * time.Millisecond
+	maxBackoff := max(time.Duration(s.cfg.MaxBackoff)*time.Millisecond, backoff)
+	for attempt := 1; ; attempt++ {
+
+		err = s.postOnce(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if s.cfg.Retries > 0 && attempt >= s.cfg.Retries {
+			return err
+		}
+
+		log.WarnWithFields("error posting to the webhook, retrying",
+			log.Fields{"err": err, "attempt": attempt, "backoff": backoff})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (s *WebhookSink) postOnce(ctx context.Context, body []byte) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range s.cfg.Headers {
+		req.Header.Set(name, value)
+	}
+	if s.cfg.Secret != "" {
+		req.Header.Set(SignatureHeader, "sha256="+Sign([]byte(s.cfg.Secret), body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		s.metrics.SinkRequestCounter.WithLabelValues("error").Inc()
+		return err
+	}
+	resp.Body.Close()
+
+	s.metrics.SinkRequestCounter.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+	return nil
+}
+
+// Send the buffered events, then wait for the pending batches
+// until the context is done
+func (s *WebhookSink) Close(ctx context.Context) error {
+
+	s.mu.Lock()
+	err := s.flush(ctx)
+	if !s.closing {
+		s.closing = true
+		close(s.batches)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		s.stopOnce.Do(func() { close(s.stop) })
+		<-s.done
+		return ctx.Err()
+	}
+	return err
+}
+
+// Hex encoded HMAC-SHA256 of the body
+func Sign(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The events as a JSON array
+func marshalEvents(events []*ChangeEvent) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i, event := range events {
+		data, err := event.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Records the batches received, failing the first requests
+type testWebhook struct {
+	mu       sync.Mutex
+	failures int
+	batches  [][]map[string]interface{}
+	badSigs  int
+}
+
+func (h *testWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if r.Header.Get(SignatureHeader) != "sha256="+Sign([]byte("secret"), body) {
+		h.badSigs++
+	}
+	if h.failures > 0 {
+		h.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	var batch []map[string]interface{}
+	json.Unmarshal(body, &batch)
+	h.batches = append(h.batches, batch)
+}
+
+func (h *testWebhook) received() [][]map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.batches
+}
+
+func newTestWebhookSink(t *testing.T, url string) *WebhookSink {
+	s, err := NewWebhookSink(config.WebhookSinkConfig{
+		Url:        url,
+		Secret:     "secret",
+		BatchSize:  2,
+		Linger:     50,
+		Timeout:    5,
+		Backoff:    10,
+		MaxBackoff: 20,
+	}, metrics.ForPipeline("test"))
+	if err != nil {
+		t.Fatalf("NewWebhookSink() = %v", err)
+	}
+	return s
+}
+
+func deleteEvent(id int) []*ChangeEvent {
+	events, _ := NewChangeEvents(newChangeLog("d", bson.D{{Key: "_id", Value: id}}, nil), nil)
+	return events
+}
+
+func TestWebhookSinkBatches(t *testing.T) {
+
+	hook := &testWebhook{failures: 2}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	s := newTestWebhookSink(t, server.URL)
+	var mu sync.Mutex
+	var acked []primitive.Timestamp
+	s.OnAcknowledged(func(ts primitive.Timestamp) {
+		mu.Lock()
+		defer mu.Unlock()
+		acked = append(acked, ts)
+	})
+
+	// A full batch, retried until acknowledged, then a lingering one
+	ctx := context.Background()
+	s.Write(ctx, primitive.Timestamp{T: 1}, deleteEvent(1))
+	s.Write(ctx, primitive.Timestamp{T: 2}, nil)
+	s.Write(ctx, primitive.Timestamp{T: 3}, deleteEvent(3))
+	s.Write(ctx, primitive.Timestamp{T: 4}, deleteEvent(4))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hook.received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s.Close(ctx); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	batches := hook.received()
+	if len(batches) != 2 || len(batches[0]) != 2 || len(batches[1]) != 1 {
+		t.Fatalf("batches = %v; want 2 then 1 events", batches)
+	}
+	if batches[0][0]["_id"] != float64(1) || batches[0][1]["_id"] != float64(3) {
+		t.Errorf("first batch = %v; want _id 1 and 3", batches[0])
+	}
+	if hook.badSigs != 0 {
+		t.Errorf("%d requests with an invalid signature", hook.badSigs)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(acked) != 2 || acked[0].T != 3 || acked[1].T != 4 {
+		t.Errorf("acknowledged = %v; want 3 then 4", acked)
+	}
+}
+
+func TestWebhookSinkNotAcknowledged(t *testing.T) {
+
+	hook := &testWebhook{failures: 1000}
+	server := httptest.NewServer(hook)
+	defer server.Close()
+
+	s := newTestWebhookSink(t, server.URL)
+	var acked atomic.Bool
+	s.OnAcknowledged(func(ts primitive.Timestamp) { acked.Store(true) })
+
+	s.Write(context.Background(), primitive.Timestamp{T: 1}, deleteEvent(1))
+
+	// The batch is retried until the deadline, never acknowledged
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := s.Close(ctx); err == nil {
+		t.Errorf("Close() = nil; want the deadline error")
+	}
+	if acked.Load() {
+		t.Errorf("the batch was acknowledged without a 2xx response")
+	}
+}
@@ -8,7 +8,11 @@ import (
 
 	"github.com/sebastienferry/mongo-repl/internal/pkg/interfaces"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -23,7 +27,17 @@ type DeltaReplication struct {
 	Database     string
 	Collection   string
 	Initial      bool
-	BatchSize    int
+
+	// The namespace on the target, after renaming
+	TargetDatabase   string
+	TargetCollection string
+	// Field level rules of the collection
+	Rules     *transform.Rules
+	BatchSize int
+	// Metrics of the pipeline
+	Metrics *metrics.PipelineMetrics
+	// Reports the progress with the status of the pipeline
+	Tracker *status.Tracker
 
 	// State variables
 	currentBatch  int
@@ -34,27 +48,64 @@ type DeltaReplication struct {
 }
 
 // Creates a new DeltaReplication object.
-func NewDeltaReplication(sourceReader interfaces.ItemReader, targetReader interfaces.ItemReader, targetWriter interfaces.ItemWriter,
+func NewDeltaReplication(p *pipeline.Pipeline, sourceReader interfaces.ItemReader, targetReader interfaces.ItemReader, targetWriter interfaces.ItemWriter,
 	database string, collection string, initial bool, batchSize int) *DeltaReplication {
+	targetDb, targetColl := p.Mapping.Target(database, collection)
 	return &DeltaReplication{
-		SourceReader: sourceReader,
-		TargetReader: targetReader,
-		TargetWriter: targetWriter,
-		Database:     database,
-		Collection:   collection,
-		Initial:      initial,
-		BatchSize:    batchSize,
+		SourceReader:     sourceReader,
+		TargetReader:     targetReader,
+		TargetWriter:     targetWriter,
+		Database:         database,
+		Collection:       collection,
+		Initial:          initial,
+		BatchSize:        batchSize,
+		TargetDatabase:   targetDb,
+		TargetCollection: targetColl,
+		Rules:            p.Transform.Rules(database, collection),
+		Metrics:          p.Metrics,
+		Tracker:          p.Tracker,
+	}
+}
+
+// Creates a new DeltaReplication object between the source collection
+// and its counterpart on the target, after renaming. Only the source documents
+// matching the predicate of the collection are read, so that the target ones
+// which stopped matching are deleted.
+func NewMappedDeltaReplication(p *pipeline.Pipeline, database string, collection string, initial bool) *DeltaReplication {
+	targetDb, targetColl := p.Mapping.Target(database, collection)
+	source := mdb.NewMongoItemReader(p.Registry.GetSource(), database, collection)
+	source.Metrics = p.Metrics
+	if predicate := p.Documents.Predicate(database, collection); predicate != nil {
+		source.Filter = predicate.Query()
 	}
+	writer := mdb.NewMongoWriter(p.Registry.GetTarget(), targetDb, targetColl)
+	writer.UpdateOnDuplicate = p.Config.Full.UpdateOnDuplicate
+	return NewDeltaReplication(p,
+		source,
+		mdb.NewMongoItemReader(p.Registry.GetTarget(), targetDb, targetColl),
+		writer,
+		database, collection, initial, p.Config.Full.BatchSize)
 }
 
 // Synchronize the collection.
 func (r *DeltaReplication) SynchronizeCollection(ctx context.Context) error {
+	err := r.synchronizeCollection(ctx)
+	if err != nil && r.Tracker != nil {
+		r.Tracker.Error(status.ErrorSnapshot)
+	}
+	return err
+}
+
+func (r *DeltaReplication) synchronizeCollection(ctx context.Context) error {
 
 	r.currentBatch = 1
 	r.firstId = primitive.ObjectID{}
 
 	// Prepare to track the replication progress
 	progress := NewSyncProgress(r.Database, r.Collection)
+	if r.Tracker != nil {
+		defer r.Tracker.Track(progress)()
+	}
 	total, err := r.SourceReader.Count(ctx)
 	if err != nil {
 		log.ErrorWithFields("error getting source count: ", log.Fields{
@@ -75,6 +126,13 @@ func (r *DeltaReplication) SynchronizeCollection(ctx context.Context) error {
 			return err
 		}
 
+		// Apply the field level rules before comparing with the target
+		if r.Rules != nil {
+			for _, item := range source {
+				*item = r.Rules.TransformDocument(*item)
+			}
+		}
+
 		lastId := primitive.ObjectID{}
 		if len(source) > 0 {
 			lastId = GetObjectId(source[len(source)-1])
@@ -125,8 +183,8 @@ func (r *DeltaReplication) SynchronizeCollection(ctx context.Context) error {
 
 			// Update the progress and metrics
 			progress.Increment(inserted.InsertedCount)
-			metrics.SnapshotWriteCounter.WithLabelValues(r.Database, r.Collection, metrics.InsertOp).Add(float64(inserted.InsertedCount))
-			metrics.SnapshotErrorTotal.WithLabelValues(r.Database, r.Collection, metrics.InsertOp).Add(float64(inserted.ErrorCount))
+			r.Metrics.SnapshotWriteCounter.WithLabelValues(r.TargetDatabase, r.TargetCollection, metrics.InsertOp).Add(float64(inserted.InsertedCount))
+			r.Metrics.SnapshotErrorTotal.WithLabelValues(r.TargetDatabase, r.TargetCollection, metrics.InsertOp).Add(float64(inserted.ErrorCount))
 		}
 
 		if len(r.itemsToUpdate) > 0 {
@@ -138,8 +196,8 @@ func (r *DeltaReplication) SynchronizeCollection(ctx context.Context) error {
 
 			// Update the progress and metrics
 			progress.Increment(updated.UpdatedCount)
-			metrics.SnapshotWriteCounter.WithLabelValues(r.Database, r.Collection, metrics.UpdateOp).Add(float64(updated.UpdatedCount))
-			metrics.SnapshotErrorTotal.WithLabelValues(r.Database, r.Collection, metrics.UpdateOp).Add(float64(updated.ErrorCount))
+			r.Metrics.SnapshotWriteCounter.WithLabelValues(r.TargetDatabase, r.TargetCollection, metrics.UpdateOp).Add(float64(updated.UpdatedCount))
+			r.Metrics.SnapshotErrorTotal.WithLabelValues(r.TargetDatabase, r.TargetCollection, metrics.UpdateOp).Add(float64(updated.ErrorCount))
 		}
 
 		if len(r.itemsToDelete) > 0 {
@@ -151,12 +209,12 @@ func (r *DeltaReplication) SynchronizeCollection(ctx context.Context) error {
 
 			// Update the metrics, but not the progress.
 			// Do not count the items to delete in the progress, only upsert to avoid goind over 100%
-			metrics.SnapshotWriteCounter.WithLabelValues(r.Database, r.Collection, metrics.DeleteOp).Add(float64(deleted.DeletedCount))
-			metrics.SnapshotErrorTotal.WithLabelValues(r.Database, r.Collection, metrics.DeleteOp).Add(float64(deleted.ErrorCount))
+			r.Metrics.SnapshotWriteCounter.WithLabelValues(r.TargetDatabase, r.TargetCollection, metrics.DeleteOp).Add(float64(deleted.DeletedCount))
+			r.Metrics.SnapshotErrorTotal.WithLabelValues(r.TargetDatabase, r.TargetCollection, metrics.DeleteOp).Add(float64(deleted.ErrorCount))
 		}
 
 		// Do not count the items to delete in the progress, only upsert to avoid goind over 100%
-		metrics.SnapshotProgressGauge.WithLabelValues(r.Database, r.Collection).Set(progress.Progress())
+		r.Metrics.SnapshotProgressGauge.WithLabelValues(r.Database, r.Collection).Set(progress.Progress())
 		r.currentBatch++
 	}
 	return nil
@@ -6,7 +6,9 @@ import (
 	"log"
 	"testing"
 
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mocks"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
@@ -23,6 +25,11 @@ func CreateTestData(items ...byte) []*bson.D {
 
 func TestCompareAndSync(t *testing.T) {
 
+	p, err := pipeline.New(&config.ReplConfig{Id: "test"})
+	if err != nil {
+		t.Fatalf("pipeline.New() = %v", err)
+	}
+
 	var data = []struct {
 		name     string
 		source   []*bson.D
@@ -84,7 +91,7 @@ func TestCompareAndSync(t *testing.T) {
 			target := mocks.NewMockDatabase(d.target)
 			//writer := NewMockDatabase(d.target)
 
-			synchronization := NewDeltaReplication(source, target, target, "test", "test", false, batchSize)
+			synchronization := NewDeltaReplication(p, source, target, target, "test", "test", false, batchSize)
 			synchronization.SynchronizeCollection(context.TODO())
 
 			// Check if the data was inserted
@@ -3,10 +3,13 @@ package snapshot
 import (
 	"context"
 
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/interfaces"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/transform"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
@@ -24,19 +27,28 @@ type DocumentReader struct {
 	Writer *DocumentWriter
 	// Progression state
 	Progress *SyncProgress
+	// Field level rules of the collection
+	Rules *transform.Rules
+	// Replicate only the documents matching the predicate
+	Predicate *filters.Predicate
+	// Metrics of the pipeline
+	Metrics *metrics.PipelineMetrics
 }
 
 const (
 	MAX_BUFFER_BYTE_SIZE = 12 * 1024 * 1024
 )
 
-func NewDocumentReader(database string, collection string, source *mdb.MDB, batchSize int, writer *DocumentWriter) *DocumentReader {
+func NewDocumentReader(p *pipeline.Pipeline, database string, collection string, source *mdb.MDB, batchSize int, writer *DocumentWriter) *DocumentReader {
 	return &DocumentReader{
 		Database:   database,
 		Collection: collection,
 		BatchSize:  batchSize,
 		Source:     source,
 		Writer:     writer,
+		Rules:      p.Transform.Rules(database, collection),
+		Predicate:  p.Documents.Predicate(database, collection),
+		Metrics:    p.Metrics,
 	}
 }
 
@@ -46,7 +58,13 @@ func (r *DocumentReader) Replicate(ctx context.Context) error {
 	log.Info("start syncing collection ", r.Collection)
 
 	// get total count
-	count, err := mdb.GetStatsByCollection(r.Source, r.Database, r.Collection)
+	var count int64
+	var err error
+	if r.Predicate != nil {
+		count, err = r.Source.Client.Database(r.Database).Collection(r.Collection).CountDocuments(ctx, r.Predicate.Query())
+	} else {
+		count, err = mdb.GetStatsByCollection(r.Source, r.Database, r.Collection)
+	}
 	if err != nil {
 		log.Error("error getting collection stats: ", err)
 		return err
@@ -69,6 +87,9 @@ func (r *DocumentReader) Replicate(ctx context.Context) error {
 	// Filter the documents
 	filter := bson.D{{}}
 	//filter = append(filter, bson.D{"_id", bson.D{{"$gt", r.lastId}}})
+	if r.Predicate != nil {
+		filter = r.Predicate.Query()
+	}
 
 	// Read the documents
 	db := r.Source.Client.Database(r.Database)
@@ -100,6 +121,15 @@ func (r *DocumentReader) Replicate(ctx context.Context) error {
 			cur.Close(ctx)
 		}
 
+		// Apply the field level rules
+		if r.Rules != nil {
+			if raw, err = r.Rules.TransformRaw(raw); err != nil {
+				log.Error("error transforming document: ", err)
+				cur.Close(ctx)
+				return err
+			}
+		}
+
 		// Wait for the QPS limit
 		limit.Wait()
 
@@ -108,7 +138,7 @@ func (r *DocumentReader) Replicate(ctx context.Context) error {
 		limit.Incr(count)
 
 		// Successfully read a batch of documents. Increment the counter
-		metrics.SnapshotReadCounter.WithLabelValues(r.Database, r.Collection).Inc()
+		r.Metrics.SnapshotReadCounter.WithLabelValues(r.Database, r.Collection).Inc()
 
 		if bufferByteSize+len(raw) > MAX_BUFFER_BYTE_SIZE || len(buffer) >= bufferSize {
 
@@ -155,11 +185,12 @@ func (r *DocumentReader) Replicate(ctx context.Context) error {
 func (r *DocumentReader) ReportResult(result interfaces.BulkResult) {
 	// TODO : Should we reflect the success rate or the progress ?
 	r.Progress.Increment(result.InsertedCount + result.UpdatedCount + result.SkippedOnDuplicateCount + result.ErrorCount)
-	metrics.SnapshotWriteCounter.WithLabelValues(r.Database, r.Collection, "insert").Add(float64(result.InsertedCount))
-	metrics.SnapshotWriteCounter.WithLabelValues(r.Database, r.Collection, "update").Add(float64(result.UpdatedCount))
-	metrics.SnapshotErrorTotal.WithLabelValues(r.Database, r.Collection, "skip").Add(float64(result.SkippedOnDuplicateCount))
-	metrics.SnapshotErrorTotal.WithLabelValues(r.Database, r.Collection, "bulk").Add(float64(result.ErrorCount))
-	metrics.SnapshotProgressGauge.WithLabelValues(r.Database, r.Collection).Set(r.Progress.Progress())
+	// Writes are reported under the target namespace
+	r.Metrics.SnapshotWriteCounter.WithLabelValues(r.Writer.Database, r.Writer.Collection, "insert").Add(float64(result.InsertedCount))
+	r.Metrics.SnapshotWriteCounter.WithLabelValues(r.Writer.Database, r.Writer.Collection, "update").Add(float64(result.UpdatedCount))
+	r.Metrics.SnapshotErrorTotal.WithLabelValues(r.Writer.Database, r.Writer.Collection, "skip").Add(float64(result.SkippedOnDuplicateCount))
+	r.Metrics.SnapshotErrorTotal.WithLabelValues(r.Writer.Database, r.Writer.Collection, "bulk").Add(float64(result.ErrorCount))
+	r.Metrics.SnapshotProgressGauge.WithLabelValues(r.Database, r.Collection).Set(r.Progress.Progress())
 }
 
 // Set the total count of documents to sync
@@ -1,10 +1,13 @@
 package snapshot
 
 import (
+	"context"
+
 	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/interfaces"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/sink"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -19,6 +22,10 @@ type DocumentWriter struct {
 	Target *mdb.MDB
 	// Progression state
 	Progress *SyncProgress
+	// Update the documents failing to insert on duplicate keys
+	UpdateOnDuplicate bool
+	// Set when the documents are loaded to a sink instead of the target
+	Sink sink.Sink
 }
 
 func NewDocumentWriter(database string, collection string, target *mdb.MDB) *DocumentWriter {
@@ -39,6 +46,15 @@ func (r *DocumentWriter) WriteDocuments(docs []*bson.Raw) (interfaces.BulkResult
 		return result, nil
 	}
 
+	if r.Sink != nil {
+		if err := r.Sink.Load(context.Background(), r.Database, r.Collection, docs); err != nil {
+			result.ErrorCount = len(docs)
+			return result, err
+		}
+		result.InsertedCount = len(docs)
+		return result, nil
+	}
+
 	var models []mongo.WriteModel
 	for _, doc := range docs {
 		models = append(models, mongo.NewInsertOneModel().SetDocument(doc))
@@ -58,7 +74,7 @@ func (r *DocumentWriter) WriteDocuments(docs []*bson.Raw) (interfaces.BulkResult
 
 	// Bulk write the documents
 	opts := options.BulkWrite().SetOrdered(false)
-	_, err := mdb.Registry.GetTarget().Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, models, opts)
+	_, err := r.Target.Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, models, opts)
 
 	// All documents were successfully written
 	if err == nil {
@@ -81,7 +97,7 @@ func (r *DocumentWriter) WriteDocuments(docs []*bson.Raw) (interfaces.BulkResult
 
 		if mdb.IsDuplicateKeyError(wError) {
 
-			if config.Current.Repl.Full.UpdateOnDuplicate {
+			if r.UpdateOnDuplicate {
 
 				log.WarnWithFields("insert of documents failed, attempting to update them",
 					log.Fields{
@@ -131,7 +147,7 @@ func (r *DocumentWriter) WriteDocuments(docs []*bson.Raw) (interfaces.BulkResult
 
 	if len(updateModels) != 0 {
 		opts := options.BulkWrite().SetOrdered(false)
-		_, err := mdb.Registry.GetTarget().Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, updateModels, opts)
+		_, err := r.Target.Client.Database(r.Database).Collection(r.Collection).BulkWrite(nil, updateModels, opts)
 		if err != nil {
 			result.ErrorCount = len(updateModels)
 			return result, err
@@ -1,27 +1,51 @@
 package snapshot
 
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
+)
+
 type SyncProgress struct {
 	Database   string
 	Collection string
-	total      int64
-	processed  int64
+	started    time.Time
+	total      atomic.Int64
+	processed  atomic.Int64
 }
 
 func NewSyncProgress(database string, collection string) *SyncProgress {
 	return &SyncProgress{
 		Database:   database,
 		Collection: collection,
+		started:    time.Now(),
 	}
 }
 
 func (f *SyncProgress) SetTotal(total int64) {
-	f.total = total
+	f.total.Store(total)
 }
 
 func (f *SyncProgress) Increment(incr int) {
-	f.processed += int64(incr)
+	f.processed.Add(int64(incr))
 }
 
 func (f *SyncProgress) Progress() float64 {
-	return float64(f.processed) / float64(f.total)
+	return float64(f.processed.Load()) / float64(f.total.Load())
+}
+
+// The progress of the collection, for the status of the pipeline
+func (f *SyncProgress) Report() status.CollectionProgress {
+	report := status.CollectionProgress{
+		Database:   f.Database,
+		Collection: f.Collection,
+		Total:      f.total.Load(),
+		Processed:  f.processed.Load(),
+		StartedAt:  f.started,
+	}
+	if report.Total > 0 {
+		report.Progress = float64(report.Processed) / float64(report.Total)
+	}
+	return report
 }
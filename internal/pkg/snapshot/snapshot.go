@@ -2,6 +2,7 @@ package snapshot
 
 import (
 	"context"
+	"errors"
 	"sync"
 	"time"
 
@@ -9,6 +10,8 @@ import (
 	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/status"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
@@ -16,11 +19,13 @@ import (
 )
 
 type Snapshot struct {
+	p    *pipeline.Pipeline
 	ckpt checkpoint.CheckpointManager
 }
 
-func NewSnapshot(ckpt checkpoint.CheckpointManager) *Snapshot {
+func NewSnapshot(p *pipeline.Pipeline, ckpt checkpoint.CheckpointManager) *Snapshot {
 	return &Snapshot{
+		p:    p,
 		ckpt: ckpt,
 	}
 }
@@ -28,13 +33,16 @@ func NewSnapshot(ckpt checkpoint.CheckpointManager) *Snapshot {
 func (s *Snapshot) RunSnapshots(ctx context.Context, dbAndCollections map[string][]string) {
 
 	// Get the oplog windows
-	oplogWindow, err := checkpoint.GetReplicasetOplogWindow()
+	oplogWindow, err := checkpoint.GetReplicasetOplogWindow(s.p.Registry.GetSource())
 	if err != nil {
 		log.Fatal("error computing oplog window: ", err)
 	}
 
-	// Replicate the collections
+	// Replicate the collections, until stopped
 	for db, cols := range dbAndCollections {
+		if ctx.Err() != nil {
+			break
+		}
 
 		var wg sync.WaitGroup
 		var replErr error
@@ -42,31 +50,21 @@ func (s *Snapshot) RunSnapshots(ctx context.Context, dbAndCollections map[string
 
 			// Filter the collections to replicate
 			// FilterIn has priority over FilterOut
-			if len(config.Current.Repl.FiltersIn) > 0 {
-				if _, ok := config.Current.Repl.FiltersIn[collection]; !ok {
-					log.Info("skipping collection (filtered by configuration): ", collection)
-					continue
-				}
-			} else if len(config.Current.Repl.FiltersOut) > 0 {
-				if _, ok := config.Current.Repl.FiltersOut[collection]; ok {
-					log.Info("skipping collection (filtered by configuration): ", collection)
-					continue
-				}
+			if !s.p.Namespaces.Keep(db, collection) {
+				log.Info("skipping collection (filtered by configuration): ", db+"."+collection)
+				continue
 			}
 
 			// Replicate the collection in a separate goroutine
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
-				if config.IsFeatureEnabled(config.DeltaReplication) {
+				if s.p.Config.IsFeatureEnabled(config.DeltaReplication) {
 					// Use the new delta replication
-					or := mdb.NewMongoItemReader(mdb.Registry.GetSource(), db, collection)
-					tr := mdb.NewMongoItemReader(mdb.Registry.GetTarget(), db, collection)
-					tw := mdb.NewMongoWriter(mdb.Registry.GetTarget(), db, collection)
-					delta := NewDeltaReplication(or, tr, tw, db, collection, true, config.Current.Repl.Full.BatchSize)
-					delta.SynchronizeCollection(context.Background())
+					delta := NewMappedDeltaReplication(s.p, db, collection, true)
+					delta.SynchronizeCollection(ctx)
 				} else {
-					replErr = s.RunSnapshot(context.Background(), db, collection)
+					replErr = s.RunSnapshot(ctx, db, collection)
 				}
 			}()
 		}
@@ -77,7 +75,7 @@ func (s *Snapshot) RunSnapshots(ctx context.Context, dbAndCollections map[string
 			"database": db,
 		})
 
-		if replErr != nil {
+		if replErr != nil && ctx.Err() == nil {
 			log.Fatal("error replicating the collections: ", replErr)
 		}
 
@@ -86,34 +84,58 @@ func (s *Snapshot) RunSnapshots(ctx context.Context, dbAndCollections map[string
 			"oldest": time.Unix(int64(oplogWindow.Oldest.T), 0),
 			"newest": time.Unix(int64(oplogWindow.Newest.T), 0),
 		})
+	}
 
-		// As the full replication is finished, we can save the checkpoint
-		s.ckpt.SetCheckpoint(ctx, oplogWindow.Newest, true)
+	// Once every database is replicated, the incremental replication can start.
+	// Unless the leadership was lost meanwhile.
+	if ctx.Err() != nil {
+		log.Warn("snapshot interrupted, the checkpoint is not saved")
+		return
+	}
+	if err := s.ckpt.SetCheckpoint(ctx, oplogWindow.Newest, true); errors.Is(err, checkpoint.ErrFenced) {
+		log.Warn("the checkpoint of the snapshot is fenced by a newer leader")
+	} else if err != nil {
+		log.Fatal("error saving the checkpoint of the snapshot: ", err)
 	}
 }
 
 func (s *Snapshot) RunSnapshot(ctx context.Context, database string, collection string) error {
 
-	writer := NewDocumentWriter(database, collection, mdb.Registry.GetTarget())
-	reader := NewDocumentReader(database, collection, mdb.Registry.GetSource(),
-		config.Current.Repl.Full.BatchSize, writer)
+	targetDb, targetColl := s.p.Mapping.Target(database, collection)
+	var target *mdb.MDB
+	if s.p.Sink == nil {
+		target = s.p.Registry.GetTarget()
+	}
+	writer := NewDocumentWriter(targetDb, targetColl, target)
+	writer.UpdateOnDuplicate = s.p.Config.Full.UpdateOnDuplicate
+	writer.Sink = s.p.Sink
+	reader := NewDocumentReader(s.p, database, collection, s.p.Registry.GetSource(),
+		s.p.Config.Full.BatchSize, writer)
 
 	// Keep track of the progress for reporting
 	progress := NewSyncProgress(database, collection)
 	writer.SetProgress(progress)
 	reader.SetProgress(progress)
+	defer s.p.Tracker.Track(progress)()
 
 	// Start the replication
 	err := reader.Replicate(ctx)
 	if err != nil {
 		log.Error("error replicating the collection: ", err)
+		s.p.Tracker.Error(status.ErrorSnapshot)
 		return err
 	}
 
+	// The indexes only exist on a MongoDB target
+	if s.p.Sink != nil {
+		return nil
+	}
+
 	// Replicate the indexes
 	err = s.ReplicateIndexes(ctx, database, collection)
 	if err != nil {
 		log.Error("error replicating the indexes: ", err)
+		s.p.Tracker.Error(status.ErrorSnapshot)
 		return err
 	}
 
@@ -124,7 +146,7 @@ func (s *Snapshot) RunSnapshot(ctx context.Context, database string, collection
 func (s *Snapshot) ReplicateIndexes(ctx context.Context, database string, collection string) error {
 
 	// Get the indexes from the source
-	indexes, err := mdb.GetIndexesByDb(ctx, database, collection)
+	indexes, err := mdb.GetIndexesByDb(ctx, s.p.Registry.GetSource(), database, collection)
 	if err != nil {
 		log.Error("error getting the indexes: ", err)
 		return err
@@ -160,7 +182,8 @@ func (s *Snapshot) ReplicateIndexes(ctx context.Context, database string, collec
 			Options: opts,
 		}
 
-		coll := mdb.Registry.GetTarget().Client.Database(database).Collection(collection)
+		targetDb, targetColl := s.p.Mapping.Target(database, collection)
+		coll := s.p.Registry.GetTarget().Client.Database(targetDb).Collection(targetColl)
 		newName, err := coll.Indexes().CreateOne(ctx, newIndex)
 		if err != nil {
 			log.Error("error creating the index: ", err)
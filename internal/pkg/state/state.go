@@ -0,0 +1,247 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
+)
+
+const (
+	StateUnknown     = iota
+	StateInitialSync = 1
+	StateCatchingUp  = 2
+	StateStreaming   = 3
+	StatePaused      = 4
+	StateResyncing   = 5
+	StateCutover     = 6
+	StateError       = 7
+)
+
+var (
+	States = map[int]string{
+		StateUnknown:     "unknown",
+		StateInitialSync: "initial_sync",
+		StateCatchingUp:  "catching_up",
+		StateStreaming:   "streaming",
+		StatePaused:      "paused",
+		StateResyncing:   "resyncing",
+		StateCutover:     "cutover",
+		StateError:       "error",
+	}
+
+	// The states reachable from each state. The replication (re)starts in
+	// the initial sync or catching up states, whatever the previous one.
+	transitions = map[int][]int{
+		StateUnknown:     {StateError},
+		StateInitialSync: {StateCatchingUp, StateError},
+		StateCatchingUp:  {StateStreaming, StatePaused, StateResyncing, StateCutover, StateError},
+		StateStreaming:   {StateCatchingUp, StatePaused, StateResyncing, StateCutover, StateError},
+		StatePaused:      {StateCatchingUp, StateError},
+		StateResyncing:   {StateCatchingUp, StatePaused, StateError},
+		StateCutover:     {StateCatchingUp, StateError},
+		StateError:       {},
+	}
+)
+
+const (
+	// Transitions kept in the saved state
+	MaxTransitions = 50
+)
+
+// A state change of the replication
+type Transition struct {
+	From   string    `bson:"from" json:"from"`
+	To     string    `bson:"to" json:"to"`
+	Reason string    `bson:"reason" json:"reason"`
+	At     time.Time `bson:"at" json:"at"`
+}
+
+// The state of the replication and its last transitions, the most recent last
+type Record struct {
+	State       string       `bson:"state" json:"state"`
+	Since       time.Time    `bson:"since" json:"since"`
+	Reason      string       `bson:"reason" json:"reason"`
+	Transitions []Transition `bson:"transitions" json:"transitions"`
+}
+
+// Where the state is saved, next to the checkpoint
+type Store interface {
+	SaveState(ctx context.Context, state any) error
+	LoadState(ctx context.Context, state any) (bool, error)
+}
+
+// Validates and records the state transitions of a replication
+type Machine struct {
+	mu      sync.Mutex
+	current int
+	record  Record
+	store   Store
+
+	gauge   *prometheus.GaugeVec
+	counter *prometheus.CounterVec
+}
+
+// The metrics are labelled by state, and by the from and to states
+func NewMachine(gauge *prometheus.GaugeVec, counter *prometheus.CounterVec) *Machine {
+	m := &Machine{
+		record: Record{
+			State:       States[StateUnknown],
+			Transitions: []Transition{},
+		},
+		gauge:   gauge,
+		counter: counter,
+	}
+	m.report()
+	return m
+}
+
+// Load the saved state, which is then saved on every transition
+func (m *Machine) Load(ctx context.Context, store Store) error {
+
+	record := Record{}
+	found, err := store.LoadState(ctx, &record)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store = store
+	if !found {
+		return nil
+	}
+	for id, name := range States {
+		if name == record.State {
+			m.current = id
+			m.record = record
+			break
+		}
+	}
+	if m.record.Transitions == nil {
+		m.record.Transitions = []Transition{}
+	}
+	m.report()
+	return nil
+}
+
+// The current state
+func (m *Machine) Current() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.current
+}
+
+// A copy of the state and its transitions
+func (m *Machine) Record() Record {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record := m.record
+	record.Transitions = append([]Transition{}, m.record.Transitions...)
+	return record
+}
+
+// Start the replication in the initial sync or catching up state,
+// whatever the previous state
+func (m *Machine) Start(ctx context.Context, to int, reason string) error {
+	if to != StateInitialSync && to != StateCatchingUp {
+		return fmt.Errorf("cannot start in the %s state", States[to])
+	}
+	return m.change(ctx, to, reason, nil)
+}
+
+// Move to a state reachable from the current one
+func (m *Machine) Transition(ctx context.Context, to int, reason string) error {
+	return m.change(ctx, to, reason, func(from int) error {
+		for _, allowed := range transitions[from] {
+			if allowed == to {
+				return nil
+			}
+		}
+		return fmt.Errorf("invalid transition from %s to %s", States[from], States[to])
+	})
+}
+
+// Move to a state only from the given one, e.g. when the current
+// state may have been changed by a command meanwhile
+func (m *Machine) TransitionFrom(ctx context.Context, from int, to int, reason string) (bool, error) {
+	changed := false
+	err := m.change(ctx, to, reason, func(current int) error {
+		if current != from {
+			return errUnchanged
+		}
+		changed = true
+		return nil
+	})
+	if err == errUnchanged {
+		return false, nil
+	}
+	return changed, err
+}
+
+// Move to the error state, from any state
+func (m *Machine) Fail(ctx context.Context, err error) {
+	if err := m.change(ctx, StateError, err.Error(), nil); err != nil {
+		log.Error("error saving the replication state: ", err)
+	}
+}
+
+var errUnchanged = fmt.Errorf("state unchanged")
+
+func (m *Machine) change(ctx context.Context, to int, reason string, check func(from int) error) error {
+
+	m.mu.Lock()
+	from := m.current
+	if check != nil {
+		if err := check(from); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+
+	now := time.Now()
+	m.current = to
+	m.record.State = States[to]
+	m.record.Since = now
+	m.record.Reason = reason
+	m.record.Transitions = append(m.record.Transitions, Transition{
+		From:   States[from],
+		To:     States[to],
+		Reason: reason,
+		At:     now,
+	})
+	if n := len(m.record.Transitions); n > MaxTransitions {
+		m.record.Transitions = append([]Transition{}, m.record.Transitions[n-MaxTransitions:]...)
+	}
+	m.report()
+	if m.counter != nil {
+		m.counter.WithLabelValues(States[from], States[to]).Inc()
+	}
+	record, store := m.record, m.store
+	record.Transitions = append([]Transition{}, m.record.Transitions...)
+	m.mu.Unlock()
+
+	log.InfoWithFields("replication state", log.Fields{"from": States[from], "to": States[to], "reason": reason})
+	if store == nil {
+		return nil
+	}
+	return store.SaveState(ctx, record)
+}
+
+// Set the gauge of the current state to 1, the others to 0.
+// Must be called with the lock held.
+func (m *Machine) report() {
+	if m.gauge == nil {
+		return
+	}
+	for id, name := range States {
+		value := 0.0
+		if id == m.current {
+			value = 1
+		}
+		m.gauge.WithLabelValues(name).Set(value)
+	}
+}
@@ -0,0 +1,113 @@
+package state
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/checkpoint"
+)
+
+func TestTransition(t *testing.T) {
+
+	ctx := context.Background()
+	m := NewMachine(nil, nil)
+
+	// Only the initial sync and the catch up start the replication
+	if err := m.Start(ctx, StateStreaming, "test"); err == nil {
+		t.Errorf("Start(streaming) = nil; want an error")
+	}
+	if err := m.Start(ctx, StateInitialSync, "no checkpoint"); err != nil {
+		t.Fatalf("Start(initial_sync) = %v", err)
+	}
+
+	tests := []struct {
+		to    int
+		valid bool
+	}{
+		{StateStreaming, false},
+		{StateCatchingUp, true},
+		{StateStreaming, true},
+		{StatePaused, true},
+		{StateResyncing, false},
+		{StateCatchingUp, true},
+		{StateCutover, true},
+		{StatePaused, false},
+		{StateCatchingUp, true},
+		{StateError, true},
+		{StateCatchingUp, false},
+	}
+	for _, test := range tests {
+		from := m.Current()
+		err := m.Transition(ctx, test.to, "test")
+		if test.valid != (err == nil) {
+			t.Errorf("Transition(%s -> %s) = %v; want valid = %v", States[from], States[test.to], err, test.valid)
+		}
+	}
+
+	// Restarted after the error
+	if err := m.Start(ctx, StateCatchingUp, "restarted"); err != nil {
+		t.Errorf("Start(catching_up) = %v", err)
+	}
+
+	record := m.Record()
+	if record.State != "catching_up" || record.Reason != "restarted" || len(record.Transitions) != 9 {
+		t.Errorf("Record() = %+v; want 9 transitions up to catching_up", record)
+	}
+	if first := record.Transitions[0]; first.From != "unknown" || first.To != "initial_sync" || first.At.IsZero() {
+		t.Errorf("Record().Transitions[0] = %+v; want unknown -> initial_sync", first)
+	}
+}
+
+func TestTransitionFrom(t *testing.T) {
+
+	ctx := context.Background()
+	m := NewMachine(nil, nil)
+	m.Start(ctx, StateCatchingUp, "test")
+
+	if changed, err := m.TransitionFrom(ctx, StateResyncing, StateCatchingUp, "test"); changed || err != nil {
+		t.Errorf("TransitionFrom(resyncing) = %v, %v; want unchanged", changed, err)
+	}
+	if changed, err := m.TransitionFrom(ctx, StateCatchingUp, StateStreaming, "test"); !changed || err != nil {
+		t.Errorf("TransitionFrom(catching_up) = %v, %v; want changed", changed, err)
+	}
+	if m.Current() != StateStreaming {
+		t.Errorf("Current() = %s; want streaming", States[m.Current()])
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	ctx := context.Background()
+	ckpt, err := checkpoint.NewFileCheckpoint(t.TempDir(), "rs0_to_rs1")
+	if err != nil {
+		t.Fatalf("NewFileCheckpoint() = %v", err)
+	}
+
+	m := NewMachine(nil, nil)
+	if err := m.Load(ctx, ckpt); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	m.Start(ctx, StateCatchingUp, "test")
+	for i := 0; i < MaxTransitions; i++ {
+		m.Transition(ctx, StatePaused, "paused")
+		m.Transition(ctx, StateCatchingUp, "resumed")
+	}
+
+	loaded := NewMachine(nil, nil)
+	if err := loaded.Load(ctx, ckpt); err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	record := loaded.Record()
+	if loaded.Current() != StateCatchingUp || record.Reason != "resumed" {
+		t.Errorf("Load() = %+v; want the saved state", record)
+	}
+	if len(record.Transitions) != MaxTransitions {
+		t.Errorf("Load() = %d transitions; want %d", len(record.Transitions), MaxTransitions)
+	}
+
+	// The transitions are saved once loaded
+	loaded.Transition(ctx, StatePaused, "paused again")
+	if err := m.Load(ctx, ckpt); err != nil || m.Current() != StatePaused {
+		t.Errorf("Load() = %v, %s; want paused", err, States[m.Current()])
+	}
+}
@@ -4,19 +4,20 @@ import (
 	"context"
 	"time"
 
-	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/log"
 	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
-	"github.com/sebastienferry/mongo-repl/internal/pkg/metrics"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/pipeline"
 )
 
 type CollectionStats struct {
+	p           *pipeline.Pipeline
 	collections map[string][]string
 	done        chan bool
 }
 
-func NewCollectionStats(initialConnections map[string][]string) *CollectionStats {
+func NewCollectionStats(p *pipeline.Pipeline, initialConnections map[string][]string) *CollectionStats {
 	return &CollectionStats{
+		p:           p,
 		collections: initialConnections,
 		done:        make(chan bool),
 	}
@@ -32,6 +33,8 @@ func (c *CollectionStats) StartCollectionStats(ctx context.Context) {
 			case <-time.After(30 * time.Second):
 			case <-c.done:
 				return
+			case <-ctx.Done():
+				return
 			}
 
 			for db, collections := range c.collections {
@@ -41,7 +44,7 @@ func (c *CollectionStats) StartCollectionStats(ctx context.Context) {
 			// Every 4 iterations, we refresh the list of collections
 			// from the source database.
 			if iter%4 == 0 {
-				cols, err := mdb.GetCollections(ctx, config.Current.Repl.Databases)
+				cols, err := mdb.GetReplicatedCollections(ctx, c.p.Registry.GetSource(), c.p.Namespaces)
 				if err != nil {
 					log.Error("error getting the list of collections to replicate: ", err)
 					continue
@@ -58,19 +61,26 @@ func (c *CollectionStats) getCollectionStats(db string, collections []string) {
 	for _, collection := range collections {
 
 		// GEt the stats for the source and target
-		count, err := mdb.GetStatsByCollection(mdb.Registry.GetSource(), db, collection)
+		count, err := mdb.GetStatsByCollection(c.p.Registry.GetSource(), db, collection)
 		if err != nil {
 			continue
 		}
 
-		metrics.MongoReplSourceTotalDocumentCount.WithLabelValues("source", db, collection).Set(float64(count))
+		c.p.Metrics.MongoReplSourceTotalDocumentCount.WithLabelValues("source", db, collection).Set(float64(count))
+
+		// The changes may go to a sink only
+		if !c.p.Registry.HasTarget() {
+			continue
+		}
 
-		count, err = mdb.GetStatsByCollection(mdb.Registry.GetTarget(), db, collection)
+		// The collection may be renamed on the target
+		targetDb, targetColl := c.p.Mapping.Target(db, collection)
+		count, err = mdb.GetStatsByCollection(c.p.Registry.GetTarget(), targetDb, targetColl)
 		if err != nil {
 			continue
 		}
 
-		metrics.MongoReplSourceTotalDocumentCount.WithLabelValues("target", db, collection).Set(float64(count))
+		c.p.Metrics.MongoReplSourceTotalDocumentCount.WithLabelValues("target", targetDb, targetColl).Set(float64(count))
 	}
 }
 
@@ -0,0 +1,114 @@
+package status
+
+import (
+	"maps"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	// Kinds of the errors counted
+	ErrorSnapshot   = "snapshot"
+	ErrorOplogRead  = "oplog_read"
+	ErrorOplogWrite = "oplog_write"
+)
+
+// What the running incremental replication exposes
+type Replication interface {
+	// Timestamp up to which the target is consistent with the source.
+	AppliedTimestamp() primitive.Timestamp
+	// Number of oplog entries read and waiting for the writer.
+	QueueDepth() int
+	// Namespaces waiting for a snapshot, `db.collection`.
+	QueuedSnapshots() []string
+}
+
+// Progress of the copy of a collection
+type CollectionProgress struct {
+	Database   string    `json:"database"`
+	Collection string    `json:"collection"`
+	Total      int64     `json:"total"`
+	Processed  int64     `json:"processed"`
+	Progress   float64   `json:"progress"`
+	StartedAt  time.Time `json:"started_at"`
+}
+
+// A collection copy in progress
+type Progress interface {
+	Report() CollectionProgress
+}
+
+// Keeps track of what a pipeline is doing, for its status
+type Tracker struct {
+	mu       sync.Mutex
+	started  time.Time
+	repl     Replication
+	progress map[Progress]struct{}
+	errors   map[string]int64
+}
+
+func NewTracker() *Tracker {
+	return &Tracker{
+		started:  time.Now(),
+		progress: make(map[Progress]struct{}),
+		errors:   make(map[string]int64),
+	}
+}
+
+// Attach the running incremental replication. Passing nil detaches it.
+func (t *Tracker) Attach(repl Replication) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.repl = repl
+}
+
+// The attached incremental replication, nil when not running
+func (t *Tracker) Replication() Replication {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.repl
+}
+
+// Track the progress of a collection copy until the returned function is called
+func (t *Tracker) Track(p Progress) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress[p] = struct{}{}
+	return func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		delete(t.progress, p)
+	}
+}
+
+// The collection copies in progress
+func (t *Tracker) Progress() []CollectionProgress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress := make([]CollectionProgress, 0, len(t.progress))
+	for p := range t.progress {
+		progress = append(progress, p.Report())
+	}
+	return progress
+}
+
+// Count an error of the given kind
+func (t *Tracker) Error(kind string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.errors[kind]++
+}
+
+// The errors counted by kind
+func (t *Tracker) Errors() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return maps.Clone(t.errors)
+}
+
+// When the pipeline started
+func (t *Tracker) Started() time.Time {
+	return t.started
+}
@@ -0,0 +1,54 @@
+package status
+
+import (
+	"testing"
+)
+
+type fakeProgress struct {
+	name string
+}
+
+func (f *fakeProgress) Report() CollectionProgress {
+	return CollectionProgress{Database: "db", Collection: f.name}
+}
+
+func TestTrackerProgress(t *testing.T) {
+
+	tracker := NewTracker()
+	untrackUsers := tracker.Track(&fakeProgress{name: "users"})
+	untrackOrders := tracker.Track(&fakeProgress{name: "orders"})
+
+	if progress := tracker.Progress(); len(progress) != 2 {
+		t.Fatalf("Progress() = %v; want 2 collections", progress)
+	}
+
+	untrackUsers()
+	progress := tracker.Progress()
+	if len(progress) != 1 || progress[0].Collection != "orders" {
+		t.Errorf("Progress() = %v; want orders only", progress)
+	}
+
+	untrackOrders()
+	if progress := tracker.Progress(); len(progress) != 0 {
+		t.Errorf("Progress() = %v; want none", progress)
+	}
+}
+
+func TestTrackerErrors(t *testing.T) {
+
+	tracker := NewTracker()
+	tracker.Error(ErrorOplogRead)
+	tracker.Error(ErrorOplogRead)
+	tracker.Error(ErrorSnapshot)
+
+	errors := tracker.Errors()
+	if errors[ErrorOplogRead] != 2 || errors[ErrorSnapshot] != 1 || errors[ErrorOplogWrite] != 0 {
+		t.Errorf("Errors() = %v; want 2 oplog read and 1 snapshot errors", errors)
+	}
+
+	// A copy is returned
+	errors[ErrorSnapshot] = 10
+	if tracker.Errors()[ErrorSnapshot] != 1 {
+		t.Errorf("Errors() is not a copy")
+	}
+}
@@ -0,0 +1,475 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/filters"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+	ActionDrop    = "drop"
+	ActionHash    = "hash"
+	ActionMask    = "mask"
+	ActionReplace = "replace"
+
+	// Replaces the values which are not strings when masked
+	MaskValue = "****"
+	MaskChar  = "*"
+)
+
+// Applies the field level rules of the namespaces
+type Transformer struct {
+	namespaces []namespaceRules
+}
+
+type namespaceRules struct {
+	namespace filters.NamespaceMatcher
+	rules     *Rules
+}
+
+// The rules of a namespace. A nil *Rules leaves the documents unchanged.
+type Rules struct {
+	keep   []string
+	fields []fieldRule
+}
+
+type fieldRule struct {
+	path    string
+	action  string
+	value   interface{}
+	salt    string
+	visible int
+}
+
+func NewTransformer(transforms []config.TransformConfig) (*Transformer, error) {
+
+	t := &Transformer{}
+	for _, cfg := range transforms {
+
+		namespace, err := filters.NewNamespaceMatcher(cfg.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("invalid transform namespace: %v", err)
+		}
+
+		rules := &Rules{keep: cfg.Keep}
+		for _, field := range cfg.Fields {
+			if field.Path == "" {
+				return nil, fmt.Errorf("transform %s: missing field path", cfg.Namespace)
+			}
+			switch field.Action {
+			case ActionDrop, ActionHash, ActionMask:
+			case ActionReplace:
+				if !isScalar(field.Value) {
+					return nil, fmt.Errorf("transform %s: the value of %s must be a scalar", cfg.Namespace, field.Path)
+				}
+			default:
+				return nil, fmt.Errorf("transform %s: unknown action %s for %s", cfg.Namespace, field.Action, field.Path)
+			}
+			rules.fields = append(rules.fields, fieldRule{
+				path:    field.Path,
+				action:  field.Action,
+				value:   field.Value,
+				salt:    field.Salt,
+				visible: field.Visible,
+			})
+		}
+
+		t.namespaces = append(t.namespaces, namespaceRules{namespace: namespace, rules: rules})
+	}
+	return t, nil
+}
+
+// Returns the rules of a source namespace, the first matching pattern wins.
+// Returns nil when the documents are replicated as is.
+func (t *Transformer) Rules(db string, collection string) *Rules {
+	for _, ns := range t.namespaces {
+		if ns.namespace.Match(db, collection) {
+			return ns.rules
+		}
+	}
+	return nil
+}
+
+// Apply the rules of their namespace to the sub-operations of an applyOps
+// command. Updates are rewritten from the diff format to $set / $unset
+// operators. Returns false when no sub-operation is left.
+func (t *Transformer) TransformApplyOps(l *oplog.ChangeLog) bool {
+
+	if len(t.namespaces) == 0 || len(l.Object) == 0 || l.Object[0].Key != "applyOps" {
+		return true
+	}
+
+	subOps, ok := l.Object[0].Value.(bson.A)
+	if !ok {
+		return true
+	}
+
+	kept := subOps[:0]
+	for _, subOp := range subOps {
+		doc, ok := subOp.(bson.D)
+		if !ok {
+			kept = append(kept, subOp)
+			continue
+		}
+
+		ns, _ := mdb.GetKey(doc, "ns").(string)
+		rules := t.Rules(oplog.GetDbAndCollection(ns))
+		if rules == nil {
+			kept = append(kept, doc)
+			continue
+		}
+
+		_, index := mdb.GetKeyWithIndex(doc, "o")
+		object, _ := doc[index].Value.(bson.D)
+		if doc[index].Key != "o" || object == nil {
+			kept = append(kept, doc)
+			continue
+		}
+
+		switch mdb.GetKey(doc, "op") {
+		case oplog.InsertOp:
+			doc[index].Value = rules.TransformDocument(object)
+		case oplog.UpdateOp:
+			update, err := mdb.DiffUpdateOplogToNormal(object)
+			if err != nil {
+				// Not applied rather than leaking the redacted fields
+				continue
+			}
+			transformed := rules.TransformUpdate(update)
+			if transformed == nil {
+				continue
+			}
+			// Pipelines are not supported by applyOps, the diff is kept
+			if normal, ok := transformed.(bson.D); ok {
+				doc[index].Value = normal
+			}
+		}
+		kept = append(kept, doc)
+	}
+
+	l.Object[0].Value = kept
+	return len(kept) > 0
+}
+
+// Returns a copy of the change log with the rules of its namespace applied,
+// as written to the target. Updates are rewritten from the diff format to
+// $set / $unset operators. Returns false when nothing is left to write.
+func (t *Transformer) TransformChangeLog(l *oplog.ChangeLog) (*oplog.ChangeLog, bool, error) {
+
+	rules := t.Rules(l.Db, l.Collection)
+	isApplyOps := l.Operation == oplog.CommandOp && len(t.namespaces) > 0
+	if rules == nil && !isApplyOps {
+		return l, true, nil
+	}
+
+	redacted, err := l.Clone()
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch redacted.Operation {
+	case oplog.InsertOp:
+		redacted.Object = rules.TransformDocument(redacted.Object)
+	case oplog.UpdateOp:
+		if !mdb.FindFiledPrefix(redacted.Object, "$v") {
+			break
+		}
+		update, err := mdb.DiffUpdateOplogToNormal(redacted.Object)
+		if err != nil {
+			return nil, false, err
+		}
+		transformed := rules.TransformUpdate(update)
+		if transformed == nil {
+			return nil, false, nil
+		}
+		// The pipelines only truncate an array, the diff is kept
+		if normal, ok := transformed.(bson.D); ok {
+			redacted.Object = normal
+		}
+	case oplog.CommandOp:
+		return redacted, t.TransformApplyOps(redacted), nil
+	}
+	return redacted, true, nil
+}
+
+// Apply the rules to a whole document
+func (r *Rules) TransformDocument(doc bson.D) bson.D {
+	if r == nil {
+		return doc
+	}
+	if len(r.keep) > 0 {
+		doc = project(doc, r.keep, true)
+	}
+	for _, f := range r.fields {
+		doc = f.applyDocument(doc, strings.Split(f.path, "."))
+	}
+	return doc
+}
+
+// Apply the rules to a raw document
+func (r *Rules) TransformRaw(raw bson.Raw) (bson.Raw, error) {
+	if r == nil {
+		return raw, nil
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return raw, err
+	}
+	return bson.Marshal(r.TransformDocument(doc))
+}
+
+// Apply the rules to an update, as produced by mdb.DiffUpdateOplogToNormal:
+// either a list of $set / $unset operators or a pipeline truncating an array.
+// Returns nil when nothing is left to update.
+func (r *Rules) TransformUpdate(update interface{}) interface{} {
+
+	if r == nil {
+		return update
+	}
+
+	switch u := update.(type) {
+	case bson.D:
+		var result bson.D
+		for _, op := range u {
+			fields, ok := op.Value.(bson.D)
+			if !ok {
+				result = append(result, op)
+				continue
+			}
+			var kept bson.D
+			for _, e := range fields {
+				if value, keep := r.transformPath(e.Key, e.Value, op.Key == "$unset"); keep {
+					kept = append(kept, bson.E{Key: e.Key, Value: value})
+				}
+			}
+			if len(kept) > 0 {
+				result = append(result, bson.E{Key: op.Key, Value: kept})
+			}
+		}
+		if len(result) == 0 {
+			return nil
+		}
+		return result
+
+	case mongo.Pipeline:
+		// The pipeline only truncates an array, it is kept as long as the
+		// array itself is replicated untouched
+		for _, stage := range u {
+			for _, op := range stage {
+				fields, _ := op.Value.(bson.D)
+				for _, e := range fields {
+					if _, keep := r.transformPath(e.Key, nil, true); !keep || r.redacts(e.Key) {
+						return nil
+					}
+				}
+			}
+		}
+	}
+	return update
+}
+
+// Apply the rules to the value written at the given path. Returns false
+// when the path must not be written at all.
+func (r *Rules) transformPath(fieldPath string, value interface{}, unset bool) (interface{}, bool) {
+
+	normalized := normalizePath(fieldPath)
+
+	if len(r.keep) > 0 && !isKept(normalized, r.keep) {
+		sub := keptUnder(normalized, r.keep)
+		if len(sub) == 0 {
+			return nil, false
+		}
+		if !unset {
+			if value = projectValue(value, sub); value == nil {
+				return nil, false
+			}
+		}
+	}
+
+	if unset {
+		return value, true
+	}
+
+	for _, f := range r.fields {
+		switch {
+		case normalized == f.path:
+			if f.action == ActionDrop {
+				return nil, false
+			}
+			value = f.transform(value)
+		case strings.HasPrefix(f.path, normalized+"."):
+			value = f.applyValue(value, strings.Split(strings.TrimPrefix(f.path, normalized+"."), "."))
+		case strings.HasPrefix(normalized, f.path+"."):
+			// Writing inside a redacted field would leak its content
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// True when a rule transforms the field or one of its sub-fields
+func (r *Rules) redacts(fieldPath string) bool {
+	normalized := normalizePath(fieldPath)
+	for _, f := range r.fields {
+		if normalized == f.path || strings.HasPrefix(f.path, normalized+".") || strings.HasPrefix(normalized, f.path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fieldRule) applyDocument(doc bson.D, segments []string) bson.D {
+	for i := 0; i < len(doc); i++ {
+		if doc[i].Key != segments[0] {
+			continue
+		}
+		if len(segments) == 1 {
+			if f.action == ActionDrop {
+				return append(doc[:i], doc[i+1:]...)
+			}
+			doc[i].Value = f.transform(doc[i].Value)
+		} else {
+			doc[i].Value = f.applyValue(doc[i].Value, segments[1:])
+		}
+		break
+	}
+	return doc
+}
+
+// Apply the rule to the sub-fields of a value, through the arrays
+func (f *fieldRule) applyValue(value interface{}, segments []string) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		return f.applyDocument(v, segments)
+	case bson.A:
+		for i := range v {
+			v[i] = f.applyValue(v[i], segments)
+		}
+		return v
+	}
+	return value
+}
+
+func (f *fieldRule) transform(value interface{}) interface{} {
+	switch f.action {
+	case ActionHash:
+		return hash(f.salt, value)
+	case ActionMask:
+		return mask(value, f.visible)
+	case ActionReplace:
+		return f.value
+	}
+	return value
+}
+
+// Hash the value with SHA-256. The hash is stable, so that the
+// hashed fields can still be used to join or group documents.
+func hash(salt string, value interface{}) string {
+	var data []byte
+	if s, ok := value.(string); ok {
+		data = []byte(s)
+	} else {
+		data, _ = bson.MarshalExtJSON(bson.D{{Key: "v", Value: value}}, true, false)
+	}
+	sum := sha256.Sum256(append([]byte(salt), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+// Mask a string, keeping its length and the last visible characters
+func mask(value interface{}, visible int) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		return MaskValue
+	}
+	length := utf8.RuneCountInString(s)
+	if visible >= length {
+		visible = 0
+	}
+	runes := []rune(s)
+	return strings.Repeat(MaskChar, length-visible) + string(runes[length-visible:])
+}
+
+// Keep only the given paths of a document. At the top level, `_id` is always kept.
+func project(doc bson.D, keep []string, top bool) bson.D {
+	result := make(bson.D, 0, len(doc))
+	for _, e := range doc {
+		if (top && e.Key == "_id") || isKept(e.Key, keep) {
+			result = append(result, e)
+			continue
+		}
+		if sub := keptUnder(e.Key, keep); len(sub) > 0 {
+			if value := projectValue(e.Value, sub); value != nil {
+				result = append(result, bson.E{Key: e.Key, Value: value})
+			}
+		}
+	}
+	return result
+}
+
+func projectValue(value interface{}, keep []string) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		return project(v, keep, false)
+	case bson.A:
+		result := make(bson.A, 0, len(v))
+		for _, item := range v {
+			if item = projectValue(item, keep); item != nil {
+				result = append(result, item)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+// True when the path, or one of its parents, is kept
+func isKept(fieldPath string, keep []string) bool {
+	for _, k := range keep {
+		if fieldPath == k || strings.HasPrefix(fieldPath, k+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// The kept paths below the given one, relative to it
+func keptUnder(fieldPath string, keep []string) []string {
+	var sub []string
+	for _, k := range keep {
+		if strings.HasPrefix(k, fieldPath+".") {
+			sub = append(sub, strings.TrimPrefix(k, fieldPath+"."))
+		}
+	}
+	return sub
+}
+
+// Remove the array indexes of an update path: `items.3.email` -> `items.email`
+func normalizePath(fieldPath string) string {
+	segments := strings.Split(fieldPath, ".")
+	result := segments[:0]
+	for _, s := range segments {
+		if _, err := strconv.Atoi(s); err == nil {
+			continue
+		}
+		result = append(result, s)
+	}
+	return strings.Join(result, ".")
+}
+
+func isScalar(value interface{}) bool {
+	switch value.(type) {
+	case nil, string, bool, int, int32, int64, float32, float64:
+		return true
+	}
+	return false
+}
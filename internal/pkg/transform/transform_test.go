@@ -0,0 +1,258 @@
+package transform
+
+import (
+	"testing"
+
+	"github.com/sebastienferry/mongo-repl/internal/pkg/config"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/mdb"
+	"github.com/sebastienferry/mongo-repl/internal/pkg/oplog"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func newTestTransformer(t *testing.T) *Transformer {
+	tr, err := NewTransformer([]config.TransformConfig{
+		{
+			Namespace: "prod.users",
+			Fields: []config.FieldRuleConfig{
+				{Path: "password", Action: ActionDrop},
+				{Path: "email", Action: ActionHash, Salt: "s"},
+				{Path: "phone", Action: ActionMask, Visible: 2},
+				{Path: "address.street", Action: ActionReplace, Value: "redacted"},
+				{Path: "cards.number", Action: ActionMask},
+			},
+		},
+		{
+			Namespace: "prod.*",
+			Keep:      []string{"region", "total", "customer.country"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewTransformer() = %v", err)
+	}
+	return tr
+}
+
+func TestTransformDocument(t *testing.T) {
+
+	rules := newTestTransformer(t).Rules("prod", "users")
+	doc := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "password", Value: "secret"},
+		{Key: "email", Value: "john@example.com"},
+		{Key: "phone", Value: "0612345678"},
+		{Key: "address", Value: bson.D{{Key: "street", Value: "1 main st"}, {Key: "city", Value: "Paris"}}},
+		{Key: "cards", Value: bson.A{bson.D{{Key: "number", Value: "4111"}}, bson.D{{Key: "number", Value: 42}}}},
+	}
+
+	doc = rules.TransformDocument(doc)
+	if mdb.GetKey(doc, "password") != nil {
+		t.Errorf("password was not dropped: %v", doc)
+	}
+	if email := mdb.GetKey(doc, "email"); email != hash("s", "john@example.com") || email == "john@example.com" {
+		t.Errorf("email = %v; want a hash", email)
+	}
+	if phone := mdb.GetKey(doc, "phone"); phone != "********78" {
+		t.Errorf("phone = %v; want ********78", phone)
+	}
+	address := mdb.GetKey(doc, "address").(bson.D)
+	if street := mdb.GetKey(address, "street"); street != "redacted" || mdb.GetKey(address, "city") != "Paris" {
+		t.Errorf("address = %v", address)
+	}
+	cards := mdb.GetKey(doc, "cards").(bson.A)
+	if cards[0].(bson.D)[0].Value != "****" || cards[1].(bson.D)[0].Value != MaskValue {
+		t.Errorf("cards = %v", cards)
+	}
+}
+
+func TestProjection(t *testing.T) {
+
+	tr := newTestTransformer(t)
+	rules := tr.Rules("prod", "orders")
+	doc := rules.TransformDocument(bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "region", Value: "eu"},
+		{Key: "customer", Value: bson.D{{Key: "name", Value: "John"}, {Key: "country", Value: "FR"}}},
+		{Key: "notes", Value: "call me"},
+	})
+
+	expected := bson.D{
+		{Key: "_id", Value: 1},
+		{Key: "region", Value: "eu"},
+		{Key: "customer", Value: bson.D{{Key: "country", Value: "FR"}}},
+	}
+	if !equal(doc, expected) {
+		t.Errorf("TransformDocument() = %v; want %v", doc, expected)
+	}
+
+	if tr.Rules("other", "orders") != nil {
+		t.Errorf("Rules(other.orders) != nil")
+	}
+}
+
+func TestTransformUpdate(t *testing.T) {
+
+	tr := newTestTransformer(t)
+	users := tr.Rules("prod", "users")
+
+	// As produced by mdb.DiffUpdateOplogToNormal
+	update := users.TransformUpdate(bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "password", Value: "secret"},
+			{Key: "email", Value: "jane@example.com"},
+			{Key: "address.street", Value: "2 main st"},
+			{Key: "cards.1.number", Value: "5500"},
+			{Key: "name", Value: "Jane"},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "password", Value: true}}},
+	})
+	expected := bson.D{
+		{Key: "$set", Value: bson.D{
+			{Key: "email", Value: hash("s", "jane@example.com")},
+			{Key: "address.street", Value: "redacted"},
+			{Key: "cards.1.number", Value: "****"},
+			{Key: "name", Value: "Jane"},
+		}},
+		{Key: "$unset", Value: bson.D{{Key: "password", Value: true}}},
+	}
+	if !equal(update, expected) {
+		t.Errorf("TransformUpdate() = %v; want %v", update, expected)
+	}
+
+	// Nothing left to update
+	if update := users.TransformUpdate(bson.D{{Key: "$set", Value: bson.D{{Key: "password.hash", Value: "x"}}}}); update != nil {
+		t.Errorf("TransformUpdate() = %v; want nil", update)
+	}
+
+	orders := tr.Rules("prod", "orders")
+	update = orders.TransformUpdate(bson.D{{Key: "$set", Value: bson.D{
+		{Key: "notes", Value: "x"},
+		{Key: "customer", Value: bson.D{{Key: "name", Value: "John"}, {Key: "country", Value: "FR"}}},
+	}}})
+	expected = bson.D{{Key: "$set", Value: bson.D{
+		{Key: "customer", Value: bson.D{{Key: "country", Value: "FR"}}},
+	}}}
+	if !equal(update, expected) {
+		t.Errorf("TransformUpdate() = %v; want %v", update, expected)
+	}
+
+	pipeline := mongo.Pipeline{{{Key: "$set", Value: bson.D{{Key: "notes", Value: bson.D{}}}}}}
+	if update := orders.TransformUpdate(pipeline); update != nil {
+		t.Errorf("TransformUpdate(pipeline) = %v; want nil", update)
+	}
+}
+
+func TestTransformApplyOps(t *testing.T) {
+
+	tr := newTestTransformer(t)
+	l := &oplog.ChangeLog{
+		ParsedLog: oplog.ParsedLog{
+			Operation: oplog.CommandOp,
+			Object: bson.D{{Key: "applyOps", Value: bson.A{
+				bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "prod.users"},
+					{Key: "o", Value: bson.D{{Key: "_id", Value: 1}, {Key: "password", Value: "secret"}}}},
+				bson.D{{Key: "op", Value: "u"}, {Key: "ns", Value: "prod.users"},
+					{Key: "o", Value: bson.D{{Key: "$v", Value: 2}, {Key: "diff", Value: bson.D{{Key: "u", Value: bson.D{{Key: "password", Value: "x"}}}}}}},
+					{Key: "o2", Value: bson.D{{Key: "_id", Value: 1}}}},
+				bson.D{{Key: "op", Value: "u"}, {Key: "ns", Value: "prod.users"},
+					{Key: "o", Value: bson.D{{Key: "$v", Value: 2}, {Key: "diff", Value: bson.D{{Key: "u", Value: bson.D{{Key: "name", Value: "x"}}}}}}},
+					{Key: "o2", Value: bson.D{{Key: "_id", Value: 1}}}},
+			}}},
+		},
+	}
+
+	if !tr.TransformApplyOps(l) {
+		t.Fatalf("TransformApplyOps() = false; want true")
+	}
+	subOps := l.Object[0].Value.(bson.A)
+	if len(subOps) != 2 {
+		t.Fatalf("applyOps has %d operations; want 2", len(subOps))
+	}
+	if o := mdb.GetKey(subOps[0].(bson.D), "o").(bson.D); mdb.GetKey(o, "password") != nil {
+		t.Errorf("insert = %v; want password dropped", o)
+	}
+	expected := bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "x"}}}}
+	if o := mdb.GetKey(subOps[1].(bson.D), "o"); !equal(o, expected) {
+		t.Errorf("update = %v; want %v", o, expected)
+	}
+}
+
+func TestTransformChangeLog(t *testing.T) {
+
+	tr := newTestTransformer(t)
+	update := func(field string) *oplog.ChangeLog {
+		return &oplog.ChangeLog{
+			ParsedLog: oplog.ParsedLog{
+				Operation: oplog.UpdateOp,
+				Object:    bson.D{{Key: "$v", Value: 2}, {Key: "diff", Value: bson.D{{Key: "u", Value: bson.D{{Key: field, Value: "x"}}}}}},
+			},
+			Db:         "prod",
+			Collection: "users",
+		}
+	}
+
+	l := update("name")
+	redacted, keep, err := tr.TransformChangeLog(l)
+	if err != nil || !keep {
+		t.Fatalf("TransformChangeLog() = %v, %v; want kept", keep, err)
+	}
+	expected := bson.D{{Key: "$set", Value: bson.D{{Key: "name", Value: "x"}}}}
+	if !equal(redacted.Object, expected) {
+		t.Errorf("update = %v; want %v", redacted.Object, expected)
+	}
+	if !mdb.FindFiledPrefix(l.Object, "$v") {
+		t.Errorf("update = %v; want the original left as is", l.Object)
+	}
+
+	if _, keep, _ := tr.TransformChangeLog(update("password")); keep {
+		t.Errorf("TransformChangeLog() = true; want false with only redacted fields")
+	}
+
+	// Not transformed, not copied
+	l = update("name")
+	l.Db = "dev"
+	if redacted, _, _ := tr.TransformChangeLog(l); redacted != l {
+		t.Errorf("TransformChangeLog() = %v; want the same entry", redacted)
+	}
+}
+
+func TestTransformerNamespaces(t *testing.T) {
+
+	tr, err := NewTransformer([]config.TransformConfig{
+		{Namespace: "/^tenant[0-9]+\\.users$/", Keep: []string{"name"}},
+		{Namespace: "accounts", Keep: []string{"id"}},
+	})
+	if err != nil {
+		t.Fatalf("NewTransformer() = %v", err)
+	}
+
+	if tr.Rules("tenant1", "users") == nil || tr.Rules("tenant1", "orders") != nil {
+		t.Errorf("Rules() does not match the regex")
+	}
+	if tr.Rules("prod", "accounts") == nil {
+		t.Errorf("Rules(prod.accounts) = nil; want the collection matched in every database")
+	}
+}
+
+func TestNewTransformerErrors(t *testing.T) {
+	tests := []config.TransformConfig{
+		{Namespace: ""},
+		{Namespace: "prod.[", Keep: []string{"a"}},
+		{Namespace: "/(/", Keep: []string{"a"}},
+		{Namespace: "prod.users", Fields: []config.FieldRuleConfig{{Path: "a", Action: "encrypt"}}},
+		{Namespace: "prod.users", Fields: []config.FieldRuleConfig{{Path: "", Action: ActionDrop}}},
+		{Namespace: "prod.users", Fields: []config.FieldRuleConfig{{Path: "a", Action: ActionReplace, Value: []interface{}{1}}}},
+	}
+
+	for _, test := range tests {
+		if _, err := NewTransformer([]config.TransformConfig{test}); err == nil {
+			t.Errorf("NewTransformer(%v) = nil; want an error", test)
+		}
+	}
+}
+
+func equal(a interface{}, b interface{}) bool {
+	ra, _ := bson.MarshalExtJSON(bson.D{{Key: "v", Value: a}}, true, false)
+	rb, _ := bson.MarshalExtJSON(bson.D{{Key: "v", Value: b}}, true, false)
+	return string(ra) == string(rb)
+}